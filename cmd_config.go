@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"webrtc-client-go/wconfig"
+)
+
+var (
+	dumpFormat  string
+	showSecrets bool
+)
+
+func configFlags(fs *flag.FlagSet) {
+	fs.StringVar(&dumpFormat, "format", "yaml", "config dump: output format, yaml or json")
+	fs.BoolVar(&showSecrets, "show-secrets", false, "config dump: do not redact the TURN password")
+}
+
+// runConfig prints the effective configuration: config dump [args]
+func runConfig(c *wconfig.Config) error {
+	return c.Dump(os.Stdout, dumpFormat, showSecrets)
+}
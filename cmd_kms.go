@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+
+	"webrtc-client-go/wconfig"
+	"webrtc-client-go/wsession"
+)
+
+func runRecorder(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("Starting recorder: video: %s, output: %s\n", c.Media.File, c.Media.Output)
+	return wsession.Recorder(cfg, c.Media.File, c.Media.Output, c.FrameTolerance)
+}
+
+func runKMS(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("Starting kms loopback: video: %s, output: %s\n", c.Media.File, c.Media.Output)
+	return wsession.KMSLoopback(cfg, c.Media.File, c.Media.Output)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"webrtc-client-go/wconfig"
+	"webrtc-client-go/wsession"
+)
+
+func runMirror(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// parallel mirror processes must not overwrite each other's output
+	pid := os.Getpid()
+	log.Println("Starting magic mirror call with pid:", pid)
+	return wsession.MagicMirror(cfg, c.Media.File, numberedOutput(c.Media.Output, pid))
+}
+
+// numberedOutput returns output with the number before its extension, if any
+func numberedOutput(output string, i int) string {
+	ext := path.Ext(output)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(output, ext), i, ext)
+}
+
+// runLoad runs parallel magic mirror calls: in static mode each call is made once, in rolling
+// mode the calls that end are restarted forever
+func runLoad(c *wconfig.Config) error {
+	if c.LoadTest.Mode != "static" && c.LoadTest.Mode != "rolling" {
+		return fmt.Errorf("unknown load mode %q: must be either static or rolling", c.LoadTest.Mode)
+	}
+
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("Starting %d magic mirror calls in %s mode\n", c.LoadTest.Calls, c.LoadTest.Mode)
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.LoadTest.Calls; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// the output of a call is overwritten by the next call in the same slot
+			output := numberedOutput(c.Media.Output, i)
+			for {
+				log.Printf("Setting up call with id: %d\n", i)
+				if err := wsession.MagicMirror(cfg, c.Media.File, output); err != nil {
+					log.Printf("call %d: %s\n", i, err)
+				}
+				if c.LoadTest.Mode == "static" {
+					return
+				}
+				time.Sleep(time.Duration(c.LoadTest.Interval))
+			}
+		}(i)
+		time.Sleep(time.Duration(c.LoadTest.Interval))
+	}
+	wg.Wait()
+
+	log.Println("All calls are done")
+	return nil
+}
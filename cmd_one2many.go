@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+
+	"webrtc-client-go/wconfig"
+	"webrtc-client-go/wsession"
+)
+
+func runPresenter(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("Starting presenter: video: %s\n", c.Media.File)
+	return wsession.Presenter(cfg, c.Media.File)
+}
+
+// runViewer starts the viewers in parallel to load-test the fan-out
+func runViewer(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	file := c.Media.File
+	ext := path.Ext(file)
+	var wg sync.WaitGroup
+	for i := 0; i < c.Viewers; i++ {
+		out := file
+		if c.Viewers > 1 {
+			out = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(file, ext), i, ext)
+		}
+		wg.Add(1)
+		go func(i int, out string) {
+			defer wg.Done()
+			log.Printf("starting viewer %d: video: %s\n", i, out)
+			if err := wsession.Viewer(cfg, out); err != nil {
+				log.Printf("viewer %d: %s\n", i, err)
+			}
+		}(i, out)
+	}
+	wg.Wait()
+
+	return nil
+}
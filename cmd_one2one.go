@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+
+	"webrtc-client-go/wconfig"
+	"webrtc-client-go/wsession"
+)
+
+func runCaller(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("Starting caller: user=%s, peer=%s: video: %s\n", c.User, c.Peer, c.Media.File)
+	return wsession.Caller(cfg, c.User, c.Peer, c.Media.File)
+}
+
+func runCallee(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("Starting callee: user=%s: video: %s\n", c.User, c.Media.File)
+	return wsession.Callee(cfg, c.User, c.Media.File)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"webrtc-client-go/wconfig"
+	"webrtc-client-go/wturn"
+)
+
+// runProbe checks the TURN server, failures make the client exit with a non-zero status
+func runProbe(c *wconfig.Config) error {
+	uri := c.TURN.URI
+	if uri == "" {
+		return errors.New("no TURN server given, use --turn")
+	}
+
+	username, credential, err := wturn.Credentials(c.TURN.Auth, c.TURN.Username, c.TURN.Password)
+	if err != nil {
+		return err
+	}
+
+	res, err := wturn.Probe(wturn.ProbeConfig{
+		URI:      uri,
+		Username: username,
+		Password: credential,
+		Timeout:  time.Duration(c.Timeouts.Probe),
+	})
+	if err != nil {
+		return fmt.Errorf("probe failed: %w", err)
+	}
+
+	fmt.Printf("TURN server: %s\n", uri)
+	fmt.Printf("relayed address: %s\n", res.RelayedAddr)
+	fmt.Printf("allocation RTT: %s\n", res.AllocateRTT)
+	fmt.Printf("permission RTT: %s\n", res.PermissionRTT)
+	fmt.Printf("round-trip RTT via %s: %s\n", res.PeerAddr, res.RoundTripRTT)
+	fmt.Printf("channel RTT: %s\n", res.ChannelRTT)
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"log"
+
+	"webrtc-client-go/wconfig"
+	"webrtc-client-go/wsession"
+)
+
+func runRoom(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("Starting room: room=%s, user=%s: video: %s\n", c.Room, c.User, c.Media.File)
+	return wsession.JoinRoom(cfg, c.Room, c.User, c.Media.File, c.Media.Output)
+}
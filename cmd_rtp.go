@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+
+	"webrtc-client-go/wconfig"
+	"webrtc-client-go/wsession"
+)
+
+func runRTPCaller(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("Starting RTP caller: user=%s, peer=%s: video: %s\n", c.User, c.Peer, c.Media.File)
+	return wsession.RTPCaller(cfg, c.User, c.Peer, c.Media.File)
+}
+
+func runRTPCallee(c *wconfig.Config) error {
+	cfg, release, err := session(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Printf("Starting RTP callee: user=%s: video: %s\n", c.User, c.Media.File)
+	return wsession.RTPCallee(cfg, c.User, c.Media.File)
+}
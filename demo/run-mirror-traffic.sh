@@ -59,7 +59,7 @@ set -- "${POSITIONAL_ARGS[@]}" # restore positional parameters
 
 cleanup
 
-MIRROR_GO_CMD="go run ../webrtc-client-magic-mirror.go --turn="turn:${TURN_SERVER_ADDR}:${TURN_SERVER_PORT}" --url="wss://${APPLICATION_SERVER_ADDR}:${APPLICATION_SERVER_PORT}/magicmirror" --debug -file="${FILE}
+MIRROR_GO_CMD="go run .. mirror --output=mirrored --turn-user=user-1 --turn-password=pass-1 --turn="turn:${TURN_SERVER_ADDR}:${TURN_SERVER_PORT}" --tls-insecure --url="wss://${APPLICATION_SERVER_ADDR}:${APPLICATION_SERVER_PORT}/magicmirror" --debug -file="${FILE}
 
 if [[ $MODE == "static" ]]; then
     echo " Invoked with static mode."
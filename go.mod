@@ -1,14 +1,36 @@
 module webrtc-client-go
 
-go 1.15
+go 1.17
 
 require (
 	github.com/gorilla/websocket v1.4.2
+	github.com/pion/dtls/v2 v2.1.3
 	github.com/pion/ice/v2 v2.2.2
-	github.com/pion/rtcp v1.2.9
-	github.com/pion/rtp v1.7.9
+	github.com/pion/interceptor v0.1.17
+	github.com/pion/logging v0.2.2
+	github.com/pion/randutil v0.1.0
+	github.com/pion/rtcp v1.2.10
+	github.com/pion/rtp v1.7.13
 	github.com/pion/sdp/v3 v3.0.4
+	github.com/pion/srtp/v2 v2.0.5
+	github.com/pion/transport v0.13.0
+	github.com/pion/turn/v2 v2.0.8
 	github.com/pion/webrtc/v3 v3.1.5
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/pion/datachannel v1.4.21 // indirect
+	github.com/pion/mdns v0.0.5 // indirect
+	github.com/pion/sctp v1.7.12 // indirect
+	github.com/pion/stun v0.3.5 // indirect
+	github.com/pion/udp v0.1.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 )
 
 // replace github.com/pion/webrtc/v3 => /export/l7mp/webrtc-client-go/webrtc
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+
+	"webrtc-client-go/wcodec"
+	"webrtc-client-go/wconfig"
+	"webrtc-client-go/wrtp"
+	"webrtc-client-go/wsession"
+	"webrtc-client-go/wturn"
+)
+
+// command is a subcommand of the client
+type command struct {
+	usage string
+	// the command sends a media file that must exist
+	input bool
+	// registers the flags of the command on top of the common flags
+	flags func(fs *flag.FlagSet)
+	run   func(c *wconfig.Config) error
+}
+
+var commands = map[string]*command{
+	"caller":     {usage: "call --peer in the one-to-one tutorial and send --file", input: true, run: runCaller},
+	"callee":     {usage: "accept a call in the one-to-one tutorial and write the video into --file", run: runCallee},
+	"mirror":     {usage: "send --file to the magic mirror tutorial and write the mirrored video into <output>_<pid>", input: true, run: runMirror},
+	"load":       {usage: "run --calls parallel magic mirror calls, once or rolling", input: true, run: runLoad},
+	"rtp-caller": {usage: "call --peer in the one-to-one tutorial over plain RTP and send --file", input: true, run: runRTPCaller},
+	"rtp-callee": {usage: "accept a call in the one-to-one tutorial over plain RTP and write the video into --file", run: runRTPCallee},
+	"presenter":  {usage: "present --file in the one-to-many tutorial", input: true, run: runPresenter},
+	"viewer":     {usage: "start --viewers viewers in the one-to-many tutorial", run: runViewer},
+	"room":       {usage: "join --room in the group call tutorial", input: true, run: runRoom},
+	"recorder":   {usage: "record --file in the recorder tutorial and play it back into --output", input: true, run: runRecorder},
+	"kms":        {usage: "loop back --file through the Kurento media server at --url into --output", input: true, run: runKMS},
+	"probe":      {usage: "check the TURN server given with --turn", run: runProbe},
+	"config":     {usage: "config dump: print the effective configuration", flags: configFlags, run: runConfig},
+}
+
+// the command is consumed from os.Args
+var progName = path.Base(os.Args[0])
+
+var Usage = func() {
+	fmt.Fprintf(os.Stderr, "%s <command> [args]\n\ncommands:\n", progName)
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].usage)
+	}
+	n := 0
+	flag.VisitAll(func(*flag.Flag) { n++ })
+	if n == 0 {
+		fmt.Fprintf(os.Stderr, "\nrun %s <command> -h for the flags\n", progName)
+	} else {
+		fmt.Fprintf(os.Stderr, "\nflags:\n")
+		flag.PrintDefaults()
+	}
+	os.Exit(1)
+}
+
+// session returns the session config of the media commands: it opens the TLS key log and
+// starts the embedded TURN server, call the returned function to release these
+func session(c *wconfig.Config) (wsession.Config, func(), error) {
+	var closers []io.Closer
+	release := func() {
+		for _, cl := range closers {
+			cl.Close()
+		}
+	}
+
+	var keyLog io.Writer
+	if c.Signaling.Debug {
+		kl, err := os.OpenFile(c.Signaling.KeyLogFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return wsession.Config{}, nil, fmt.Errorf("keylog: %w", err)
+		}
+		closers = append(closers, kl)
+		keyLog = kl
+		fmt.Fprintf(kl, "# SSL/TLS secrets log file, generated by go\n")
+	}
+
+	if c.TURN.Embedded != "" {
+		srv, err := runEmbeddedTurn(c)
+		if err != nil {
+			release()
+			return wsession.Config{}, nil, err
+		}
+		closers = append(closers, srv)
+	}
+
+	// Select the receiver side codec, set up ICE and TURN
+	cfg, err := c.Session()
+	if err != nil {
+		release()
+		return wsession.Config{}, nil, err
+	}
+	cfg.KeyLog = keyLog
+
+	// the media secrets may go into the key log of the signaling connection
+	if c.Media.KeyLogFile != "" {
+		var mediaKeyLog io.Writer = keyLog
+		if keyLog == nil || c.Media.KeyLogFile != c.Signaling.KeyLogFile {
+			kl, err := os.OpenFile(c.Media.KeyLogFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				release()
+				return wsession.Config{}, nil, fmt.Errorf("media keylog: %w", err)
+			}
+			closers = append(closers, kl)
+			mediaKeyLog = kl
+		}
+		cfg.MediaKeyLog = wrtp.NewKeyLog(mediaKeyLog)
+	}
+
+	// the packets of all the PeerConnections of the process go into the same file
+	if c.Media.Capture != "" {
+		format, err := wrtp.ParseCaptureFormat(c.Media.CaptureFormat)
+		if err != nil {
+			release()
+			return wsession.Config{}, nil, err
+		}
+		capture, err := wrtp.NewCapture(c.Media.Capture, format)
+		if err != nil {
+			release()
+			return wsession.Config{}, nil, fmt.Errorf("capture: %w", err)
+		}
+		closers = append(closers, capture)
+		cfg.Capture = capture
+	}
+
+	return cfg, release, nil
+}
+
+// runEmbeddedTurn starts the embedded TURN server, and uses it unless a TURN server is given
+func runEmbeddedTurn(c *wconfig.Config) (*wturn.Server, error) {
+	turnCfg := wturn.Config{
+		Auth:     c.TURN.Auth,
+		Username: c.TURN.Username,
+		Password: c.TURN.Password,
+	}
+	var srv *wturn.Server
+	var err error
+	switch c.TURN.EmbeddedTransport {
+	case "udp":
+		srv, err = wturn.Listen(c.TURN.Embedded, turnCfg)
+	case "tls":
+		if turnCfg.TLSConfig, err = wturn.SelfSignedTLSConfig(); err != nil {
+			return nil, fmt.Errorf("embedded TURN server: %w", err)
+		}
+		srv, err = wturn.ListenTCP(c.TURN.Embedded, turnCfg)
+	case "tcp":
+		srv, err = wturn.ListenTCP(c.TURN.Embedded, turnCfg)
+	default:
+		return nil, fmt.Errorf("unknown embedded TURN transport: %s", c.TURN.EmbeddedTransport)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("embedded TURN server: %w", err)
+	}
+	if c.TURN.URI == "" {
+		c.TURN.URI = srv.URI()
+	}
+	return srv, nil
+}
+
+/////////////////////////
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	flag.Usage = Usage
+
+	if err := wcodec.Validate(); err != nil {
+		log.Fatalln("invalid codec tables:", err)
+	}
+
+	// we need to consume the first positional arg
+	if len(os.Args) < 2 {
+		Usage()
+	}
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		Usage()
+	}
+	os.Args = os.Args[1:]
+
+	// the only config command is dump
+	if name == "config" {
+		if len(os.Args) < 2 || os.Args[1] != "dump" {
+			Usage()
+		}
+		os.Args = os.Args[1:]
+	}
+
+	if cmd.flags != nil {
+		cmd.flags(flag.CommandLine)
+	}
+
+	// defaults < config file < environment < cmd line
+	c, err := wconfig.Parse(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Assert that we have an audio or video file
+	if cmd.input {
+		if _, err := os.Stat(c.Media.File); os.IsNotExist(err) {
+			log.Fatalf("Could not open file `%s`: %s\n", c.Media.File, err)
+		}
+	}
+
+	if err := cmd.run(c); err != nil {
+		log.Fatalf("%s: %s\n", name, err)
+	}
+}
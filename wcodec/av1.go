@@ -0,0 +1,308 @@
+package wcodec
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+// MimeTypeAV1 is not known to pion/webrtc v3.1
+const MimeTypeAV1 = "video/AV1"
+
+// rtpOutboundMTU is the MTU pion uses for sample tracks
+const rtpOutboundMTU = 1200
+
+// AV1 OBU types, see the AV1 bitstream specification, section 6.2.2
+const (
+	obuSequenceHeader    = 1
+	obuTemporalDelimiter = 2
+	obuTileList          = 8
+	obuPadding           = 15
+)
+
+// AV1 aggregation header bits, see the AV1 RTP payload format, section 4.4
+const (
+	av1Z = 0x80 // the first OBU element continues an OBU of the previous packet
+	av1Y = 0x40 // the last OBU element continues in the next packet
+	av1N = 0x08 // the packet starts a new coded video sequence
+)
+
+var errAV1Short = errors.New("AV1: short OBU")
+
+// readLEB128 decodes an unsigned LEB128 integer, and returns its value and length
+func readLEB128(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 8; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("AV1: invalid LEB128 value")
+}
+
+// appendLEB128 appends v encoded as an unsigned LEB128 integer
+func appendLEB128(b []byte, v uint64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func leb128Size(v int) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// splitOBUs splits a temporal unit in the low overhead bitstream format into OBUs without the
+// size field, as these are carried in RTP; temporal delimiters, tile lists and padding are
+// dropped
+func splitOBUs(tu []byte) ([][]byte, bool, error) {
+	var obus [][]byte
+	seqHeader := false
+	for len(tu) > 0 {
+		header := 1
+		if tu[0]&0x04 != 0 {
+			header = 2
+		}
+		if len(tu) < header {
+			return nil, false, errAV1Short
+		}
+
+		size := len(tu) - header
+		sizeLen := 0
+		if tu[0]&0x02 != 0 {
+			v, n, err := readLEB128(tu[header:])
+			if err != nil {
+				return nil, false, err
+			}
+			if v > uint64(len(tu)-header-n) {
+				return nil, false, errAV1Short
+			}
+			size, sizeLen = int(v), n
+		}
+
+		switch obuType := (tu[0] >> 3) & 0x0f; obuType {
+		case obuTemporalDelimiter, obuTileList, obuPadding:
+		default:
+			if obuType == obuSequenceHeader {
+				seqHeader = true
+			}
+			obu := make([]byte, 0, header+size)
+			obu = append(obu, tu[0]&^0x02)
+			obu = append(obu, tu[1:header]...)
+			obu = append(obu, tu[header+sizeLen:header+sizeLen+size]...)
+			obus = append(obus, obu)
+		}
+		tu = tu[header+sizeLen+size:]
+	}
+	return obus, seqHeader, nil
+}
+
+// AV1Payloader payloads AV1 temporal units in the low overhead bitstream format (as stored in
+// IVF files) according to the AV1 RTP payload format, every OBU element is length prefixed.
+type AV1Payloader struct{}
+
+// Payload fragments a temporal unit into packets of at most mtu bytes.
+func (p *AV1Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	obus, seqHeader, err := splitOBUs(payload)
+	if err != nil || mtu < 4 {
+		return nil
+	}
+
+	var packets [][]byte
+	cur := []byte{0}
+	z := false
+	flush := func(y bool) {
+		if z {
+			cur[0] |= av1Z
+		}
+		if y {
+			cur[0] |= av1Y
+		}
+		if seqHeader && len(packets) == 0 {
+			cur[0] |= av1N
+		}
+		packets = append(packets, cur)
+		cur, z = []byte{0}, y
+	}
+
+	for _, obu := range obus {
+		for len(obu) > 0 {
+			free := int(mtu) - len(cur)
+			if n := len(obu); leb128Size(n)+n <= free {
+				cur = append(appendLEB128(cur, uint64(n)), obu...)
+				break
+			}
+			// the element does not fit: fragment it unless the packet is almost full
+			if free < 3 {
+				flush(false)
+				continue
+			}
+			n := free - leb128Size(free)
+			cur = append(appendLEB128(cur, uint64(n)), obu[:n]...)
+			obu = obu[n:]
+			flush(true)
+		}
+	}
+	if len(cur) > 1 {
+		flush(false)
+	}
+	return packets
+}
+
+// av1Depacketizer reassembles AV1 temporal units in the low overhead bitstream format from RTP
+type av1Depacketizer struct {
+	// OBU continued in the next packet
+	fragment []byte
+	tu       []byte
+	// lost packets corrupt the temporal unit until the next one
+	broken  bool
+	lastSeq uint16
+	started bool
+}
+
+// push adds a packet, and returns the temporal unit the packet completes, if any
+func (d *av1Depacketizer) push(p *rtp.Packet) ([]byte, bool) {
+	if d.started && p.SequenceNumber != d.lastSeq+1 {
+		d.broken = true
+	}
+	d.started, d.lastSeq = true, p.SequenceNumber
+
+	if err := d.unmarshal(p.Payload); err != nil {
+		d.broken = true
+	}
+
+	if !p.Marker {
+		return nil, false
+	}
+	tu, broken := d.tu, d.broken
+	d.tu, d.fragment, d.broken = nil, nil, false
+	if broken || len(tu) == 0 {
+		return nil, false
+	}
+	// temporal units start with a temporal delimiter in the low overhead format
+	return append([]byte{obuTemporalDelimiter<<3 | 0x02, 0}, tu...), true
+}
+
+func (d *av1Depacketizer) unmarshal(payload []byte) error {
+	if len(payload) < 1 {
+		return errAV1Short
+	}
+	header := payload[0]
+	// W: the number of elements, the last one is not length prefixed, 0: all are prefixed
+	w := int(header>>4) & 0x03
+	payload = payload[1:]
+
+	if header&av1Z == 0 && d.fragment != nil {
+		// the continuation was lost
+		d.fragment = nil
+		return errAV1Short
+	}
+
+	for i := 0; len(payload) > 0; i++ {
+		n := len(payload)
+		if w == 0 || i < w-1 {
+			v, l, err := readLEB128(payload)
+			if err != nil {
+				return err
+			}
+			if v > uint64(len(payload)-l) {
+				return errAV1Short
+			}
+			n, payload = int(v), payload[l:]
+		}
+		element := payload[:n]
+		payload = payload[n:]
+
+		if i == 0 && header&av1Z != 0 {
+			if d.fragment == nil {
+				// the beginning was lost
+				d.broken = true
+			}
+			element = append(d.fragment, element...)
+			d.fragment = nil
+		}
+		if len(payload) == 0 && header&av1Y != 0 {
+			d.fragment = append([]byte{}, element...)
+			break
+		}
+		d.appendOBU(element)
+	}
+	return nil
+}
+
+// appendOBU adds an OBU received without the size field to the temporal unit in the low
+// overhead format
+func (d *av1Depacketizer) appendOBU(obu []byte) {
+	if len(obu) == 0 {
+		return
+	}
+	header := 1
+	if obu[0]&0x04 != 0 {
+		header = 2
+	}
+	if len(obu) < header {
+		d.broken = true
+		return
+	}
+	if obu[0]&0x02 != 0 {
+		// already has a size field
+		d.tu = append(d.tu, obu...)
+		return
+	}
+	d.tu = append(d.tu, obu[0]|0x02)
+	d.tu = append(d.tu, obu[1:header]...)
+	d.tu = appendLEB128(d.tu, uint64(len(obu)-header))
+	d.tu = append(d.tu, obu[header:]...)
+}
+
+// av1Track is a sample track for AV1, that pion/webrtc v3.1 cannot payload
+type av1Track struct {
+	*webrtc.TrackLocalStaticRTP
+
+	lock       sync.Mutex
+	packetizer rtp.Packetizer
+}
+
+func (t *av1Track) Bind(c webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticRTP.Bind(c)
+	if err != nil {
+		return codec, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.packetizer == nil {
+		t.packetizer = rtp.NewPacketizer(rtpOutboundMTU, 0, 0, &AV1Payloader{},
+			rtp.NewRandomSequencer(), codec.ClockRate)
+	}
+	return codec, nil
+}
+
+// WriteSample payloads and writes a temporal unit.
+func (t *av1Track) WriteSample(sample media.Sample) error {
+	t.lock.Lock()
+	p := t.packetizer
+	t.lock.Unlock()
+	if p == nil {
+		return nil
+	}
+
+	for _, packet := range p.Packetize(sample.Data, uint32(sample.Duration.Seconds()*90000)) {
+		if err := t.WriteRTP(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package wcodec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+const mimeTypeRTX = "video/rtx"
+
+// LookupCodec returns the codec parameters of a named codec, each followed by its RTX: vp8,
+// vp9, av1, h264 (all profiles), h264-baseline, h264-constrained-baseline, h264-main or
+// h264-high.
+func LookupCodec(name string) ([]webrtc.RTPCodecParameters, error) {
+	switch name = strings.ToLower(name); name {
+	case "vp8":
+		return VP8Codecs, nil
+	case "vp9":
+		return VP9Codecs, nil
+	case "av1":
+		return AV1Codecs, nil
+	case "h264":
+		return H264Codecs, nil
+	}
+
+	if profile, ok := lookupH264Profile(name); ok {
+		return withRTX(H264Codecs, func(c webrtc.RTPCodecParameters) bool {
+			return fmtpParam(c.SDPFmtpLine, "profile-level-id") == profile.profileLevelID
+		}), nil
+	}
+
+	return nil, fmt.Errorf("unknown codec %q: must be one of %s", name,
+		strings.Join(CodecNames(), ", "))
+}
+
+// CodecNames returns the names known to LookupCodec.
+func CodecNames() []string {
+	names := []string{"vp8", "vp9", "av1", "h264"}
+	for _, p := range h264Profiles {
+		names = append(names, "h264-"+p.name)
+	}
+	return names
+}
+
+// CodecMimeType returns the mime type of a named codec.
+func CodecMimeType(name string) (string, error) {
+	codecs, err := LookupCodec(name)
+	if err != nil {
+		return "", err
+	}
+	if len(codecs) == 0 {
+		return "", fmt.Errorf("no codec for %q", name)
+	}
+	return codecs[0].MimeType, nil
+}
+
+// CodecPreferences returns the codec parameters of the named codecs in preference order,
+// without duplicate payload types.
+func CodecPreferences(names []string) ([]webrtc.RTPCodecParameters, error) {
+	var list []webrtc.RTPCodecParameters
+	seen := map[webrtc.PayloadType]bool{}
+	for _, name := range names {
+		codecs, err := LookupCodec(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range codecs {
+			if !seen[c.PayloadType] {
+				seen[c.PayloadType] = true
+				list = append(list, c)
+			}
+		}
+	}
+	return list, nil
+}
+
+// HasMimeType tells whether codecs have a codec of the mime type.
+func HasMimeType(codecs []webrtc.RTPCodecParameters, mimeType string) bool {
+	for _, c := range codecs {
+		if strings.EqualFold(c.MimeType, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// withRTX returns the codecs of table that are kept, with the RTX of each
+func withRTX(table []webrtc.RTPCodecParameters, keep func(webrtc.RTPCodecParameters) bool) []webrtc.RTPCodecParameters {
+	kept := map[string]bool{}
+	var codecs []webrtc.RTPCodecParameters
+	for _, c := range table {
+		if strings.EqualFold(c.MimeType, mimeTypeRTX) {
+			if kept[fmtpParam(c.SDPFmtpLine, "apt")] {
+				codecs = append(codecs, c)
+			}
+			continue
+		}
+		if keep(c) {
+			kept[strconv.Itoa(int(c.PayloadType))] = true
+			codecs = append(codecs, c)
+		}
+	}
+	return codecs
+}
+
+// fmtpParam returns the value of a parameter of an fmtp line, e.g., apt=96
+func fmtpParam(fmtp, key string) string {
+	for _, p := range strings.Split(fmtp, ";") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], key) {
+			return strings.ToLower(kv[1])
+		}
+	}
+	return ""
+}
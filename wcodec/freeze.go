@@ -0,0 +1,431 @@
+package wcodec
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// DefaultFreezeThreshold is how long received video may go without a decodable frame before it
+// is reported frozen.
+const DefaultFreezeThreshold = 500 * time.Millisecond
+
+// RTP timestamps that advance by more than this many usual frame steps are discontinuities
+const timestampJumpFactor = 4
+
+// after this many consistent steps that are jumps, the frame rate has changed: these steps are
+// the usual step from then on
+const timestampRelearnSteps = 3
+
+// isKeyframePacket tells whether an RTP payload of codec starts a key frame
+func isKeyframePacket(mimeType string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		vp8 := codecs.VP8Packet{}
+		if _, err := vp8.Unmarshal(payload); err != nil || vp8.S != 1 || vp8.PID != 0 {
+			return false
+		}
+		return isKeyframe(mimeType, vp8.Payload)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		vp9 := codecs.VP9Packet{}
+		if _, err := vp9.Unmarshal(payload); err != nil || !vp9.B {
+			return false
+		}
+		return isKeyframe(mimeType, vp9.Payload)
+	case strings.EqualFold(mimeType, MimeTypeAV1):
+		return len(payload) > 0 && payload[0]&av1N != 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return isH264KeyframePacket(payload)
+	}
+	return false
+}
+
+// isH264KeyframePacket tells whether an H264 RTP payload has an IDR slice or a sequence
+// parameter set, that encoders send in front of IDR slices, or starts a fragmented IDR slice
+func isH264KeyframePacket(payload []byte) bool {
+	const (
+		idr   = 5
+		sps   = 7
+		stapA = 24
+		fuA   = 28
+	)
+	if len(payload) == 0 {
+		return false
+	}
+	switch payload[0] & 0x1f {
+	case idr, sps:
+		return true
+	case stapA:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if t := payload[i+2] & 0x1f; t == idr || t == sps {
+				return true
+			}
+			i += 2 + size
+		}
+	case fuA:
+		// start bit and type of the fragmented NAL unit
+		return len(payload) > 1 && payload[1]&0x80 != 0 && payload[1]&0x1f == idr
+	}
+	return false
+}
+
+// FrameStats summarizes the frames of received video.
+type FrameStats struct {
+	// frames received, and those that could be decoded: all their packets and the frames they
+	// reference since the last key frame were received
+	Frames, Decodable, Keyframes int
+	// time between the arrival of frames and between key frames
+	MeanGap, MaxGap                           time.Duration
+	MeanKeyframeInterval, MaxKeyframeInterval time.Duration
+	// RTP timestamps that moved backwards or jumped ahead
+	TimestampJumps int
+	// times no decodable frame arrived within the freeze threshold, and how long these lasted
+	Freezes        int
+	FreezeDuration time.Duration
+}
+
+// String implements fmt.Stringer.
+func (s FrameStats) String() string {
+	return fmt.Sprintf("%d frames (%d decodable, %d key frames), frame gap mean %s max %s, "+
+		"key frame interval mean %s max %s, %d timestamp jumps, %d freezes for %s",
+		s.Frames, s.Decodable, s.Keyframes, s.MeanGap.Round(time.Millisecond),
+		s.MaxGap.Round(time.Millisecond), s.MeanKeyframeInterval.Round(time.Millisecond),
+		s.MaxKeyframeInterval.Round(time.Millisecond), s.TimestampJumps, s.Freezes,
+		s.FreezeDuration.Round(time.Millisecond))
+}
+
+// frameCounters are the sums behind FrameStats, they add up over tracks
+type frameCounters struct {
+	frames, decodable, keyframes int
+	gaps, keyIntervals           int
+	gapSum, gapMax               time.Duration
+	keySum, keyMax               time.Duration
+	jumps, freezes               int
+	freezeDuration               time.Duration
+}
+
+func (c *frameCounters) add(o frameCounters) {
+	c.frames += o.frames
+	c.decodable += o.decodable
+	c.keyframes += o.keyframes
+	c.gaps += o.gaps
+	c.keyIntervals += o.keyIntervals
+	c.gapSum += o.gapSum
+	c.keySum += o.keySum
+	if o.gapMax > c.gapMax {
+		c.gapMax = o.gapMax
+	}
+	if o.keyMax > c.keyMax {
+		c.keyMax = o.keyMax
+	}
+	c.jumps += o.jumps
+	c.freezes += o.freezes
+	c.freezeDuration += o.freezeDuration
+}
+
+func (c frameCounters) stats() FrameStats {
+	s := FrameStats{
+		Frames:              c.frames,
+		Decodable:           c.decodable,
+		Keyframes:           c.keyframes,
+		MaxGap:              c.gapMax,
+		MaxKeyframeInterval: c.keyMax,
+		TimestampJumps:      c.jumps,
+		Freezes:             c.freezes,
+		FreezeDuration:      c.freezeDuration,
+	}
+	if c.gaps > 0 {
+		s.MeanGap = c.gapSum / time.Duration(c.gaps)
+	}
+	if c.keyIntervals > 0 {
+		s.MeanKeyframeInterval = c.keySum / time.Duration(c.keyIntervals)
+	}
+	return s
+}
+
+// freezeDetector follows the frames of a received stream: frames are told apart by their RTP
+// timestamp and end with the marker bit, a frame is decodable if none of its packets is missing
+// and the frames since the last key frame were decodable. The packets behind a missing one are
+// held back until it is retransmitted, its frame is given up when it is still missing after the
+// NACK window, like the keyframeRequester does.
+type freezeDetector struct {
+	name, mimeType string
+	threshold      time.Duration
+
+	lock sync.Mutex
+	// sequence number of the last packet passed on in order
+	started bool
+	lastSeq uint16
+	// packets held back behind missing ones, by sequence number
+	held map[uint16]heldPacket
+	// frame being received
+	inFrame            bool
+	ts                 uint32
+	complete, keyframe bool
+	// previous frame
+	hasPrev bool
+	prevTS  uint32
+	step    uint32
+	// a step that jumped and how many consistent steps followed it
+	newStep     uint32
+	newSteps    int
+	lastArrival time.Time
+	lastKey     time.Time
+	// the frames since the last key frame are decodable
+	chain         bool
+	lastDecodable time.Time
+	frozen        bool
+	counters      frameCounters
+}
+
+// newFreezeDetector returns a detector of the stream of a track called name, that has received
+// nothing at start
+func newFreezeDetector(name, mimeType string, threshold time.Duration, start time.Time) *freezeDetector {
+	return &freezeDetector{name: name, mimeType: mimeType, threshold: threshold, lastDecodable: start,
+		held: map[uint16]heldPacket{}}
+}
+
+// heldPacket is a packet held back behind missing ones and when it arrived
+type heldPacket struct {
+	p       *rtp.Packet
+	arrival time.Time
+}
+
+// packet adds a packet that arrived at now
+func (d *freezeDetector) packet(p *rtp.Packet, now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !d.started {
+		d.started, d.lastSeq = true, p.SequenceNumber-1
+	}
+	diff := p.SequenceNumber - d.lastSeq
+	if _, ok := d.held[p.SequenceNumber]; ok || diff == 0 || diff >= 0x8000 {
+		// duplicate, or late and the frame has been given up already
+		return
+	}
+	switch {
+	case diff == 1:
+		d.next(p, now, now, false)
+		d.release(now)
+	case diff > keyframeMaxMissing:
+		// too many packets are missing to wait for
+		d.giveUp(0, now)
+		d.next(p, now, now, true)
+	default:
+		d.held[p.SequenceNumber] = heldPacket{p: p, arrival: now}
+	}
+	d.expire(now)
+}
+
+// release passes on the held packets that follow the last one in order
+func (d *freezeDetector) release(now time.Time) {
+	for {
+		h, ok := d.held[d.lastSeq+1]
+		if !ok {
+			return
+		}
+		delete(d.held, d.lastSeq+1)
+		d.next(h.p, h.arrival, now, false)
+	}
+}
+
+// expire gives up the missing packets that are not retransmitted within the NACK window: they
+// were missing since the first packet held back behind them arrived
+func (d *freezeDetector) expire(now time.Time) {
+	for len(d.held) > 0 {
+		first := now
+		for _, h := range d.held {
+			if h.arrival.Before(first) {
+				first = h.arrival
+			}
+		}
+		if now.Sub(first) < keyframeNACKWindow {
+			return
+		}
+		d.giveUp(1, now)
+	}
+}
+
+// giveUp passes on the held packets, skipping the missing ones, until at most keep packets are
+// held. The lowest sequence numbers go first.
+func (d *freezeDetector) giveUp(keep int, now time.Time) {
+	for len(d.held) > keep {
+		seq := d.lastSeq + 1
+		for {
+			if _, ok := d.held[seq]; ok {
+				break
+			}
+			seq++
+		}
+		h := d.held[seq]
+		delete(d.held, seq)
+		d.next(h.p, h.arrival, now, true)
+		d.release(now)
+	}
+}
+
+// next passes on the next packet in order, that arrived at arrival and is passed on at now,
+// gap tells whether packets before it are missing
+func (d *freezeDetector) next(p *rtp.Packet, arrival, now time.Time, gap bool) {
+	d.lastSeq = p.SequenceNumber
+	if !d.inFrame || p.Timestamp != d.ts {
+		if d.inFrame {
+			// the end of the previous frame is missing
+			d.endFrame(false, arrival, now)
+		}
+		d.startFrame(p.Timestamp)
+		d.keyframe = isKeyframePacket(d.mimeType, p.Payload)
+		if gap {
+			// frames before this one are missing, a key frame starts in this packet though
+			d.complete, d.chain = d.keyframe, false
+		}
+	} else if gap {
+		d.complete, d.chain = false, false
+	}
+	if p.Marker {
+		d.endFrame(true, arrival, now)
+	}
+}
+
+// startFrame checks the RTP timestamp of a new frame against the previous one, a jump followed
+// by steps like it is a new frame rate
+func (d *freezeDetector) startFrame(ts uint32) {
+	if d.hasPrev {
+		switch step := ts - d.prevTS; {
+		case step == 0:
+		case step >= 0x80000000:
+			d.counters.jumps++
+			d.newSteps = 0
+		case d.step > 0 && step > timestampJumpFactor*d.step:
+			if d.newSteps == 0 || !similarStep(step, d.newStep) {
+				d.counters.jumps++
+				d.newStep, d.newSteps = step, 1
+				break
+			}
+			d.newSteps++
+			if d.newSteps >= timestampRelearnSteps {
+				d.step, d.newSteps = step, 0
+			}
+		default:
+			d.step, d.newSteps = step, 0
+		}
+	}
+	d.hasPrev, d.prevTS = true, ts
+	d.inFrame, d.ts, d.complete, d.keyframe = true, ts, true, false
+}
+
+// similarStep tells whether two timestamp steps differ by at most an eighth, e.g., 3000 and
+// 3003 at 29.97 fps
+func similarStep(a, b uint32) bool {
+	diff := a - b
+	if a < b {
+		diff = b - a
+	}
+	return diff <= b/8
+}
+
+// endFrame counts a frame that ended with a packet that arrived at arrival: it can be decoded
+// at now, once the packets held back behind it are passed on
+func (d *freezeDetector) endFrame(marker bool, arrival, now time.Time) {
+	d.inFrame = false
+	d.counters.frames++
+	if arrival.Before(d.lastArrival) {
+		// arrived before a retransmission of the previous frame
+		arrival = d.lastArrival
+	}
+	if !d.lastArrival.IsZero() {
+		gap := arrival.Sub(d.lastArrival)
+		d.counters.gaps++
+		d.counters.gapSum += gap
+		if gap > d.counters.gapMax {
+			d.counters.gapMax = gap
+		}
+	}
+	d.lastArrival = arrival
+
+	complete := marker && d.complete
+	switch {
+	case complete && d.keyframe:
+		d.chain = true
+		d.counters.keyframes++
+		if !d.lastKey.IsZero() {
+			interval := arrival.Sub(d.lastKey)
+			d.counters.keyIntervals++
+			d.counters.keySum += interval
+			if interval > d.counters.keyMax {
+				d.counters.keyMax = interval
+			}
+		}
+		d.lastKey = arrival
+	case !complete:
+		d.chain = false
+	}
+	if !complete || !d.chain {
+		return
+	}
+
+	d.counters.decodable++
+	if d.frozen {
+		frozen := now.Sub(d.lastDecodable)
+		d.counters.freezeDuration += frozen
+		d.frozen = false
+		log.Printf("track %s: video resumed after %s frozen\n", d.name, frozen.Round(time.Millisecond))
+	}
+	d.lastDecodable = now
+}
+
+// check raises a freeze event if no decodable frame arrived within the threshold before now
+func (d *freezeDetector) check(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.expire(now)
+	if d.frozen || now.Sub(d.lastDecodable) <= d.threshold {
+		return
+	}
+	d.frozen = true
+	d.counters.freezes++
+	log.Printf("track %s: video frozen, no decodable frame for %s\n", d.name,
+		now.Sub(d.lastDecodable).Round(time.Millisecond))
+}
+
+// finish ends a freeze at the end of the stream, the missing packets are not retransmitted
+// anymore
+func (d *freezeDetector) finish(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.giveUp(0, now)
+	if d.frozen {
+		d.counters.freezeDuration += now.Sub(d.lastDecodable)
+		d.frozen = false
+	}
+}
+
+// run checks for freezes until ctx is done
+func (d *freezeDetector) run(ctx context.Context) {
+	ticker := time.NewTicker(d.threshold / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.check(now)
+		case <-ctx.Done():
+			d.finish(time.Now())
+			return
+		}
+	}
+}
+
+func (d *freezeDetector) frameCounters() frameCounters {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.counters
+}
@@ -0,0 +1,159 @@
+package wcodec
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+// vp8Packet returns a single packet VP8 frame
+func vp8Packet(seq uint16, ts uint32, key bool) *rtp.Packet {
+	frame := byte(0x01)
+	if key {
+		frame = 0x00
+	}
+	return &rtp.Packet{
+		Header:  rtp.Header{SequenceNumber: seq, Timestamp: ts, Marker: true},
+		Payload: []byte{0x10, frame, 0x00, 0x00},
+	}
+}
+
+func TestFreezeDetector(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	d := newFreezeDetector("video", webrtc.MimeTypeVP8, 500*time.Millisecond, start)
+
+	// key frame and 9 frames every 33 ms
+	seq, ts := uint16(100), uint32(1000)
+	for i := 0; i < 10; i++ {
+		d.packet(vp8Packet(seq, ts, i == 0), at(i*33))
+		seq, ts = seq+1, ts+3000
+	}
+	// the next frame is lost, so the 20 frames after it cannot be decoded
+	seq, ts = seq+1, ts+3000
+	for i := 11; i < 31; i++ {
+		d.packet(vp8Packet(seq, ts, false), at(i*33))
+		d.check(at(i * 33))
+		seq, ts = seq+1, ts+3000
+	}
+	// a key frame after a timestamp jump
+	ts += 30000
+	d.packet(vp8Packet(seq, ts, true), at(31*33))
+	d.finish(at(32 * 33))
+
+	s := d.frameCounters().stats()
+	want := FrameStats{
+		Frames:               31,
+		Decodable:            11,
+		Keyframes:            2,
+		MeanGap:              (31*33 - 0) * time.Millisecond / 30,
+		MaxGap:               66 * time.Millisecond,
+		MeanKeyframeInterval: 31 * 33 * time.Millisecond,
+		MaxKeyframeInterval:  31 * 33 * time.Millisecond,
+		TimestampJumps:       1,
+		Freezes:              1,
+		FreezeDuration:       (31*33 - 9*33) * time.Millisecond,
+	}
+	if s != want {
+		t.Errorf("expected %v,\ngot %v", want, s)
+	}
+}
+
+func TestFreezeDetectorRetransmission(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	d := newFreezeDetector("video", webrtc.MimeTypeVP8, 500*time.Millisecond, start)
+
+	// frame 5 is retransmitted after frame 9, within the NACK window
+	for i := 0; i < 11; i++ {
+		if i != 5 {
+			d.packet(vp8Packet(uint16(i), uint32(i*3000), i == 0), at(i*33))
+			d.check(at(i * 33))
+		}
+		if i == 9 {
+			d.packet(vp8Packet(5, 5*3000, false), at(i*33+10))
+		}
+	}
+	// frame 13 is retransmitted after the NACK window, it is given up
+	for _, i := range []int{11, 12, 14, 15} {
+		d.packet(vp8Packet(uint16(i), uint32(i*3000), false), at(i*33))
+	}
+	ms := 15*33 + int(keyframeNACKWindow/time.Millisecond)
+	d.check(at(ms))
+	d.packet(vp8Packet(13, 13*3000, false), at(ms))
+	d.finish(at(ms))
+
+	s := d.frameCounters().stats()
+	if s.Frames != 15 || s.Decodable != 13 || s.Freezes != 0 {
+		t.Errorf("expected 15 frames with 13 decodable and no freeze, got %v", s)
+	}
+	// the frames after 5 are shown once it arrives
+	if s.MaxGap != (9*33+10-4*33)*time.Millisecond {
+		t.Errorf("expected the longest frame gap before the retransmission, got %v", s)
+	}
+}
+
+func TestFreezeDetectorFrameRate(t *testing.T) {
+	start := time.Now()
+	d := newFreezeDetector("video", webrtc.MimeTypeVP8, 500*time.Millisecond, start)
+	// 30 fps, then 5 fps and a jump ahead of 10 seconds
+	var steps []uint32
+	for i := 0; i < 30; i++ {
+		switch {
+		case i < 10:
+			steps = append(steps, 3000)
+		case i == 20:
+			steps = append(steps, 918000)
+		default:
+			steps = append(steps, 18000)
+		}
+	}
+	ts := uint32(0)
+	for i, step := range steps {
+		ts += step
+		d.packet(vp8Packet(uint16(i), ts, i == 0), start)
+	}
+
+	if s := d.frameCounters().stats(); s.TimestampJumps != 2 {
+		t.Errorf("expected 2 timestamp jumps, got %v", s)
+	}
+}
+
+func TestFreezeDetectorNoVideo(t *testing.T) {
+	start := time.Now()
+	d := newFreezeDetector("video", webrtc.MimeTypeVP8, 500*time.Millisecond, start)
+	// inter frames only
+	for i := 0; i < 3; i++ {
+		d.packet(vp8Packet(uint16(i), uint32(i*3000), false), start.Add(time.Duration(i)*time.Second))
+		d.check(start.Add(time.Duration(i) * time.Second))
+	}
+	d.finish(start.Add(3 * time.Second))
+
+	if s := d.frameCounters().stats(); s.Decodable != 0 || s.Freezes != 1 || s.FreezeDuration != 3*time.Second {
+		t.Errorf("expected a freeze for the whole stream, got %v", s)
+	}
+}
+
+func TestIsH264KeyframePacket(t *testing.T) {
+	for _, c := range []struct {
+		payload []byte
+		key     bool
+	}{
+		{[]byte{0x65, 0x88}, true},
+		{[]byte{0x41, 0x9a}, false},
+		// STAP-A of SPS and PPS
+		{[]byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce}, true},
+		// STAP-A of SEI and a slice
+		{[]byte{0x78, 0x00, 0x02, 0x06, 0x05, 0x00, 0x02, 0x41, 0x9a}, false},
+		// FU-A start and middle of an IDR slice
+		{[]byte{0x7c, 0x85, 0x88}, true},
+		{[]byte{0x7c, 0x05, 0x88}, false},
+		{nil, false},
+	} {
+		if got := isKeyframePacket(webrtc.MimeTypeH264, c.payload); got != c.key {
+			t.Errorf("%x: expected key frame %v, got %v", c.payload, c.key, got)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package wcodec
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+// h264Profile is an H264 profile with the payload types of its packetization modes, the codec
+// name of the profile is h264-<name>
+type h264Profile struct {
+	name           string
+	profileLevelID string
+	modes          []h264Mode
+}
+
+// h264Mode is a packetization mode with the payload types of the codec and of its RTX
+type h264Mode struct {
+	mode    int
+	pt, rtx webrtc.PayloadType
+}
+
+// H264 profiles in preference order, the payload types follow Chrome where possible
+var h264Profiles = []h264Profile{
+	{"baseline", "42001f", []h264Mode{{1, 102, 121}, {0, 127, 120}}},
+	{"constrained-baseline", "42e01f", []h264Mode{{1, 125, 107}, {0, 108, 109}}},
+	{"main", "4d001f", []h264Mode{{1, 39, 40}, {0, 41, 42}}},
+	{"high", "640032", []h264Mode{{1, 123, 118}, {0, 124, 119}}},
+}
+
+// H264Codecs is generated from h264Profiles
+var H264Codecs = h264Codecs(h264Profiles)
+
+func h264Codecs(profiles []h264Profile) []webrtc.RTPCodecParameters {
+	var codecs []webrtc.RTPCodecParameters
+	for _, p := range profiles {
+		for _, m := range p.modes {
+			fmtp := fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=%d;profile-level-id=%s",
+				m.mode, p.profileLevelID)
+			codecs = append(codecs,
+				webrtc.RTPCodecParameters{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264,
+						ClockRate: 90000, SDPFmtpLine: fmtp, RTCPFeedback: videoRTCPFeedback},
+					PayloadType: m.pt,
+				},
+				webrtc.RTPCodecParameters{
+					RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRTX,
+						ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", m.pt)},
+					PayloadType: m.rtx,
+				})
+		}
+	}
+	return codecs
+}
+
+// lookupH264Profile returns the profile of a codec name like h264-high
+func lookupH264Profile(name string) (h264Profile, bool) {
+	for _, p := range h264Profiles {
+		if name == "h264-"+p.name {
+			return p, true
+		}
+	}
+	return h264Profile{}, false
+}
+
+// Validate checks that the payload types of the codec tables are unique and that every RTX
+// refers to a codec of its own table, to be called at startup.
+func Validate() error {
+	tables := map[string][]webrtc.RTPCodecParameters{
+		"VP8": VP8Codecs, "VP9": VP9Codecs, "AV1": AV1Codecs, "H264": H264Codecs,
+	}
+	owner := map[webrtc.PayloadType]string{}
+	for name, table := range tables {
+		if err := validateCodecs(table); err != nil {
+			return fmt.Errorf("%s codecs: %w", name, err)
+		}
+		for _, c := range table {
+			if other, ok := owner[c.PayloadType]; ok {
+				return fmt.Errorf("payload type %d is used by both the %s and the %s codecs",
+					c.PayloadType, other, name)
+			}
+			owner[c.PayloadType] = name
+		}
+	}
+	return nil
+}
+
+// validateCodecs checks the payload types and the RTX apt links of a codec table
+func validateCodecs(codecs []webrtc.RTPCodecParameters) error {
+	media := map[string]bool{}
+	seen := map[webrtc.PayloadType]bool{}
+	for _, c := range codecs {
+		if seen[c.PayloadType] {
+			return fmt.Errorf("duplicate payload type %d", c.PayloadType)
+		}
+		seen[c.PayloadType] = true
+		if !strings.EqualFold(c.MimeType, mimeTypeRTX) {
+			media[strconv.Itoa(int(c.PayloadType))] = true
+		}
+	}
+
+	linked := map[string]bool{}
+	for _, c := range codecs {
+		if !strings.EqualFold(c.MimeType, mimeTypeRTX) {
+			continue
+		}
+		apt := fmtpParam(c.SDPFmtpLine, "apt")
+		if !media[apt] {
+			return fmt.Errorf("RTX payload type %d refers to an unknown payload type %q",
+				c.PayloadType, apt)
+		}
+		if linked[apt] {
+			return fmt.Errorf("payload type %s has more than one RTX", apt)
+		}
+		linked[apt] = true
+	}
+	return nil
+}
+
+/////////////////////////
+// SPS check
+
+// h264ProfileName returns the profile name of profile_idc and the constraint flags
+func h264ProfileName(profileIdc, constraints byte) string {
+	switch profileIdc {
+	case 66:
+		// constraint_set1_flag
+		if constraints&0x40 != 0 {
+			return "constrained-baseline"
+		}
+		return "baseline"
+	case 77:
+		return "main"
+	case 100:
+		return "high"
+	}
+	return fmt.Sprintf("profile_idc=%d", profileIdc)
+}
+
+// readSPS returns the profile_idc, the constraint flags and the level_idc of the first SPS in
+// an H264 file
+func readSPS(fileName string) ([3]byte, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return [3]byte{}, err
+	}
+	defer file.Close()
+
+	h264, err := h264reader.NewReader(file)
+	if err != nil {
+		return [3]byte{}, err
+	}
+	for {
+		nal, err := h264.NextNAL()
+		if err == io.EOF {
+			return [3]byte{}, fmt.Errorf("%s: no SPS", fileName)
+		}
+		if err != nil {
+			return [3]byte{}, err
+		}
+		if nal.UnitType == h264reader.NalUnitTypeSPS && len(nal.Data) >= 4 {
+			return [3]byte{nal.Data[1], nal.Data[2], nal.Data[3]}, nil
+		}
+	}
+}
+
+// h264ProfileCompatible tells whether a stream of a profile can be sent on a negotiated profile:
+// constrained-baseline is a subset of baseline
+func h264ProfileCompatible(negotiated, stream string) bool {
+	return negotiated == stream || negotiated == "baseline" && stream == "constrained-baseline"
+}
+
+// sentCodec returns the codec that the sender is bound to: the payload type of its encoding, or
+// of its track if pion does not report it, pion v3.1 leaves it 0
+func sentCodec(rtpSender *webrtc.RTPSender) (webrtc.RTPCodecParameters, bool) {
+	params := rtpSender.GetParameters()
+	var payloadType webrtc.PayloadType
+	if len(params.Encodings) > 0 {
+		payloadType = params.Encodings[0].PayloadType
+	}
+	if t, ok := rtpSender.Track().(interface{ PayloadType() webrtc.PayloadType }); ok && payloadType == 0 {
+		payloadType = t.PayloadType()
+	}
+	for _, c := range params.Codecs {
+		if c.PayloadType == payloadType {
+			return c, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// checkH264Profile warns if the profile or level of the codec the sender is bound to does not
+// match the SPS of the file
+func checkH264Profile(fileName string, rtpSender *webrtc.RTPSender) {
+	sps, err := readSPS(fileName)
+	if err != nil {
+		log.Println("cannot check the H264 profile:", err)
+		return
+	}
+
+	c, ok := sentCodec(rtpSender)
+	if !ok || !strings.EqualFold(c.MimeType, webrtc.MimeTypeH264) {
+		log.Println("cannot check the H264 profile: the sender is not bound to an H264 codec")
+		return
+	}
+	id := fmtpParam(c.SDPFmtpLine, "profile-level-id")
+	var negotiated [3]byte
+	if _, err := fmt.Sscanf(id, "%02x%02x%02x", &negotiated[0], &negotiated[1], &negotiated[2]); err != nil {
+		log.Printf("cannot check the H264 profile: invalid profile-level-id %q\n", id)
+		return
+	}
+
+	if want, got := h264ProfileName(negotiated[0], negotiated[1]), h264ProfileName(sps[0], sps[1]); !h264ProfileCompatible(want, got) {
+		log.Printf("WARNING: negotiated H264 profile %s (payload type %d), but %s has profile %s\n",
+			want, c.PayloadType, fileName, got)
+	} else if sps[2] > negotiated[2] {
+		log.Printf("WARNING: negotiated H264 level %d (payload type %d), but %s has level %d\n",
+			negotiated[2], c.PayloadType, fileName, sps[2])
+	}
+}
+
+// firstSlice tells whether a NAL unit is the first slice of a picture, first_mb_in_slice is 0:
+// an access unit has one, so multi-slice frames are counted once
+func firstSlice(nal *h264reader.NAL) bool {
+	switch nal.UnitType {
+	case h264reader.NalUnitTypeCodedSliceNonIdr, h264reader.NalUnitTypeCodedSliceIdr:
+		// first_mb_in_slice is ue(v), 0 is the single bit 1
+		return len(nal.Data) > 1 && nal.Data[1]&0x80 != 0
+	}
+	return false
+}
+
+// accessUnitReader reads an H264 stream an access unit at a time, for the NAL units of a
+// picture to be sent with a single RTP timestamp. An access unit ends before an AUD, SEI or
+// parameter set or the first slice of the next picture, ITU-T H.264, section 7.4.1.2.3.
+type accessUnitReader struct {
+	h264 *h264reader.H264Reader
+	// the NAL unit at pos, read ahead, or nil
+	next *h264reader.NAL
+	// position of the next NAL unit in the stream
+	pos int
+}
+
+func (r *accessUnitReader) peek() (*h264reader.NAL, error) {
+	if r.next == nil {
+		nal, err := r.h264.NextNAL()
+		if err != nil {
+			return nil, err
+		}
+		r.next = nal
+	}
+	return r.next, nil
+}
+
+// skip drops the NAL units before position to
+func (r *accessUnitReader) skip(to int) error {
+	for r.pos < to {
+		if _, err := r.peek(); err != nil {
+			return err
+		}
+		r.next, r.pos = nil, r.pos+1
+	}
+	return nil
+}
+
+// read returns the NAL units of the next access unit, io.EOF at the end of the stream
+func (r *accessUnitReader) read() ([]*h264reader.NAL, error) {
+	var au []*h264reader.NAL
+	slices := false
+	for {
+		nal, err := r.peek()
+		if err == io.EOF && len(au) > 0 {
+			return au, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch nal.UnitType {
+		case h264reader.NalUnitTypeAUD, h264reader.NalUnitTypeSEI, h264reader.NalUnitTypeSPS,
+			h264reader.NalUnitTypePPS:
+			if slices {
+				return au, nil
+			}
+		case h264reader.NalUnitTypeCodedSliceNonIdr, h264reader.NalUnitTypeCodedSliceIdr:
+			if slices && firstSlice(nal) {
+				return au, nil
+			}
+			slices = true
+		}
+		au = append(au, nal)
+		r.next, r.pos = nil, r.pos+1
+	}
+}
+
+// annexB returns the NAL units of an access unit with start codes, as a single sample
+func annexB(au []*h264reader.NAL) []byte {
+	var b []byte
+	for _, nal := range au {
+		b = append(b, 0x00, 0x00, 0x00, 0x01)
+		b = append(b, nal.Data...)
+	}
+	return b
+}
+
+// spsSize returns the picture size of an SPS NAL unit, cropped, ITU-T H.264, section 7.3.2.1
+func spsSize(sps []byte) (int, int, error) {
+	// remove the emulation prevention bytes
+	var rbsp []byte
+	for i := 1; i < len(sps); i++ {
+		if i >= 3 && sps[i] == 0x03 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+	r := &bitReader{b: rbsp}
+	profileIdc := r.read(8)
+	r.read(16) // constraint flags and level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chromaFormatIdc := uint32(1)
+	switch profileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormatIdc = r.ue(); chromaFormatIdc == 3 {
+			if r.read(1) == 1 {
+				// separate_colour_plane_flag: monochrome planes
+				chromaFormatIdc = 0
+			}
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.read(1) // qpprime_y_zero_transform_bypass_flag
+		if r.read(1) == 1 {
+			lists := 8
+			if chromaFormatIdc == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.read(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue() // log2_max_frame_num_minus4
+	switch r.ue() {
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.read(1) // delta_pic_order_always_zero_flag
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.read(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs, heightMapUnits := r.ue()+1, r.ue()+1
+	frameMbsOnly := r.read(1)
+	if frameMbsOnly == 0 {
+		r.read(1) // mb_adaptive_frame_field_flag
+	}
+	r.read(1) // direct_8x8_inference_flag
+	var left, right, top, bottom uint32
+	if r.read(1) == 1 {
+		left, right, top, bottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return 0, 0, fmt.Errorf("invalid SPS: %w", r.err)
+	}
+
+	cropX, cropY := uint32(1), 2-frameMbsOnly
+	switch chromaFormatIdc {
+	case 1:
+		cropX, cropY = 2, 2*cropY
+	case 2:
+		cropX = 2
+	}
+	width := widthMbs*16 - (left+right)*cropX
+	height := (2-frameMbsOnly)*heightMapUnits*16 - (top+bottom)*cropY
+	return int(width), int(height), nil
+}
@@ -0,0 +1,236 @@
+package wcodec
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+)
+
+func TestValidate(t *testing.T) {
+	if err := Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, profiles := range map[string][]h264Profile{
+		"duplicate payload type": {
+			{"baseline", "42001f", []h264Mode{{1, 102, 121}}},
+			{"high", "640032", []h264Mode{{1, 102, 118}}},
+		},
+		"duplicate RTX": {
+			{"baseline", "42001f", []h264Mode{{1, 102, 121}, {0, 127, 121}}},
+		},
+	} {
+		if err := validateCodecs(h264Codecs(profiles)); err == nil {
+			t.Errorf("%s: should be rejected", name)
+		}
+	}
+
+	dangling := append(h264Codecs(h264Profiles[:1]), webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRTX, ClockRate: 90000,
+			SDPFmtpLine: "apt=100"},
+		PayloadType: 101,
+	})
+	if err := validateCodecs(dangling); err == nil {
+		t.Error("RTX of an unknown payload type should be rejected")
+	}
+}
+
+func TestLookupH264Profile(t *testing.T) {
+	codecs, err := LookupCodec("h264-main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// two packetization modes, each with RTX
+	if len(codecs) != 4 {
+		t.Fatalf("h264-main: %d codecs", len(codecs))
+	}
+	for _, c := range codecs {
+		if c.MimeType == webrtc.MimeTypeH264 &&
+			fmtpParam(c.SDPFmtpLine, "profile-level-id") != "4d001f" {
+			t.Errorf("h264-main: unexpected codec %s", c.SDPFmtpLine)
+		}
+	}
+
+	for _, c := range []struct {
+		sps  [2]byte
+		name string
+	}{
+		{[2]byte{0x42, 0xc0}, "constrained-baseline"},
+		{[2]byte{0x42, 0x00}, "baseline"},
+		{[2]byte{0x4d, 0x40}, "main"},
+		{[2]byte{0x64, 0x00}, "high"},
+	} {
+		if name := h264ProfileName(c.sps[0], c.sps[1]); name != c.name {
+			t.Errorf("SPS %x: profile %s, expected %s", c.sps, name, c.name)
+		}
+	}
+
+	for _, c := range []struct {
+		negotiated, stream string
+		compatible         bool
+	}{
+		{"baseline", "constrained-baseline", true},
+		{"constrained-baseline", "baseline", false},
+		{"main", "main", true},
+		{"high", "main", false},
+	} {
+		if h264ProfileCompatible(c.negotiated, c.stream) != c.compatible {
+			t.Errorf("%s sent on %s: compatible is %v", c.stream, c.negotiated, !c.compatible)
+		}
+	}
+}
+
+// bitWriter writes big endian bit fields and Exp-Golomb codes
+type bitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *bitWriter) write(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		w.b[len(w.b)-1] |= byte(v>>uint(i)&0x01) << (7 - uint(w.n%8))
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	bits := 0
+	for (v+1)>>uint(bits) > 1 {
+		bits++
+	}
+	w.write(0, bits)
+	w.write(v+1, bits+1)
+}
+
+// testSPS returns an SPS of a frame of width x height macroblocks, cropped by bottom chroma
+// lines at the bottom
+func testSPS(profileIdc byte, width, height, bottom uint32) []byte {
+	w := &bitWriter{b: []byte{0x67, profileIdc, 0xc0, 0x1f}, n: 32}
+	w.ue(0) // seq_parameter_set_id
+	if profileIdc == 100 {
+		w.ue(1)       // chroma_format_idc
+		w.ue(0)       // bit_depth_luma_minus8
+		w.ue(0)       // bit_depth_chroma_minus8
+		w.write(0, 1) // qpprime_y_zero_transform_bypass_flag
+		// a scaling matrix with the first list, all deltas 0
+		w.write(1, 1)
+		w.write(1, 1)
+		for i := 0; i < 16; i++ {
+			w.ue(0)
+		}
+		w.write(0, 7)
+	}
+	w.ue(0)       // log2_max_frame_num_minus4
+	w.ue(0)       // pic_order_cnt_type
+	w.ue(0)       // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1)       // max_num_ref_frames
+	w.write(0, 1) // gaps_in_frame_num_value_allowed_flag
+	w.ue(width - 1)
+	w.ue(height - 1)
+	w.write(1, 1) // frame_mbs_only_flag
+	w.write(1, 1) // direct_8x8_inference_flag
+	w.write(1, 1) // frame_cropping_flag
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(bottom)
+	w.write(0, 1) // vui_parameters_present_flag
+	w.write(1, 1) // rbsp_stop_one_bit
+	return w.b
+}
+
+func TestSPSSize(t *testing.T) {
+	for _, profile := range []byte{66, 100} {
+		width, height, err := spsSize(testSPS(profile, 40, 23, 4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if width != 640 || height != 360 {
+			t.Errorf("profile %d: expected 640x360, got %dx%d", profile, width, height)
+		}
+	}
+	if _, _, err := spsSize([]byte{0x67, 0x42}); err == nil {
+		t.Error("a short SPS should be rejected")
+	}
+}
+
+func TestFirstSlice(t *testing.T) {
+	for _, c := range []struct {
+		nal   h264reader.NAL
+		first bool
+	}{
+		{h264reader.NAL{UnitType: h264reader.NalUnitTypeCodedSliceIdr, Data: []byte{0x65, 0x88}}, true},
+		{h264reader.NAL{UnitType: h264reader.NalUnitTypeCodedSliceNonIdr, Data: []byte{0x41, 0x9a}}, true},
+		// first_mb_in_slice 120 of the second slice
+		{h264reader.NAL{UnitType: h264reader.NalUnitTypeCodedSliceNonIdr, Data: []byte{0x41, 0x03, 0xc8}}, false},
+		{h264reader.NAL{UnitType: h264reader.NalUnitTypeSPS, Data: []byte{0x67, 0x42}}, false},
+	} {
+		if first := firstSlice(&c.nal); first != c.first {
+			t.Errorf("NAL %x: first slice %v, expected %v", c.nal.Data, first, c.first)
+		}
+	}
+}
+
+// TestSentCodec binds a constrained-baseline track, which is not the first negotiated H264
+// codec, and checks that its codec is found by the payload type
+func TestSentCodec(t *testing.T) {
+	newPeer := func() *webrtc.PeerConnection {
+		m := &webrtc.MediaEngine{}
+		for _, c := range H264Codecs {
+			if err := m.RegisterCodec(c, webrtc.RTPCodecTypeVideo); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m)).NewPeerConnection(webrtc.Configuration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	offerer, answerer := newPeer(), newPeer()
+
+	want := H264Codecs[4]
+	if fmtpParam(want.SDPFmtpLine, "profile-level-id") != "42e01f" {
+		t.Fatalf("unexpected codec %s", want.SDPFmtpLine)
+	}
+	track, err := NewTrack(want.RTPCodecCapability, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtpSender, err := offerer.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := offerer.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := answerer.SetRemoteDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := answerer.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := offerer.SetRemoteDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+
+	// pion binds the tracks when the answer is set
+	c, ok := sentCodec(rtpSender)
+	if !ok || c.PayloadType != want.PayloadType {
+		t.Fatalf("sent codec %d %s, bound to %d", c.PayloadType, c.SDPFmtpLine, want.PayloadType)
+	}
+}
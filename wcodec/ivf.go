@@ -0,0 +1,231 @@
+package wcodec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+const ivfHeaderSize = 32
+
+// codecs stored in IVF files
+var ivfCodecs = []struct{ mimeType, fourCC string }{
+	{webrtc.MimeTypeVP8, "VP80"},
+	{webrtc.MimeTypeVP9, "VP90"},
+	{MimeTypeAV1, "AV01"},
+}
+
+// ivfFourCC returns the IVF FourCC of a codec mime type, or "" if IVF does not store it
+func ivfFourCC(mimeType string) string {
+	for _, c := range ivfCodecs {
+		if strings.EqualFold(c.mimeType, mimeType) {
+			return c.fourCC
+		}
+	}
+	return ""
+}
+
+// ivfFrameDuration returns the duration of a frame of an IVF file, a tick of its timebase
+func ivfFrameDuration(header *ivfreader.IVFFileHeader) time.Duration {
+	if header.TimebaseNumerator == 0 || header.TimebaseDenominator == 0 {
+		return h264FrameDuration
+	}
+	return time.Second * time.Duration(header.TimebaseNumerator) /
+		time.Duration(header.TimebaseDenominator)
+}
+
+// SampleWriter is written the frames of media files.
+type SampleWriter interface {
+	WriteSample(s media.Sample) error
+}
+
+// SampleTrack is a local track that media files are sent into.
+type SampleTrack interface {
+	webrtc.TrackLocal
+	SampleWriter
+}
+
+// NewTrack returns a local track that payloads the samples of codec.
+func NewTrack(codec webrtc.RTPCodecCapability, id, streamID string) (SampleTrack, error) {
+	if strings.EqualFold(codec.MimeType, MimeTypeAV1) {
+		t, err := webrtc.NewTrackLocalStaticRTP(codec, id, streamID)
+		if err != nil {
+			return nil, err
+		}
+		return &av1Track{TrackLocalStaticRTP: t}, nil
+	}
+	t, err := webrtc.NewTrackLocalStaticSample(codec, id, streamID)
+	if err != nil {
+		return nil, err
+	}
+	return &sampleTrack{TrackLocalStaticSample: t}, nil
+}
+
+// sampleTrack is a sample track that keeps the payload type it is bound to
+type sampleTrack struct {
+	*webrtc.TrackLocalStaticSample
+	payloadType uint32
+}
+
+func (t *sampleTrack) Bind(c webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	codec, err := t.TrackLocalStaticSample.Bind(c)
+	if err == nil {
+		atomic.StoreUint32(&t.payloadType, uint32(codec.PayloadType))
+	}
+	return codec, err
+}
+
+// PayloadType returns the payload type of the last bound codec, 0 before binding.
+func (t *sampleTrack) PayloadType() webrtc.PayloadType {
+	return webrtc.PayloadType(atomic.LoadUint32(&t.payloadType))
+}
+
+// IVFCodec returns the codec mime type of an IVF file by its FourCC.
+func IVFCodec(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", file, err)
+	}
+	for _, c := range ivfCodecs {
+		if header.FourCC == c.fourCC {
+			return c.mimeType, nil
+		}
+	}
+	return "", fmt.Errorf("%s: unknown IVF FourCC %q", file, header.FourCC)
+}
+
+// ivfWriter writes frames into an IVF file at 30 fps, like pion's ivfwriter, so that the file
+// can be sent again
+type ivfWriter struct {
+	file   *os.File
+	frames uint32
+}
+
+func newIVFWriter(file, fourCC string) (*ivfWriter, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, ivfHeaderSize)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)  // version
+	binary.LittleEndian.PutUint16(header[6:], 32) // header size
+	copy(header[8:], fourCC)
+	binary.LittleEndian.PutUint16(header[12:], 640) // width
+	binary.LittleEndian.PutUint16(header[14:], 480) // height
+	binary.LittleEndian.PutUint32(header[16:], 30)  // timebase denominator
+	binary.LittleEndian.PutUint32(header[20:], 1)   // timebase numerator
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &ivfWriter{file: f}, nil
+}
+
+func (w *ivfWriter) writeFrame(frame []byte) error {
+	header := make([]byte, 12)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(frame)))
+	binary.LittleEndian.PutUint64(header[4:], uint64(w.frames))
+	if _, err := w.file.Write(append(header, frame...)); err != nil {
+		return err
+	}
+	w.frames++
+	return nil
+}
+
+// Close updates the frame count in the header and closes the file.
+func (w *ivfWriter) Close() error {
+	count := make([]byte, 4)
+	binary.LittleEndian.PutUint32(count, w.frames)
+	if _, err := w.file.WriteAt(count, 24); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// depacketizer reassembles frames from RTP
+type depacketizer interface {
+	// push adds a packet, and returns the frame the packet completes, if any
+	push(p *rtp.Packet) ([]byte, bool)
+}
+
+// vp9Depacketizer reassembles VP9 frames by the B and E flags of the payload descriptor
+type vp9Depacketizer struct {
+	frame   []byte
+	inFrame bool
+	lastSeq uint16
+}
+
+func (d *vp9Depacketizer) push(p *rtp.Packet) ([]byte, bool) {
+	vp9 := codecs.VP9Packet{}
+	if _, err := vp9.Unmarshal(p.Payload); err != nil {
+		d.inFrame = false
+		return nil, false
+	}
+
+	switch {
+	case vp9.B:
+		d.frame, d.inFrame = append([]byte{}, vp9.Payload...), true
+	case d.inFrame && p.SequenceNumber == d.lastSeq+1:
+		d.frame = append(d.frame, vp9.Payload...)
+	default:
+		// lost the beginning of the frame
+		d.inFrame = false
+	}
+	d.lastSeq = p.SequenceNumber
+
+	if d.inFrame && (vp9.E || p.Marker) {
+		d.inFrame = false
+		return d.frame, true
+	}
+	return nil, false
+}
+
+// receiveIVFTrack writes a VP9 or AV1 track into an IVF file
+func receiveIVFTrack(track *webrtc.TrackRemote, r *Receiver, m *trackMonitor, file string, d depacketizer) {
+	mimeType := track.Codec().MimeType
+
+	ivf, err := newIVFWriter(file, ivfFourCC(mimeType))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer ivf.Close()
+
+	log.Printf("Got %s track, saving to disk as %s\n", mimeType, file)
+	for {
+		rtpPacket, _, err := track.ReadRTP()
+		if err == io.EOF {
+			log.Println("End of track")
+			return
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if frame, ok := d.push(rtpPacket); ok {
+			if err := ivf.writeFrame(frame); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		m.packet(rtpPacket)
+		r.countFrame(rtpPacket)
+	}
+}
@@ -0,0 +1,485 @@
+package wcodec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/h264reader"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+
+	"webrtc-client-go/wrtp"
+)
+
+/////////////////////////
+// receiver
+
+// key frames are requested on loss at most this often, the sender needs time to answer
+const keyframeLossHoldoff = time.Second
+
+// a missing packet has this long to be retransmitted after it is NACKed before its frame is
+// broken, a few NACK intervals and round trips
+const keyframeNACKWindow = 300 * time.Millisecond
+
+// at most this many missing packets are waited for, a longer gap is a loss right away
+const keyframeMaxMissing = 512
+
+// KeyframeRequest is the RTCP feedback message a receiver requests key frames with.
+type KeyframeRequest string
+
+const (
+	// Picture Loss Indication, RFC 4585
+	KeyframePLI KeyframeRequest = "pli"
+	// Full Intra Request, RFC 5104
+	KeyframeFIR KeyframeRequest = "fir"
+	// no key frame requests
+	KeyframeNone KeyframeRequest = "none"
+)
+
+// ParseKeyframeRequest parses pli, fir or none.
+func ParseKeyframeRequest(s string) (KeyframeRequest, error) {
+	switch r := KeyframeRequest(strings.ToLower(s)); r {
+	case KeyframePLI, KeyframeFIR, KeyframeNone:
+		return r, nil
+	}
+	return "", fmt.Errorf("invalid key frame request %q: must be one of pli, fir or none", s)
+}
+
+// KeyframePolicy tells a receiver when and how to request key frames from the sender.
+type KeyframePolicy struct {
+	Request KeyframeRequest
+	// request a key frame this often, 0 for no periodic requests
+	Interval time.Duration
+	// request a key frame when packets are missing, so the following frames cannot be decoded
+	OnLoss bool
+}
+
+// DefaultKeyframePolicy requests a key frame with a PLI every 3 seconds.
+var DefaultKeyframePolicy = KeyframePolicy{Request: KeyframePLI, Interval: 3 * time.Second}
+
+// String implements fmt.Stringer.
+func (k KeyframePolicy) String() string {
+	if k.Request == KeyframeNone || (k.Interval == 0 && !k.OnLoss) {
+		return "no key frame requests"
+	}
+	var when []string
+	if k.Interval > 0 {
+		when = append(when, "every "+k.Interval.String())
+	}
+	if k.OnLoss {
+		when = append(when, "on loss")
+	}
+	return fmt.Sprintf("%s %s", strings.ToUpper(string(k.Request)), strings.Join(when, " and "))
+}
+
+// keyframeRequester sends the key frame requests of a policy for a received stream. A loss is
+// a frame that is still incomplete when the NACK window of its missing packets is over, unless
+// a complete key frame follows it: the frames after it cannot be decoded until the next key
+// frame.
+type keyframeRequester struct {
+	policy   KeyframePolicy
+	mimeType string
+	write    func([]rtcp.Packet) error
+
+	lock sync.Mutex
+	// media SSRC, taken from the received packets if not known up front
+	ssrc    uint32
+	lastSeq uint16
+	started bool
+	// sequence numbers of the missing packets and when they were found missing
+	missing map[uint16]time.Time
+	// more packets were missing than waited for
+	overflow bool
+	// key frame being received: its timestamp and first sequence number
+	inKeyframe bool
+	keyTS      uint32
+	keySeq     uint16
+	firSeq     uint8
+	last       time.Time
+
+	requests, onLoss int64
+}
+
+// newKeyframeRequester returns a requester of policy for a stream of mimeType that sends RTCP
+// with write, ssrc may be 0 if unknown
+func newKeyframeRequester(policy KeyframePolicy, mimeType string, ssrc uint32,
+	write func([]rtcp.Packet) error) *keyframeRequester {
+	return &keyframeRequester{policy: policy, mimeType: mimeType, ssrc: ssrc, write: write,
+		missing: map[uint16]time.Time{}}
+}
+
+// run sends periodic requests and the requests on loss until ctx is done
+func (k *keyframeRequester) run(ctx context.Context) {
+	if k.policy.Request == KeyframeNone {
+		return
+	}
+
+	var tick, check <-chan time.Time
+	if k.policy.Interval > 0 {
+		ticker := time.NewTicker(k.policy.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	if k.policy.OnLoss {
+		ticker := time.NewTicker(keyframeNACKWindow / 5)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+			k.request(false)
+		case now := <-check:
+			if k.lost(now) {
+				k.request(true)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// packet tracks the sequence numbers of the packets received at now: a gap is waited for
+// until its packets are retransmitted, or a complete key frame makes them needless
+func (k *keyframeRequester) packet(p *rtp.Packet, now time.Time) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.ssrc == 0 {
+		k.ssrc = p.SSRC
+	}
+
+	diff := p.SequenceNumber - k.lastSeq
+	switch {
+	case !k.started:
+		k.lastSeq, k.started = p.SequenceNumber, true
+	case diff == 0:
+		return
+	case diff < 0x8000:
+		for seq := k.lastSeq + 1; seq != p.SequenceNumber; seq++ {
+			if len(k.missing) >= keyframeMaxMissing {
+				// the packets are not waited for, the frame is broken
+				k.overflow = true
+				break
+			}
+			k.missing[seq] = now
+		}
+		// late packets do not move the highest sequence number back
+		k.lastSeq = p.SequenceNumber
+	default:
+		// retransmitted or reordered
+		delete(k.missing, p.SequenceNumber)
+	}
+
+	if isKeyframePacket(k.mimeType, p.Payload) && (!k.inKeyframe || p.Timestamp != k.keyTS) {
+		k.inKeyframe, k.keyTS, k.keySeq = true, p.Timestamp, p.SequenceNumber
+	}
+	if !k.inKeyframe || p.Timestamp != k.keyTS || !p.Marker {
+		return
+	}
+	k.inKeyframe = false
+	for seq := range k.missing {
+		if seq-k.keySeq < 0x8000 && p.SequenceNumber-seq < 0x8000 {
+			// the key frame itself is incomplete
+			return
+		}
+	}
+	// the frames before the key frame are not needed anymore
+	k.overflow = false
+	for seq := range k.missing {
+		if k.keySeq-seq < 0x8000 {
+			delete(k.missing, seq)
+		}
+	}
+}
+
+// lost tells whether a packet is still missing at now after the NACK window, these are given up
+func (k *keyframeRequester) lost(now time.Time) bool {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	lost := k.overflow
+	k.overflow = false
+	for seq, since := range k.missing {
+		if now.Sub(since) >= keyframeNACKWindow {
+			delete(k.missing, seq)
+			lost = true
+		}
+	}
+	return lost
+}
+
+// requestNow sends a request unless the policy has none, e.g., for a track waiting for its
+// first key frame
+func (k *keyframeRequester) requestNow() {
+	if k.policy.Request != KeyframeNone {
+		k.request(false)
+	}
+}
+
+func (k *keyframeRequester) request(onLoss bool) {
+	k.lock.Lock()
+	if k.ssrc == 0 || (onLoss && time.Since(k.last) < keyframeLossHoldoff) {
+		k.lock.Unlock()
+		return
+	}
+	k.last = time.Now()
+	var pkt rtcp.Packet = &rtcp.PictureLossIndication{MediaSSRC: k.ssrc}
+	if k.policy.Request == KeyframeFIR {
+		pkt = &rtcp.FullIntraRequest{MediaSSRC: k.ssrc,
+			FIR: []rtcp.FIREntry{{SSRC: k.ssrc, SequenceNumber: k.firSeq}}}
+		k.firSeq++
+	}
+	k.lock.Unlock()
+
+	if err := k.write([]rtcp.Packet{pkt}); err != nil {
+		log.Println("cannot send key frame request:", err)
+		return
+	}
+	atomic.AddInt64(&k.requests, 1)
+	if onLoss {
+		atomic.AddInt64(&k.onLoss, 1)
+	}
+}
+
+// checkFeedback warns if the remote did not negotiate the feedback of the policy
+func (k *keyframeRequester) checkFeedback(codec webrtc.RTPCodecParameters) {
+	want := webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBNACK, Parameter: "pli"}
+	switch k.policy.Request {
+	case KeyframeNone:
+		return
+	case KeyframeFIR:
+		want = webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBCCM, Parameter: "fir"}
+	}
+	for _, fb := range codec.RTCPFeedback {
+		if fb == want {
+			return
+		}
+	}
+	log.Printf("%s feedback not negotiated for %s, the sender may ignore key frame requests\n",
+		strings.ToUpper(string(k.policy.Request)), codec.MimeType)
+}
+
+/////////////////////////
+// sender
+
+// key frame requests are answered at most this often, receivers and media servers repeat them
+const keyframeAnswerHoldoff = 500 * time.Millisecond
+
+// KeyframeResponse is how a file sender answers the key frame requests of the receiver.
+type KeyframeResponse string
+
+const (
+	// skip ahead to the next key frame of the file, or repeat the last one if there is none
+	KeyframeJump KeyframeResponse = "jump"
+	// send the last key frame again
+	KeyframeRepeat KeyframeResponse = "repeat"
+	// keep sending from the current position
+	KeyframeIgnore KeyframeResponse = "none"
+)
+
+// ParseKeyframeResponse parses jump, repeat or none.
+func ParseKeyframeResponse(s string) (KeyframeResponse, error) {
+	switch r := KeyframeResponse(strings.ToLower(s)); r {
+	case KeyframeJump, KeyframeRepeat, KeyframeIgnore:
+		return r, nil
+	}
+	return "", fmt.Errorf("invalid key frame response %q: must be one of jump, repeat or none", s)
+}
+
+// rtcpReader is an RTPSender, or a wrtp.Tap
+type rtcpReader interface {
+	ReadRTCP() ([]rtcp.Packet, interceptor.Attributes, error)
+}
+
+// readRTCP reads incoming RTCP packets and passes the media SSRCs of the key frame requests
+// to onKeyframe, if not nil. Readers of the same packets, like a simulcast sender and the taps
+// of its layers that all get the compound packets with report blocks of their SSRCs, share
+// duplicates so that each request is passed once; nil if reader is the only one.
+// Before these packets are returned they are processed by interceptors. For things like
+// NACK and bandwidth estimation this needs to be called.
+func readRTCP(reader rtcpReader, duplicates *wrtp.Duplicates, onKeyframe func(ssrc uint32)) {
+	// FIRs are repeated with the same sequence number until they are answered
+	firSeqs := map[uint32]uint8{}
+	for {
+		pkts, _, err := reader.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if onKeyframe == nil {
+			continue
+		}
+		if duplicates != nil {
+			b, err := rtcp.Marshal(pkts)
+			if err != nil || !duplicates.Fresh(b) {
+				continue
+			}
+		}
+		for _, p := range pkts {
+			switch p := p.(type) {
+			case *rtcp.PictureLossIndication:
+				onKeyframe(p.MediaSSRC)
+			case *rtcp.FullIntraRequest:
+				for _, e := range p.FIR {
+					if seq, ok := firSeqs[e.SSRC]; ok && seq == e.SequenceNumber {
+						continue
+					}
+					firSeqs[e.SSRC] = e.SequenceNumber
+					onKeyframe(e.SSRC)
+				}
+			}
+		}
+	}
+}
+
+// keyframeIndex holds the positions of the key frames of a media file in ascending order:
+// frame numbers of IVF files, NAL unit numbers of H264 files
+type keyframeIndex []int
+
+// indexIVF returns the key frames of an IVF file of codec
+func indexIVF(fileName, codec string) (keyframeIndex, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ivf, _, err := ivfreader.NewWith(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	var index keyframeIndex
+	for pos := 0; ; pos++ {
+		frame, _, err := ivf.ParseNextFrame()
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fileName, err)
+		}
+		if isKeyframe(codec, frame) {
+			index = append(index, pos)
+		}
+	}
+}
+
+// indexH264 returns the key frames of an H264 file: the first NAL unit of each IDR access
+// unit, that is the parameter sets in front of the IDR slices if any
+func indexH264(fileName string) (keyframeIndex, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h264, err := h264reader.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	var index keyframeIndex
+	start, prev := -1, h264reader.NalUnitType(0)
+	for pos := 0; ; pos++ {
+		nal, err := h264.NextNAL()
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fileName, err)
+		}
+		switch nal.UnitType {
+		case h264reader.NalUnitTypeSEI, h264reader.NalUnitTypeSPS, h264reader.NalUnitTypePPS,
+			h264reader.NalUnitTypeAUD:
+			if start < 0 {
+				start = pos
+			}
+		case h264reader.NalUnitTypeCodedSliceIdr:
+			if prev != h264reader.NalUnitTypeCodedSliceIdr {
+				if start < 0 {
+					start = pos
+				}
+				index = append(index, start)
+			}
+			start = -1
+		default:
+			start = -1
+		}
+		prev = nal.UnitType
+	}
+}
+
+// contains tells whether a key frame starts at pos
+func (x keyframeIndex) contains(pos int) bool {
+	i := sort.SearchInts(x, pos)
+	return i < len(x) && x[i] == pos
+}
+
+// next returns the position of the first key frame after pos
+func (x keyframeIndex) next(pos int) (int, bool) {
+	i := sort.SearchInts(x, pos+1)
+	if i == len(x) {
+		return 0, false
+	}
+	return x[i], true
+}
+
+// RequestKeyframe asks the sender to answer a key frame request of the receiver.
+func (s *Sender) RequestKeyframe() {
+	atomic.AddInt64(&s.requests, 1)
+	select {
+	case s.keyframes <- struct{}{}:
+	default:
+	}
+}
+
+// KeyframeRequests returns the number of key frame requests received and answered so far, by
+// all simulcast layers if any.
+func (s *Sender) KeyframeRequests() (received, answered int) {
+	received, answered = int(atomic.LoadInt64(&s.requests)), int(atomic.LoadInt64(&s.answered))
+	for _, l := range s.layers {
+		r, a := l.KeyframeRequests()
+		received, answered = received+r, answered+a
+	}
+	return received, answered
+}
+
+// answerKeyframe returns how to answer a pending key frame request at pos of a file with the
+// key frames of the index: the position to jump to, or pos, and whether to repeat the last key
+// frame
+func (s *Sender) answerKeyframe(index keyframeIndex, pos int) (int, bool) {
+	select {
+	case <-s.keyframes:
+	default:
+		return pos, false
+	}
+	if s.response == KeyframeIgnore || index.contains(pos) ||
+		time.Since(s.lastAnswer) < keyframeAnswerHoldoff {
+		return pos, false
+	}
+	s.lastAnswer = time.Now()
+	atomic.AddInt64(&s.answered, 1)
+
+	if s.response == KeyframeJump {
+		if next, ok := index.next(pos); ok {
+			log.Printf("key frame requested: jumping from %d to %d\n", pos, next)
+			return next, false
+		}
+	}
+	log.Printf("key frame requested: repeating the last key frame at %d\n", pos)
+	return pos, true
+}
+
+// logKeyframeRequests logs the key frame requests at the end of the file, if any
+func (s *Sender) logKeyframeRequests() {
+	if received, answered := s.KeyframeRequests(); received > 0 {
+		log.Printf("key frame requests: received %d, answered %d (%s)\n", received, answered, s.response)
+	}
+}
@@ -0,0 +1,400 @@
+package wcodec
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+
+	"webrtc-client-go/wrtp"
+)
+
+// rtcpRecorder records the RTCP packets written by a keyframeRequester
+type rtcpRecorder struct {
+	lock sync.Mutex
+	pkts []rtcp.Packet
+}
+
+func (r *rtcpRecorder) write(pkts []rtcp.Packet) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pkts = append(r.pkts, pkts...)
+	return nil
+}
+
+func (r *rtcpRecorder) packets() []rtcp.Packet {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]rtcp.Packet{}, r.pkts...)
+}
+
+func rtpPacket(ssrc uint32, seq uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SSRC: ssrc, SequenceNumber: seq}}
+}
+
+func TestKeyframeLoss(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	k := newKeyframeRequester(KeyframePolicy{Request: KeyframePLI, OnLoss: true},
+		webrtc.MimeTypeVP8, 1234, (&rtcpRecorder{}).write)
+	frame := func(seq uint16, ts uint32, key, marker bool, ms int) {
+		p := vp8Packet(seq, ts, key)
+		p.Marker = marker
+		k.packet(p, at(ms))
+	}
+
+	// wraparound and a late packet are no loss
+	for i, seq := range []uint16{65534, 65535, 0, 2, 1, 3} {
+		frame(seq, uint32(seq)*3000, false, true, i)
+	}
+	if k.lost(at(1000)) {
+		t.Error("a reordered packet is a loss")
+	}
+
+	// a packet retransmitted within the NACK window
+	frame(5, 15000, false, true, 1000)
+	if k.lost(at(1100)) {
+		t.Error("a loss before the NACK window is over")
+	}
+	frame(4, 12000, false, true, 1200)
+	if k.lost(at(2000)) {
+		t.Error("a retransmitted packet is a loss")
+	}
+
+	// a packet that is not retransmitted
+	frame(7, 21000, false, true, 2000)
+	if !k.lost(at(2000).Add(keyframeNACKWindow)) {
+		t.Error("no loss after the NACK window")
+	}
+	if k.lost(at(3000)) {
+		t.Error("a loss is reported twice")
+	}
+
+	// a complete key frame follows the missing packet
+	frame(9, 27000, true, false, 3000)
+	frame(10, 27000, false, true, 3000)
+	if k.lost(at(4000)) {
+		t.Error("a loss before a complete key frame")
+	}
+
+	// the missing packet is part of the key frame
+	frame(11, 30000, true, false, 4000)
+	frame(13, 30000, false, true, 4000)
+	if !k.lost(at(5000)) {
+		t.Error("no loss in an incomplete key frame")
+	}
+}
+
+// TestKeyframeMaxMissing waits for at most keyframeMaxMissing packets, whatever the gaps
+func TestKeyframeMaxMissing(t *testing.T) {
+	k := newKeyframeRequester(KeyframePolicy{Request: KeyframePLI, OnLoss: true},
+		webrtc.MimeTypeVP8, 0, (&rtcpRecorder{}).write)
+	now := time.Now()
+	for seq := uint16(0); seq < 10*keyframeMaxMissing; seq += 2 * keyframeMaxMissing / 3 {
+		k.packet(rtpPacket(1234, seq), now)
+	}
+	if n := len(k.missing); n > keyframeMaxMissing {
+		t.Errorf("expected at most %d missing packets, got %d", keyframeMaxMissing, n)
+	}
+	if !k.lost(now) {
+		t.Error("no loss after too many missing packets")
+	}
+}
+
+func TestKeyframeOnLoss(t *testing.T) {
+	r := &rtcpRecorder{}
+	k := newKeyframeRequester(KeyframePolicy{Request: KeyframeFIR, OnLoss: true},
+		webrtc.MimeTypeVP8, 0, r.write)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go k.run(ctx)
+
+	for _, seq := range []uint16{1, 3} {
+		k.packet(rtpPacket(1234, seq), time.Now())
+	}
+	time.Sleep(keyframeNACKWindow + 100*time.Millisecond)
+	pkts := r.packets()
+	if len(pkts) != 1 {
+		t.Fatalf("expected 1 key frame request for the packet lost at 2, got %v", pkts)
+	}
+	fir, ok := pkts[0].(*rtcp.FullIntraRequest)
+	if !ok || fir.MediaSSRC != 1234 || len(fir.FIR) != 1 || fir.FIR[0].SSRC != 1234 {
+		t.Fatalf("expected a FIR for SSRC 1234, got %v", pkts[0])
+	}
+
+	// held off
+	k.packet(rtpPacket(1234, 10), time.Now())
+	time.Sleep(keyframeNACKWindow + 100*time.Millisecond)
+	if n := len(r.packets()); n != 1 {
+		t.Errorf("expected no request within %s, got %d requests", keyframeLossHoldoff, n)
+	}
+}
+
+// rtcpFeed returns its packets to ReadRTCP, then io.EOF
+type rtcpFeed [][]rtcp.Packet
+
+func (f *rtcpFeed) ReadRTCP() ([]rtcp.Packet, interceptor.Attributes, error) {
+	if len(*f) == 0 {
+		return nil, nil, io.EOF
+	}
+	pkts := (*f)[0]
+	*f = (*f)[1:]
+	return pkts, nil, nil
+}
+
+func TestReadRTCPDuplicates(t *testing.T) {
+	// the compound packet with report blocks of both layers is read by the readers of both
+	compound := func() []rtcp.Packet {
+		return []rtcp.Packet{
+			&rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{{SSRC: 1234}, {SSRC: 5678}}},
+			&rtcp.PictureLossIndication{SenderSSRC: 1, MediaSSRC: 5678},
+		}
+	}
+	var lock sync.Mutex
+	requests := map[uint32]int{}
+	onKeyframe := func(ssrc uint32) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests[ssrc]++
+	}
+	duplicates := &wrtp.Duplicates{}
+	var wg sync.WaitGroup
+	for n := 0; n < 2; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readRTCP(&rtcpFeed{compound()}, duplicates, onKeyframe)
+		}()
+	}
+	wg.Wait()
+	if !reflect.DeepEqual(requests, map[uint32]int{5678: 1}) {
+		t.Errorf("expected 1 key frame request for SSRC 5678, got %v", requests)
+	}
+
+	// a reader of its own passes every request
+	requests = map[uint32]int{}
+	readRTCP(&rtcpFeed{compound(), compound()}, nil, onKeyframe)
+	if !reflect.DeepEqual(requests, map[uint32]int{5678: 2}) {
+		t.Errorf("expected 2 key frame requests for SSRC 5678, got %v", requests)
+	}
+}
+
+func TestKeyframeInterval(t *testing.T) {
+	r := &rtcpRecorder{}
+	k := newKeyframeRequester(KeyframePolicy{Request: KeyframePLI, Interval: 20 * time.Millisecond},
+		webrtc.MimeTypeVP8, 5678, r.write)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		k.run(ctx)
+		close(done)
+	}()
+
+	// a gap does not trigger a request without OnLoss
+	k.packet(rtpPacket(5678, 1), time.Now())
+	k.packet(rtpPacket(5678, 5), time.Now())
+	time.Sleep(110 * time.Millisecond)
+	cancel()
+	<-done
+
+	pkts := r.packets()
+	if len(pkts) < 3 || len(pkts) > 6 {
+		t.Fatalf("expected about 5 periodic requests, got %d", len(pkts))
+	}
+	for _, p := range pkts {
+		if pli, ok := p.(*rtcp.PictureLossIndication); !ok || pli.MediaSSRC != 5678 {
+			t.Fatalf("expected a PLI for SSRC 5678, got %v", p)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if n := len(r.packets()); n != len(pkts) {
+		t.Errorf("requests sent after the context was done: %d -> %d", len(pkts), n)
+	}
+}
+
+func TestKeyframePolicy(t *testing.T) {
+	for s, want := range map[string]string{
+		"pli":  "PLI every 3s",
+		"FIR":  "FIR every 3s",
+		"none": "no key frame requests",
+	} {
+		r, err := ParseKeyframeRequest(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := (KeyframePolicy{Request: r, Interval: 3 * time.Second}).String(); got != want {
+			t.Errorf("%s: expected %q, got %q", s, want, got)
+		}
+	}
+	if _, err := ParseKeyframeRequest("sli"); err == nil {
+		t.Error("unknown key frame request should be rejected")
+	}
+}
+
+// writeKeyframeIVF writes a VP8 IVF file of n frames, frame i is {P, i} where P is 0 for the
+// key frames
+func writeKeyframeIVF(t *testing.T, n int, keyframes ...int) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "input.ivf")
+	w, err := newIVFWriter(file, "VP80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		frame := []byte{0x01, byte(i)}
+		for _, k := range keyframes {
+			if i == k {
+				frame[0] = 0x00
+			}
+		}
+		if err := w.writeFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestIndexIVF(t *testing.T) {
+	index, err := indexIVF(writeKeyframeIVF(t, 12, 0, 6), webrtc.MimeTypeVP8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(index, keyframeIndex{0, 6}) {
+		t.Fatalf("expected key frames at 0 and 6, got %v", index)
+	}
+	for pos, want := range map[int]int{0: 6, 3: 6, 6: -1, 11: -1} {
+		next, ok := index.next(pos)
+		if !ok {
+			next = -1
+		}
+		if next != want {
+			t.Errorf("next key frame after %d: expected %d, got %d", pos, want, next)
+		}
+	}
+}
+
+func TestIndexH264(t *testing.T) {
+	// SPS, PPS, IDR, P, P, SPS, PPS, IDR slice 1 and 2, P
+	var stream []byte
+	for _, header := range []byte{0x67, 0x68, 0x65, 0x41, 0x41, 0x67, 0x68, 0x65, 0x65, 0x41} {
+		stream = append(stream, 0x00, 0x00, 0x00, 0x01, header, 0x88)
+	}
+	file := filepath.Join(t.TempDir(), "input.h264")
+	if err := ioutil.WriteFile(file, stream, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := indexH264(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(index, keyframeIndex{0, 5}) {
+		t.Fatalf("expected key frames at NAL units 0 and 5, got %v", index)
+	}
+}
+
+// requestingWriter records the frame numbers written, the byte at offset of the samples, and
+// their durations, and requests a key frame after the frame written at
+type requestingWriter struct {
+	s         *Sender
+	at        int
+	offset    int
+	frames    []byte
+	durations []time.Duration
+}
+
+func (w *requestingWriter) WriteSample(sample media.Sample) error {
+	w.frames = append(w.frames, sample.Data[w.offset])
+	w.durations = append(w.durations, sample.Duration)
+	if len(w.frames) == w.at+1 {
+		w.s.RequestKeyframe()
+	}
+	return nil
+}
+
+// checkDurations checks that all samples were written with the frame duration
+func (w *requestingWriter) checkDurations(t *testing.T, response KeyframeResponse, want time.Duration) {
+	t.Helper()
+	for i, d := range w.durations {
+		if d != want {
+			t.Errorf("%s: sample %d has duration %s, expected %s", response, i, d, want)
+		}
+	}
+}
+
+func TestKeyframeResponse(t *testing.T) {
+	file := writeKeyframeIVF(t, 10, 0, 6)
+	// connected
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for response, want := range map[KeyframeResponse][]byte{
+		KeyframeJump:   {0, 1, 2, 6, 7, 8, 9},
+		KeyframeRepeat: {0, 1, 2, 0, 3, 4, 5, 6, 7, 8, 9},
+		KeyframeIgnore: {0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+	} {
+		s := newSender(response)
+		w := &requestingWriter{s: s, at: 2, offset: 1}
+		go sendIvfFile(ctx, file, webrtc.MimeTypeVP8, w, s)
+		<-s.Done()
+
+		if !reflect.DeepEqual(w.frames, want) {
+			t.Errorf("%s: expected frames %v, got %v", response, want, w.frames)
+		}
+		w.checkDurations(t, response, time.Second/30)
+		if received, answered := s.KeyframeRequests(); received != 1 ||
+			answered != map[bool]int{true: 0, false: 1}[response == KeyframeIgnore] {
+			t.Errorf("%s: %d key frame requests received, %d answered", response, received, answered)
+		}
+	}
+}
+
+func TestKeyframeResponseH264(t *testing.T) {
+	// SPS, PPS, IDR, P, P, SPS, PPS, IDR slice 1 and 2, P: the slices have first_mb_in_slice 0
+	// but the second IDR slice, and the third byte numbers the NAL units
+	var stream []byte
+	for i, header := range []byte{0x67, 0x68, 0x65, 0x41, 0x41, 0x67, 0x68, 0x65, 0x65, 0x41} {
+		firstMB := byte(0x80)
+		if i == 8 {
+			firstMB = 0x03
+		}
+		stream = append(stream, 0x00, 0x00, 0x00, 0x01, header, firstMB, byte(i))
+	}
+	file := filepath.Join(t.TempDir(), "input.h264")
+	if err := ioutil.WriteFile(file, stream, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// access units are numbered by their first NAL unit
+	for response, want := range map[KeyframeResponse][]byte{
+		KeyframeJump:   {0, 3, 5, 9},
+		KeyframeRepeat: {0, 3, 0, 4, 5, 9},
+		KeyframeIgnore: {0, 3, 4, 5, 9},
+	} {
+		s := newSender(response)
+		w := &requestingWriter{s: s, at: 1, offset: 6}
+		go sendH264File(ctx, file, nil, w, s)
+		<-s.Done()
+
+		if !reflect.DeepEqual(w.frames, want) {
+			t.Errorf("%s: expected access units %v, got %v", response, want, w.frames)
+		}
+		w.checkDurations(t, response, h264FrameDuration)
+	}
+}
@@ -0,0 +1,271 @@
+package wcodec
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// sample flags of the track fragment run, ISO/IEC 14496-12, section 8.8.3.1
+const (
+	mp4SyncSample    = 0x02000000
+	mp4NonSyncSample = 0x01010000
+)
+
+// audio-only files are fragmented this often
+const mp4AudioFragment = time.Second
+
+// mp4Writer writes a fragmented MP4 file with a fragment at each video key frame: the movie
+// box has the tracks without samples, and each fragment a run of samples per track
+type mp4Writer struct {
+	file   *os.File
+	tracks []*mp4Track
+	video  bool
+	seq    uint32
+}
+
+type mp4Track struct {
+	*muxTrack
+	// the duration of the last sample is known at the next one
+	last    *mp4Sample
+	samples []mp4Sample
+}
+
+type mp4Sample struct {
+	dts      uint64
+	duration uint32
+	key      bool
+	data     []byte
+}
+
+func newMP4Writer(file string) (*mp4Writer, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	return &mp4Writer{file: f}, nil
+}
+
+func (w *mp4Writer) supports(mimeType string) bool {
+	return strings.EqualFold(mimeType, webrtc.MimeTypeH264) || strings.EqualFold(mimeType, webrtc.MimeTypeOpus)
+}
+
+func (w *mp4Writer) writeHeader(tracks []*muxTrack) error {
+	ftyp := mp4Box("ftyp", []byte("isom"), mp4Uint32(0x200), []byte("isomiso5iso6avc1mp41"))
+
+	traks := [][]byte{mp4FullBox("mvhd", 0, 0,
+		make([]byte, 8),               // creation and modification time
+		mp4Uint32(1000), mp4Uint32(0), // timescale and duration
+		mp4Uint32(0x00010000), []byte{1, 0}, // rate and volume
+		make([]byte, 10), mp4Matrix(), make([]byte, 24),
+		mp4Uint32(uint32(len(tracks)+1)))} // next track ID
+	var trex [][]byte
+	for _, t := range tracks {
+		w.tracks = append(w.tracks, &mp4Track{muxTrack: t})
+		traks = append(traks, mp4Trak(t))
+		trex = append(trex, mp4FullBox("trex", 0, 0, mp4Uint32(uint32(t.number)), mp4Uint32(1),
+			mp4Uint32(0), mp4Uint32(0), mp4Uint32(0)))
+		if t.kind == webrtc.RTPCodecTypeVideo {
+			w.video = true
+		}
+	}
+	moov := mp4Box("moov", append(traks, mp4Box("mvex", trex...))...)
+
+	_, err := w.file.Write(append(ftyp, moov...))
+	return err
+}
+
+func (w *mp4Writer) writeFrame(t *muxTrack, f muxFrame) error {
+	mt := w.tracks[t.number-1]
+	s := &mp4Sample{dts: uint64(f.pts) * uint64(t.clockRate) / uint64(time.Second), key: f.key, data: f.data}
+	if mt.last != nil {
+		mt.last.duration = uint32(s.dts - mt.last.dts)
+		if mt.last.duration == 0 {
+			mt.last.duration = 1
+		}
+		mt.samples = append(mt.samples, *mt.last)
+	}
+	mt.last = s
+
+	flush := false
+	if w.video {
+		flush = t.kind == webrtc.RTPCodecTypeVideo && f.key
+	} else if n := len(mt.samples); n > 0 {
+		flush = mt.samples[n-1].dts-mt.samples[0].dts >= uint64(mp4AudioFragment)*uint64(t.clockRate)/uint64(time.Second)
+	}
+	if flush {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush writes the samples whose duration is known in a fragment
+func (w *mp4Writer) flush() error {
+	var tracks []*mp4Track
+	for _, t := range w.tracks {
+		if len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	if len(tracks) == 0 {
+		return nil
+	}
+	w.seq++
+
+	// the data offsets are counted from the start of the movie fragment box, whose size is
+	// known after a first pass
+	moof := func(offset int) []byte {
+		boxes := [][]byte{mp4FullBox("mfhd", 0, 0, mp4Uint32(w.seq))}
+		for _, t := range tracks {
+			run := [][]byte{mp4Uint32(uint32(len(t.samples))), mp4Uint32(uint32(offset))}
+			for _, s := range t.samples {
+				flags := uint32(mp4NonSyncSample)
+				if s.key {
+					flags = mp4SyncSample
+				}
+				run = append(run, mp4Uint32(s.duration), mp4Uint32(uint32(len(s.data))), mp4Uint32(flags))
+				offset += len(s.data)
+			}
+			dts := make([]byte, 8)
+			binary.BigEndian.PutUint64(dts, t.samples[0].dts)
+			boxes = append(boxes, mp4Box("traf",
+				// default-base-is-moof
+				mp4FullBox("tfhd", 0, 0x020000, mp4Uint32(uint32(t.number))),
+				mp4FullBox("tfdt", 1, 0, dts),
+				// data offset, sample durations, sizes and flags
+				mp4FullBox("trun", 0, 0x000701, run...)))
+		}
+		return mp4Box("moof", boxes...)
+	}
+	size := len(moof(0))
+	fragment := moof(size + 8)
+
+	var data [][]byte
+	for _, t := range tracks {
+		for _, s := range t.samples {
+			data = append(data, s.data)
+		}
+		t.samples = nil
+	}
+	_, err := w.file.Write(append(fragment, mp4Box("mdat", data...)...))
+	return err
+}
+
+// Close writes the last fragment and closes the file, the last samples last as long as the
+// ones before them.
+func (w *mp4Writer) Close() error {
+	for _, t := range w.tracks {
+		if t.last == nil {
+			continue
+		}
+		t.last.duration = 1
+		if n := len(t.samples); n > 0 {
+			t.last.duration = t.samples[n-1].duration
+		}
+		t.samples = append(t.samples, *t.last)
+		t.last = nil
+	}
+	if err := w.flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// mp4Trak returns the track box of a track without samples
+func mp4Trak(t *muxTrack) []byte {
+	volume, handler, name := []byte{0, 0}, "vide", "VideoHandler"
+	width, height := uint32(t.width), uint32(t.height)
+	header := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	entry := mp4VisualSampleEntry(t)
+	if t.kind == webrtc.RTPCodecTypeAudio {
+		volume, handler, name = []byte{1, 0}, "soun", "SoundHandler"
+		width, height = 0, 0
+		header = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+		entry = mp4OpusSampleEntry(t)
+	}
+
+	tkhd := mp4FullBox("tkhd", 0, 0x000003, // enabled and in the movie
+		make([]byte, 8), mp4Uint32(uint32(t.number)), make([]byte, 4), mp4Uint32(0),
+		make([]byte, 8), make([]byte, 4), // reserved, layer and alternate group
+		volume, make([]byte, 2), mp4Matrix(), mp4Uint32(width<<16), mp4Uint32(height<<16))
+
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4Uint32(1), entry),
+		mp4FullBox("stts", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsc", 0, 0, mp4Uint32(0)),
+		mp4FullBox("stsz", 0, 0, mp4Uint32(0), mp4Uint32(0)),
+		mp4FullBox("stco", 0, 0, mp4Uint32(0)))
+	minf := mp4Box("minf", header,
+		mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4Uint32(1), mp4FullBox("url ", 0, 1))),
+		stbl)
+	mdia := mp4Box("mdia",
+		mp4FullBox("mdhd", 0, 0, make([]byte, 8), mp4Uint32(t.clockRate), mp4Uint32(0),
+			[]byte{0x55, 0xc4, 0, 0}), // language und
+		mp4FullBox("hdlr", 0, 0, make([]byte, 4), []byte(handler), make([]byte, 12),
+			append([]byte(name), 0)),
+		minf)
+	return mp4Box("trak", tkhd, mdia)
+}
+
+// mp4VisualSampleEntry returns the avc1 sample entry of an H264 track
+func mp4VisualSampleEntry(t *muxTrack) []byte {
+	return mp4Box("avc1",
+		make([]byte, 6), []byte{0, 1}, // reserved and data reference index
+		make([]byte, 16),
+		[]byte{byte(t.width >> 8), byte(t.width), byte(t.height >> 8), byte(t.height)},
+		mp4Uint32(0x00480000), mp4Uint32(0x00480000), // 72 dpi
+		make([]byte, 4), []byte{0, 1}, // reserved and frame count
+		make([]byte, 32),            // compressor name
+		[]byte{0, 0x18, 0xff, 0xff}, // depth and pre-defined
+		mp4Box("avcC", t.avcC))
+}
+
+// mp4OpusSampleEntry returns the Opus sample entry, see Encapsulation of Opus in ISO Base Media
+// File Format, section 4.3
+func mp4OpusSampleEntry(t *muxTrack) []byte {
+	return mp4Box("Opus",
+		make([]byte, 6), []byte{0, 1}, // reserved and data reference index
+		make([]byte, 8),
+		[]byte{byte(t.channels >> 8), byte(t.channels), 0, 16}, // channels and sample size
+		make([]byte, 4), mp4Uint32(t.clockRate<<16),
+		mp4Box("dOps",
+			[]byte{0, byte(t.channels), opusPreSkip >> 8, opusPreSkip & 0xff}, // version, channels and pre-skip
+			mp4Uint32(t.clockRate),
+			[]byte{0, 0, 0})) // output gain and channel mapping family
+}
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := append(mp4Uint32(uint32(size)), typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+func mp4Uint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// mp4Matrix returns the unity transformation matrix
+func mp4Matrix() []byte {
+	m := make([]byte, 36)
+	binary.BigEndian.PutUint32(m[0:], 0x00010000)
+	binary.BigEndian.PutUint32(m[16:], 0x00010000)
+	binary.BigEndian.PutUint32(m[32:], 0x40000000)
+	return m
+}
@@ -0,0 +1,635 @@
+package wcodec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+)
+
+// the container header waits at least this long after the first frame for the other tracks
+const muxTrackWait = 2 * time.Second
+
+// muxWait returns how long the container header waits for the other tracks with a key frame
+// policy: video tracks start at a key frame, so longer than a periodic request takes to be
+// answered if its first key frame is lost
+func muxWait(policy KeyframePolicy) time.Duration {
+	if policy.Request == KeyframeNone || policy.Interval+keyframeLossHoldoff < muxTrackWait {
+		return muxTrackWait
+	}
+	return policy.Interval + keyframeLossHoldoff
+}
+
+// OutputFormat is the file format received media is written in.
+type OutputFormat string
+
+const (
+	// the format follows the extension of the output file: .webm or .mp4, raw otherwise
+	OutputAuto OutputFormat = "auto"
+	// IVF for VP8, VP9 and AV1 and an Annex B stream for H264, video only
+	OutputRaw OutputFormat = "raw"
+	// WebM with VP8 or VP9 video and Opus audio in the same file
+	OutputWebM OutputFormat = "webm"
+	// fragmented MP4 with H264 video and Opus audio in the same file
+	OutputMP4 OutputFormat = "mp4"
+)
+
+// ParseOutputFormat parses auto, raw, webm or mp4.
+func ParseOutputFormat(s string) (OutputFormat, error) {
+	switch f := OutputFormat(strings.ToLower(s)); f {
+	case OutputAuto, OutputRaw, OutputWebM, OutputMP4:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid output format %q: must be one of auto, raw, webm or mp4", s)
+}
+
+// ResolveOutputFormat returns the format file is written in: format itself, or if it is auto
+// or empty, the format of the extension of file.
+func ResolveOutputFormat(file string, format OutputFormat) OutputFormat {
+	if format != OutputAuto && format != "" {
+		return format
+	}
+	switch strings.ToLower(path.Ext(file)) {
+	case ".webm":
+		return OutputWebM
+	case ".mp4":
+		return OutputMP4
+	}
+	return OutputRaw
+}
+
+// outputFile returns the name of the file that media of codec is written into in format, the
+// extension of the format is added unless file already has it
+func outputFile(file string, format OutputFormat, mimeType string) string {
+	ext := "." + string(format)
+	if format == OutputRaw {
+		ext = ".ivf"
+		if strings.EqualFold(mimeType, webrtc.MimeTypeH264) {
+			ext = ".h264"
+		}
+	}
+	if strings.EqualFold(path.Ext(file), ext) {
+		return file
+	}
+	return file + ext
+}
+
+// muxFrame is a frame of a track, pts is counted from the first frame of the file
+type muxFrame struct {
+	pts  time.Duration
+	key  bool
+	data []byte
+}
+
+// container writes the tracks of a muxer into a file
+type container interface {
+	// supports tells whether the container can store codec
+	supports(mimeType string) bool
+	writeHeader(tracks []*muxTrack) error
+	writeFrame(t *muxTrack, f muxFrame) error
+	Close() error
+}
+
+// muxTrack is a track of a muxer
+type muxTrack struct {
+	id        string
+	mimeType  string
+	kind      webrtc.RTPCodecType
+	clockRate uint32
+	channels  uint16
+	// number in the container, from 1, set when the header is written
+	number int
+	// video size, and the AVC decoder configuration record of H264
+	width, height int
+	avcC          []byte
+
+	// the track starts at its first decodable frame
+	ready, late bool
+	offset      time.Duration
+	// unwrapped RTP timestamps
+	firstTS, lastTS int64
+	rtpTS           uint32
+}
+
+// pts returns the presentation time of a frame with an RTP timestamp, and whether it comes
+// after the previous one
+func (t *muxTrack) pts(ts uint32) (time.Duration, bool) {
+	ext := t.lastTS + int64(int32(ts-t.rtpTS))
+	if ext < t.lastTS {
+		return 0, false
+	}
+	t.lastTS, t.rtpTS = ext, ts
+	return t.offset + time.Duration(ext-t.firstTS)*time.Second/time.Duration(t.clockRate), true
+}
+
+type pendingFrame struct {
+	track *muxTrack
+	frame muxFrame
+}
+
+// muxer writes the tracks received into the same file: the header is written when all the
+// expected tracks have a decodable frame, or wait after the first one, and the tracks timed by
+// their arrival
+type muxer struct {
+	lock     sync.Mutex
+	file     string
+	c        container
+	expected int
+	wait     time.Duration
+	tracks   []*muxTrack
+	open     int
+	// arrival of the first frame
+	epoch   time.Time
+	header  bool
+	pending []pendingFrame
+}
+
+// newMuxer creates file in format, the header waits for expected tracks
+func newMuxer(file string, format OutputFormat, expected int) (*muxer, error) {
+	var c container
+	var err error
+	switch format {
+	case OutputWebM:
+		c, err = newWebMWriter(file)
+	case OutputMP4:
+		c, err = newMP4Writer(file)
+	default:
+		return nil, fmt.Errorf("no muxer for output format %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &muxer{file: file, c: c, expected: expected, wait: muxTrackWait}, nil
+}
+
+// addTrack adds a track of the codec, it must be ended when it is done
+func (m *muxer) addTrack(id string, codec webrtc.RTPCodecParameters, kind webrtc.RTPCodecType) (*muxTrack, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.c.supports(codec.MimeType) {
+		m.expected--
+		return nil, fmt.Errorf("codec %s cannot be written into %s", codec.MimeType, m.file)
+	}
+	t := &muxTrack{id: id, mimeType: codec.MimeType, kind: kind, clockRate: codec.ClockRate,
+		channels: codec.Channels, width: defaultWidth, height: defaultHeight}
+	if t.channels == 0 {
+		t.channels = 1
+	}
+	m.tracks = append(m.tracks, t)
+	m.open++
+	return t, nil
+}
+
+// writeFrame adds a frame of t with an RTP timestamp that arrived at now
+func (m *muxer) writeFrame(t *muxTrack, ts uint32, frame []byte, now time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if t.late {
+		return nil
+	}
+
+	key := t.kind == webrtc.RTPCodecTypeAudio || isMuxKeyframe(t.mimeType, frame)
+	if !t.ready {
+		// video starts at a key frame that tells the size and for H264 the parameter sets
+		if !key || !t.start(frame) {
+			return nil
+		}
+		if m.header {
+			t.late = true
+			log.Printf("track %s started too late, not written into %s\n", t.id, m.file)
+			return nil
+		}
+		if m.epoch.IsZero() {
+			m.epoch = now
+		}
+		t.ready, t.offset = true, now.Sub(m.epoch)
+		t.firstTS, t.lastTS, t.rtpTS = int64(ts), int64(ts), ts
+	}
+
+	pts, ok := t.pts(ts)
+	if !ok {
+		// reordered, the container needs increasing times
+		return nil
+	}
+	f := muxFrame{pts: pts, key: key, data: frame}
+
+	if m.header {
+		return m.c.writeFrame(t, f)
+	}
+	m.pending = append(m.pending, pendingFrame{track: t, frame: f})
+	ready := 0
+	for _, t := range m.tracks {
+		if t.ready {
+			ready++
+		}
+	}
+	if ready >= m.expected || now.Sub(m.epoch) >= m.wait {
+		return m.writeHeader()
+	}
+	return nil
+}
+
+// started tells whether t has had its first decodable frame, or started too late
+func (m *muxer) started(t *muxTrack) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return t.ready || t.late
+}
+
+// writeHeader writes the header with the tracks ready and the frames received before
+func (m *muxer) writeHeader() error {
+	m.header = true
+	var tracks []*muxTrack
+	for _, t := range m.tracks {
+		if t.ready {
+			t.number = len(tracks) + 1
+			tracks = append(tracks, t)
+		}
+	}
+	if err := m.c.writeHeader(tracks); err != nil {
+		return err
+	}
+	for _, p := range m.pending {
+		if err := m.c.writeFrame(p.track, p.frame); err != nil {
+			return err
+		}
+	}
+	m.pending = nil
+	return nil
+}
+
+// endTrack ends a track, the file is closed after the last one
+func (m *muxer) endTrack(t *muxTrack) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.open--; m.open > 0 {
+		return nil
+	}
+	if !m.header && !m.epoch.IsZero() {
+		if err := m.writeHeader(); err != nil {
+			m.c.Close()
+			return err
+		}
+	}
+	return m.c.Close()
+}
+
+// start takes the video size and the parameter sets from the first key frame
+func (t *muxTrack) start(frame []byte) bool {
+	if t.kind == webrtc.RTPCodecTypeAudio {
+		return true
+	}
+	if w, h, ok := frameSize(t.mimeType, frame); ok {
+		t.width, t.height = w, h
+	}
+	if !strings.EqualFold(t.mimeType, webrtc.MimeTypeH264) {
+		return true
+	}
+	sps, pps := avcParameterSets(frame)
+	if sps == nil || pps == nil {
+		return false
+	}
+	t.avcC = avcDecoderConfig(sps, pps)
+	if w, h, err := spsSize(sps); err == nil {
+		t.width, t.height = w, h
+	}
+	return true
+}
+
+/////////////////////////
+// frames
+
+// isMuxKeyframe tells whether a frame of a depacketizer can be decoded on its own
+func isMuxKeyframe(mimeType string, frame []byte) bool {
+	if !strings.EqualFold(mimeType, webrtc.MimeTypeH264) {
+		return isKeyframe(mimeType, frame)
+	}
+	key := false
+	forEachAVCNAL(frame, func(nal []byte) {
+		if nal[0]&0x1f == 5 {
+			key = true
+		}
+	})
+	return key
+}
+
+// forEachAVCNAL calls fn with the NAL units of a frame of 4 byte length prefixed NAL units
+func forEachAVCNAL(frame []byte, fn func(nal []byte)) {
+	for len(frame) > 4 {
+		n := int(binary.BigEndian.Uint32(frame))
+		frame = frame[4:]
+		if n == 0 || n > len(frame) {
+			return
+		}
+		fn(frame[:n])
+		frame = frame[n:]
+	}
+}
+
+// avcParameterSets returns the first SPS and PPS of a frame of length prefixed NAL units
+func avcParameterSets(frame []byte) (sps, pps []byte) {
+	forEachAVCNAL(frame, func(nal []byte) {
+		switch nal[0] & 0x1f {
+		case 7:
+			if sps == nil {
+				sps = nal
+			}
+		case 8:
+			if pps == nil {
+				pps = nal
+			}
+		}
+	})
+	return sps, pps
+}
+
+// avcDecoderConfig returns an AVC decoder configuration record with 4 byte NAL unit lengths,
+// ISO/IEC 14496-15, section 5.2.4.1
+func avcDecoderConfig(sps, pps []byte) []byte {
+	b := []byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1, byte(len(sps) >> 8), byte(len(sps))}
+	b = append(b, sps...)
+	b = append(b, 1, byte(len(pps)>>8), byte(len(pps)))
+	return append(b, pps...)
+}
+
+// video size until the first key frame tells it, like in the IVF header
+const (
+	defaultWidth  = 640
+	defaultHeight = 480
+)
+
+// frameSize returns the size of a VP8 or VP9 key frame
+func frameSize(mimeType string, frame []byte) (int, int, bool) {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		// frame tag, start code and sizes, RFC 6386, section 9.1
+		if len(frame) < 10 || frame[3] != 0x9d || frame[4] != 0x01 || frame[5] != 0x2a {
+			return 0, 0, false
+		}
+		return int(binary.LittleEndian.Uint16(frame[6:]) & 0x3fff),
+			int(binary.LittleEndian.Uint16(frame[8:]) & 0x3fff), true
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return vp9FrameSize(frame)
+	}
+	return 0, 0, false
+}
+
+// vp9FrameSize parses the uncompressed header of a VP9 key frame up to the frame size
+func vp9FrameSize(frame []byte) (int, int, bool) {
+	r := &bitReader{b: frame}
+	r.read(2) // frame_marker
+	profile := r.read(1) | r.read(1)<<1
+	if profile == 3 {
+		r.read(1)
+	}
+	// show_existing_frame, frame_type, show_frame, error_resilient_mode
+	if r.read(1) != 0 || r.read(1) != 0 {
+		return 0, 0, false
+	}
+	r.read(2)
+	if r.read(24) != 0x498342 {
+		return 0, 0, false
+	}
+	// color config
+	if profile >= 2 {
+		r.read(1)
+	}
+	if r.read(3) != 7 {
+		// not sRGB: color_range, and the subsampling for profiles 1 and 3
+		r.read(1)
+		if profile == 1 || profile == 3 {
+			r.read(3)
+		}
+	} else if profile == 1 || profile == 3 {
+		r.read(1)
+	}
+	w, h := r.read(16)+1, r.read(16)+1
+	return int(w), int(h), r.err == nil
+}
+
+var errBitsShort = errors.New("bitstream too short")
+
+// bitReader reads big endian bit fields
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= 8*len(r.b) {
+			r.err = errBitsShort
+			return 0
+		}
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-uint(r.pos%8))&0x01)
+		r.pos++
+	}
+	return v
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.read(1) == 0 && r.err == nil {
+		if zeros++; zeros > 31 {
+			r.err = errBitsShort
+			return 0
+		}
+	}
+	return (1<<uint(zeros) - 1) + r.read(zeros)
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v&0x01 != 0 {
+		return int32(v+1) / 2
+	}
+	return -int32(v / 2)
+}
+
+/////////////////////////
+// depacketizers
+
+// vp8Depacketizer reassembles VP8 frames that start at the first partition and end with the
+// marker bit
+type vp8Depacketizer struct {
+	frame   []byte
+	inFrame bool
+	lastSeq uint16
+}
+
+func (d *vp8Depacketizer) push(p *rtp.Packet) ([]byte, bool) {
+	vp8 := codecs.VP8Packet{}
+	if _, err := vp8.Unmarshal(p.Payload); err != nil {
+		d.inFrame = false
+		return nil, false
+	}
+
+	switch {
+	case vp8.S == 1 && vp8.PID == 0:
+		d.frame, d.inFrame = append([]byte{}, vp8.Payload...), true
+	case d.inFrame && p.SequenceNumber == d.lastSeq+1:
+		d.frame = append(d.frame, vp8.Payload...)
+	default:
+		d.inFrame = false
+	}
+	d.lastSeq = p.SequenceNumber
+
+	if d.inFrame && p.Marker {
+		d.inFrame = false
+		return d.frame, true
+	}
+	return nil, false
+}
+
+// h264Depacketizer reassembles H264 access units of length prefixed NAL units
+type h264Depacketizer struct {
+	h264    codecs.H264Packet
+	frame   []byte
+	ts      uint32
+	broken  bool
+	started bool
+	lastSeq uint16
+}
+
+func (d *h264Depacketizer) push(p *rtp.Packet) ([]byte, bool) {
+	if !d.started || p.Timestamp != d.ts {
+		d.frame, d.ts, d.broken = nil, p.Timestamp, false
+	}
+	if d.started && p.SequenceNumber != d.lastSeq+1 {
+		d.broken = true
+	}
+	d.started, d.lastSeq = true, p.SequenceNumber
+
+	if d.broken {
+		d.h264 = codecs.H264Packet{IsAVC: true}
+	} else {
+		d.h264.IsAVC = true
+		nals, err := d.h264.Unmarshal(p.Payload)
+		if err != nil {
+			d.broken = true
+		}
+		d.frame = append(d.frame, nals...)
+	}
+
+	if !p.Marker {
+		return nil, false
+	}
+	frame, broken := d.frame, d.broken
+	d.frame, d.broken = nil, false
+	if broken || len(frame) == 0 {
+		return nil, false
+	}
+	return frame, true
+}
+
+// opusDepacketizer returns the payload of each packet as a frame
+type opusDepacketizer struct{}
+
+func (opusDepacketizer) push(p *rtp.Packet) ([]byte, bool) {
+	return p.Payload, len(p.Payload) > 0
+}
+
+// newMuxDepacketizer returns the depacketizer of a codec the muxers store
+func newMuxDepacketizer(mimeType string) depacketizer {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return &vp8Depacketizer{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return &vp9Depacketizer{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return &h264Depacketizer{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeOpus):
+		return opusDepacketizer{}
+	}
+	return nil
+}
+
+/////////////////////////
+// receiver
+
+// muxer returns the muxer of the receiver, the header waits for the tracks of all receiving
+// transceivers
+func (r *Receiver) muxer(file string, format OutputFormat) (*muxer, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.mux != nil {
+		return r.mux, nil
+	}
+	expected := 0
+	for _, t := range r.peerConnection.GetTransceivers() {
+		switch t.Direction() {
+		case webrtc.RTPTransceiverDirectionRecvonly, webrtc.RTPTransceiverDirectionSendrecv:
+			expected++
+		}
+	}
+	mux, err := newMuxer(file, format, expected)
+	if err != nil {
+		return nil, err
+	}
+	mux.wait = muxWait(r.keyframes)
+	r.mux = mux
+	return mux, nil
+}
+
+// receiveMuxedTrack writes a track into the container shared by the tracks of the receiver,
+// m follows the packets of video tracks and requests a key frame for a video track to start
+// with, until it has one
+func receiveMuxedTrack(track *webrtc.TrackRemote, r *Receiver, m *trackMonitor, file string,
+	format OutputFormat) {
+	mimeType := track.Codec().MimeType
+	mux, err := r.muxer(file, format)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	t, err := mux.addTrack(track.ID(), track.Codec(), track.Kind())
+	if err != nil {
+		log.Printf("%s, track %s not saved\n", err, track.ID())
+		return
+	}
+	defer func() {
+		if err := mux.endTrack(t); err != nil {
+			log.Println(err)
+		}
+	}()
+	// the containers store the codecs that have a depacketizer
+	d := newMuxDepacketizer(mimeType)
+
+	log.Printf("Got %s track, saving to disk as %s\n", mimeType, file)
+	var requested time.Time
+	for {
+		rtpPacket, _, err := track.ReadRTP()
+		if err == io.EOF {
+			log.Println("End of track")
+			return
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if frame, ok := d.push(rtpPacket); ok {
+			if err := mux.writeFrame(t, rtpPacket.Timestamp, frame, time.Now()); err != nil {
+				log.Fatalln(err)
+			}
+		}
+		if m != nil {
+			m.packet(rtpPacket)
+			r.countFrame(rtpPacket)
+			if now := time.Now(); now.Sub(requested) >= keyframeLossHoldoff && !mux.started(t) {
+				requested = now
+				m.keyframes.requestNow()
+			}
+		}
+	}
+}
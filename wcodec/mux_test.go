@@ -0,0 +1,340 @@
+package wcodec
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestOutputFile(t *testing.T) {
+	for _, c := range []struct {
+		file     string
+		format   OutputFormat
+		mimeType string
+		want     string
+	}{
+		{"output", OutputAuto, webrtc.MimeTypeVP8, "output.ivf"},
+		{"output", OutputAuto, webrtc.MimeTypeH264, "output.h264"},
+		{"output.ivf", OutputAuto, webrtc.MimeTypeVP8, "output.ivf"},
+		{"output.h264", OutputAuto, webrtc.MimeTypeH264, "output.h264"},
+		{"output.webm", OutputAuto, webrtc.MimeTypeVP8, "output.webm"},
+		{"output.MP4", OutputAuto, webrtc.MimeTypeOpus, "output.MP4"},
+		{"output", OutputWebM, webrtc.MimeTypeVP9, "output.webm"},
+		{"output.ivf", OutputMP4, webrtc.MimeTypeH264, "output.ivf.mp4"},
+	} {
+		format := ResolveOutputFormat(c.file, c.format)
+		if got := outputFile(c.file, format, c.mimeType); got != c.want {
+			t.Errorf("%s in %s: expected %s, got %s", c.file, c.format, c.want, got)
+		}
+	}
+}
+
+// vp8Keyframe returns a VP8 key frame of the given size
+func vp8Keyframe(width, height int) []byte {
+	frame := []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0, 0, 0, 0, 0xaa}
+	binary.LittleEndian.PutUint16(frame[6:], uint16(width))
+	binary.LittleEndian.PutUint16(frame[8:], uint16(height))
+	return frame
+}
+
+// avcFrame returns a frame of 4 byte length prefixed NAL units
+func avcFrame(nals ...[]byte) []byte {
+	var frame []byte
+	for _, nal := range nals {
+		frame = append(frame, byte(len(nal)>>24), byte(len(nal)>>16), byte(len(nal)>>8), byte(len(nal)))
+		frame = append(frame, nal...)
+	}
+	return frame
+}
+
+// writeAV writes a second of 30 fps video, with a key frame at the start and in the middle,
+// and 20 ms audio frames that start 100 ms later
+func writeAV(t *testing.T, m *muxer, video, audio *muxTrack, key, delta []byte) {
+	t.Helper()
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		at := start.Add(time.Duration(i) * 20 * time.Millisecond)
+		if i%3 == 0 {
+			frame := delta
+			if i%45 == 0 {
+				frame = key
+			}
+			if err := m.writeFrame(video, uint32(1000+i/3*3000), frame, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i >= 5 {
+			if err := m.writeFrame(audio, uint32(5000+(i-5)*960), []byte{0xfc, byte(i)}, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, track := range []*muxTrack{video, audio} {
+		if err := m.endTrack(track); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func addTracks(t *testing.T, m *muxer, mimeType string) (*muxTrack, *muxTrack) {
+	t.Helper()
+	video, err := m.addTrack("video", webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeType, ClockRate: 90000}},
+		webrtc.RTPCodecTypeVideo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audio, err := m.addTrack("audio", OpusCodecs[0], webrtc.RTPCodecTypeAudio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video, audio
+}
+
+// ebmlElements returns the elements of an EBML body by ID
+func ebmlElements(t *testing.T, b []byte) map[uint32][][]byte {
+	t.Helper()
+	elements := map[uint32][][]byte{}
+	for len(b) > 0 {
+		l := 1
+		for b[0]&(0x80>>uint(l-1)) == 0 {
+			l++
+		}
+		var id uint32
+		for _, c := range b[:l] {
+			id = id<<8 | uint32(c)
+		}
+		b = b[l:]
+
+		l = 1
+		for b[0]&(0x80>>uint(l-1)) == 0 {
+			l++
+		}
+		size := uint64(b[0] & (0xff >> uint(l)))
+		for _, c := range b[1:l] {
+			size = size<<8 | uint64(c)
+		}
+		b = b[l:]
+		if size > uint64(len(b)) {
+			t.Fatalf("element %x: size %d is beyond the end", id, size)
+		}
+		elements[id] = append(elements[id], b[:size])
+		b = b[size:]
+	}
+	return elements
+}
+
+func TestWebMWriter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "output.webm")
+	// the H264 track is not expected anymore
+	m, err := newMuxer(file, OutputWebM, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.addTrack("h264", webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000}},
+		webrtc.RTPCodecTypeVideo); err == nil {
+		t.Error("H264 should not be written into WebM")
+	}
+	video, audio := addTracks(t, m, webrtc.MimeTypeVP8)
+	// the video starts with an inter frame, that is dropped
+	if err := m.writeFrame(video, 0, []byte{0x11, 0x00, 0x00}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	writeAV(t, m, video, audio, vp8Keyframe(320, 240), []byte{0x11, 0x00, 0x00})
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := ebmlElements(t, data)
+	if len(top[ebmlIDHeader]) != 1 || len(top[mkvIDSegment]) != 1 {
+		t.Fatalf("expected an EBML header and a segment, got %d and %d", len(top[ebmlIDHeader]),
+			len(top[mkvIDSegment]))
+	}
+	segment := ebmlElements(t, top[mkvIDSegment][0])
+
+	entries := ebmlElements(t, segment[mkvIDTracks][0])[mkvIDTrackEntry]
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 tracks, got %d", len(entries))
+	}
+	if codec := string(ebmlElements(t, entries[0])[mkvIDCodecID][0]); codec != "V_VP8" {
+		t.Errorf("expected V_VP8, got %s", codec)
+	}
+	if width := ebmlElements(t, ebmlElements(t, entries[0])[mkvIDVideo][0])[mkvIDPixelWidth][0]; binary.BigEndian.Uint16(width) != 320 {
+		t.Errorf("expected width 320, got %x", width)
+	}
+	opus := ebmlElements(t, entries[1])
+	if head := opus[mkvIDCodecPrivate][0]; binary.LittleEndian.Uint16(head[10:]) != 312 {
+		t.Errorf("expected a pre-skip of 312 samples, got %x", head)
+	}
+	for id, want := range map[uint32]uint64{mkvIDCodecDelay: 6500000, mkvIDSeekPreRoll: 80000000} {
+		if len(opus[id]) != 1 {
+			t.Errorf("no element %x in the Opus track", id)
+			continue
+		}
+		got := uint64(0)
+		for _, b := range opus[id][0] {
+			got = got<<8 | uint64(b)
+		}
+		if got != want {
+			t.Errorf("element %x: expected %d ns, got %d", id, want, got)
+		}
+	}
+
+	clusters := segment[mkvIDCluster]
+	if len(clusters) != 2 {
+		t.Fatalf("expected a cluster at each key frame, got %d", len(clusters))
+	}
+	blocks := map[byte]int{}
+	last := map[byte]int{}
+	for _, c := range clusters {
+		cluster := ebmlElements(t, c)
+		timecode := 0
+		for _, b := range cluster[mkvIDTimecode][0] {
+			timecode = timecode<<8 | int(b)
+		}
+		for _, b := range cluster[mkvIDSimpleBlock] {
+			track := b[0] & 0x7f
+			at := timecode + int(int16(binary.BigEndian.Uint16(b[1:])))
+			if at < last[track] {
+				t.Errorf("track %d: time %d ms is before %d ms", track, at, last[track])
+			}
+			blocks[track]++
+			last[track] = at
+		}
+	}
+	if blocks[1] != 17 || blocks[2] != 45 {
+		t.Errorf("expected 17 video and 45 audio blocks, got %d and %d", blocks[1], blocks[2])
+	}
+	if last[2] < 1000-25 || last[2] > 1000 {
+		t.Errorf("expected the last audio frame at 980 ms, got %d ms", last[2])
+	}
+}
+
+// mp4Boxes returns the boxes of an ISO BMFF body by type
+func mp4Boxes(t *testing.T, b []byte) map[string][][]byte {
+	t.Helper()
+	boxes := map[string][][]byte{}
+	for len(b) > 0 {
+		size := binary.BigEndian.Uint32(b)
+		if size < 8 || int(size) > len(b) {
+			t.Fatalf("box %s: invalid size %d", b[4:8], size)
+		}
+		typ := string(b[4:8])
+		boxes[typ] = append(boxes[typ], b[8:size])
+		b = b[size:]
+	}
+	return boxes
+}
+
+func TestMP4Writer(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "output.mp4")
+	// the VP8 track is not expected anymore
+	m, err := newMuxer(file, OutputMP4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.addTrack("vp8", webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}},
+		webrtc.RTPCodecTypeVideo); err == nil {
+		t.Error("VP8 should not be written into MP4")
+	}
+	video, audio := addTracks(t, m, webrtc.MimeTypeH264)
+	sps := testSPS(66, 40, 23, 4)
+	key := avcFrame(sps, []byte{0x68, 0xce, 0x3c, 0x80}, []byte{0x65, 0x88, 0x84})
+	writeAV(t, m, video, audio, key, avcFrame([]byte{0x41, 0x9a, 0x02}))
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := mp4Boxes(t, data)
+	if len(top["ftyp"]) != 1 || len(top["moov"]) != 1 {
+		t.Fatalf("expected ftyp and moov, got %d and %d", len(top["ftyp"]), len(top["moov"]))
+	}
+	traks := mp4Boxes(t, top["moov"][0])["trak"]
+	if len(traks) != 2 {
+		t.Fatalf("expected 2 tracks, got %d", len(traks))
+	}
+	tkhd := mp4Boxes(t, traks[0])["tkhd"][0]
+	if w, h := binary.BigEndian.Uint32(tkhd[76:])>>16, binary.BigEndian.Uint32(tkhd[80:])>>16; w != 640 || h != 360 {
+		t.Errorf("expected 640x360, got %dx%d", w, h)
+	}
+
+	if len(top["moof"]) != 2 || len(top["mdat"]) != 2 {
+		t.Fatalf("expected a fragment at each key frame, got %d", len(top["moof"]))
+	}
+	samples := map[uint32]int{}
+	offset := len(data)
+	for i := len(top["moof"]) - 1; i >= 0; i-- {
+		// the fragments are at the end of the file
+		offset -= len(top["mdat"][i]) + 8 + len(top["moof"][i]) + 8
+	}
+	for i, moof := range top["moof"] {
+		for _, traf := range mp4Boxes(t, moof)["traf"] {
+			boxes := mp4Boxes(t, traf)
+			track := binary.BigEndian.Uint32(boxes["tfhd"][0][4:])
+			trun := boxes["trun"][0]
+			n := int(binary.BigEndian.Uint32(trun[4:]))
+			dataOffset := int(binary.BigEndian.Uint32(trun[8:]))
+			size := int(binary.BigEndian.Uint32(trun[16:]))
+			if dataOffset+size > len(moof)+8+8+len(top["mdat"][i]) {
+				t.Errorf("track %d: data offset %d is beyond the media data", track, dataOffset)
+			}
+			if track == 1 && string(data[offset+dataOffset:offset+dataOffset+size]) != string(key) && i == 0 {
+				t.Errorf("fragment %d should start with the key frame", i)
+			}
+			samples[track] += n
+		}
+		offset += len(moof) + 8 + len(top["mdat"][i]) + 8
+	}
+	if samples[1] != 17 || samples[2] != 45 {
+		t.Errorf("expected 17 video and 45 audio samples, got %d and %d", samples[1], samples[2])
+	}
+}
+
+func TestMuxWait(t *testing.T) {
+	for _, c := range []struct {
+		policy KeyframePolicy
+		want   time.Duration
+	}{
+		{DefaultKeyframePolicy, 4 * time.Second},
+		{KeyframePolicy{Request: KeyframeFIR, Interval: 500 * time.Millisecond}, muxTrackWait},
+		{KeyframePolicy{Request: KeyframeNone, Interval: 10 * time.Second}, muxTrackWait},
+	} {
+		if got := muxWait(c.policy); got != c.want {
+			t.Errorf("%s: expected a wait of %s, got %s", c.policy, c.want, got)
+		}
+	}
+}
+
+func TestH264Depacketizer(t *testing.T) {
+	d := &h264Depacketizer{}
+	packet := func(seq uint16, ts uint32, marker bool, payload ...byte) *rtp.Packet {
+		return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: ts, Marker: marker},
+			Payload: payload}
+	}
+
+	// STAP-A of SPS and PPS, and an IDR slice in two FU-A fragments
+	d.push(packet(1, 100, false, 0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x02, 0x68, 0xce))
+	d.push(packet(2, 100, false, 0x7c, 0x85, 0x88))
+	frame, ok := d.push(packet(3, 100, true, 0x7c, 0x45, 0x84))
+	want := avcFrame([]byte{0x67, 0x42}, []byte{0x68, 0xce}, []byte{0x65, 0x88, 0x84})
+	if !ok || string(frame) != string(want) {
+		t.Errorf("expected %x, got %x", want, frame)
+	}
+
+	// the first fragment is lost
+	if _, ok := d.push(packet(5, 200, true, 0x7c, 0x41, 0x9a)); ok {
+		t.Error("a frame with a lost packet should be dropped")
+	}
+	if frame, ok := d.push(packet(6, 300, true, 0x41, 0x9a, 0x02)); !ok || string(frame) != string(avcFrame([]byte{0x41, 0x9a, 0x02})) {
+		t.Errorf("expected the next frame, got %x", frame)
+	}
+}
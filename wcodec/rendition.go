@@ -0,0 +1,210 @@
+package wcodec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+)
+
+// renditions are switched up only if their bitrate is below this fraction of the estimate
+const renditionHeadroom = 0.85
+
+// isKeyframe tells whether an IVF frame of codec can be decoded on its own
+func isKeyframe(mimeType string, frame []byte) bool {
+	if len(frame) == 0 {
+		return false
+	}
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		// frame tag, RFC 6386, section 9.1: P is 0 for key frames
+		return frame[0]&0x01 == 0
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		// uncompressed header: frame_marker(2) profile_low_bit profile_high_bit
+		// [reserved_zero] show_existing_frame frame_type
+		b := frame[0]
+		if b>>6 != 0x02 {
+			return false
+		}
+		// position of show_existing_frame
+		bit := 3
+		if profile := (b>>5)&0x01 | ((b>>4)&0x01)<<1; profile == 3 {
+			bit--
+		}
+		if b>>uint(bit)&0x01 != 0 {
+			// show_existing_frame
+			return false
+		}
+		return b>>uint(bit-1)&0x01 == 0
+	case strings.EqualFold(mimeType, MimeTypeAV1):
+		// encoders repeat the sequence header on key frames
+		_, seqHeader, err := splitOBUs(frame)
+		return err == nil && seqHeader
+	}
+	return false
+}
+
+// rendition is a pre-encoded IVF file of the input at some bitrate
+type rendition struct {
+	name    string
+	file    *os.File
+	reader  *ivfreader.IVFReader
+	header  *ivfreader.IVFFileHeader
+	bitrate uint64
+}
+
+// openRendition opens an IVF file of codec and measures its bitrate
+func openRendition(fileName, codec string) (*rendition, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &rendition{name: fileName, file: file}
+	if r.reader, r.header, err = ivfreader.NewWith(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	if r.header.FourCC != ivfFourCC(codec) {
+		file.Close()
+		return nil, fmt.Errorf("%s: IVF FourCC %s does not match codec %s", fileName,
+			r.header.FourCC, codec)
+	}
+
+	frames, bytes := 0, 0
+	for {
+		frame, _, err := r.reader.ParseNextFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s: %w", fileName, err)
+		}
+		frames++
+		bytes += len(frame)
+	}
+	if frames == 0 || r.header.TimebaseNumerator == 0 {
+		file.Close()
+		return nil, fmt.Errorf("%s: no frames", fileName)
+	}
+	duration := float64(frames) * float64(r.header.TimebaseNumerator) /
+		float64(r.header.TimebaseDenominator)
+	r.bitrate = uint64(float64(bytes*8) / duration)
+
+	// rewind
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if r.reader, _, err = ivfreader.NewWith(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// pickRendition returns the highest rendition that fits in the estimate, or else the lowest
+// one; renditions are sorted by bitrate
+func pickRendition(renditions []*rendition, estimate uint64) int {
+	best := 0
+	for i, r := range renditions {
+		if float64(r.bitrate) <= renditionHeadroom*float64(estimate) {
+			best = i
+		}
+	}
+	return best
+}
+
+// SendRenditions streams IVF encodings of the same input at different bitrates into a local
+// track, switching between them at key frames to follow the estimated bandwidth in bits per
+// second. The files must have the same frame rate and key frames at the same positions.
+func SendRenditions(ctx context.Context, rtpSender *webrtc.RTPSender, files []string, codec string,
+	track SampleTrack, estimate func() uint64) *Sender {
+	// key frame requests are not answered, the sender switches renditions at key frames
+	go readRTCP(rtpSender, nil, nil)
+
+	var renditions []*rendition
+	for _, f := range files {
+		r, err := openRendition(f, codec)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if len(renditions) > 0 {
+			first := renditions[0]
+			if r.header.TimebaseNumerator != first.header.TimebaseNumerator ||
+				r.header.TimebaseDenominator != first.header.TimebaseDenominator {
+				log.Fatalf("%s: the frame rate differs from %s\n", f, first.name)
+			}
+		}
+		renditions = append(renditions, r)
+	}
+	sort.Slice(renditions, func(i, j int) bool {
+		return renditions[i].bitrate < renditions[j].bitrate
+	})
+	for _, r := range renditions {
+		log.Printf("rendition %s: %d kbps\n", r.name, r.bitrate/1000)
+	}
+
+	s := newSender(KeyframeIgnore)
+	go sendRenditions(ctx, renditions, codec, track, estimate, s)
+	return s
+}
+
+func sendRenditions(ctx context.Context, renditions []*rendition, codec string, track SampleTrack,
+	estimate func() uint64, s *Sender) {
+	defer func() {
+		for _, r := range renditions {
+			r.file.Close()
+		}
+	}()
+
+	// Wait for connection established
+	<-ctx.Done()
+
+	header := renditions[0].header
+	frameDuration := ivfFrameDuration(header)
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+
+	// the renditions are read in lockstep, the first frames are key frames
+	current := -1
+	frames := make([][]byte, len(renditions))
+	for ; true; <-ticker.C {
+		for i, r := range renditions {
+			frame, _, err := r.reader.ParseNextFrame()
+			if err == io.EOF {
+				log.Println("End of video")
+				close(s.done)
+				return
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+			frames[i] = frame
+		}
+
+		bitrate := estimate()
+		if next := pickRendition(renditions, bitrate); next != current &&
+			(current < 0 || isKeyframe(codec, frames[next])) {
+			log.Printf("sending rendition %s (%d kbps), estimated bandwidth %d kbps\n",
+				renditions[next].name, renditions[next].bitrate/1000, bitrate/1000)
+			current = next
+		}
+
+		if err := track.WriteSample(media.Sample{Data: frames[current],
+			Duration: frameDuration}); err != nil {
+			log.Fatalln(err)
+		}
+		atomic.AddInt64(&s.frames, 1)
+	}
+}
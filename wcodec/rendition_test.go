@@ -0,0 +1,49 @@
+package wcodec
+
+import (
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+func TestIsKeyframe(t *testing.T) {
+	for _, c := range []struct {
+		mimeType string
+		frame    []byte
+		key      bool
+	}{
+		{webrtc.MimeTypeVP8, []byte{0x10, 0x02}, true},
+		{webrtc.MimeTypeVP8, []byte{0x11, 0x02}, false},
+		// profile 0: key frame, inter frame, show existing frame
+		{webrtc.MimeTypeVP9, []byte{0x82}, true},
+		{webrtc.MimeTypeVP9, []byte{0x86}, false},
+		{webrtc.MimeTypeVP9, []byte{0x88}, false},
+		// profile 3 has a reserved bit
+		{webrtc.MimeTypeVP9, []byte{0xb1}, true},
+		{webrtc.MimeTypeVP9, []byte{0xb3}, false},
+		// temporal delimiter and sequence header, temporal delimiter and frame
+		{MimeTypeAV1, []byte{0x12, 0x00, 0x0a, 0x01, 0x00}, true},
+		{MimeTypeAV1, []byte{0x12, 0x00, 0x32, 0x01, 0x00}, false},
+		{webrtc.MimeTypeVP8, nil, false},
+	} {
+		if got := isKeyframe(c.mimeType, c.frame); got != c.key {
+			t.Errorf("%s %x: expected key frame %v, got %v", c.mimeType, c.frame, c.key, got)
+		}
+	}
+}
+
+func TestPickRendition(t *testing.T) {
+	renditions := []*rendition{{bitrate: 300000}, {bitrate: 800000}, {bitrate: 2000000}}
+	for estimate, want := range map[uint64]int{
+		0:        0,
+		300000:   0,
+		1000000:  1,
+		2300000:  1,
+		2400000:  2,
+		10000000: 2,
+	} {
+		if got := pickRendition(renditions, estimate); got != want {
+			t.Errorf("estimate %d bps: expected rendition %d, got %d", estimate, want, got)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package wcodec
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wrtp"
+)
+
+// ReplayTrack is a video track that captured RTP packets are replayed into: the packets keep
+// their markers and timestamps, and get the SSRC and the negotiated payload type of the codec.
+type ReplayTrack struct {
+	codec        webrtc.RTPCodecCapability
+	id, streamID string
+
+	lock        sync.Mutex
+	writer      webrtc.TrackLocalWriter
+	ssrc        uint32
+	payloadType uint8
+}
+
+// NewReplayTrack returns a track that replays a capture of codec.
+func NewReplayTrack(codec webrtc.RTPCodecCapability, id, streamID string) *ReplayTrack {
+	return &ReplayTrack{codec: codec, id: id, streamID: streamID}
+}
+
+// Bind implements webrtc.TrackLocal.
+func (t *ReplayTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	for _, c := range ctx.CodecParameters() {
+		if strings.EqualFold(c.MimeType, t.codec.MimeType) {
+			t.lock.Lock()
+			defer t.lock.Unlock()
+			t.writer, t.ssrc, t.payloadType = ctx.WriteStream(), uint32(ctx.SSRC()), uint8(c.PayloadType)
+			return c, nil
+		}
+	}
+	return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+}
+
+// Unbind implements webrtc.TrackLocal.
+func (t *ReplayTrack) Unbind(webrtc.TrackLocalContext) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.writer = nil
+	return nil
+}
+
+// ID implements webrtc.TrackLocal.
+func (t *ReplayTrack) ID() string { return t.id }
+
+// StreamID implements webrtc.TrackLocal.
+func (t *ReplayTrack) StreamID() string { return t.streamID }
+
+// Kind implements webrtc.TrackLocal.
+func (t *ReplayTrack) Kind() webrtc.RTPCodecType { return webrtc.RTPCodecTypeVideo }
+
+// Codec returns the codec of the track.
+func (t *ReplayTrack) Codec() webrtc.RTPCodecCapability { return t.codec }
+
+// writeRTP writes a media packet with the SSRC and the payload type of the track
+func (t *ReplayTrack) writeRTP(p *rtp.Packet) error {
+	t.lock.Lock()
+	writer, ssrc, payloadType := t.writer, t.ssrc, t.payloadType
+	t.lock.Unlock()
+	if writer == nil {
+		return nil
+	}
+	p.SSRC, p.PayloadType = ssrc, payloadType
+	_, err := writer.WriteRTP(&p.Header, p.Payload)
+	return err
+}
+
+// replayStream is the RTP stream of a capture that is replayed
+type replayStream struct {
+	ssrc uint32
+	// the most frequent payload type, the one of the media: the packets of others, e.g., RED,
+	// FEC or RTX in the stream, are not replayed
+	payloadType uint8
+	packets     []replayPacket
+}
+
+type replayPacket struct {
+	at     time.Duration
+	packet *rtp.Packet
+}
+
+// readReplayStream returns the stream of a capture with the most RTP packets, usually the video,
+// its SRTP packets are decrypted with the media key log keyLog if given, or else dropped
+func readReplayStream(file, keyLog string) (*replayStream, error) {
+	captured, err := wrtp.ReadCapture(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys *wrtp.MediaKeys
+	if keyLog != "" {
+		if keys, err = wrtp.ReadMediaKeys(keyLog); err != nil {
+			return nil, err
+		}
+	}
+	captured, dropped := keys.Decrypt(captured)
+	if dropped > 0 {
+		log.Printf("%s: dropped %d SRTP packets that no key of the media key log decrypts\n", file, dropped)
+	}
+
+	streams := map[uint32]*replayStream{}
+	var replayed *replayStream
+	for _, c := range captured {
+		if c.RTCP {
+			continue
+		}
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(c.Data); err != nil {
+			continue
+		}
+		s, ok := streams[p.SSRC]
+		if !ok {
+			s = &replayStream{ssrc: p.SSRC}
+			streams[p.SSRC] = s
+		}
+		s.packets = append(s.packets, replayPacket{at: c.Time, packet: p})
+		if replayed == nil || len(s.packets) > len(replayed.packets) {
+			replayed = s
+		}
+	}
+	if replayed == nil {
+		if dropped > 0 {
+			return nil, fmt.Errorf("%s: only SRTP packets, give the media key log of the capture", file)
+		}
+		return nil, fmt.Errorf("%s: no RTP packets", file)
+	}
+
+	types := map[uint8]int{}
+	for _, p := range replayed.packets {
+		types[p.packet.PayloadType]++
+		if n := types[p.packet.PayloadType]; n > types[replayed.payloadType] {
+			replayed.payloadType = p.packet.PayloadType
+		}
+	}
+	// the packets of other payload types in the sequence numbers of the media are taken out of
+	// them too, so that they are not replayed as losses
+	seqs := make([]int64, len(replayed.packets))
+	var others []int64
+	for i, p := range replayed.packets {
+		if i > 0 {
+			seqs[i] = seqs[i-1] + int64(int16(p.packet.SequenceNumber-replayed.packets[i-1].packet.SequenceNumber))
+		}
+		if p.packet.PayloadType != replayed.payloadType {
+			others = append(others, seqs[i])
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i] < others[j] })
+	var media []replayPacket
+	for i, p := range replayed.packets {
+		if p.packet.PayloadType == replayed.payloadType {
+			p.packet.SequenceNumber -= uint16(sort.Search(len(others), func(j int) bool { return others[j] > seqs[i] }))
+			media = append(media, p)
+		}
+	}
+	log.Printf("%s: replaying SSRC %d with payload type %d, %d packets in %s, %d packets of other "+
+		"payload types and %d other streams skipped\n", file, replayed.ssrc, replayed.payloadType,
+		len(media), media[len(media)-1].at-media[0].at, len(replayed.packets)-len(media), len(streams)-1)
+	replayed.packets = media
+	return replayed, nil
+}
+
+// SendCapture replays the RTP stream of a capture file with the most packets into a replay
+// track once ctx is done, with the timing of the capture. The sequence numbers are shifted to
+// a random start, so that losses and reordering are replayed as well. Frames are counted by
+// the marker bit, and key frame requests are not answered. SRTP packets are decrypted with
+// the media key log keyLog, if not empty.
+func SendCapture(ctx context.Context, rtpSender *webrtc.RTPSender, file, keyLog string,
+	track *ReplayTrack) (*Sender, error) {
+	stream, err := readReplayStream(file, keyLog)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSender(KeyframeIgnore)
+	go readRTCP(rtpSender, nil, func(uint32) { s.RequestKeyframe() })
+	go func() {
+		<-ctx.Done()
+
+		start, first := time.Now(), stream.packets[0]
+		seq := uint16(random.Uint32()) - first.packet.SequenceNumber
+		for _, r := range stream.packets {
+			// the deadlines are from the start, so that the delays do not add up
+			if d := time.Until(start.Add(r.at - first.at)); d > 0 {
+				time.Sleep(d)
+			}
+
+			p := *r.packet
+			// the header extensions were negotiated in the captured session, and the padding
+			// is not in the payload
+			p.Extension, p.Extensions, p.Padding = false, nil, false
+			p.SequenceNumber += seq
+			if err := track.writeRTP(&p); err != nil {
+				log.Fatalln(err)
+			}
+			if p.Marker {
+				atomic.AddInt64(&s.frames, 1)
+			}
+		}
+		log.Println("End of capture")
+		s.logKeyframeRequests()
+		close(s.done)
+	}()
+	return s, nil
+}
@@ -0,0 +1,53 @@
+package wcodec
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/rtp"
+
+	"webrtc-client-go/wrtp"
+)
+
+func TestReadReplayStream(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.rtpdump")
+	c, err := wrtp.NewCapture(file, wrtp.CaptureAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	// the video with a RED packet, an RTX packet and audio
+	for _, p := range []rtp.Packet{
+		{Header: rtp.Header{Version: 2, PayloadType: 111, SSRC: 1, SequenceNumber: 1}},
+		{Header: rtp.Header{Version: 2, PayloadType: 100, SSRC: 2, SequenceNumber: 1}},
+		{Header: rtp.Header{Version: 2, PayloadType: 116, SSRC: 2, SequenceNumber: 2}},
+		{Header: rtp.Header{Version: 2, PayloadType: 100, SSRC: 2, SequenceNumber: 3, Marker: true}},
+		{Header: rtp.Header{Version: 2, PayloadType: 101, SSRC: 3, SequenceNumber: 1}},
+		{Header: rtp.Header{Version: 2, PayloadType: 100, SSRC: 2, SequenceNumber: 4}},
+	} {
+		b, err := p.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Packet(true, addr, addr, append(b, 1, 2, 3))
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := readReplayStream(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ssrc != 2 || s.payloadType != 100 || len(s.packets) != 3 {
+		t.Fatalf("expected SSRC 2 with payload type 100 and 3 packets, got SSRC %d with %d and %d",
+			s.ssrc, s.payloadType, len(s.packets))
+	}
+	// the RED packet is taken out of the sequence numbers
+	for i, seq := range []uint16{1, 2, 3} {
+		if p := s.packets[i].packet; p.SequenceNumber != seq || p.PayloadType != 100 || p.Marker != (i == 1) {
+			t.Errorf("packet %d: expected sequence number %d, got %v", i, seq, p)
+		}
+	}
+}
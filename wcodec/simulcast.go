@@ -0,0 +1,302 @@
+package wcodec
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/randutil"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+
+	"webrtc-client-go/wrtp"
+)
+
+// random SSRCs of the simulcast layers, seeded from crypto/rand
+var random = randutil.NewMathRandomGenerator()
+
+// SimulcastRIDs returns the RTP stream IDs of n simulcast layers from the lowest to the highest
+// resolution, like browsers name them.
+func SimulcastRIDs(n int) []string {
+	rids := []string{"q", "h", "f"}
+	if n >= len(rids) {
+		return rids
+	}
+	return rids[len(rids)-n:]
+}
+
+// SimulcastTrack is a video track of several encodings of the same source, the simulcast
+// layers, each sent with its own SSRC and identified by the MID and RID header extensions.
+// pion/webrtc v3.1 sends a single encoding per sender, so the highest layer is sent on the
+// SSRC of the sender and the others are written into the same stream with SSRCs of their own,
+// the SSRCs of taps that read their RTCP.
+type SimulcastTrack struct {
+	codec        webrtc.RTPCodecCapability
+	id, streamID string
+	layers       []*SimulcastLayer
+
+	lock   sync.Mutex
+	mid    string
+	single bool
+	bound  bool
+	writer webrtc.TrackLocalWriter
+	// negotiated header extension IDs, 0 if not negotiated
+	midID, ridID uint8
+}
+
+// SimulcastLayer is a simulcast layer of a SimulcastTrack that media files are sent into.
+type SimulcastLayer struct {
+	track *SimulcastTrack
+	rid   string
+	ssrc  uint32
+
+	lock       sync.Mutex
+	packetizer rtp.Packetizer
+}
+
+// NewSimulcastTrack returns a track of codec with a layer for each RID.
+func NewSimulcastTrack(codec webrtc.RTPCodecCapability, id, streamID string,
+	rids []string) (*SimulcastTrack, error) {
+	if len(rids) < 2 {
+		return nil, fmt.Errorf("simulcast needs at least 2 layers, got %d", len(rids))
+	}
+	if payloaderFor(codec.MimeType) == nil {
+		return nil, fmt.Errorf("simulcast: no payloader for codec %s", codec.MimeType)
+	}
+
+	t := &SimulcastTrack{codec: codec, id: id, streamID: streamID}
+	for _, rid := range rids {
+		t.layers = append(t.layers, &SimulcastLayer{track: t, rid: rid, ssrc: random.Uint32()})
+	}
+	return t, nil
+}
+
+func payloaderFor(mimeType string) rtp.Payloader {
+	switch {
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		return &codecs.VP8Payloader{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		return &codecs.VP9Payloader{}
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		return &codecs.H264Payloader{}
+	case strings.EqualFold(mimeType, MimeTypeAV1):
+		return &AV1Payloader{}
+	}
+	return nil
+}
+
+// Layers returns the layers from the lowest to the highest resolution.
+func (t *SimulcastTrack) Layers() []*SimulcastLayer {
+	return t.layers
+}
+
+// RIDs returns the RTP stream IDs of the layers.
+func (t *SimulcastTrack) RIDs() []string {
+	var rids []string
+	for _, l := range t.layers {
+		rids = append(rids, l.rid)
+	}
+	return rids
+}
+
+// SetMID sets the MID of the transceiver, sent in the MID header extension.
+func (t *SimulcastTrack) SetMID(mid string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.mid = mid
+}
+
+// SetSingle makes the track send only its highest layer without RID, for remote peers that did
+// not accept simulcast.
+func (t *SimulcastTrack) SetSingle(single bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.single = single
+}
+
+// Bind implements webrtc.TrackLocal.
+func (t *SimulcastTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.bound {
+		return webrtc.RTPCodecParameters{}, fmt.Errorf("simulcast track %s is already bound", t.id)
+	}
+
+	var codec webrtc.RTPCodecParameters
+	found := false
+	for _, c := range ctx.CodecParameters() {
+		if strings.EqualFold(c.MimeType, t.codec.MimeType) {
+			codec, found = c, true
+			break
+		}
+	}
+	if !found {
+		return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+	}
+
+	t.midID, t.ridID = 0, 0
+	for _, e := range ctx.HeaderExtensions() {
+		switch e.URI {
+		case sdp.SDESMidURI:
+			t.midID = uint8(e.ID)
+		case sdp.SDESRTPStreamIDURI:
+			t.ridID = uint8(e.ID)
+		}
+	}
+
+	t.top().ssrc = uint32(ctx.SSRC())
+	for _, l := range t.layers {
+		l.lock.Lock()
+		l.packetizer = rtp.NewPacketizer(rtpOutboundMTU, uint8(codec.PayloadType), l.ssrc,
+			payloaderFor(codec.MimeType), rtp.NewRandomSequencer(), codec.ClockRate)
+		l.lock.Unlock()
+	}
+	t.bound, t.writer = true, ctx.WriteStream()
+	return codec, nil
+}
+
+// top returns the highest layer
+func (t *SimulcastTrack) top() *SimulcastLayer {
+	return t.layers[len(t.layers)-1]
+}
+
+// Unbind implements webrtc.TrackLocal.
+func (t *SimulcastTrack) Unbind(webrtc.TrackLocalContext) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.bound, t.writer = false, nil
+	return nil
+}
+
+// ID implements webrtc.TrackLocal.
+func (t *SimulcastTrack) ID() string { return t.id }
+
+// StreamID implements webrtc.TrackLocal.
+func (t *SimulcastTrack) StreamID() string { return t.streamID }
+
+// Kind implements webrtc.TrackLocal.
+func (t *SimulcastTrack) Kind() webrtc.RTPCodecType { return webrtc.RTPCodecTypeVideo }
+
+// Codec returns the codec of the track.
+func (t *SimulcastTrack) Codec() webrtc.RTPCodecCapability { return t.codec }
+
+// layerOf returns the index of the layer sent with ssrc, or -1
+func (t *SimulcastTrack) layerOf(ssrc uint32) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i, l := range t.layers {
+		if l.ssrc == ssrc {
+			return i
+		}
+	}
+	return -1
+}
+
+// setSSRC sets the SSRC of a lower layer
+func (l *SimulcastLayer) setSSRC(ssrc uint32) {
+	l.track.lock.Lock()
+	defer l.track.lock.Unlock()
+	l.ssrc = ssrc
+}
+
+// RID returns the RTP stream ID of the layer.
+func (l *SimulcastLayer) RID() string {
+	return l.rid
+}
+
+// WriteSample payloads and writes a frame of the layer.
+func (l *SimulcastLayer) WriteSample(sample media.Sample) error {
+	t := l.track
+	t.lock.Lock()
+	writer, mid, single, midID, ridID, ssrc := t.writer, t.mid, t.single, t.midID, t.ridID, l.ssrc
+	t.lock.Unlock()
+	if writer == nil || (single && l != t.top()) {
+		return nil
+	}
+
+	l.lock.Lock()
+	packets := l.packetizer.Packetize(sample.Data, uint32(sample.Duration.Seconds()*90000))
+	l.lock.Unlock()
+	for _, p := range packets {
+		p.Header.SSRC = ssrc
+		if midID != 0 && mid != "" {
+			if err := p.Header.SetExtension(midID, []byte(mid)); err != nil {
+				return err
+			}
+		}
+		if ridID != 0 && !single {
+			if err := p.Header.SetExtension(ridID, []byte(l.rid)); err != nil {
+				return err
+			}
+		}
+		if _, err := writer.WriteRTP(&p.Header, p.Payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendSimulcast streams a media file into each layer of a simulcast track, the files are
+// given from the lowest to the highest layer. The RTCP of the lower layers is read by taps
+// through interceptors, the interceptors of the PeerConnection, and key frame requests of the
+// receiver are answered by the layer of their SSRC following response.
+func SendSimulcast(ctx context.Context, rtpSender *webrtc.RTPSender, interceptors interceptor.Interceptor,
+	files []string, codec string, track *SimulcastTrack, response KeyframeResponse) (*Sender, error) {
+	if len(files) != len(track.layers) {
+		return nil, fmt.Errorf("simulcast: %d files for %d layers", len(files), len(track.layers))
+	}
+
+	var taps []*wrtp.Tap
+	for _, l := range track.layers[:len(track.layers)-1] {
+		tap, err := wrtp.NewTap(rtpSender.Transport(), interceptors)
+		if err != nil {
+			for _, t := range taps {
+				t.Close()
+			}
+			return nil, fmt.Errorf("simulcast layer %s: %w", l.rid, err)
+		}
+		l.setSSRC(tap.SSRC())
+		taps = append(taps, tap)
+	}
+
+	s := newSender(response)
+	for i, file := range files {
+		l := newSender(response)
+		switch codec {
+		case webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, MimeTypeAV1:
+			go sendIvfFile(ctx, file, codec, track.layers[i], l)
+		case webrtc.MimeTypeH264:
+			go sendH264File(ctx, file, rtpSender, track.layers[i], l)
+		}
+		s.layers = append(s.layers, l)
+	}
+	onKeyframe := func(ssrc uint32) {
+		if i := track.layerOf(ssrc); i >= 0 {
+			s.layers[i].RequestKeyframe()
+		}
+	}
+	// the sender and the taps read the compound packets with report blocks of several layers
+	duplicates := &wrtp.Duplicates{}
+	for _, tap := range taps {
+		go readRTCP(tap, duplicates, onKeyframe)
+	}
+	go func() {
+		readRTCP(rtpSender, duplicates, onKeyframe)
+		// the sender is stopped
+		for _, tap := range taps {
+			tap.Close()
+		}
+	}()
+	go func() {
+		for _, l := range s.layers {
+			<-l.Done()
+		}
+		close(s.done)
+	}()
+	return s, nil
+}
@@ -5,136 +5,145 @@ import (
 	"fmt"
 	"log"
 	"context"
+	"errors"
 	"time"
 	"io"
 	"net"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/rtp"
 	"github.com/pion/rtcp"
-	"github.com/pion/sdp/v3"
 	"github.com/pion/ice/v2"
 	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
 	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
 	"github.com/pion/webrtc/v3/pkg/media/h264reader"
 	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+
+	"webrtc-client-go/wrtp"
 )
 	
 // codec defs: from RegisterDefaultCodecs
 const (
 	// oggPageDuration   = time.Millisecond * 20
 	h264FrameDuration = time.Millisecond * 33
+	// size of the RTCP packets read, like pion's default receive MTU
+	receiveMTU = 1460
 )
 
-var videoRTCPFeedback = []webrtc.RTCPFeedback{{"goog-remb", ""}, {"ccm", "fir"}, {"nack", ""}, {"nack", "pli"}}
+var videoRTCPFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb", Parameter: ""}, {Type: "ccm", Parameter: "fir"}, {Type: "nack", Parameter: ""}, {Type: "nack", Parameter: "pli"}}
 
 var VP8Codecs = []webrtc.RTPCodecParameters {
 	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeVP8, 90000, 0, "", videoRTCPFeedback},
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: videoRTCPFeedback},
 		PayloadType:        96,
 	},
 	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=96", nil},
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, Channels: 0, SDPFmtpLine: "apt=96", RTCPFeedback: nil},
 		PayloadType:        97,
 	},
 }
 
-var H264Codecs = []webrtc.RTPCodecParameters {
-	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0,
-			"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", videoRTCPFeedback},
-		PayloadType:        102,
-	},
-	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=102", nil},
-		PayloadType:        121,
-	},
+var VP9Codecs = []webrtc.RTPCodecParameters {
 	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0,
-			"level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f", videoRTCPFeedback},
-		PayloadType:        127,
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, Channels: 0, SDPFmtpLine: "profile-id=0", RTCPFeedback: videoRTCPFeedback},
+		PayloadType:        98,
 	},
 	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=127", nil},
-		PayloadType:        120,
-	},
-	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0,
-			"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", videoRTCPFeedback},
-		PayloadType:        125,
-	},
-	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=125", nil},
-		PayloadType:        107,
-	},
-	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0,
-			"level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", videoRTCPFeedback},
-		PayloadType:        108,
-	},
-	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=108", nil},
-		PayloadType:        109,
-	},
-	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0,
-			"level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f", videoRTCPFeedback},
-		PayloadType:        127,
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, Channels: 0, SDPFmtpLine: "apt=98", RTCPFeedback: nil},
+		PayloadType:        99,
 	},
+}
+
+var AV1Codecs = []webrtc.RTPCodecParameters {
 	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=127", nil},
-		PayloadType:        120,
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: MimeTypeAV1, ClockRate: 90000, Channels: 0, SDPFmtpLine: "", RTCPFeedback: videoRTCPFeedback},
+		PayloadType:        45,
 	},
 	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{webrtc.MimeTypeH264, 90000, 0,
-			"level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", videoRTCPFeedback},
-		PayloadType:        123,
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, Channels: 0, SDPFmtpLine: "apt=45", RTCPFeedback: nil},
+		PayloadType:        46,
 	},
+}
+
+// OpusCodecs is the audio codec received into containers
+var OpusCodecs = []webrtc.RTPCodecParameters {
 	{
-		RTPCodecCapability: webrtc.RTPCodecCapability{"video/rtx", 90000, 0, "apt=123", nil},
-		PayloadType:        118,
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1", RTCPFeedback: nil},
+		PayloadType:        111,
 	},
 }
 
+// Sender streams a media file into a local track.
+type Sender struct {
+	frames int64
+	done   chan struct{}
+	// senders of the simulcast layers, if any
+	layers []*Sender
+
+	// pending key frame request and how it is answered
+	keyframes          chan struct{}
+	response           KeyframeResponse
+	lastAnswer         time.Time
+	requests, answered int64
+}
+
+func newSender(response KeyframeResponse) *Sender {
+	return &Sender{done: make(chan struct{}), keyframes: make(chan struct{}, 1), response: response}
+}
+
+// Done is closed when the whole file has been sent.
+func (s *Sender) Done() <-chan struct{} {
+	return s.done
+}
+
+// Frames returns the number of video frames sent so far, in the lowest simulcast layer if any.
+func (s *Sender) Frames() int {
+	if len(s.layers) > 0 {
+		return s.layers[0].Frames()
+	}
+	return int(atomic.LoadInt64(&s.frames))
+}
+
 // transmitters: disk -> WebRTC
+// Key frame requests of the receiver are answered following response.
 func SendFile(ctx context.Context, rtpSender *webrtc.RTPSender, file, codec string,
-	track *webrtc.TrackLocalStaticSample) {
-	
-	// Read incoming RTCP packets
-	// Before these packets are returned they are processed by interceptors. For things like
-	// NACK this needs to be called.
-	go func() {
-		for {
-			if rtcps, _, rtcpErr := rtpSender.ReadRTCP(); rtcpErr != nil {
-				for _, rtcp := range rtcps {
-					log.Println(rtcp)
-				}
-			}
-		}
-	}()
+	track SampleTrack, response KeyframeResponse) *Sender {
+	s := newSender(response)
+	go readRTCP(rtpSender, nil, func(uint32) { s.RequestKeyframe() })
 	
 	switch codec {
-	case webrtc.MimeTypeVP8:
-		go sendIvfFile(ctx, file, track)
+	case webrtc.MimeTypeVP8, webrtc.MimeTypeVP9, MimeTypeAV1:
+		go sendIvfFile(ctx, file, codec, track, s)
 	case webrtc.MimeTypeH264:	
-		go sendH264File(ctx, file, track)
+		go sendH264File(ctx, file, rtpSender, track, s)
 	}
+
+	return s
 }
 
-func sendIvfFile(ctx context.Context, fileName string, track *webrtc.TrackLocalStaticSample) {
+func sendIvfFile(ctx context.Context, fileName, codec string, track SampleWriter, s *Sender) {
 	// Open a IVF file and start reading using our IVFReader
 	file, ivfErr := os.Open(fileName)
 	if ivfErr != nil {
 		log.Fatalln(ivfErr)
 	}
+	defer file.Close()
 
 	ivf, header, ivfErr := ivfreader.NewWith(file)
 	if ivfErr != nil {
 		log.Fatalln(ivfErr)
 	}
+	if header.FourCC != ivfFourCC(codec) {
+		log.Fatalf("%s: IVF FourCC %s does not match codec %s\n", fileName, header.FourCC, codec)
+	}
+	index, ivfErr := indexIVF(fileName, codec)
+	if ivfErr != nil {
+		log.Fatalln(ivfErr)
+	}
 
 	// Wait for connection established
 	<-ctx.Done()
@@ -148,40 +157,72 @@ func sendIvfFile(ctx context.Context, fileName string, track *webrtc.TrackLocalS
 	// accumulating skew, just calling time.Sleep didn't compensate for the time spent
 	// parsing the data * works around latency issues with Sleep (see
 	// https://github.com/golang/go/issues/44343)
-	ticker := time.NewTicker(time.Millisecond * time.Duration((float32(header.TimebaseNumerator) /
-		float32(header.TimebaseDenominator))*1000))
+	frameDuration := ivfFrameDuration(header)
+	ticker := time.NewTicker(frameDuration)
+	defer ticker.Stop()
+
+	// position of the next frame, and the last key frame sent
+	pos, key := 0, []byte(nil)
 	for ; true; <-ticker.C {
+		next, repeat := s.answerKeyframe(index, pos)
+		for ; pos < next; pos++ {
+			if _, _, ivfErr = ivf.ParseNextFrame(); ivfErr != nil {
+				break
+			}
+		}
+		if repeat && key != nil {
+			if ivfErr = track.WriteSample(media.Sample{Data: key,
+				Duration: frameDuration}); ivfErr != nil {
+				log.Fatalln(ivfErr)
+			}
+			atomic.AddInt64(&s.frames, 1)
+			continue
+		}
+
 		frame, _, ivfErr := ivf.ParseNextFrame()
 		if ivfErr == io.EOF {
 			log.Println("End of video")
-			os.Exit(0)
+			s.logKeyframeRequests()
+			close(s.done)
+			return
 		}
 
 		if ivfErr != nil {
 			log.Fatalln(ivfErr)
 		}
+		if index.contains(pos) {
+			key = frame
+		}
+		pos++
 
 		if ivfErr = track.WriteSample(media.Sample{Data: frame,
-			Duration: time.Second}); ivfErr != nil {
+			Duration: frameDuration}); ivfErr != nil {
 				log.Fatalln(ivfErr)
 			}
+		atomic.AddInt64(&s.frames, 1)
 	}
 }
 
-func sendH264File(ctx context.Context, fileName string, track *webrtc.TrackLocalStaticSample) {
+func sendH264File(ctx context.Context, fileName string, rtpSender *webrtc.RTPSender, track SampleWriter, s *Sender) {
 	// Open a H264 file and start reading using our IVFReader
 	file, h264Err := os.Open(fileName)
 	if h264Err != nil {
 		log.Fatalln(h264Err)
 	}
+	defer file.Close()
 
 	h264, h264Err := h264reader.NewReader(file)
 	if h264Err != nil {
 		log.Fatalln(h264Err)
 	}
+	index, h264Err := indexH264(fileName)
+	if h264Err != nil {
+		log.Fatalln(h264Err)
+	}
 
 	// Wait for connection established
 	<-ctx.Done()
+	checkH264Profile(fileName, rtpSender)
 
 	// Send our video file frame at a time. Pace our sending so we send it at the same speed it should be played back as.
 	// This isn't required since the video is timestamped, but we will such much higher loss if we send all at once.
@@ -190,55 +231,225 @@ func sendH264File(ctx context.Context, fileName string, track *webrtc.TrackLocal
 	// * avoids accumulating skew, just calling time.Sleep didn't compensate for the time spent parsing the data
 	// * works around latency issues with Sleep (see https://github.com/golang/go/issues/44343)
 	ticker := time.NewTicker(h264FrameDuration)
+	defer ticker.Stop()
+
+	// the NAL units of an access unit are sent with the same timestamp, and the last key frame
+	// sent: parameter sets and IDR slices
+	reader := &accessUnitReader{h264: h264}
+	var key []byte
 	for ; true; <-ticker.C {
-		nal, h264Err := h264.NextNAL()
+		next, repeat := s.answerKeyframe(index, reader.pos)
+		if h264Err = reader.skip(next); h264Err != nil && h264Err != io.EOF {
+			log.Fatalln(h264Err)
+		}
+		if repeat && key != nil {
+			if h264Err = track.WriteSample(media.Sample{Data: key, Duration: h264FrameDuration}); h264Err != nil {
+				log.Fatalln(h264Err)
+			}
+			atomic.AddInt64(&s.frames, 1)
+			continue
+		}
+
+		pos := reader.pos
+		au, h264Err := reader.read()
 		if h264Err == io.EOF {
 			log.Printf("All video frames parsed and sent")
-			os.Exit(0)
+			s.logKeyframeRequests()
+			close(s.done)
+			return
 		}
 		if h264Err != nil {
 			log.Fatalln(h264Err)
 		}
+		sample := annexB(au)
+		if index.contains(pos) {
+			key = sample
+		}
 
-		if h264Err = track.WriteSample(media.Sample{Data: nal.Data, Duration: time.Second}); h264Err != nil {
+		if h264Err = track.WriteSample(media.Sample{Data: sample, Duration: h264FrameDuration}); h264Err != nil {
 			log.Fatalln(h264Err)
 		}
+		atomic.AddInt64(&s.frames, 1)
 	}
 }
 
-// receivers: WebRTC -> disk
-func ReceiveTrack(peerConnection *webrtc.PeerConnection, file, codec string) func (*webrtc.TrackRemote, *webrtc.RTPReceiver) {
+// Receiver writes a remote track to disk.
+type Receiver struct {
+	ctx            context.Context
+	peerConnection *webrtc.PeerConnection
+	file           string
+	keyframes      KeyframePolicy
+	freeze         time.Duration
+	format         OutputFormat
+
+	frames   int64
+	requests int64
+	done     chan struct{}
+	doneOnce sync.Once
+	// the tracks being written
+	tracks sync.WaitGroup
+
+	lock    sync.Mutex
+	freezes []*freezeDetector
+	// the container of the tracks, if the format has one
+	mux *muxer
+}
 
-	switch codec {
-	case webrtc.MimeTypeVP8:
-		// curry
-		return func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) () {
-			receiveVP8Track(track, peerConnection, file)
-		}
-	case webrtc.MimeTypeH264:	
-		return func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-			receiveH264Track(track, peerConnection, file)
-		}
+// NewReceiver returns a Receiver of file in format, the writer is chosen from the format and the
+// negotiated codec of the track, and the extension of the format is added to file unless it
+// has it already. Key frames are requested following the policy until the track ends or ctx
+// is done, and the video is reported frozen after freezeThreshold without a decodable frame,
+// 0 for the DefaultFreezeThreshold.
+func NewReceiver(ctx context.Context, peerConnection *webrtc.PeerConnection, file string,
+	format OutputFormat, keyframes KeyframePolicy, freezeThreshold time.Duration) *Receiver {
+	if freezeThreshold <= 0 {
+		freezeThreshold = DefaultFreezeThreshold
 	}
+	return &Receiver{
+		ctx:            ctx,
+		peerConnection: peerConnection,
+		file:           file,
+		format:         ResolveOutputFormat(file, format),
+		keyframes:      keyframes,
+		freeze:         freezeThreshold,
+		done:           make(chan struct{}),
+	}
+}
 
-	panic("This can never happen")
+// Done is closed when the remote video track ends.
+func (r *Receiver) Done() <-chan struct{} {
+	return r.done
 }
 
-func receiveVP8Track(track *webrtc.TrackRemote, peerConnection *webrtc.PeerConnection, file string) {
+// Frames returns the number of video frames received so far (counted by the RTP marker bit).
+func (r *Receiver) Frames() int {
+	return int(atomic.LoadInt64(&r.frames))
+}
+
+// KeyframeRequests returns the number of key frame requests sent so far.
+func (r *Receiver) KeyframeRequests() int {
+	return int(atomic.LoadInt64(&r.requests))
+}
+
+// Wait waits until the tracks received so far have ended and their files are closed.
+func (r *Receiver) Wait() {
+	r.tracks.Wait()
+}
 
-	// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
+// FrameStats returns the frames and freezes of the tracks received so far.
+func (r *Receiver) FrameStats() FrameStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var c frameCounters
+	for _, f := range r.freezes {
+		c.add(f.frameCounters())
+	}
+	return c.stats()
+}
+
+// OnTrack is to be set as the OnTrack handler of the PeerConnection. Audio tracks are written
+// only into containers, together with the video.
+func (r *Receiver) OnTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	r.tracks.Add(1)
+	defer r.tracks.Done()
+	go readReceiverRTCP(track, receiver)
+	file := outputFile(r.file, r.format, track.Codec().MimeType)
+	if track.Kind() == webrtc.RTPCodecTypeAudio {
+		if r.format == OutputRaw {
+			log.Printf("no writer for audio in raw files, track %s not saved\n", track.ID())
+			return
+		}
+		receiveMuxedTrack(track, r, nil, file, r.format)
+		return
+	}
+	defer r.doneOnce.Do(func() { close(r.done) })
+
+	// key frame requests and freeze checks stop with the track
+	ctx, cancel := context.WithCancel(r.ctx)
+	k := newKeyframeRequester(r.keyframes, track.Codec().MimeType, uint32(track.SSRC()), r.peerConnection.WriteRTCP)
+	k.checkFeedback(track.Codec())
+	log.Printf("track %s: %s\n", track.ID(), r.keyframes)
+	go k.run(ctx)
+	f := newFreezeDetector(track.ID(), track.Codec().MimeType, r.freeze, time.Now())
+	r.lock.Lock()
+	r.freezes = append(r.freezes, f)
+	r.lock.Unlock()
+	freezesDone := make(chan struct{})
 	go func() {
-		ticker := time.NewTicker(time.Second * 3)
-		for range ticker.C {
-			errSend := peerConnection.WriteRTCP([]rtcp.Packet{
-				&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
-			if errSend != nil {
-				log.Println(errSend)
-			}
+		f.run(ctx)
+		close(freezesDone)
+	}()
+	defer func() {
+		cancel()
+		atomic.AddInt64(&r.requests, atomic.LoadInt64(&k.requests))
+		if n := atomic.LoadInt64(&k.requests); n > 0 {
+			log.Printf("track %s: %d key frame requests, %d on loss\n", track.ID(), n,
+				atomic.LoadInt64(&k.onLoss))
 		}
+		<-freezesDone
+		log.Printf("track %s: %s\n", track.ID(), f.frameCounters().stats())
 	}()
 
-	ivfFile, err := ivfwriter.New(file + ".ivf")
+	m := &trackMonitor{keyframes: k, freezes: f}
+	switch mimeType := track.Codec().MimeType; {
+	case r.format != OutputRaw:
+		receiveMuxedTrack(track, r, m, file, r.format)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP8):
+		receiveVP8Track(track, r, m, file)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeH264):
+		receiveH264Track(track, r, m, file)
+	case strings.EqualFold(mimeType, webrtc.MimeTypeVP9):
+		receiveIVFTrack(track, r, m, file, &vp9Depacketizer{})
+	case strings.EqualFold(mimeType, MimeTypeAV1):
+		receiveIVFTrack(track, r, m, file, &av1Depacketizer{})
+	default:
+		log.Printf("no writer for codec %s, track %s not saved\n", mimeType, track.ID())
+	}
+}
+
+// readReceiverRTCP reads the RTCP of a received track, e.g., the sender reports, until the
+// receiver stops, so that the interceptors see it
+func readReceiverRTCP(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	b := make([]byte, receiveMTU)
+	for {
+		var err error
+		if rid := track.RID(); rid != "" {
+			_, _, err = receiver.ReadSimulcast(b, rid)
+		} else {
+			_, _, err = receiver.Read(b)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (r *Receiver) countFrame(p *rtp.Packet) {
+	if p.Marker {
+		atomic.AddInt64(&r.frames, 1)
+	}
+}
+
+// trackMonitor follows the packets of a received track for key frame requests and freezes
+type trackMonitor struct {
+	keyframes *keyframeRequester
+	freezes   *freezeDetector
+}
+
+func (m *trackMonitor) packet(p *rtp.Packet) {
+	now := time.Now()
+	m.keyframes.packet(p, now)
+	m.freezes.packet(p, now)
+}
+
+// receivers: WebRTC -> disk
+func ReceiveTrack(ctx context.Context, peerConnection *webrtc.PeerConnection, file string,
+	format OutputFormat, keyframes KeyframePolicy, freezeThreshold time.Duration) func (*webrtc.TrackRemote, *webrtc.RTPReceiver) {
+	return NewReceiver(ctx, peerConnection, file, format, keyframes, freezeThreshold).OnTrack
+}
+
+func receiveVP8Track(track *webrtc.TrackRemote, r *Receiver, m *trackMonitor, file string) {
+	ivfFile, err := ivfwriter.New(file)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -249,34 +460,27 @@ func receiveVP8Track(track *webrtc.TrackRemote, peerConnection *webrtc.PeerConne
 		log.Fatalln("Got Opus track: unimplemented")
 		// saveToDisk(oggFile, track)
 	} else if strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8) {
-		log.Println("Got VP8 track, saving to disk as " + file + ".ivf")
+		log.Println("Got VP8 track, saving to disk as " + file)
 		for {
 			rtpPacket, _, err := track.ReadRTP()
+			if err == io.EOF {
+				log.Println("End of track")
+				return
+			}
 			if err != nil {
 				log.Fatalln(err)
 			}
 			if err := ivfFile.WriteRTP(rtpPacket); err != nil {
 				log.Fatalln(err)
 			}
+			m.packet(rtpPacket)
+			r.countFrame(rtpPacket)
 		}
 	}
 }
 		
-func receiveH264Track(track *webrtc.TrackRemote, peerConnection *webrtc.PeerConnection, file string) {
-
-	// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-	go func() {
-		ticker := time.NewTicker(time.Second * 3)
-		for range ticker.C {
-			errSend := peerConnection.WriteRTCP([]rtcp.Packet{
-				&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
-			if errSend != nil {
-				log.Println(errSend)
-			}
-		}
-	}()
-
-	h264File, err := h264writer.New(file + ".h264")
+func receiveH264Track(track *webrtc.TrackRemote, r *Receiver, m *trackMonitor, file string) {
+	h264File, err := h264writer.New(file)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -287,15 +491,21 @@ func receiveH264Track(track *webrtc.TrackRemote, peerConnection *webrtc.PeerConn
 		log.Fatalln("Got Opus track: unimplemented")
 		// saveToDisk(oggFile, track)
 	} else if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) {
-		log.Println("Got H264 track, saving to disk as " + file + " .h264")
+		log.Println("Got H264 track, saving to disk as " + file)
 		for {
 			rtpPacket, _, err := track.ReadRTP()
+			if err == io.EOF {
+				log.Println("End of track")
+				return
+			}
 			if err != nil {
 				log.Fatalln(err)
 			}
 			if err := h264File.WriteRTP(rtpPacket); err != nil {
 				log.Fatalln(err)
 			}
+			m.packet(rtpPacket)
+			r.countFrame(rtpPacket)
 		}
 	}
 
@@ -304,12 +514,14 @@ func receiveH264Track(track *webrtc.TrackRemote, peerConnection *webrtc.PeerConn
 		
 //////////////////////////
 // transmitters: disk -> WebRTC
-func createConnections(offer, answer *webrtc.SessionDescription) (*net.UDPConn, *net.UDPConn) {
+// the packets of the connections are captured into capture unless it is nil
+// createConnections opens the RTP and RTCP sockets of a plain RTP session, they are closed when
+// ctx is done
+func createConnections(ctx context.Context, offer, answer *webrtc.SessionDescription, capture *wrtp.Capture) (net.Conn, net.Conn) {
 	// local addr:port: first candidate
 	// remote addr: answer.c=...
 	// remote port: answer.m=...
 	var laddr, raddr *net.UDPAddr
-	var ssrc uint32
 	
 	// offer
 	parsedOffer, err := offer.Unmarshal()
@@ -336,19 +548,6 @@ func createConnections(offer, answer *webrtc.SessionDescription) (*net.UDPConn,
 					}
 				break
 			}
-			if a.Key == sdp.AttrKeySSRC {
-				s := strings.Split(a.Value, " ")
-				if len(s) == 0 {
-					log.Println("cannot split attribute:", a.Value)
-					continue
-				}
-				u64, err := strconv.ParseUint(s[0], 10, 32)
-				if err != nil {
-					log.Println("cannot parse SSRC from attribute:", a.Value)
-					continue
-				}
-				ssrc = uint32(u64)
-			}
 		}
 	} else {
 		log.Fatal("cannot find media info (m=) in SDP:", offer)
@@ -381,16 +580,10 @@ func createConnections(offer, answer *webrtc.SessionDescription) (*net.UDPConn,
 	}
 
 	// RTP
-	rtpConn, err := net.DialUDP("udp", laddr, raddr)
+	rtpUDPConn, err := net.DialUDP("udp", laddr, raddr)
 	if err != nil {
 		log.Fatalf("could not open RTP connection: %s", err)
 	}
-	
-	defer func(conn net.UDPConn) {
-		if closeErr := conn.Close(); closeErr != nil {
-			log.Fatalf("could not close RTP connection: %s -> %s: %s", laddr, raddr, closeErr)
-		}
-	}(*rtpConn)
 
 	// RTCP: RTP port + 1
 	if laddr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", laddr.IP, laddr.Port+1)); err != nil {
@@ -400,57 +593,39 @@ func createConnections(offer, answer *webrtc.SessionDescription) (*net.UDPConn,
 		log.Fatalf("cannot create remote RTCP address: %s", err)
 	}	
 
-	rtcpConn, err := net.DialUDP("udp", laddr, raddr)
+	rtcpUDPConn, err := net.DialUDP("udp", laddr, raddr)
 	if err != nil {
 		log.Fatalf("could not open RTCP connection: %s", err)
 	}
-	
-	defer func(conn net.UDPConn) {
-		if closeErr := conn.Close(); closeErr != nil {
-			log.Fatalf("could not close RTCP connection: %s -> %s: %s", laddr, raddr, closeErr)
-		}
-	}(*rtcpConn)
-	
-	// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
+
+	rtpConn, rtcpConn := capture.Conn(rtpUDPConn), capture.Conn(rtcpUDPConn)
 	go func() {
-		ticker := time.NewTicker(time.Second * 2)
-		for range ticker.C {
-			ps := []rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}}
-			for _, p := range ps {
-				buf, err := p.Marshal()
-				if err != nil {
-					log.Println("cannot marshal RTCP packer:", p)
-				}
-				if _, err := rtcpConn.Write(buf); err != nil {
-					log.Println(err)
-				}
-			}
-		}
+		<-ctx.Done()
+		rtpConn.Close()
+		rtcpConn.Close()
 	}()
 
-	// Read incoming RTCP packets
-	// Before these packets are returned they are processed by interceptors. For things like
-	// NACK this needs to be called.
+	// read incoming RTCP packets until the session ends, so that they are captured
 	go func() {
-		buf := make([]byte, 2000)
+		buf := make([]byte, receiveMTU)
 		for {
-			_, _, err := rtcpConn.ReadFrom(buf[0:])
-			if err != nil {
-				// log.Fatalln("could not read RTCP packet:", err)
-				log.Println("could not read RTCP packet:", err)
+			if _, err := rtcpConn.Read(buf); err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					log.Println("could not read RTCP packet:", err)
+				}
+				return
 			}
-
-			log.Println(string(buf))
 		}
 	}()
-	
+
 	return rtpConn, rtcpConn
 }
 
-func RTPSendFile(offer, answer *webrtc.SessionDescription, file, codec string,
-	track *webrtc.TrackLocalStaticSample) {
+// RTPSendFile sends file over plain RTP until it ends or ctx is done.
+func RTPSendFile(ctx context.Context, offer, answer *webrtc.SessionDescription, file, codec string,
+	track *webrtc.TrackLocalStaticSample, capture *wrtp.Capture) {
 
-	rtpConn, rtcpConn := createConnections(offer, answer)
+	rtpConn, rtcpConn := createConnections(ctx, offer, answer, capture)
 	
 	switch codec {
 	case webrtc.MimeTypeVP8:
@@ -460,7 +635,7 @@ func RTPSendFile(offer, answer *webrtc.SessionDescription, file, codec string,
 	}
 }
 
-func rtpSendIvfFile(rtpConn, rtcpConn *net.UDPConn, fileName string, track *webrtc.TrackLocalStaticSample) {
+func rtpSendIvfFile(rtpConn, rtcpConn net.Conn, fileName string, track *webrtc.TrackLocalStaticSample) {
 	// Open a IVF file and start reading using our IVFReader
 	file, ivfErr := os.Open(fileName)
 	if ivfErr != nil {
@@ -495,12 +670,15 @@ func rtpSendIvfFile(rtpConn, rtcpConn *net.UDPConn, fileName string, track *webr
 		}
 
 		if _, err := rtpConn.Write(frame); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Fatalln(err)
 		}
 	}
 }
 
-func rtpSendH264File(rtpConn, rtcpConn *net.UDPConn, fileName string, track *webrtc.TrackLocalStaticSample) {
+func rtpSendH264File(rtpConn, rtcpConn net.Conn, fileName string, track *webrtc.TrackLocalStaticSample) {
 	// Open a H264 file and start reading using our IVFReader
 	file, h264Err := os.Open(fileName)
 	if h264Err != nil {
@@ -534,26 +712,50 @@ func rtpSendH264File(rtpConn, rtcpConn *net.UDPConn, fileName string, track *web
 		// 	log.Fatalln(h264Err)
 		// }
 		if _, err := rtpConn.Write(nal.Data); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Fatalln("cannot write RTP packet:", err)
 		}
 	}
 }
 
 // receivers: WebRTC -> disk
-func RTPReceiveTrack(offer, answer *webrtc.SessionDescription, codec, file string) {
-	rtpConn, rtcpConn := createConnections(offer, answer)
+// Key frames are requested following the policy and freezes are checked until ctx is done, then
+// the frames received are logged.
+func RTPReceiveTrack(ctx context.Context, offer, answer *webrtc.SessionDescription, codec, file string,
+	keyframes KeyframePolicy, freezeThreshold time.Duration, capture *wrtp.Capture) {
+	if freezeThreshold <= 0 {
+		freezeThreshold = DefaultFreezeThreshold
+	}
+	rtpConn, rtcpConn := createConnections(ctx, offer, answer, capture)
+
+	// the media SSRC is learned from the received packets
+	k := newKeyframeRequester(keyframes, codec, 0, func(pkts []rtcp.Packet) error {
+		buf, err := rtcp.Marshal(pkts)
+		if err != nil {
+			return err
+		}
+		_, err = rtcpConn.Write(buf)
+		return err
+	})
+	go k.run(ctx)
+	f := newFreezeDetector("rtp", codec, freezeThreshold, time.Now())
+	go func() {
+		f.run(ctx)
+		log.Println("received video:", f.frameCounters().stats())
+	}()
+	m := &trackMonitor{keyframes: k, freezes: f}
 	
 	switch codec {
 	case webrtc.MimeTypeVP8:
-		rtpReceiveVP8Track(rtpConn, rtcpConn, file)
+		rtpReceiveVP8Track(rtpConn, rtcpConn, file, m)
 	case webrtc.MimeTypeH264:	
-		rtpReceiveH264Track(rtpConn, rtcpConn, file)
+		rtpReceiveH264Track(rtpConn, rtcpConn, file, m)
 	}
-
-	panic("This can never happen")
 }
 
-func rtpReceiveVP8Track(rtpConn, rtcpConn *net.UDPConn, file string) {
+func rtpReceiveVP8Track(rtpConn, rtcpConn net.Conn, file string, m *trackMonitor) {
 	ivfFile, err := ivfwriter.New(file)
 	if err != nil {
 		log.Fatalln(err)
@@ -562,14 +764,19 @@ func rtpReceiveVP8Track(rtpConn, rtcpConn *net.UDPConn, file string) {
 	
 	buf := make([]byte, 2000)
 	for {
-		_, err := rtpConn.Read(buf)
+		n, err := rtpConn.Read(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Fatalln("cannot read RTP packet:", err)
 		}
-		var p *rtp.Packet
-		if err := p.Unmarshal(buf); err != nil {
+		p := &rtp.Packet{}
+		if err := p.Unmarshal(buf[:n]); err != nil {
 			log.Println("could not parse received RTP packet:", err)
+			continue
 		}
+		m.packet(p)
 		
 		if err := ivfFile.WriteRTP(p); err != nil {
 			log.Println(err)
@@ -577,7 +784,7 @@ func rtpReceiveVP8Track(rtpConn, rtcpConn *net.UDPConn, file string) {
 	}
 }
 
-func rtpReceiveH264Track(rtpConn, rtcpConn *net.UDPConn, file string) {
+func rtpReceiveH264Track(rtpConn, rtcpConn net.Conn, file string, m *trackMonitor) {
 	log.Fatalln("ReceiveH264Track: Unimplemented")
 }
 		
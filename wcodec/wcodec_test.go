@@ -0,0 +1,105 @@
+package wcodec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wrtp"
+)
+
+// udpPortPair listens on two consecutive UDP ports of the loopback, for RTP and RTCP
+func udpPortPair(t *testing.T) (*net.UDPConn, *net.UDPConn) {
+	t.Helper()
+	for n := 0; n < 100; n++ {
+		rtpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		rtcpConn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port + 1})
+		if err == nil {
+			return rtpConn, rtcpConn
+		}
+		rtpConn.Close()
+	}
+	t.Fatal("no consecutive free UDP ports")
+	return nil, nil
+}
+
+// TestCreateConnections sends and receives over the plain RTP sockets after they are created,
+// until the session ends
+func TestCreateConnections(t *testing.T) {
+	localRTP, localRTCP := udpPortPair(t)
+	local := localRTP.LocalAddr().(*net.UDPAddr).Port
+	localRTP.Close()
+	localRTCP.Close()
+	remoteRTP, remoteRTCP := udpPortPair(t)
+	defer remoteRTP.Close()
+	defer remoteRTCP.Close()
+	remote := remoteRTP.LocalAddr().(*net.UDPAddr).Port
+
+	offer := &webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n" +
+		"m=video 9 RTP/AVP 96\r\nc=IN IP4 0.0.0.0\r\n" +
+		fmt.Sprintf("a=candidate:1 1 udp 2130706431 127.0.0.1 %d typ host\r\n", local)}
+	answer := &webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: "v=0\r\no=- 1 1 IN IP4 127.0.0.1\r\ns=-\r\n" +
+		"c=IN IP4 127.0.0.1\r\nt=0 0\r\n" + fmt.Sprintf("m=video %d RTP/AVP 96\r\n", remote)}
+	file := filepath.Join(t.TempDir(), "capture.rtpdump")
+	c, err := wrtp.NewCapture(file, wrtp.CaptureAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rtpConn, _ := createConnections(ctx, offer, answer, c)
+
+	p, err := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SSRC: 1}, Payload: []byte{1}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rtpConn.Write(p); err != nil {
+		t.Fatal("RTP socket closed after it is created:", err)
+	}
+	remoteRTP.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := remoteRTP.Read(make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	pli, err := rtcp.Marshal([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remoteRTCP.WriteToUDP(pli, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: local + 1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := rtpConn.Write(p); errors.Is(err, net.ErrClosed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("RTP socket not closed with the session")
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	packets, err := wrtp.ReadCapture(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the packets written until the socket is closed follow
+	if len(packets) < 2 || packets[0].RTCP || !packets[1].RTCP {
+		t.Errorf("expected the RTP packet sent and the RTCP packet received, got %v", packets)
+	}
+}
@@ -0,0 +1,297 @@
+package wcodec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// EBML and Matroska element IDs, see https://www.matroska.org/technical/elements.html
+const (
+	ebmlIDHeader             = 0x1a45dfa3
+	ebmlIDVersion            = 0x4286
+	ebmlIDReadVersion        = 0x42f7
+	ebmlIDMaxIDLength        = 0x42f2
+	ebmlIDMaxSizeLength      = 0x42f3
+	ebmlIDDocType            = 0x4282
+	ebmlIDDocTypeVersion     = 0x4287
+	ebmlIDDocTypeReadVersion = 0x4285
+
+	mkvIDSegment           = 0x18538067
+	mkvIDInfo              = 0x1549a966
+	mkvIDTimecodeScale     = 0x2ad7b1
+	mkvIDMuxingApp         = 0x4d80
+	mkvIDWritingApp        = 0x5741
+	mkvIDDuration          = 0x4489
+	mkvIDTracks            = 0x1654ae6b
+	mkvIDTrackEntry        = 0xae
+	mkvIDTrackNumber       = 0xd7
+	mkvIDTrackUID          = 0x73c5
+	mkvIDTrackType         = 0x83
+	mkvIDFlagLacing        = 0x9c
+	mkvIDCodecID           = 0x86
+	mkvIDCodecPrivate      = 0x63a2
+	mkvIDCodecDelay        = 0x56aa
+	mkvIDSeekPreRoll       = 0x56bb
+	mkvIDVideo             = 0xe0
+	mkvIDPixelWidth        = 0xb0
+	mkvIDPixelHeight       = 0xba
+	mkvIDAudio             = 0xe1
+	mkvIDSamplingFrequency = 0xb5
+	mkvIDChannels          = 0x9f
+	mkvIDCluster           = 0x1f43b675
+	mkvIDTimecode          = 0xe7
+	mkvIDSimpleBlock       = 0xa3
+)
+
+// the codec IDs of the codecs stored in WebM, H264 is Matroska only and written into MP4
+var webmCodecs = []struct{ mimeType, codecID string }{
+	{webrtc.MimeTypeVP8, "V_VP8"},
+	{webrtc.MimeTypeVP9, "V_VP9"},
+	{webrtc.MimeTypeOpus, "A_OPUS"},
+}
+
+const (
+	// samples the Opus decoder drops at the start, at 48 kHz, what libopus encoders signal
+	opusPreSkip = 312
+	// Opus needs 80 ms of audio before a seek point to converge, RFC 7845, section 4.6
+	opusSeekPreRoll = 80 * time.Millisecond
+)
+
+func webmCodecID(mimeType string) string {
+	for _, c := range webmCodecs {
+		if strings.EqualFold(c.mimeType, mimeType) {
+			return c.codecID
+		}
+	}
+	return ""
+}
+
+// webmWriter writes a WebM file with a cluster at each video key frame, the segment size and
+// the duration are filled in when the file is closed; there are no cues, so players seek by
+// scanning the clusters
+type webmWriter struct {
+	file    *os.File
+	written int64
+	// offsets of the segment data and of the duration value
+	segment, duration int64
+	video             bool
+
+	cluster     bytes.Buffer
+	clusterTime time.Duration
+	inCluster   bool
+	end         time.Duration
+}
+
+func newWebMWriter(file string) (*webmWriter, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	return &webmWriter{file: f}, nil
+}
+
+func (w *webmWriter) supports(mimeType string) bool {
+	return webmCodecID(mimeType) != ""
+}
+
+func (w *webmWriter) write(b []byte) error {
+	n, err := w.file.Write(b)
+	w.written += int64(n)
+	return err
+}
+
+func (w *webmWriter) writeHeader(tracks []*muxTrack) error {
+	header := ebmlElement(ebmlIDHeader,
+		ebmlUint(ebmlIDVersion, 1),
+		ebmlUint(ebmlIDReadVersion, 1),
+		ebmlUint(ebmlIDMaxIDLength, 4),
+		ebmlUint(ebmlIDMaxSizeLength, 8),
+		ebmlString(ebmlIDDocType, "webm"),
+		ebmlUint(ebmlIDDocTypeVersion, 4),
+		ebmlUint(ebmlIDDocTypeReadVersion, 2))
+	// the segment size is unknown until the file is closed
+	header = append(header, ebmlID(mkvIDSegment)...)
+	header = append(header, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	if err := w.write(header); err != nil {
+		return err
+	}
+	w.segment = w.written
+
+	// the duration comes last so that its offset is known
+	info := ebmlElement(mkvIDInfo,
+		ebmlUint(mkvIDTimecodeScale, uint64(time.Millisecond)),
+		ebmlString(mkvIDMuxingApp, "webrtc-client-go"),
+		ebmlString(mkvIDWritingApp, "webrtc-client-go"),
+		ebmlFloat(mkvIDDuration, 0))
+	w.duration = w.written + int64(len(info)) - 8
+
+	var entries [][]byte
+	for _, t := range tracks {
+		entry := [][]byte{
+			ebmlUint(mkvIDTrackNumber, uint64(t.number)),
+			ebmlUint(mkvIDTrackUID, uint64(t.number)),
+			ebmlUint(mkvIDFlagLacing, 0),
+			ebmlString(mkvIDCodecID, webmCodecID(t.mimeType)),
+		}
+		if t.kind == webrtc.RTPCodecTypeAudio {
+			entry = append(entry,
+				ebmlUint(mkvIDTrackType, 2),
+				ebmlBytes(mkvIDCodecPrivate, opusHead(t.channels)),
+				ebmlUint(mkvIDCodecDelay, uint64(opusPreSkip*time.Second/48000)),
+				ebmlUint(mkvIDSeekPreRoll, uint64(opusSeekPreRoll)),
+				ebmlElement(mkvIDAudio,
+					ebmlFloat(mkvIDSamplingFrequency, float64(t.clockRate)),
+					ebmlUint(mkvIDChannels, uint64(t.channels))))
+		} else {
+			w.video = true
+			entry = append(entry, ebmlUint(mkvIDTrackType, 1))
+			entry = append(entry, ebmlElement(mkvIDVideo,
+				ebmlUint(mkvIDPixelWidth, uint64(t.width)),
+				ebmlUint(mkvIDPixelHeight, uint64(t.height))))
+		}
+		entries = append(entries, ebmlElement(mkvIDTrackEntry, entry...))
+	}
+	return w.write(append(info, ebmlElement(mkvIDTracks, entries...)...))
+}
+
+func (w *webmWriter) writeFrame(t *muxTrack, f muxFrame) error {
+	rel := (f.pts - w.clusterTime) / time.Millisecond
+	if w.inCluster && (t.kind == webrtc.RTPCodecTypeVideo && f.key ||
+		!w.video && rel >= 5000 || rel > math.MaxInt16 || rel < math.MinInt16) {
+		if err := w.flushCluster(); err != nil {
+			return err
+		}
+	}
+	if !w.inCluster {
+		w.inCluster, w.clusterTime, rel = true, f.pts.Truncate(time.Millisecond), 0
+	}
+
+	block := []byte{0x80 | byte(t.number), byte(int16(rel) >> 8), byte(int16(rel)), 0}
+	if f.key {
+		block[3] = 0x80
+	}
+	w.cluster.Write(ebmlBytes(mkvIDSimpleBlock, append(block, f.data...)))
+	if f.pts > w.end {
+		w.end = f.pts
+	}
+	return nil
+}
+
+func (w *webmWriter) flushCluster() error {
+	w.inCluster = false
+	cluster := ebmlElement(mkvIDCluster,
+		ebmlUint(mkvIDTimecode, uint64(w.clusterTime/time.Millisecond)), w.cluster.Bytes())
+	w.cluster.Reset()
+	return w.write(cluster)
+}
+
+// Close writes the last cluster, fills in the segment size and the duration and closes the
+// file.
+func (w *webmWriter) Close() error {
+	if w.inCluster {
+		if err := w.flushCluster(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	if w.segment > 0 {
+		size := make([]byte, 8)
+		binary.BigEndian.PutUint64(size, uint64(w.written-w.segment))
+		size[0] = 0x01
+		if _, err := w.file.WriteAt(size, w.segment-8); err != nil {
+			w.file.Close()
+			return err
+		}
+		duration := make([]byte, 8)
+		binary.BigEndian.PutUint64(duration, math.Float64bits(float64(w.end)/float64(time.Millisecond)))
+		if _, err := w.file.WriteAt(duration, w.duration); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	return w.file.Close()
+}
+
+// opusHead returns the Opus identification header, RFC 7845, section 5.1
+func opusHead(channels uint16) []byte {
+	b := []byte("OpusHead")
+	b = append(b, 1, byte(channels))
+	b = append(b, opusPreSkip&0xff, opusPreSkip>>8) // pre-skip, little endian
+	b = append(b, 0x80, 0xbb, 0x00, 0x00)           // 48000 Hz, little endian
+	return append(b, 0, 0, 0)                       // output gain and channel mapping family
+}
+
+/////////////////////////
+// EBML
+
+// ebmlID returns the bytes of an element ID, the ID includes its length marker
+func ebmlID(id uint32) []byte {
+	switch {
+	case id >= 1<<24:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<16:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id >= 1<<8:
+		return []byte{byte(id >> 8), byte(id)}
+	}
+	return []byte{byte(id)}
+}
+
+// ebmlSize returns the shortest variable size integer of n
+func ebmlSize(n int) []byte {
+	l := 1
+	// all ones are reserved for unknown sizes
+	for uint64(n) >= 1<<(7*uint(l))-1 {
+		l++
+	}
+	b := make([]byte, l)
+	for i := l - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	b[0] |= 0x80 >> uint(l-1)
+	return b
+}
+
+func ebmlElement(id uint32, children ...[]byte) []byte {
+	size := 0
+	for _, c := range children {
+		size += len(c)
+	}
+	b := append(ebmlID(id), ebmlSize(size)...)
+	for _, c := range children {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func ebmlBytes(id uint32, data []byte) []byte {
+	return ebmlElement(id, data)
+}
+
+func ebmlString(id uint32, s string) []byte {
+	return ebmlElement(id, []byte(s))
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	b := []byte{}
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFloat(id uint32, f float64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, math.Float64bits(f))
+	return ebmlElement(id, b)
+}
@@ -0,0 +1,736 @@
+package wconfig
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+	"gopkg.in/yaml.v3"
+
+	"webrtc-client-go/wcodec"
+	"webrtc-client-go/wrtp"
+	"webrtc-client-go/wsession"
+	"webrtc-client-go/wturn"
+)
+
+const (
+	DefaultUrl = "ws://localhost:8443/"
+	// every setting can be overridden with an environment variable named after its flag, e.g.,
+	// --turn-password is WEBRTC_CLIENT_TURN_PASSWORD
+	EnvPrefix = "WEBRTC_CLIENT_"
+	// the config file, if --config is not given
+	EnvConfig = EnvPrefix + "CONFIG"
+	redacted  = "<redacted>"
+)
+
+// Config is the configuration of the clients, loaded from the defaults, a YAML or JSON config
+// file, the environment and the command line, in this order of precedence.
+type Config struct {
+	Signaling Signaling `json:"signaling" yaml:"signaling"`
+	// user names registered with the application server
+	User string `json:"user" yaml:"user"`
+	Peer string `json:"peer" yaml:"peer"`
+	ICE  ICE    `json:"ice" yaml:"ice"`
+	TURN TURN   `json:"turn" yaml:"turn"`
+	// other STUN/TURN servers, used besides TURN: config file only
+	ICEServers []ICEServer `json:"iceServers" yaml:"iceServers"`
+	// media source and sink
+	Media    Media    `json:"media" yaml:"media"`
+	Timeouts Timeouts `json:"timeouts" yaml:"timeouts"`
+	// one-to-many: number of viewers to start
+	Viewers int `json:"viewers" yaml:"viewers"`
+	// group call: name of the room to join
+	Room string `json:"room" yaml:"room"`
+	// recorder: percentage of frames allowed to be missing from the played-back video
+	FrameTolerance float64 `json:"frameTolerance" yaml:"frameTolerance"`
+	// load: parallel magic mirror calls
+	LoadTest LoadTest `json:"loadTest" yaml:"loadTest"`
+}
+
+type Signaling struct {
+	// application server URL, or the media server JSON-RPC URL
+	URL string `json:"url" yaml:"url"`
+	TLS TLS    `json:"tls" yaml:"tls"`
+	// dump the TLS secrets of the signaling connection into KeyLogFile
+	Debug      bool   `json:"debug" yaml:"debug"`
+	KeyLogFile string `json:"keyLogFile" yaml:"keyLogFile"`
+}
+
+// TLS is how the certificate of a wss:// server is verified.
+type TLS struct {
+	// PEM file of the CA certificates to verify with, default: the system roots
+	CAFile string `json:"caFile" yaml:"caFile"`
+	// do not verify the certificate at all, e.g., a self-signed one
+	InsecureSkipVerify bool `json:"insecureSkipVerify" yaml:"insecureSkipVerify"`
+}
+
+type ICE struct {
+	Addr                 string   `json:"addr" yaml:"addr"`
+	NetworkTypes         []string `json:"networkTypes" yaml:"networkTypes"`
+	CIDRs                []string `json:"cidrs" yaml:"cidrs"`
+	ExcludeInterfaces    string   `json:"excludeInterfaces" yaml:"excludeInterfaces"`
+	CandidateTypes       []string `json:"candidateTypes" yaml:"candidateTypes"`
+	NAT1To1IPs           []string `json:"nat1To1IPs" yaml:"nat1To1IPs"`
+	NAT1To1CandidateType string   `json:"nat1To1CandidateType" yaml:"nat1To1CandidateType"`
+	UDPPortRange         string   `json:"udpPortRange" yaml:"udpPortRange"`
+}
+
+type TURN struct {
+	URI      string `json:"uri" yaml:"uri"`
+	Auth     string `json:"auth" yaml:"auth"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+	// start a TURN server in-process on this address
+	Embedded          string `json:"embedded" yaml:"embedded"`
+	EmbeddedTransport string `json:"embeddedTransport" yaml:"embeddedTransport"`
+}
+
+// ICEServer is a STUN or TURN server, like in the iceServers of an RTCConfiguration.
+type ICEServer struct {
+	URLs       []string `json:"urls" yaml:"urls"`
+	Username   string   `json:"username" yaml:"username"`
+	Credential string   `json:"credential" yaml:"credential"`
+}
+
+type Media struct {
+	// media file to send or to write
+	File string `json:"file" yaml:"file"`
+	// vp8, vp9, av1 or h264, default: from the extension of File
+	Codec string `json:"codec" yaml:"codec"`
+	// codecs to send and to receive in preference order, default: Codec
+	SendCodecs []string `json:"sendCodecs" yaml:"sendCodecs"`
+	RecvCodecs []string `json:"recvCodecs" yaml:"recvCodecs"`
+	// estimate the available send bandwidth and log it
+	BWE bool `json:"bwe" yaml:"bwe"`
+	// other IVF encodings of File at different bitrates, sent following the estimate
+	Renditions []string `json:"renditions" yaml:"renditions"`
+	// lower resolution encodings of File from the lowest, sent as simulcast layers with File
+	Simulcast []string `json:"simulcast" yaml:"simulcast"`
+	// key frame requests of the received video: pli, fir or none, how often, and on loss
+	KeyframeRequest  string   `json:"keyframeRequest" yaml:"keyframeRequest"`
+	KeyframeInterval Duration `json:"keyframeInterval" yaml:"keyframeInterval"`
+	KeyframeOnLoss   bool     `json:"keyframeOnLoss" yaml:"keyframeOnLoss"`
+	// received video is reported frozen after this without a decodable frame
+	FreezeThreshold Duration `json:"freezeThreshold" yaml:"freezeThreshold"`
+	// answer to key frame requests of the sent video: jump, repeat or none
+	KeyframeResponse string `json:"keyframeResponse" yaml:"keyframeResponse"`
+	// output file or prefix of the output files
+	Output string `json:"output" yaml:"output"`
+	// file format of the received media: auto, raw, webm or mp4
+	OutputFormat string `json:"outputFormat" yaml:"outputFormat"`
+	// capture the RTP and RTCP packets sent and received into this file in auto, pcapng or
+	// rtpdump format
+	Capture       string `json:"capture" yaml:"capture"`
+	CaptureFormat string `json:"captureFormat" yaml:"captureFormat"`
+	// log the DTLS master secrets and the SRTP keys of the media into this file
+	KeyLogFile string `json:"keyLogFile" yaml:"keyLogFile"`
+	// media key log of File if it is a capture taken on the wire, to decrypt its SRTP packets
+	CaptureKeyLogFile string `json:"captureKeyLogFile" yaml:"captureKeyLogFile"`
+}
+
+type LoadTest struct {
+	// number of parallel calls
+	Calls int `json:"calls" yaml:"calls"`
+	// static: make the calls once, rolling: restart the calls that end
+	Mode string `json:"mode" yaml:"mode"`
+	// delay between starting two calls
+	Interval Duration `json:"interval" yaml:"interval"`
+}
+
+type Timeouts struct {
+	Probe           Duration `json:"probe" yaml:"probe"`
+	ICEDisconnected Duration `json:"iceDisconnected" yaml:"iceDisconnected"`
+	ICEFailed       Duration `json:"iceFailed" yaml:"iceFailed"`
+}
+
+// Duration is a time.Duration that is written as a string, e.g., 5s, in config files.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		Signaling: Signaling{URL: DefaultUrl, KeyLogFile: "/tmp/keylog"},
+		User:      "test1",
+		Peer:      "test2",
+		ICE: ICE{
+			NetworkTypes:         []string{"udp4"},
+			NAT1To1CandidateType: "host",
+		},
+		TURN: TURN{
+			Auth:              wturn.AuthPlaintext,
+			Username:          "user",
+			Password:          "pass",
+			EmbeddedTransport: "udp",
+		},
+		Media: Media{
+			KeyframeRequest:  string(wcodec.DefaultKeyframePolicy.Request),
+			KeyframeInterval: Duration(wcodec.DefaultKeyframePolicy.Interval),
+			KeyframeResponse: string(wcodec.KeyframeJump),
+			FreezeThreshold:  Duration(wcodec.DefaultFreezeThreshold),
+			Output:           "output",
+			OutputFormat:     string(wcodec.OutputAuto),
+			CaptureFormat:    string(wrtp.CaptureAuto),
+		},
+		Timeouts:       Timeouts{Probe: Duration(wturn.DefaultProbeTimeout)},
+		Viewers:        1,
+		Room:           "room1",
+		FrameTolerance: 5,
+		LoadTest: LoadTest{
+			Calls:    1,
+			Mode:     "static",
+			Interval: Duration(700 * time.Millisecond),
+		},
+	}
+}
+
+/////////////////////////
+// flags
+
+// listValue is a comma-separated list flag
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// durationValue is a Duration flag
+type durationValue Duration
+
+func (d *durationValue) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *durationValue) Set(s string) error {
+	return (*Duration)(d).UnmarshalText([]byte(s))
+}
+
+// bind registers the settings of c as flags in fs, the current values of c are the defaults
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.Signaling.URL, "url", c.Signaling.URL, "WebRtc server URL (kms: media server JSON-RPC URL, e.g., ws://localhost:8888/kurento)")
+	fs.StringVar(&c.Signaling.TLS.CAFile, "tls-ca-file", c.Signaling.TLS.CAFile, "PEM file of the CA certificates to verify the certificate of a wss:// --url with (default: the system roots)")
+	fs.BoolVar(&c.Signaling.TLS.InsecureSkipVerify, "tls-insecure", c.Signaling.TLS.InsecureSkipVerify, "Do not verify the certificate of a wss:// --url, e.g., the self-signed certificate of a Kurento tutorial server")
+	fs.BoolVar(&c.Signaling.Debug, "debug", c.Signaling.Debug, "Debug the TLS connection using a keylogger: dumps data into the key log file")
+	fs.StringVar(&c.Signaling.KeyLogFile, "keylog-file", c.Signaling.KeyLogFile, "Key log file of --debug")
+	fs.StringVar(&c.Media.File, "file", c.Media.File, "caller/presenter: media file to send, or a pcapng/pcap/rtpdump capture to replay / callee/viewer: media file to write (extension is either h264 or vp8/ivf, this selects the codec unless --codec, --send-codec or --recv-codec is given)")
+	fs.StringVar(&c.Media.Codec, "codec", c.Media.Codec, "Video codec: vp8, vp9, av1 or h264 (default: from the extension of --file, or the FourCC of an IVF file)")
+	fs.Var((*listValue)(&c.Media.SendCodecs), "send-codec", "Comma-separated list of video codecs to send in preference order: "+strings.Join(wcodec.CodecNames(), ", ")+" (default: --codec)")
+	fs.Var((*listValue)(&c.Media.RecvCodecs), "recv-codec", "Comma-separated list of video codecs to receive in preference order, the received video is written in the negotiated codec (default: --codec)")
+	fs.BoolVar(&c.Media.BWE, "bwe", c.Media.BWE, "Estimate the available send bandwidth with Google Congestion Control from transport-cc feedback, capped by REMB, or from RTCP receiver reports, and log it (implied by --renditions)")
+	fs.Var((*listValue)(&c.Media.Renditions), "renditions", "caller/presenter: comma-separated list of other IVF encodings of --file at different bitrates, the sender switches between them at key frames to follow the bandwidth estimate")
+	fs.Var((*listValue)(&c.Media.Simulcast), "simulcast", "caller/callee/presenter/room: comma-separated list of 1 or 2 lower resolution encodings of --file from the lowest, published with --file as simulcast layers with RIDs q, h and f")
+	fs.StringVar(&c.Media.KeyframeRequest, "keyframe-request", c.Media.KeyframeRequest, "callee/viewer/recorder/kms/room: RTCP message to request key frames of the received video with: pli, fir or none")
+	fs.Var((*durationValue)(&c.Media.KeyframeInterval), "keyframe-interval", "callee/viewer/recorder/kms/room: request a key frame of the received video this often, 0 for no periodic requests")
+	fs.BoolVar(&c.Media.KeyframeOnLoss, "keyframe-on-loss", c.Media.KeyframeOnLoss, "callee/viewer/recorder/kms/room: request a key frame when a received video frame is still incomplete after its lost packets were NACKed, at most once a second")
+	fs.Var((*durationValue)(&c.Media.FreezeThreshold), "freeze-threshold", "callee/viewer/recorder/kms/room: report the received video frozen after this without a decodable frame, the freezes are summarized at the end of the track")
+	fs.StringVar(&c.Media.KeyframeResponse, "keyframe-response", c.Media.KeyframeResponse, "caller/presenter/room: answer to key frame requests of the sent video: jump to the next key frame of --file, repeat the last key frame, or none")
+	fs.StringVar(&c.Media.Output, "output", c.Media.Output, "room: prefix of the output files, the video of each participant is written into <output>_<participant> / recorder: file to write the played-back video into / kms: file to write the looped-back video into")
+	fs.StringVar(&c.Media.OutputFormat, "output-format", c.Media.OutputFormat, "callee/viewer/recorder/kms/room: file format of the received media: webm (VP8, VP9) or mp4 (H264) with the audio and the video in the same file, raw for IVF or H264 video only, auto to follow the extension of the output file, raw if it has none")
+	fs.StringVar(&c.Media.Capture, "capture", c.Media.Capture, "Capture the RTP and RTCP packets sent and received, after SRTP decryption, into this file")
+	fs.StringVar(&c.Media.CaptureFormat, "capture-format", c.Media.CaptureFormat, "File format of --capture: pcapng with synthetic UDP headers, rtpdump, or auto for rtpdump if the extension is .rtpdump or .rtp and pcapng otherwise")
+	fs.StringVar(&c.Media.KeyLogFile, "media-keylog-file", c.Media.KeyLogFile, "Log the DTLS master secrets of the media in NSS key log format, and the SRTP master keys and salts of each SSRC sent and received as comments, into this file (may be the --keylog-file of --debug)")
+	fs.StringVar(&c.Media.CaptureKeyLogFile, "capture-keylog-file", c.Media.CaptureKeyLogFile, "Decrypt the SRTP packets of a --file capture taken on the wire with the SRTP keys of this --media-keylog-file of the captured session; without it, SRTP packets are not replayed")
+	fs.StringVar(&c.User, "user", c.User, "User name (will be registered with the WebRTC server)")
+	fs.StringVar(&c.Peer, "peer", c.Peer, "Peer name (will be registered with the WebRTC server)")
+	fs.StringVar(&c.ICE.Addr, "ice-addr", c.ICE.Addr, "Use only the given IP address to generate local ICE candidates")
+	fs.Var((*listValue)(&c.ICE.NetworkTypes), "network-types", "Comma-separated list of ICE network types: udp4, udp6, tcp4, tcp6")
+	fs.Var((*listValue)(&c.ICE.CIDRs), "ice-cidrs", "Comma-separated list of networks, generate local ICE candidates only on interfaces with an address in these (e.g., 10.0.0.0/8); other addresses of these interfaces are not signaled, but may still show up as peer-reflexive at the remote")
+	fs.StringVar(&c.ICE.ExcludeInterfaces, "ice-exclude-interfaces", c.ICE.ExcludeInterfaces, "Never generate local ICE candidates on interfaces whose name matches this regexp (e.g., 'docker0|veth.*')")
+	fs.Var((*listValue)(&c.ICE.CandidateTypes), "ice-candidate-types", "Comma-separated list of ICE candidate types: host, srflx, relay (default: relay if a TURN server is given, all otherwise); relay or host alone are enforced, other combinations only filter the signaled candidates and the rest may still show up as peer-reflexive at the remote")
+	fs.Var((*listValue)(&c.ICE.NAT1To1IPs), "nat-1to1-ips", "Comma-separated list of external IPs of a static 1:1 NAT, advertised instead of the local IPs")
+	fs.StringVar(&c.ICE.NAT1To1CandidateType, "nat-1to1-candidate-type", c.ICE.NAT1To1CandidateType, "ICE candidate type the NAT 1:1 IPs are advertised in: host or srflx")
+	fs.StringVar(&c.ICE.UDPPortRange, "udp-port-range", c.ICE.UDPPortRange, "Local UDP port range for ICE, e.g., 10000-20000 (default: any port)")
+	fs.StringVar(&c.TURN.URI, "turn", c.TURN.URI, "STUN/TURN server URI")
+	fs.StringVar(&c.TURN.Auth, "turn-auth", c.TURN.Auth, "TURN authentication mode: plaintext or longterm")
+	fs.StringVar(&c.TURN.Username, "turn-user", c.TURN.Username, "TURN username (plaintext authentication)")
+	fs.StringVar(&c.TURN.Password, "turn-password", c.TURN.Password, "TURN password (plaintext authentication) or shared secret (longterm authentication)")
+	fs.StringVar(&c.TURN.Embedded, "embedded-turn", c.TURN.Embedded, "Start a TURN server in-process on the given address (e.g., 127.0.0.1:3478) with the TURN credentials, used as the TURN server unless --turn is given")
+	fs.StringVar(&c.TURN.EmbeddedTransport, "embedded-turn-transport", c.TURN.EmbeddedTransport, "Transport of the embedded TURN server: udp, tcp or tls (with a self-signed certificate)")
+	fs.Var((*durationValue)(&c.Timeouts.Probe), "probe-timeout", "probe: timeout of the whole probe, from the allocations to the round-trip over the channel")
+	fs.Var((*durationValue)(&c.Timeouts.ICEDisconnected), "ice-disconnected-timeout", "ICE connection is reported disconnected after this without traffic (default: 5s)")
+	fs.Var((*durationValue)(&c.Timeouts.ICEFailed), "ice-failed-timeout", "ICE connection is reported failed after this in the disconnected state (default: 25s)")
+	fs.IntVar(&c.Viewers, "viewers", c.Viewers, "viewer: number of viewers to start (output files are numbered)")
+	fs.StringVar(&c.Room, "room", c.Room, "room: name of the room to join")
+	fs.Float64Var(&c.FrameTolerance, "frame-tolerance", c.FrameTolerance, "recorder: percentage of frames allowed to be missing from the played-back video")
+	fs.IntVar(&c.LoadTest.Calls, "calls", c.LoadTest.Calls, "load: number of parallel magic mirror calls")
+	fs.StringVar(&c.LoadTest.Mode, "load-mode", c.LoadTest.Mode, "load: static (make the calls once) or rolling (restart the calls that end)")
+	fs.Var((*durationValue)(&c.LoadTest.Interval), "call-interval", "load: delay between starting two calls")
+}
+
+// EnvName returns the environment variable that overrides the setting of a flag.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Parse registers the flags in fs, parses args and returns the effective configuration:
+// the defaults are overridden by the config file given with --config or in
+// WEBRTC_CLIENT_CONFIG, which is overridden by the environment, which is overridden by the
+// flags given explicitly on the command line.
+func Parse(fs *flag.FlagSet, args []string) (*Config, error) {
+	configFile := fs.String("config", os.Getenv(EnvConfig), "YAML or JSON config file")
+	Default().bind(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *configFile != "" {
+		if err := c.Load(*configFile); err != nil {
+			return nil, err
+		}
+	}
+
+	settings := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	c.bind(settings)
+
+	var err error
+	settings.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(EnvName(f.Name)); ok && err == nil {
+			if e := settings.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", v, EnvName(f.Name), e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// fs may have flags of its own, e.g., --config
+	fs.Visit(func(f *flag.Flag) {
+		if settings.Lookup(f.Name) != nil && err == nil {
+			err = settings.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+/////////////////////////
+// config file
+
+// envVar is a reference to an environment variable in a config file value
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Load reads a YAML or JSON config file into c, the settings missing from the file are left
+// untouched. Environment variables in braces, e.g., ${TURN_SERVER_ADDR}, are expanded in the
+// string values, any other $ is kept as is.
+func (c *Config) Load(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	if strings.ToLower(path.Ext(file)) == ".json" {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		// empty file
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", file, err)
+	}
+
+	expandEnv(reflect.ValueOf(c).Elem())
+	return nil
+}
+
+// expandEnv expands the environment variables in the strings of v, after parsing, so that the
+// values of the variables are not parsed as YAML or JSON
+func expandEnv(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(envVar.ReplaceAllStringFunc(v.String(), func(s string) string {
+			return os.Getenv(envVar.FindStringSubmatch(s)[1])
+		}))
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			expandEnv(v.Field(i))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandEnv(v.Index(i))
+		}
+	}
+}
+
+// Dump writes the configuration in YAML or JSON format, with the TURN password and the ICE
+// server credentials redacted unless showSecrets is set.
+func (c *Config) Dump(w io.Writer, format string, showSecrets bool) error {
+	d := *c
+	if !showSecrets && d.TURN.Password != "" {
+		d.TURN.Password = redacted
+	}
+	if !showSecrets {
+		d.ICEServers = append([]ICEServer{}, c.ICEServers...)
+		for i := range d.ICEServers {
+			if d.ICEServers[i].Credential != "" {
+				d.ICEServers[i].Credential = redacted
+			}
+		}
+	}
+
+	switch format {
+	case "yaml":
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(&d); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(&d)
+	default:
+		return fmt.Errorf("unknown config format %q: must be either yaml or json", format)
+	}
+}
+
+/////////////////////////
+// session config
+
+// VideoCodec returns the mime type of the video codec, given explicitly or selected by the
+// extension of the media file, or else the first send or receive codec.
+func (c *Config) VideoCodec() (string, error) {
+	switch strings.ToLower(c.Media.Codec) {
+	case "vp8":
+		return webrtc.MimeTypeVP8, nil
+	case "vp9":
+		return webrtc.MimeTypeVP9, nil
+	case "av1":
+		return wcodec.MimeTypeAV1, nil
+	case "h264":
+		return webrtc.MimeTypeH264, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown codec %s: must be one of vp8, vp9, av1 or h264", c.Media.Codec)
+	}
+
+	if wrtp.IsCaptureFile(c.Media.File) {
+		// captures do not tell their codec
+		if names := append(append([]string{}, c.Media.SendCodecs...), c.Media.RecvCodecs...); len(names) > 0 {
+			return wcodec.CodecMimeType(names[0])
+		}
+		return "", fmt.Errorf("the codec of capture %s must be given with --codec", c.Media.File)
+	}
+
+	switch ext := strings.ToLower(path.Ext(c.Media.File)); ext {
+	case ".h264", ".mkv", ".mp4":
+		return webrtc.MimeTypeH264, nil
+	case ".vp8", ".webm":
+		return webrtc.MimeTypeVP8, nil
+	case ".ivf":
+		// files to send tell their codec, files to write default to VP8
+		if _, err := os.Stat(c.Media.File); err != nil {
+			return webrtc.MimeTypeVP8, nil
+		}
+		return wcodec.IVFCodec(c.Media.File)
+	default:
+		if names := append(append([]string{}, c.Media.SendCodecs...), c.Media.RecvCodecs...); len(names) > 0 {
+			return wcodec.CodecMimeType(names[0])
+		}
+		return "", fmt.Errorf("unknown codec %s: file extension must be either mkv/h264/mp4 or vp8/ivf/webm",
+			ext)
+	}
+}
+
+// validateSimulcast checks that there are 2 or 3 simulcast layers in files of codec
+func (c *Config) validateSimulcast(codec string) error {
+	layers := c.Media.Simulcast
+	switch {
+	case len(layers) == 0:
+		return nil
+	case len(layers) > 2:
+		return fmt.Errorf("simulcast: at most 3 layers are supported, got %d", len(layers)+1)
+	case len(c.Media.Renditions) > 0:
+		return errors.New("simulcast and renditions cannot be used together")
+	}
+
+	for _, l := range layers {
+		if codec == webrtc.MimeTypeH264 {
+			if _, err := os.Stat(l); err != nil {
+				return fmt.Errorf("simulcast layer: %w", err)
+			}
+			continue
+		}
+		mimeType, err := wcodec.IVFCodec(l)
+		if err != nil {
+			return fmt.Errorf("simulcast layer: %w", err)
+		}
+		if mimeType != codec {
+			return fmt.Errorf("simulcast layer %s is %s, not %s", l, mimeType, codec)
+		}
+	}
+	return nil
+}
+
+// checkICEAddr checks that the ICE address is an IP of a family of the network types, else no
+// candidates are gathered
+func checkICEAddr(addr string, types []webrtc.NetworkType) error {
+	if addr == "" {
+		return nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return fmt.Errorf("invalid ICE address %q", addr)
+	}
+	family := "4"
+	if ip.To4() == nil {
+		family = "6"
+	}
+	for _, t := range types {
+		if strings.HasSuffix(t.String(), family) {
+			return nil
+		}
+	}
+	return fmt.Errorf("ICE address %s is IPv%s, but the network types %v have no IPv%s, add udp%s "+
+		"or tcp%s", addr, family, types, family, family, family)
+}
+
+// tlsConfig returns the TLS config of the signaling connection
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	t := c.Signaling.TLS
+	if t.CAFile == "" {
+		return &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}, nil
+	}
+	if t.InsecureSkipVerify {
+		return nil, errors.New("tls: a CA file is of no use without verifying the certificate")
+	}
+	pem, err := ioutil.ReadFile(t.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tls: no PEM certificate in CA file %s", t.CAFile)
+	}
+	return &tls.Config{RootCAs: roots}, nil
+}
+
+// iceServers checks the other STUN/TURN servers and returns them for wsession.Config
+func (c *Config) iceServers() ([]webrtc.ICEServer, error) {
+	var servers []webrtc.ICEServer
+	for i, s := range c.ICEServers {
+		if len(s.URLs) == 0 {
+			return nil, fmt.Errorf("ICE server %d: no URLs", i+1)
+		}
+		for _, u := range s.URLs {
+			uri, err := ice.ParseURL(u)
+			if err != nil {
+				return nil, fmt.Errorf("ICE server %d: invalid URL %q: %w", i+1, u, err)
+			}
+			// TURN works over IPv4 only, STUN over both
+			if uri.Scheme == ice.SchemeTypeTURN || uri.Scheme == ice.SchemeTypeTURNS {
+				if err := wturn.CheckIPv4(uri.Host); err != nil {
+					return nil, fmt.Errorf("ICE server %d: %w", i+1, err)
+				}
+			}
+		}
+		servers = append(servers, webrtc.ICEServer{
+			URLs:           s.URLs,
+			Username:       s.Username,
+			Credential:     s.Credential,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		})
+	}
+	return servers, nil
+}
+
+// Session returns the session config, the TLS key log writer must be set by the caller.
+func (c *Config) Session() (wsession.Config, error) {
+	codec, err := c.VideoCodec()
+	if err != nil {
+		return wsession.Config{}, err
+	}
+	for _, names := range [][]string{c.Media.SendCodecs, c.Media.RecvCodecs} {
+		if _, err := wcodec.CodecPreferences(names); err != nil {
+			return wsession.Config{}, err
+		}
+	}
+
+	for _, r := range c.Media.Renditions {
+		mimeType, err := wcodec.IVFCodec(r)
+		if err != nil {
+			return wsession.Config{}, fmt.Errorf("rendition: %w", err)
+		}
+		if mimeType != codec {
+			return wsession.Config{}, fmt.Errorf("rendition %s is %s, not %s", r, mimeType, codec)
+		}
+	}
+
+	if err := c.validateSimulcast(codec); err != nil {
+		return wsession.Config{}, err
+	}
+	if wrtp.IsCaptureFile(c.Media.File) && (len(c.Media.Renditions) > 0 || len(c.Media.Simulcast) > 0) {
+		return wsession.Config{}, errors.New("captures are replayed as is, without renditions or simulcast")
+	}
+	if c.Media.CaptureKeyLogFile != "" {
+		if !wrtp.IsCaptureFile(c.Media.File) {
+			return wsession.Config{}, fmt.Errorf("--capture-keylog-file decrypts a capture, %s is not one", c.Media.File)
+		}
+		// the key logs of the session are truncated
+		if c.Media.CaptureKeyLogFile == c.Media.KeyLogFile || (c.Signaling.Debug && c.Media.CaptureKeyLogFile == c.Signaling.KeyLogFile) {
+			return wsession.Config{}, errors.New("--capture-keylog-file must not be a key log of the session")
+		}
+	}
+
+	request, err := wcodec.ParseKeyframeRequest(c.Media.KeyframeRequest)
+	if err != nil {
+		return wsession.Config{}, err
+	}
+	if c.Media.KeyframeInterval < 0 {
+		return wsession.Config{}, fmt.Errorf("invalid key frame interval %s", time.Duration(c.Media.KeyframeInterval))
+	}
+	if c.Media.FreezeThreshold <= 0 {
+		return wsession.Config{}, fmt.Errorf("invalid freeze threshold %s", time.Duration(c.Media.FreezeThreshold))
+	}
+	response, err := wcodec.ParseKeyframeResponse(c.Media.KeyframeResponse)
+	if err != nil {
+		return wsession.Config{}, err
+	}
+	format, err := wcodec.ParseOutputFormat(c.Media.OutputFormat)
+	if err != nil {
+		return wsession.Config{}, err
+	}
+	if _, err := wrtp.ParseCaptureFormat(c.Media.CaptureFormat); err != nil {
+		return wsession.Config{}, err
+	}
+	keyframes := wcodec.KeyframePolicy{
+		Request:  request,
+		Interval: time.Duration(c.Media.KeyframeInterval),
+		OnLoss:   c.Media.KeyframeOnLoss,
+	}
+
+	username, credential, err := wturn.Credentials(c.TURN.Auth, c.TURN.Username, c.TURN.Password)
+	if err != nil {
+		return wsession.Config{}, err
+	}
+
+	types, err := wsession.ParseNetworkTypes(strings.Join(c.ICE.NetworkTypes, ","))
+	if err != nil {
+		return wsession.Config{}, err
+	}
+	if err := checkICEAddr(c.ICE.Addr, types); err != nil {
+		return wsession.Config{}, err
+	}
+	if c.TURN.URI != "" {
+		if err := wturn.CheckURI(c.TURN.URI); err != nil {
+			return wsession.Config{}, err
+		}
+	}
+
+	iceServers, err := c.iceServers()
+	if err != nil {
+		return wsession.Config{}, err
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return wsession.Config{}, err
+	}
+
+	cidrs, err := wsession.ParseCIDRs(strings.Join(c.ICE.CIDRs, ","))
+	if err != nil {
+		return wsession.Config{}, err
+	}
+
+	var exclude *regexp.Regexp
+	if c.ICE.ExcludeInterfaces != "" {
+		if exclude, err = regexp.Compile(c.ICE.ExcludeInterfaces); err != nil {
+			return wsession.Config{}, fmt.Errorf("invalid interface exclude regexp: %w", err)
+		}
+	}
+
+	candTypes, err := wsession.ParseCandidateTypes(strings.Join(c.ICE.CandidateTypes, ","))
+	if err != nil {
+		return wsession.Config{}, err
+	}
+
+	natType, err := webrtc.NewICECandidateType(c.ICE.NAT1To1CandidateType)
+	if err != nil || (natType != webrtc.ICECandidateTypeHost && natType != webrtc.ICECandidateTypeSrflx) {
+		return wsession.Config{}, fmt.Errorf("invalid NAT 1:1 candidate type %q: must be either "+
+			"host or srflx", c.ICE.NAT1To1CandidateType)
+	}
+
+	portMin, portMax, err := wsession.ParsePortRange(c.ICE.UDPPortRange)
+	if err != nil {
+		return wsession.Config{}, err
+	}
+
+	return wsession.Config{
+		Url:                    c.Signaling.URL,
+		TLS:                    tlsConfig,
+		ICEAddr:                c.ICE.Addr,
+		TurnURI:                c.TURN.URI,
+		Username:               username,
+		Credential:             credential,
+		ICEServers:             iceServers,
+		Codec:                  codec,
+		SendCodecs:             c.Media.SendCodecs,
+		RecvCodecs:             c.Media.RecvCodecs,
+		BWE:                    c.Media.BWE,
+		Renditions:             c.Media.Renditions,
+		Simulcast:              c.Media.Simulcast,
+		CaptureKeyLog:          c.Media.CaptureKeyLogFile,
+		Keyframes:              keyframes,
+		KeyframeResponse:       response,
+		OutputFormat:           format,
+		FreezeThreshold:        time.Duration(c.Media.FreezeThreshold),
+		NetworkTypes:           types,
+		CIDRs:                  cidrs,
+		ExcludeInterfaces:      exclude,
+		CandidateTypes:         candTypes,
+		NAT1To1IPs:             c.ICE.NAT1To1IPs,
+		NAT1To1CandidateType:   natType,
+		PortMin:                portMin,
+		PortMax:                portMax,
+		ICEDisconnectedTimeout: time.Duration(c.Timeouts.ICEDisconnected),
+		ICEFailedTimeout:       time.Duration(c.Timeouts.ICEFailed),
+	}, nil
+}
@@ -0,0 +1,246 @@
+package wconfig
+
+import (
+	"bytes"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Unsetenv(key) })
+}
+
+func TestPrecedence(t *testing.T) {
+	setenv(t, "TEST_SERVER_ADDR", "1.2.3.4")
+	setenv(t, "TEST_PEER", "x: y")
+	file := writeFile(t, "config.yaml", `
+signaling:
+  url: wss://${TEST_SERVER_ADDR}:8443/one2one
+user: file-user
+turn:
+  password: pa$$word$TEST_SERVER_ADDR
+media:
+  sendCodecs: ["${TEST_PEER}"]
+peer: file-peer
+room: file-room
+ice:
+  networkTypes: [udp4, tcp4]
+timeouts:
+  probe: 2s
+`)
+	setenv(t, EnvName("peer"), "env-peer")
+	setenv(t, EnvName("room"), "env-room")
+
+	c, err := Parse(flag.NewFlagSet("test", flag.ContinueOnError),
+		[]string{"--config", file, "--room", "flag-room"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Signaling.URL != "wss://1.2.3.4:8443/one2one" {
+		t.Error("environment not expanded in the config file:", c.Signaling.URL)
+	}
+	if c.TURN.Password != "pa$$word$TEST_SERVER_ADDR" || c.Media.SendCodecs[0] != "x: y" {
+		t.Errorf("invalid expansion: password=%s, send codecs=%v", c.TURN.Password, c.Media.SendCodecs)
+	}
+	if c.User != "file-user" || c.Peer != "env-peer" || c.Room != "flag-room" {
+		t.Errorf("invalid precedence: user=%s, peer=%s, room=%s", c.User, c.Peer, c.Room)
+	}
+	if len(c.ICE.NetworkTypes) != 2 || time.Duration(c.Timeouts.Probe) != 2*time.Second {
+		t.Errorf("invalid config: %+v", c)
+	}
+	// untouched defaults
+	if c.TURN.Username != "user" || c.Viewers != 1 {
+		t.Errorf("defaults lost: %+v", c)
+	}
+}
+
+func TestDumpLoad(t *testing.T) {
+	c := Default()
+	c.ICE.CIDRs = []string{"10.0.0.0/8"}
+	c.Timeouts.ICEFailed = Duration(10 * time.Second)
+
+	for _, format := range []string{"yaml", "json"} {
+		t.Run(format, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := c.Dump(&buf, format, true); err != nil {
+				t.Fatal(err)
+			}
+
+			loaded := &Config{}
+			if err := loaded.Load(writeFile(t, "config."+format, buf.String())); err != nil {
+				t.Fatal(err)
+			}
+			if len(loaded.ICE.CIDRs) != 1 || loaded.Timeouts.ICEFailed != c.Timeouts.ICEFailed ||
+				loaded.TURN.Password != c.TURN.Password {
+				t.Errorf("config changed in a dump/load round: %+v", loaded)
+			}
+		})
+	}
+
+	var buf bytes.Buffer
+	if err := c.Dump(&buf, "yaml", false); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("password: "+c.TURN.Password)) {
+		t.Error("TURN password not redacted")
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	c := Default()
+	if err := c.Load(writeFile(t, "config.yaml", "foo: bar\n")); err == nil {
+		t.Error("unknown setting should be rejected")
+	}
+
+	setenv(t, EnvName("viewers"), "many")
+	if _, err := Parse(flag.NewFlagSet("test", flag.ContinueOnError), nil); err == nil {
+		t.Error("invalid environment variable should be rejected")
+	}
+
+	c.Media.File = "video.mp3"
+	if _, err := c.Session(); err == nil {
+		t.Error("unknown codec should be rejected")
+	}
+
+	c.Media.RecvCodecs = []string{"vp8", "theora"}
+	if _, err := c.Session(); err == nil {
+		t.Error("unknown receive codec should be rejected")
+	}
+
+	c.Media.File, c.Media.RecvCodecs = "video.h264", nil
+	c.Media.Renditions = []string{writeFile(t, "low.h264", "")}
+	if _, err := c.Session(); err == nil {
+		t.Error("renditions that are not IVF should be rejected")
+	}
+
+	c.Media.Renditions = nil
+	c.Media.KeyframeRequest = "sli"
+	if _, err := c.Session(); err == nil {
+		t.Error("unknown key frame request should be rejected")
+	}
+
+	c.Media.KeyframeRequest, c.Media.KeyframeResponse = "pli", "rewind"
+	if _, err := c.Session(); err == nil {
+		t.Error("unknown key frame response should be rejected")
+	}
+
+	c.Media.KeyframeResponse = "jump"
+	c.ICE.Addr = "fd00::1"
+	if _, err := c.Session(); err == nil {
+		t.Error("IPv6 ICE address without IPv6 network types should be rejected")
+	}
+
+	c.ICE.Addr, c.TURN.URI = "", "turn:[fd00::1]:3478"
+	if _, err := c.Session(); err == nil {
+		t.Error("IPv6 TURN URI should be rejected")
+	}
+}
+
+func TestTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	ca := writeFile(t, "ca.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+
+	for _, test := range []struct {
+		name     string
+		tls      TLS
+		verified bool
+	}{
+		{"system roots", TLS{}, false},
+		{"CA file", TLS{CAFile: ca}, true},
+		{"insecure", TLS{InsecureSkipVerify: true}, true},
+	} {
+		c := Default()
+		c.Media.Codec = "vp8"
+		c.Signaling.TLS = test.tls
+		cfg, err := c.Session()
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		client := http.Client{Transport: &http.Transport{TLSClientConfig: cfg.TLS}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if verified := err == nil; verified != test.verified {
+			t.Errorf("%s: expected the certificate verified %v, got %v", test.name, test.verified, err)
+		}
+	}
+
+	c := Default()
+	c.Media.Codec = "vp8"
+	c.Signaling.TLS = TLS{CAFile: ca, InsecureSkipVerify: true}
+	if _, err := c.Session(); err == nil {
+		t.Error("CA file without verification should be rejected")
+	}
+	c.Signaling.TLS = TLS{CAFile: writeFile(t, "ca.txt", "not a certificate")}
+	if _, err := c.Session(); err == nil {
+		t.Error("CA file without certificates should be rejected")
+	}
+}
+
+func TestICEServers(t *testing.T) {
+	c := Default()
+	c.Media.Codec = "vp8"
+	if err := c.Load(writeFile(t, "config.yaml", `
+turn:
+  uri: turn:1.2.3.4:3478
+iceServers:
+  - urls: ["stun:5.6.7.8:3478"]
+  - urls: ["turn:5.6.7.8:3478?transport=tcp", "turns:5.6.7.8:443"]
+    username: other
+    credential: secret
+`)); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := c.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TurnURI != "turn:1.2.3.4:3478" || len(cfg.ICEServers) != 2 ||
+		!reflect.DeepEqual(cfg.ICEServers[1].URLs, c.ICEServers[1].URLs) ||
+		cfg.ICEServers[1].Username != "other" || cfg.ICEServers[1].Credential != "secret" {
+		t.Errorf("invalid ICE servers: %+v", cfg.ICEServers)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Dump(&buf, "yaml", false); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("secret")) || c.ICEServers[1].Credential != "secret" {
+		t.Error("ICE server credential not redacted in the dump only")
+	}
+
+	for _, servers := range [][]ICEServer{
+		{{}},
+		{{URLs: []string{"http://5.6.7.8"}}},
+		{{URLs: []string{"turn:[fd00::1]:3478"}}},
+	} {
+		c.ICEServers = servers
+		if _, err := c.Session(); err == nil {
+			t.Errorf("invalid ICE servers %v should be rejected", servers)
+		}
+	}
+}
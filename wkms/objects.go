@@ -0,0 +1,166 @@
+package wkms
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// media object types
+const (
+	TypeMediaPipeline  = "MediaPipeline"
+	TypeWebRtcEndpoint = "WebRtcEndpoint"
+	TypeRtpEndpoint    = "RtpEndpoint"
+)
+
+// event types
+const (
+	EventIceCandidateFound        = "IceCandidateFound"
+	EventIceGatheringDone         = "IceGatheringDone"
+	EventIceComponentStateChange  = "IceComponentStateChange"
+	EventNewCandidatePairSelected = "NewCandidatePairSelected"
+	EventMediaStateChanged        = "MediaStateChanged"
+	EventConnectionStateChanged   = "ConnectionStateChanged"
+	EventMediaFlowInStateChange   = "MediaFlowInStateChange"
+	EventMediaFlowOutStateChange  = "MediaFlowOutStateChange"
+	EventError                    = "Error"
+)
+
+// MediaObject is a media object living in the media server.
+type MediaObject struct {
+	client *Client
+	Id     string
+}
+
+// Subscribe registers a handler for an event raised by the media object.
+func (o *MediaObject) Subscribe(eventType string, handler func(Event)) (string, error) {
+	return o.client.Subscribe(o.Id, eventType, handler)
+}
+
+func (o *MediaObject) Release() error {
+	return o.client.Release(o.Id)
+}
+
+// MediaPipeline is a container for media elements.
+type MediaPipeline struct {
+	MediaObject
+}
+
+func (c *Client) CreateMediaPipeline() (*MediaPipeline, error) {
+	id, err := c.Create(TypeMediaPipeline, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &MediaPipeline{MediaObject{client: c, Id: id}}, nil
+}
+
+func (p *MediaPipeline) createElement(elementType string) (MediaElement, error) {
+	id, err := p.client.Create(elementType, map[string]interface{}{"mediaPipeline": p.Id})
+	if err != nil {
+		return MediaElement{}, err
+	}
+	return MediaElement{MediaObject{client: p.client, Id: id}}, nil
+}
+
+func (p *MediaPipeline) CreateWebRtcEndpoint() (*WebRtcEndpoint, error) {
+	e, err := p.createElement(TypeWebRtcEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &WebRtcEndpoint{e}, nil
+}
+
+func (p *MediaPipeline) CreateRtpEndpoint() (*RtpEndpoint, error) {
+	e, err := p.createElement(TypeRtpEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &RtpEndpoint{e}, nil
+}
+
+// MediaElement is a media object that can be connected to other media elements.
+type MediaElement struct {
+	MediaObject
+}
+
+// Connect sends the media of this element to sink.
+func (e *MediaElement) Connect(sink *MediaElement) error {
+	_, err := e.client.Invoke(e.Id, "connect", map[string]interface{}{"sink": sink.Id})
+	return err
+}
+
+func (e *MediaElement) Disconnect(sink *MediaElement) error {
+	_, err := e.client.Invoke(e.Id, "disconnect", map[string]interface{}{"sink": sink.Id})
+	return err
+}
+
+// processOffer is shared by the SDP endpoints
+func (e *MediaElement) processOffer(offer string) (string, error) {
+	v, err := e.client.Invoke(e.Id, "processOffer", map[string]interface{}{"offer": offer})
+	if err != nil {
+		return "", err
+	}
+	answer, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("invalid SDP answer: %v", v)
+	}
+	return answer, nil
+}
+
+// WebRtcEndpoint is a media element that talks WebRTC to a remote peer.
+type WebRtcEndpoint struct {
+	MediaElement
+}
+
+// ProcessOffer processes an SDP offer and returns the SDP answer.
+func (e *WebRtcEndpoint) ProcessOffer(offer string) (string, error) {
+	return e.processOffer(offer)
+}
+
+// GatherCandidates starts ICE gathering, candidates are reported in IceCandidateFound events.
+func (e *WebRtcEndpoint) GatherCandidates() error {
+	_, err := e.client.Invoke(e.Id, "gatherCandidates", nil)
+	return err
+}
+
+// AddIceCandidate adds a remote ICE candidate.
+func (e *WebRtcEndpoint) AddIceCandidate(c webrtc.ICECandidateInit) error {
+	candidate := map[string]interface{}{
+		"__module__": "kurento",
+		"__type__":   "IceCandidate",
+		"candidate":  c.Candidate,
+	}
+	if c.SDPMid != nil {
+		candidate["sdpMid"] = *c.SDPMid
+	}
+	if c.SDPMLineIndex != nil {
+		candidate["sdpMLineIndex"] = *c.SDPMLineIndex
+	}
+	_, err := e.client.Invoke(e.Id, "addIceCandidate", map[string]interface{}{"candidate": candidate})
+	return err
+}
+
+// OnIceCandidateFound subscribes to the local ICE candidates of the endpoint.
+func (e *WebRtcEndpoint) OnIceCandidateFound(f func(webrtc.ICECandidateInit)) (string, error) {
+	return e.Subscribe(EventIceCandidateFound, func(ev Event) {
+		c, ok := ev.Data["candidate"].(map[string]interface{})
+		if !ok {
+			return
+		}
+		candidate, _ := c["candidate"].(string)
+		sdpMid, _ := c["sdpMid"].(string)
+		sdpMLineIndex, _ := c["sdpMLineIndex"].(float64)
+		index := uint16(sdpMLineIndex)
+		f(webrtc.ICECandidateInit{Candidate: candidate, SDPMid: &sdpMid, SDPMLineIndex: &index})
+	})
+}
+
+// RtpEndpoint is a media element that talks plain RTP to a remote peer.
+type RtpEndpoint struct {
+	MediaElement
+}
+
+// ProcessOffer processes an SDP offer and returns the SDP answer.
+func (e *RtpEndpoint) ProcessOffer(offer string) (string, error) {
+	return e.processOffer(offer)
+}
@@ -0,0 +1,314 @@
+package wkms
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const rpcTimeout = 30 * time.Second
+
+var ErrClosed = errors.New("KMS connection closed")
+
+// Error is a JSON-RPC error returned by the media server.
+type Error struct {
+	Code    int                    `json:"code"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("KMS error %d: %s", e.Code, e.Message)
+}
+
+// Event is a notification sent by the media server for a subscribed event type.
+type Event struct {
+	// event type, e.g., IceCandidateFound
+	Type string
+	// the media object that raised the event
+	Object string
+	Data   map[string]interface{}
+}
+
+type request struct {
+	JSONRPC string                 `json:"jsonrpc"`
+	Id      int64                  `json:"id"`
+	Method  string                 `json:"method"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      *int64          `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	Result  *struct {
+		Value     interface{} `json:"value"`
+		SessionId string      `json:"sessionId"`
+	} `json:"result"`
+	Error *Error `json:"error"`
+}
+
+type eventParams struct {
+	Value struct {
+		Type   string                 `json:"type"`
+		Object string                 `json:"object"`
+		Data   map[string]interface{} `json:"data"`
+	} `json:"value"`
+}
+
+// Client is a JSON-RPC 2.0 connection to a Kurento Media Server, this allows to drive media
+// pipelines directly, without a tutorial application server.
+type Client struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+
+	lock      sync.Mutex
+	nextId    int64
+	sessionId string
+	pending   map[int64]chan *response
+	handlers  map[string]func(Event)
+	closed    bool
+}
+
+// Dial connects to the media server, e.g., at ws://localhost:8888/kurento, a wss:// URL with
+// tlsConfig, or with the system roots if nil.
+func Dial(url string, tlsConfig *tls.Config, keyLog io.Writer) (*Client, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig.Clone()
+	if dialer.TLSClientConfig == nil {
+		dialer.TLSClientConfig = &tls.Config{}
+	}
+	dialer.TLSClientConfig.KeyLogWriter = keyLog
+
+	log.Printf("connecting to KMS at %s", url)
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	c := &Client{
+		conn:     conn,
+		pending:  map[int64]chan *response{},
+		handlers: map[string]func(Event){},
+	}
+	go c.reader()
+
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) reader() {
+	defer func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		c.closed = true
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+	}()
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			log.Println("KMS readMessage:", err)
+			return
+		}
+
+		log.Printf("KMS recv: %s\n", message)
+
+		res := &response{}
+		if err := json.Unmarshal(message, res); err != nil {
+			log.Println("KMS JSON unmarshal:", err)
+			continue
+		}
+
+		// server-to-client notification
+		if res.Method == "onEvent" {
+			c.handleEvent(res.Params)
+			continue
+		}
+
+		if res.Id == nil {
+			log.Println("KMS message without id:", string(message))
+			continue
+		}
+
+		c.lock.Lock()
+		ch, ok := c.pending[*res.Id]
+		delete(c.pending, *res.Id)
+		c.lock.Unlock()
+		if !ok {
+			log.Println("KMS response to unknown request:", *res.Id)
+			continue
+		}
+		ch <- res
+	}
+}
+
+func (c *Client) handleEvent(raw json.RawMessage) {
+	p := eventParams{}
+	if err := json.Unmarshal(raw, &p); err != nil {
+		log.Println("KMS cannot parse event:", err)
+		return
+	}
+
+	c.lock.Lock()
+	h, ok := c.handlers[handlerKey(p.Value.Object, p.Value.Type)]
+	c.lock.Unlock()
+	if !ok {
+		log.Printf("KMS unhandled event %s on %s", p.Value.Type, p.Value.Object)
+		return
+	}
+
+	h(Event{Type: p.Value.Type, Object: p.Value.Object, Data: p.Value.Data})
+}
+
+func handlerKey(object, eventType string) string {
+	return object + "/" + eventType
+}
+
+// call sends a request and waits for the response, returns the value of the result
+func (c *Client) call(method string, params map[string]interface{}) (interface{}, error) {
+	ch := make(chan *response, 1)
+
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil, ErrClosed
+	}
+	c.nextId++
+	id := c.nextId
+	c.pending[id] = ch
+	if c.sessionId != "" {
+		params["sessionId"] = c.sessionId
+	}
+	c.lock.Unlock()
+
+	req := request{JSONRPC: "2.0", Id: id, Method: method, Params: params}
+	log.Printf("KMS send: %s %v\n", method, params)
+
+	c.writeLock.Lock()
+	err := c.conn.WriteJSON(req)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return nil, fmt.Errorf("WriteJSON: %w", err)
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		if res.Result == nil {
+			return nil, nil
+		}
+		if res.Result.SessionId != "" {
+			c.lock.Lock()
+			c.sessionId = res.Result.SessionId
+			c.lock.Unlock()
+		}
+		return res.Result.Value, nil
+	case <-time.After(rpcTimeout):
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+		return nil, fmt.Errorf("KMS request %s timed out", method)
+	}
+}
+
+// Create creates a media object of the given type and returns its id.
+func (c *Client) Create(objectType string, constructorParams map[string]interface{}) (string, error) {
+	if constructorParams == nil {
+		constructorParams = map[string]interface{}{}
+	}
+	v, err := c.call("create", map[string]interface{}{
+		"type":              objectType,
+		"constructorParams": constructorParams,
+		"properties":        map[string]interface{}{},
+	})
+	if err != nil {
+		return "", err
+	}
+	id, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("invalid object id in create response: %v", v)
+	}
+	return id, nil
+}
+
+// Invoke calls an operation on a media object and returns the result value.
+func (c *Client) Invoke(object, operation string, operationParams map[string]interface{}) (interface{}, error) {
+	params := map[string]interface{}{
+		"object":    object,
+		"operation": operation,
+	}
+	if operationParams != nil {
+		params["operationParams"] = operationParams
+	}
+	return c.call("invoke", params)
+}
+
+// Subscribe registers a handler for an event type raised by a media object and returns the
+// subscription id. Handlers run on the reader goroutine so they must not block on calls to
+// the media server.
+func (c *Client) Subscribe(object, eventType string, handler func(Event)) (string, error) {
+	c.lock.Lock()
+	c.handlers[handlerKey(object, eventType)] = handler
+	c.lock.Unlock()
+
+	v, err := c.call("subscribe", map[string]interface{}{
+		"object": object,
+		"type":   eventType,
+	})
+	if err != nil {
+		c.lock.Lock()
+		delete(c.handlers, handlerKey(object, eventType))
+		c.lock.Unlock()
+		return "", err
+	}
+	id, _ := v.(string)
+	return id, nil
+}
+
+// Unsubscribe removes an event subscription.
+func (c *Client) Unsubscribe(object, eventType, subscription string) error {
+	c.lock.Lock()
+	delete(c.handlers, handlerKey(object, eventType))
+	c.lock.Unlock()
+
+	_, err := c.call("unsubscribe", map[string]interface{}{
+		"object":       object,
+		"subscription": subscription,
+	})
+	return err
+}
+
+// Release destroys a media object, releasing a pipeline releases all its elements.
+func (c *Client) Release(object string) error {
+	_, err := c.call("release", map[string]interface{}{"object": object})
+	return err
+}
+
+// Ping checks that the media server is alive.
+func (c *Client) Ping() error {
+	_, err := c.call("ping", map[string]interface{}{"interval": 240000})
+	return err
+}
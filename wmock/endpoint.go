@@ -0,0 +1,353 @@
+package wmock
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/report"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wcodec"
+)
+
+// endpoint is a PeerConnection that plays the role of a Kurento WebRtcEndpoint: it answers
+// the client's offer, trickles its own ICE candidates to the client and forwards the media
+// received from the client to a sink endpoint.
+type endpoint struct {
+	pc    *webrtc.PeerConnection
+	track *webrtc.TrackLocalStaticRTP
+	// the simulcast layer forwarded, if the client sends simulcast
+	rid string
+	// feedback on the other layers, nil for none
+	layers *layerFeedback
+
+	lock sync.Mutex
+	sink *endpoint
+	// packets not forwarded at the start
+	skip int
+}
+
+// keyframeRequests counts the key frame requests received
+type keyframeRequests struct {
+	pli, fir int64
+}
+
+func (k *keyframeRequests) count(pkts []rtcp.Packet) {
+	for _, p := range pkts {
+		switch p.(type) {
+		case *rtcp.PictureLossIndication:
+			atomic.AddInt64(&k.pli, 1)
+		case *rtcp.FullIntraRequest:
+			atomic.AddInt64(&k.fir, 1)
+		}
+	}
+}
+
+// layerFeedback NACKs a packet of each simulcast layer that is not forwarded and requests a
+// key frame of it, like an SFU that keeps the layers ready to switch to, and counts the
+// retransmissions and the key frames received in answer
+type layerFeedback struct {
+	retransmissions, keyframes int64
+}
+
+const (
+	// the number of packets of a layer received before one is NACKed and a key frame requested
+	layerFeedbackAfter = 10
+	// a key frame within this many packets after the request answers it
+	layerKeyframeWithin = 5
+)
+
+// newEndpoint answers offer, onCandidate is called with each local ICE candidate. The
+// endpoint sends the same codec the client offered, so that the client's receiver can pick
+// the right file writer.
+func newEndpoint(offer string, vn *vnet.Net, requests *keyframeRequests, layers *layerFeedback,
+	onCandidate func(webrtc.ICECandidateInit)) (*endpoint, string, error) {
+	mimeType, err := offeredCodec(offer)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s := webrtc.SettingEngine{}
+	s.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+	s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+	// the layers are retransmitted as is, with the sequence number that SRTP replay protection
+	// has seen already
+	if layers != nil {
+		s.DisableSRTPReplayProtection(true)
+	}
+	if vn != nil {
+		s.SetVNet(vn)
+	}
+
+	m := &webrtc.MediaEngine{}
+	// simulcast layers are told apart by these
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri},
+			webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, codecs := range [][]webrtc.RTPCodecParameters{wcodec.VP8Codecs, wcodec.VP9Codecs,
+		wcodec.AV1Codecs, wcodec.H264Codecs} {
+		for _, c := range codecs {
+			if err := m.RegisterCodec(c, webrtc.RTPCodecTypeVideo); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	// sender reports, like a media server
+	i := &interceptor.Registry{}
+	reports, err := report.NewSenderInterceptor()
+	if err != nil {
+		return nil, "", err
+	}
+	i.Add(reports)
+
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(s), webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(i)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, "", err
+	}
+
+	e := &endpoint{pc: pc, rid: simulcastLayer(offer), layers: layers}
+
+	e.track, err = webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: mimeType}, "video", "wmock")
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+
+	rtpSender, err := pc.AddTrack(e.track)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+
+	// drain RTCP so that the interceptors run
+	go func() {
+		for {
+			pkts, _, err := rtpSender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			requests.count(pkts)
+		}
+	}()
+
+	pc.OnTrack(e.forward)
+	pc.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i != nil {
+			onCandidate(i.ToJSON())
+		}
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+
+	if err := pc.SetLocalDescription(answer); err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+
+	sdpAnswer, err := withMediaFingerprint(answer.SDP)
+	if err != nil {
+		pc.Close()
+		return nil, "", err
+	}
+
+	return e, sdpAnswer, nil
+}
+
+// connect sends the media received by e to sink, like MediaElement.connect in Kurento.
+func (e *endpoint) connect(sink *endpoint) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.sink = sink
+}
+
+// skipPackets does not forward the first n packets of the media received by e.
+func (e *endpoint) skipPackets(n int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.skip = n
+}
+
+func (e *endpoint) forward(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	log.Printf("mock endpoint: got %s track %s", track.Codec().MimeType, track.RID())
+	// like an SFU, forward a single simulcast layer
+	drop := track.RID() != e.rid
+	feedback := drop && e.layers != nil
+	received, nacked := 0, false
+	var nackedSeq uint16
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			if err != io.EOF {
+				log.Println("mock endpoint: ReadRTP:", err)
+			}
+			return
+		}
+
+		if feedback {
+			received++
+			switch {
+			case !nacked && received == layerFeedbackAfter:
+				nacked, nackedSeq = true, p.SequenceNumber-1
+				ssrc := uint32(track.SSRC())
+				// report on all the layers, like a browser does: the compound packet is read by
+				// the client for each of their SSRCs, and must be answered once
+				rr := &rtcp.ReceiverReport{}
+				for _, t := range receiver.Tracks() {
+					rr.Reports = append(rr.Reports, rtcp.ReceptionReport{SSRC: uint32(t.SSRC())})
+				}
+				if err := e.pc.WriteRTCP([]rtcp.Packet{
+					rr,
+					&rtcp.TransportLayerNack{MediaSSRC: ssrc, Nacks: []rtcp.NackPair{{PacketID: nackedSeq}}},
+					&rtcp.PictureLossIndication{MediaSSRC: ssrc},
+				}); err != nil {
+					log.Println("mock endpoint: WriteRTCP:", err)
+				}
+			case nacked && p.SequenceNumber == nackedSeq:
+				atomic.AddInt64(&e.layers.retransmissions, 1)
+			case nacked && received <= layerFeedbackAfter+layerKeyframeWithin && isVP8Keyframe(p.Payload):
+				atomic.AddInt64(&e.layers.keyframes, 1)
+			}
+		}
+
+		e.lock.Lock()
+		sink, skip := e.sink, e.skip > 0 && !drop
+		if skip {
+			e.skip--
+		}
+		e.lock.Unlock()
+		if sink == nil || drop || skip {
+			continue
+		}
+
+		if err := sink.track.WriteRTP(p); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			log.Println("mock endpoint: WriteRTP:", err)
+			return
+		}
+	}
+}
+
+// isVP8Keyframe tells whether a VP8 RTP payload starts a key frame
+func isVP8Keyframe(payload []byte) bool {
+	vp8 := codecs.VP8Packet{}
+	if _, err := vp8.Unmarshal(payload); err != nil || vp8.S != 1 || vp8.PID != 0 {
+		return false
+	}
+	return len(vp8.Payload) > 0 && vp8.Payload[0]&0x01 == 0
+}
+
+func (e *endpoint) addCandidate(c webrtc.ICECandidateInit) {
+	if err := e.pc.AddICECandidate(c); err != nil {
+		log.Println("mock endpoint: cannot add remote ICE candidate:", err)
+	}
+}
+
+func (e *endpoint) close() {
+	if err := e.pc.Close(); err != nil {
+		log.Println("mock endpoint: close:", err)
+	}
+}
+
+// offeredCodec returns the mime type of the first video codec in offer that the mock knows.
+func offeredCodec(offer string) (string, error) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer)); err != nil {
+		return "", err
+	}
+
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Media != "video" {
+			continue
+		}
+		for _, f := range md.MediaName.Formats {
+			pt, err := strconv.ParseUint(f, 10, 8)
+			if err != nil {
+				continue
+			}
+			c, err := parsed.GetCodecForPayloadType(uint8(pt))
+			if err != nil {
+				continue
+			}
+			switch strings.ToUpper(c.Name) {
+			case "VP8":
+				return webrtc.MimeTypeVP8, nil
+			case "VP9":
+				return webrtc.MimeTypeVP9, nil
+			case "AV1":
+				return wcodec.MimeTypeAV1, nil
+			case "H264":
+				return webrtc.MimeTypeH264, nil
+			}
+		}
+	}
+
+	return "", errors.New("no VP8, VP9, AV1 or H264 codec in offer")
+}
+
+// simulcastLayer returns the RID of the highest simulcast layer in offer, or "" without
+// simulcast
+func simulcastLayer(offer string) string {
+	for _, line := range strings.Split(offer, "\r\n") {
+		if !strings.HasPrefix(line, "a=simulcast:send ") {
+			continue
+		}
+		rids := strings.FieldsFunc(strings.TrimPrefix(line, "a=simulcast:send "), func(r rune) bool {
+			return r == ';' || r == ','
+		})
+		if len(rids) > 0 {
+			return strings.TrimPrefix(rids[len(rids)-1], "~")
+		}
+	}
+	return ""
+}
+
+// withMediaFingerprint repeats the session level DTLS fingerprint in each media section, like
+// Kurento does, the clients remove the session level one
+func withMediaFingerprint(answer string) (string, error) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(answer)); err != nil {
+		return "", err
+	}
+
+	fingerprint, ok := parsed.Attribute("fingerprint")
+	if !ok {
+		return answer, nil
+	}
+	for _, md := range parsed.MediaDescriptions {
+		if _, ok := md.Attribute("fingerprint"); !ok {
+			md.WithValueAttribute("fingerprint", fingerprint)
+		}
+	}
+
+	b, err := parsed.Marshal()
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,174 @@
+package wmock
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+
+	"webrtc-client-go/wcodec"
+)
+
+// WriteIVF writes a synthetic VP8 IVF file of the given number of frames at 30 fps to be
+// sent in tests. Every frame is flagged as a keyframe so that the receiver side can start
+// writing at any frame.
+func WriteIVF(file string, frames int) error {
+	return WriteIVFCodec(file, webrtc.MimeTypeVP8, frames)
+}
+
+// WriteIVFCodec writes a synthetic IVF file of the given codec, VP8, VP9 or AV1. AV1 frames are
+// temporal units of valid OBUs, large enough to be fragmented into several packets.
+func WriteIVFCodec(file, mimeType string, frames int) error {
+	return writeIVF(file, mimeType, frames, 200, 1)
+}
+
+// WriteIVFRendition writes a synthetic VP8 IVF file with frames of the given size, to be sent as
+// a rendition of a file written by WriteIVF.
+func WriteIVFRendition(file string, frames, size int) error {
+	return writeIVF(file, webrtc.MimeTypeVP8, frames, size, 1)
+}
+
+// WriteIVFKeyframes writes a synthetic VP8 IVF file with frames of the given size and a key
+// frame every interval frames, to be sent where key frame requests are answered.
+func WriteIVFKeyframes(file string, frames, size, interval int) error {
+	return writeIVF(file, webrtc.MimeTypeVP8, frames, size, interval)
+}
+
+// writeIVF writes frames with a key frame every interval frames, 1 for VP8 only
+func writeIVF(file, mimeType string, frames, size, interval int) error {
+	var fourCC string
+	switch mimeType {
+	case webrtc.MimeTypeVP8:
+		fourCC = "VP80"
+	case webrtc.MimeTypeVP9:
+		fourCC = "VP90"
+	case wcodec.MimeTypeAV1:
+		fourCC = "AV01"
+	default:
+		return fmt.Errorf("no IVF FourCC for %s", mimeType)
+	}
+
+	header := make([]byte, 32)
+	copy(header[0:], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:], 0)
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourCC)
+	binary.LittleEndian.PutUint16(header[12:], 640)
+	binary.LittleEndian.PutUint16(header[14:], 360)
+	binary.LittleEndian.PutUint32(header[16:], 30)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	binary.LittleEndian.PutUint32(header[24:], uint32(frames))
+
+	data := header
+	for i := 0; i < frames; i++ {
+		frame := make([]byte, size)
+		frame[1] = byte(i)
+		if i%interval != 0 {
+			// the inverse key frame flag of the VP8 frame tag
+			frame[0] = 0x01
+		}
+		if mimeType == wcodec.MimeTypeAV1 {
+			frame = av1TemporalUnit(i)
+		}
+		h := make([]byte, 12)
+		binary.LittleEndian.PutUint32(h[0:], uint32(len(frame)))
+		binary.LittleEndian.PutUint64(h[4:], uint64(i))
+		data = append(data, h...)
+		data = append(data, frame...)
+	}
+
+	return os.WriteFile(file, data, 0644)
+}
+
+// av1TemporalUnit returns a temporal delimiter, a sequence header in the first unit and a
+// 3000 byte frame OBU, with size fields
+func av1TemporalUnit(i int) []byte {
+	tu := []byte{0x12, 0x00}
+	if i == 0 {
+		tu = append(tu, 0x0a, 0x03, 0x00, 0x00, 0x00)
+	}
+	// frame OBU, the size is 3000 in LEB128
+	tu = append(tu, 0x32, 0xb8, 0x17)
+	payload := make([]byte, 3000)
+	payload[0] = byte(i)
+	return append(tu, payload...)
+}
+
+// CountIVFFrames returns the number of frames in an IVF file.
+func CountIVFFrames(file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	ivf, _, err := ivfreader.NewWith(f)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for {
+		if _, _, err := ivf.ParseNextFrame(); err != nil {
+			return n, nil
+		}
+		n++
+	}
+}
+
+// CountWebMFrames returns the number of blocks of each track in a WebM file, by track number.
+func CountWebMFrames(file string) (map[int]int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := map[int]int{}
+	// the segment and the clusters are entered, other elements are skipped
+	for b := data; len(b) > 0; {
+		id, n := ebmlVint(b, false)
+		if n == 0 {
+			return nil, fmt.Errorf("%s: invalid element ID", file)
+		}
+		size, m := ebmlVint(b[n:], true)
+		if m == 0 || size > uint64(len(b)-n-m) {
+			return nil, fmt.Errorf("%s: invalid size of element %x", file, id)
+		}
+		body := b[n+m:]
+		switch id {
+		case 0x18538067, 0x1f43b675:
+			b = body
+			continue
+		case 0xa3:
+			if len(body) > 0 {
+				frames[int(body[0]&0x7f)]++
+			}
+		}
+		b = body[size:]
+	}
+	return frames, nil
+}
+
+// ebmlVint returns an EBML variable size integer and its length, with the length marker for IDs
+func ebmlVint(b []byte, size bool) (uint64, int) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0
+	}
+	l := 1
+	for b[0]&(0x80>>uint(l-1)) == 0 {
+		l++
+	}
+	if l > len(b) {
+		return 0, 0
+	}
+	v := uint64(b[0])
+	if size {
+		v &= 0xff >> uint(l)
+	}
+	for _, c := range b[1:l] {
+		v = v<<8 | uint64(c)
+	}
+	return v, l
+}
@@ -0,0 +1,308 @@
+package wmock
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wsession"
+)
+
+// Server is a mock of the Kurento tutorial application servers that allows to run the
+// clients end-to-end without a media server: each client session gets an in-process
+// endpoint that answers the client's offer and forwards the media to the peer (one-to-one)
+// or back to the client (magic mirror). Use it with net/http/httptest.
+type Server struct {
+	// if not nil, the endpoints are created in this virtual network, set before serving
+	VNet *vnet.Net
+	// if set before serving, the endpoints NACK a packet of each simulcast layer they do not
+	// forward and request a key frame of it
+	LayerFeedback bool
+	// if set before serving, the endpoints do not forward this many packets at the start, like
+	// a media server that connects a sink between two key frames
+	SkipPackets int
+
+	mux      *http.ServeMux
+	upgrader websocket.Upgrader
+
+	// guards the registry and the state of all sessions
+	lock  sync.Mutex
+	users map[string]*session
+
+	// key frame requests received by the endpoints
+	requests keyframeRequests
+	// answers of the layers that are not forwarded
+	layers layerFeedback
+}
+
+// session is a client connected to the mock
+type session struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+
+	name string
+	// one-to-one: the caller's offer until the callee answers, and the other party
+	offer string
+	peer  *session
+
+	ep *endpoint
+	// remote ICE candidates received before the endpoint is created
+	cache []webrtc.ICECandidateInit
+}
+
+func NewServer() *Server {
+	s := &Server{
+		mux:   http.NewServeMux(),
+		users: map[string]*session{},
+	}
+	s.mux.HandleFunc("/one2one", s.serve(s.handleOne2One))
+	s.mux.HandleFunc("/magicmirror", s.serve(s.handleMagicMirror))
+	return s
+}
+
+// KeyframeRequests returns the number of PLIs and FIRs the endpoints received.
+func (s *Server) KeyframeRequests() (pli, fir int) {
+	return int(atomic.LoadInt64(&s.requests.pli)), int(atomic.LoadInt64(&s.requests.fir))
+}
+
+// LayerRetransmissions returns the number of NACKed packets of the simulcast layers that are
+// not forwarded that the endpoints received again, see LayerFeedback.
+func (s *Server) LayerRetransmissions() int {
+	return int(atomic.LoadInt64(&s.layers.retransmissions))
+}
+
+// LayerKeyframes returns the number of key frames of the simulcast layers that are not
+// forwarded that the endpoints received right after requesting them, see LayerFeedback.
+func (s *Server) LayerKeyframes() int {
+	return int(atomic.LoadInt64(&s.layers.keyframes))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// serve runs the read loop of a client connection, ICE candidates are handled here, all
+// other messages are passed to handle
+func (s *Server) serve(handle func(*session, map[string]interface{})) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := s.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println("mock: upgrade:", err)
+			return
+		}
+		defer conn.Close()
+
+		ss := &session{conn: conn}
+		defer s.cleanup(ss)
+
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			m := map[string]interface{}{}
+			if err := json.Unmarshal(message, &m); err != nil {
+				log.Println("mock: JSON unmarshal:", err)
+				continue
+			}
+			id, _ := m["id"].(string)
+
+			if id == "onIceCandidate" {
+				c, err := wsession.ParseICECandidate(m)
+				if err != nil {
+					log.Println("mock:", err)
+					continue
+				}
+				s.lock.Lock()
+				if ss.ep == nil {
+					ss.cache = append(ss.cache, c)
+				} else {
+					ss.ep.addCandidate(c)
+				}
+				s.lock.Unlock()
+				continue
+			}
+
+			handle(ss, m)
+		}
+	}
+}
+
+func (ss *session) send(m interface{}) {
+	ss.writeLock.Lock()
+	defer ss.writeLock.Unlock()
+	if err := ss.conn.WriteJSON(m); err != nil {
+		log.Println("mock: WriteJSON:", err)
+	}
+}
+
+func (ss *session) sendError(msg string) {
+	ss.send(map[string]interface{}{"id": "error", "message": msg})
+}
+
+// createEndpoint answers offer and trickles the ICE candidates of the endpoint to the client,
+// must be called with the server lock held
+func (s *Server) createEndpoint(ss *session, offer string) (string, error) {
+	var layers *layerFeedback
+	if s.LayerFeedback {
+		layers = &s.layers
+	}
+	ep, answer, err := newEndpoint(offer, s.VNet, &s.requests, layers, func(c webrtc.ICECandidateInit) {
+		ss.send(map[string]interface{}{"id": "iceCandidate", "candidate": c})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ep.skipPackets(s.SkipPackets)
+	ss.ep = ep
+	for _, c := range ss.cache {
+		ep.addCandidate(c)
+	}
+	ss.cache = nil
+
+	return answer, nil
+}
+
+// release closes the endpoint of the session, must be called with the server lock held
+func (ss *session) release() {
+	if ss.ep != nil {
+		ss.ep.close()
+		ss.ep = nil
+	}
+	ss.offer = ""
+	ss.peer = nil
+}
+
+func (s *Server) cleanup(ss *session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if ss.peer != nil {
+		ss.peer.send(map[string]interface{}{"id": "stopCommunication"})
+		ss.peer.release()
+	}
+	ss.release()
+	if ss.name != "" && s.users[ss.name] == ss {
+		delete(s.users, ss.name)
+	}
+}
+
+/////////////////////////
+// one-to-one
+
+func (s *Server) handleOne2One(ss *session, m map[string]interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch m["id"] {
+	case "register":
+		name, _ := m["name"].(string)
+		res := map[string]interface{}{"id": "registerResponse", "response": "accepted"}
+		switch {
+		case name == "":
+			res["response"] = "rejected: empty user name"
+		case s.users[name] != nil:
+			res["response"] = fmt.Sprintf("rejected: user %s is already registered", name)
+		default:
+			ss.name = name
+			s.users[name] = ss
+		}
+		ss.send(res)
+
+	case "call":
+		to, _ := m["to"].(string)
+		offer, _ := m["sdpOffer"].(string)
+		callee := s.users[to]
+		if callee == nil || callee == ss || callee.peer != nil {
+			ss.send(map[string]interface{}{"id": "callResponse", "response": "rejected",
+				"message": fmt.Sprintf("user %s is not registered or busy", to)})
+			return
+		}
+		ss.offer = offer
+		ss.peer = callee
+		callee.send(map[string]interface{}{"id": "incomingCall", "from": ss.name})
+
+	case "incomingCallResponse":
+		from, _ := m["from"].(string)
+		caller := s.users[from]
+		if caller == nil || caller.peer == nil || caller.offer == "" {
+			ss.sendError(fmt.Sprintf("unknown caller: %s", from))
+			return
+		}
+
+		if m["callResponse"] != "accept" {
+			caller.send(map[string]interface{}{"id": "callResponse", "response": "rejected",
+				"message": "user declined"})
+			caller.release()
+			return
+		}
+
+		offer, _ := m["sdpOffer"].(string)
+		calleeAnswer, err := s.createEndpoint(ss, offer)
+		if err != nil {
+			ss.sendError(err.Error())
+			return
+		}
+		callerAnswer, err := s.createEndpoint(caller, caller.offer)
+		if err != nil {
+			caller.send(map[string]interface{}{"id": "callResponse", "response": "rejected",
+				"message": err.Error()})
+			caller.release()
+			ss.release()
+			return
+		}
+
+		caller.ep.connect(ss.ep)
+		ss.ep.connect(caller.ep)
+		ss.peer = caller
+
+		caller.send(map[string]interface{}{"id": "callResponse", "response": "accepted",
+			"sdpAnswer": callerAnswer})
+		ss.send(map[string]interface{}{"id": "startCommunication", "sdpAnswer": calleeAnswer})
+
+	case "stop":
+		if ss.peer != nil {
+			ss.peer.send(map[string]interface{}{"id": "stopCommunication"})
+			ss.peer.release()
+		}
+		ss.release()
+
+	default:
+		ss.sendError(fmt.Sprintf("invalid message: %v", m["id"]))
+	}
+}
+
+/////////////////////////
+// magic mirror
+
+func (s *Server) handleMagicMirror(ss *session, m map[string]interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch m["id"] {
+	case "start":
+		offer, _ := m["sdpOffer"].(string)
+		answer, err := s.createEndpoint(ss, offer)
+		if err != nil {
+			ss.sendError(err.Error())
+			return
+		}
+		ss.ep.connect(ss.ep)
+		ss.send(map[string]interface{}{"id": "startResponse", "sdpAnswer": answer})
+
+	case "stop":
+		ss.release()
+
+	default:
+		ss.sendError(fmt.Sprintf("invalid message: %v", m["id"]))
+	}
+}
@@ -0,0 +1,647 @@
+package wmock
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+
+	"webrtc-client-go/wcodec"
+	"webrtc-client-go/wrtp"
+	"webrtc-client-go/wsession"
+)
+
+const (
+	testFrames  = 60
+	testTimeout = 30 * time.Second
+)
+
+func writeTestIVF(t *testing.T, file string) {
+	t.Helper()
+	if err := WriteIVF(file, testFrames); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countIVFFrames(t *testing.T, file string) int {
+	t.Helper()
+	n, err := CountIVFFrames(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func testConfig(srv *httptest.Server, path string) wsession.Config {
+	return wsession.Config{
+		Url:   "ws" + strings.TrimPrefix(srv.URL, "http") + path,
+		Codec: webrtc.MimeTypeVP8,
+	}
+}
+
+func waitRegistered(t *testing.T, s *Server, name string) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		s.lock.Lock()
+		ok := s.users[name] != nil
+		s.lock.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("user %s did not register", name)
+}
+
+func TestOne2One(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	output := filepath.Join(dir, "output")
+	writeTestIVF(t, input)
+
+	s := NewServer()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	cfg := testConfig(srv, "/one2one")
+
+	callee := make(chan error, 1)
+	go func() { callee <- wsession.Callee(cfg, "test2", output) }()
+	waitRegistered(t, s, "test2")
+
+	if err := wsession.Caller(cfg, "test1", "test2", input); err != nil {
+		t.Fatal("caller:", err)
+	}
+
+	select {
+	case err := <-callee:
+		if err != nil {
+			t.Fatal("callee:", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("callee did not stop")
+	}
+
+	if n := countIVFFrames(t, output+".ivf"); n < testFrames/2 {
+		t.Fatalf("callee received %d frames, sent %d", n, testFrames)
+	}
+}
+
+// TestOne2OneCapture captures the packets of the callee, that receives only: the sender reports
+// of the mock are read by its receiver
+func TestOne2OneCapture(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	capture := filepath.Join(dir, "callee.pcapng")
+	writeTestIVF(t, input)
+
+	s := NewServer()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	cfg := testConfig(srv, "/one2one")
+
+	c, err := wrtp.NewCapture(capture, wrtp.CaptureAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calleeCfg := cfg
+	calleeCfg.Capture = c
+	callee := make(chan error, 1)
+	go func() { callee <- wsession.Callee(calleeCfg, "test2", filepath.Join(dir, "output")) }()
+	waitRegistered(t, s, "test2")
+
+	if err := wsession.Caller(cfg, "test1", "test2", input); err != nil {
+		t.Fatal("caller:", err)
+	}
+	select {
+	case err := <-callee:
+		if err != nil {
+			t.Fatal("callee:", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("callee did not stop")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	packets, err := wrtp.ReadCapture(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports := 0
+	for _, p := range packets {
+		if !p.RTCP {
+			continue
+		}
+		pkts, err := rtcp.Unmarshal(p.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pkt := range pkts {
+			// the sender of the callee reports too, but sends nothing
+			if sr, ok := pkt.(*rtcp.SenderReport); ok && sr.PacketCount > 0 {
+				reports++
+			}
+		}
+	}
+	if reports == 0 {
+		t.Error("no sender report of the mock captured")
+	}
+}
+
+func TestOne2OneUnknownPeer(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	writeTestIVF(t, input)
+
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	if err := wsession.Caller(testConfig(srv, "/one2one"), "test1", "nobody", input); err == nil {
+		t.Fatal("call to an unregistered user should fail")
+	}
+}
+
+func TestMagicMirror(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	output := filepath.Join(dir, "mirrored")
+	writeTestIVF(t, input)
+
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	if err := wsession.MagicMirror(testConfig(srv, "/magicmirror"), input, output); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+
+	if n := countIVFFrames(t, output+".ivf"); n < testFrames/2 {
+		t.Fatalf("received %d mirrored frames, sent %d", n, testFrames)
+	}
+}
+
+func TestMagicMirrorWebM(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	output := filepath.Join(dir, "mirrored.webm")
+	writeTestIVF(t, input)
+
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	// the mock sends no audio, the video is written without it
+	if err := wsession.MagicMirror(testConfig(srv, "/magicmirror"), input, output); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+
+	frames, err := CountWebMFrames(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := frames[1]; n < testFrames/2 {
+		t.Fatalf("received %d mirrored frames, sent %d", n, testFrames)
+	}
+}
+
+// TestMagicMirrorWebMKeyframe mirrors a stream that starts between two key frames: the video
+// track requests a key frame to start with, without periodic requests
+func TestMagicMirrorWebMKeyframe(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	output := filepath.Join(dir, "mirrored.webm")
+	if err := WriteIVFKeyframes(input, testFrames, 200, 30); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer()
+	s.SkipPackets = 5
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	cfg := testConfig(srv, "/magicmirror")
+	cfg.Keyframes = wcodec.KeyframePolicy{Request: wcodec.KeyframePLI}
+	if err := wsession.MagicMirror(cfg, input, output); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+
+	if pli, _ := s.KeyframeRequests(); pli == 0 {
+		t.Error("no key frame requested for the video track to start with")
+	}
+	// the mock does not pass the request on to the sender, the video starts at frame 30
+	frames, err := CountWebMFrames(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := frames[1]; n < testFrames/4 {
+		t.Fatalf("received %d mirrored frames, sent %d", n, testFrames)
+	}
+}
+
+func TestKeyframeRequests(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	writeTestIVF(t, input)
+
+	for _, c := range []struct {
+		request  wcodec.KeyframeRequest
+		pli, fir bool
+	}{
+		{wcodec.KeyframeFIR, false, true},
+		{wcodec.KeyframeNone, false, false},
+	} {
+		t.Run(string(c.request), func(t *testing.T) {
+			s := NewServer()
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+
+			cfg := testConfig(srv, "/magicmirror")
+			cfg.Keyframes = wcodec.KeyframePolicy{Request: c.request, Interval: 200 * time.Millisecond}
+			if err := wsession.MagicMirror(cfg, input, filepath.Join(dir, "mirrored")); err != nil {
+				t.Fatal("magic mirror:", err)
+			}
+
+			pli, fir := s.KeyframeRequests()
+			if (pli > 0) != c.pli || (fir > 0) != c.fir {
+				t.Errorf("received %d PLIs and %d FIRs", pli, fir)
+			}
+		})
+	}
+}
+
+// TestCandidateFilter restricts the client to host candidates on a single IP in a port range
+func TestCandidateFilter(t *testing.T) {
+	// pion skips loopback interfaces, so use the first external IPv4 address
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cidr := ""
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			cidr = ipnet.IP.String() + "/32"
+			break
+		}
+	}
+	if cidr == "" {
+		t.Skip("no external IPv4 address")
+	}
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	output := filepath.Join(dir, "mirrored")
+	writeTestIVF(t, input)
+
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	cidrs, err := wsession.ParseCIDRs(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	types, err := wsession.ParseCandidateTypes("host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max, err := wsession.ParsePortRange("40000-40100")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := testConfig(srv, "/magicmirror")
+	cfg.CIDRs = cidrs
+	cfg.ExcludeInterfaces = regexp.MustCompile("^(docker|veth)")
+	cfg.CandidateTypes = types
+	cfg.PortMin, cfg.PortMax = min, max
+	if err := wsession.MagicMirror(cfg, input, output); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+
+	if n := countIVFFrames(t, output+".ivf"); n < testFrames/2 {
+		t.Fatalf("received %d mirrored frames, sent %d", n, testFrames)
+	}
+}
+
+// TestCodecPreferences lets the callee pick its writer from the negotiated codec and rejects a
+// media file whose codec is not in the send codecs
+func TestCodecPreferences(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	output := filepath.Join(dir, "output")
+	writeTestIVF(t, input)
+
+	s := NewServer()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	cfg := testConfig(srv, "/one2one")
+
+	calleeCfg := cfg
+	calleeCfg.Codec = ""
+	calleeCfg.RecvCodecs = []string{"vp8", "h264-high"}
+	callee := make(chan error, 1)
+	go func() { callee <- wsession.Callee(calleeCfg, "test2", output) }()
+	waitRegistered(t, s, "test2")
+
+	badCfg := cfg
+	badCfg.SendCodecs = []string{"h264"}
+	if err := wsession.Caller(badCfg, "test1", "test2", input); err == nil {
+		t.Fatal("sending VP8 with H264 send codecs should fail")
+	}
+
+	if err := wsession.Caller(cfg, "test3", "test2", input); err != nil {
+		t.Fatal("caller:", err)
+	}
+
+	select {
+	case err := <-callee:
+		if err != nil {
+			t.Fatal("callee:", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("callee did not stop")
+	}
+
+	if n := countIVFFrames(t, output+".ivf"); n < testFrames/2 {
+		t.Fatalf("callee received %d frames, sent %d", n, testFrames)
+	}
+}
+
+// readIVFFrames returns the frames of an IVF file and its FourCC
+func readIVFFrames(t *testing.T, file string) ([][]byte, string) {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ivf, header, err := ivfreader.NewWith(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames [][]byte
+	for {
+		frame, _, err := ivf.ParseNextFrame()
+		if err != nil {
+			return frames, header.FourCC
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// TestIVFCodecs sends VP9 and AV1 files to the magic mirror, the mirrored frames must be
+// identical to the sent ones
+func TestIVFCodecs(t *testing.T) {
+	for _, c := range []struct{ mimeType, fourCC string }{
+		{webrtc.MimeTypeVP9, "VP90"},
+		{wcodec.MimeTypeAV1, "AV01"},
+	} {
+		t.Run(c.fourCC, func(t *testing.T) {
+			dir := t.TempDir()
+			input := filepath.Join(dir, "input.ivf")
+			output := filepath.Join(dir, "mirrored")
+			if err := WriteIVFCodec(input, c.mimeType, testFrames); err != nil {
+				t.Fatal(err)
+			}
+
+			srv := httptest.NewServer(NewServer())
+			defer srv.Close()
+
+			cfg := testConfig(srv, "/magicmirror")
+			cfg.Codec = c.mimeType
+			if err := wsession.MagicMirror(cfg, input, output); err != nil {
+				t.Fatal("magic mirror:", err)
+			}
+
+			sent, _ := readIVFFrames(t, input)
+			received, fourCC := readIVFFrames(t, output+".ivf")
+			if fourCC != c.fourCC {
+				t.Errorf("received FourCC %s", fourCC)
+			}
+			if len(received) < testFrames/2 {
+				t.Fatalf("received %d mirrored frames, sent %d", len(received), testFrames)
+			}
+			known := map[string]bool{}
+			for _, f := range sent {
+				known[string(f)] = true
+			}
+			for i, f := range received {
+				if !known[string(f)] {
+					t.Fatalf("received frame %d of %d bytes was not sent", i, len(f))
+				}
+			}
+		})
+	}
+}
+
+func TestRenditions(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	output := filepath.Join(dir, "mirrored")
+	writeTestIVF(t, input)
+	// 240 and 480 kbps, the mock sends no feedback so the estimate stays at its start, 300 kbps
+	var renditions []string
+	for _, size := range []int{1000, 2000} {
+		file := filepath.Join(dir, fmt.Sprintf("rendition%d.ivf", size))
+		if err := WriteIVFRendition(file, testFrames, size); err != nil {
+			t.Fatal(err)
+		}
+		renditions = append(renditions, file)
+	}
+
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	cfg := testConfig(srv, "/magicmirror")
+	cfg.Renditions = renditions
+	if err := wsession.MagicMirror(cfg, input, output); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+
+	received, _ := readIVFFrames(t, output+".ivf")
+	if len(received) < testFrames/2 {
+		t.Fatalf("received %d mirrored frames, sent %d", len(received), testFrames)
+	}
+	for i, f := range received {
+		if len(f) != 1000 {
+			t.Fatalf("received frame %d of %d bytes, expected the 1000 byte rendition", i, len(f))
+		}
+	}
+}
+
+func TestSimulcast(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	output := filepath.Join(dir, "mirrored")
+	if err := WriteIVFRendition(input, testFrames, 1000); err != nil {
+		t.Fatal(err)
+	}
+	var layers []string
+	for _, size := range []int{200, 500} {
+		file := filepath.Join(dir, fmt.Sprintf("layer%d.ivf", size))
+		if err := WriteIVFRendition(file, testFrames, size); err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, file)
+	}
+
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	// the mock forwards the highest layer, f
+	cfg := testConfig(srv, "/magicmirror")
+	cfg.Simulcast = layers
+	if err := wsession.MagicMirror(cfg, input, output); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+
+	received, _ := readIVFFrames(t, output+".ivf")
+	if len(received) < testFrames/2 {
+		t.Fatalf("received %d mirrored frames, sent %d", len(received), testFrames)
+	}
+	for i, f := range received {
+		if len(f) != 1000 {
+			t.Fatalf("received frame %d of %d bytes, expected the 1000 byte layer", i, len(f))
+		}
+	}
+}
+
+// TestSimulcastFeedback NACKs packets of the layers that the mock does not forward and requests
+// key frames of them, they are written into the stream of another sender and their RTCP is read
+// through taps
+func TestSimulcastFeedback(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	writeTestIVF(t, input)
+	// the layers have a key frame a second, a request is answered by jumping ahead to the next
+	var layers []string
+	for _, size := range []int{200, 500} {
+		file := filepath.Join(dir, fmt.Sprintf("layer%d.ivf", size))
+		if err := WriteIVFKeyframes(file, testFrames, size, 30); err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, file)
+	}
+
+	s := NewServer()
+	s.LayerFeedback = true
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	cfg := testConfig(srv, "/magicmirror")
+	cfg.Simulcast = layers
+	// each layer logs the key frame requests it received at its end
+	var logged lockedBuffer
+	log.SetOutput(io.MultiWriter(os.Stderr, &logged))
+	defer log.SetOutput(os.Stderr)
+	if err := wsession.MagicMirror(cfg, input, filepath.Join(dir, "mirrored")); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+
+	if n := s.LayerRetransmissions(); n != len(layers) {
+		t.Errorf("received %d retransmissions of the %d lower layers", n, len(layers))
+	}
+	if n := s.LayerKeyframes(); n != len(layers) {
+		t.Errorf("received %d requested key frames of the %d lower layers", n, len(layers))
+	}
+	requests := regexp.MustCompile(`key frame requests: received (\d+)`).FindAllStringSubmatch(logged.String(), -1)
+	if len(requests) != len(layers) {
+		t.Fatalf("expected the key frame requests of the %d lower layers, got %v", len(layers), requests)
+	}
+	for _, r := range requests {
+		if r[1] != "1" {
+			t.Errorf("a layer received %s key frame requests for 1 sent", r[1])
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer written by several goroutines
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestMagicMirrorReplay(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	capture := filepath.Join(dir, "capture.pcapng")
+	writeTestIVF(t, input)
+
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	// the sent stream has a packet more than the mirrored one, it is replayed
+	c, err := wrtp.NewCapture(capture, wrtp.CaptureAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(srv, "/magicmirror")
+	cfg.Capture = c
+	if err := wsession.MagicMirror(cfg, input, filepath.Join(dir, "mirrored")); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "replayed")
+	if err := wsession.MagicMirror(testConfig(srv, "/magicmirror"), capture, output); err != nil {
+		t.Fatal("magic mirror replay:", err)
+	}
+	if n := countIVFFrames(t, output+".ivf"); n < testFrames/2 {
+		t.Fatalf("received %d mirrored frames of the replayed capture, sent %d", n, testFrames)
+	}
+}
+
+func TestMagicMirrorMediaKeyLog(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	writeTestIVF(t, input)
+
+	srv := httptest.NewServer(NewServer())
+	defer srv.Close()
+
+	var keyLog bytes.Buffer
+	cfg := testConfig(srv, "/magicmirror")
+	cfg.MediaKeyLog = wrtp.NewKeyLog(&keyLog)
+	if err := wsession.MagicMirror(cfg, input, filepath.Join(dir, "mirrored")); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+
+	logged := keyLog.String()
+	for _, re := range []string{
+		`(?m)^CLIENT_RANDOM [0-9a-f]{64} [0-9a-f]{96}$`,
+		`(?m)^# SRTP sent ssrc=\d+ profile=\w+ key=[0-9a-f]{32} salt=[0-9a-f]+ inline=\S+$`,
+		`(?m)^# SRTP received ssrc=\d+ `,
+	} {
+		if !regexp.MustCompile(re).MatchString(logged) {
+			t.Errorf("media key log does not match %s:\n%s", re, logged)
+		}
+	}
+}
@@ -53,17 +53,20 @@ func NewCallRequest(from, to, sdp string) Message {
 	return CallRequest{"call", from, to, sdp}
 }
 
+// rejected calls come with a message instead of an SDP answer
 type CallResponse struct {
 	Id string	`json:"id"`
 	Response string `json:"response"`
-	Sdp string	`json:"sdpAnswer"`
+	Sdp string	`json:"sdpAnswer,omitempty"`
+	Msg string	`json:"message,omitempty"`
 }
 
 func (CallResponse) Message() { return }
 
 func NewCallResponse(m map[string]interface{}) (CallResponse, error) {
-	ret := CallResponse{Id: m["id"].(string), Response: m["response"].(string),
-		Sdp: m["sdpAnswer"].(string)}
+	ret := CallResponse{Id: m["id"].(string), Response: m["response"].(string)}
+	ret.Sdp, _ = m["sdpAnswer"].(string)
+	ret.Msg, _ = m["message"].(string)
 	if m["id"].(string) != "callResponse" {
 		return ret, errors.New("expected message: callResponse")
 	}
@@ -142,6 +145,247 @@ func NewMagicMirrorResponse(m map[string]interface{}) (MagicMirrorResponse, erro
 }
 // --------------
 
+// --- One-to-many example related structures
+type PresenterRequest struct {
+	Id string   `json:"id"`
+	Sdp string  `json:"sdpOffer"`
+}
+
+func (PresenterRequest) Message() { return }
+
+func NewPresenterRequest(sdp string) Message {
+	return PresenterRequest{"presenter", sdp}
+}
+
+type ViewerRequest struct {
+	Id string   `json:"id"`
+	Sdp string  `json:"sdpOffer"`
+}
+
+func (ViewerRequest) Message() { return }
+
+func NewViewerRequest(sdp string) Message {
+	return ViewerRequest{"viewer", sdp}
+}
+
+// presenterResponse and viewerResponse: rejected responses come with a message instead of
+// an SDP answer
+type One2ManyResponse struct {
+	Id string	`json:"id"`
+	Response string `json:"response"`
+	Sdp string	`json:"sdpAnswer"`
+	Msg string	`json:"message"`
+}
+
+func (One2ManyResponse) Message() { return }
+
+func newOne2ManyResponse(id string, m map[string]interface{}) (One2ManyResponse, error) {
+	ret := One2ManyResponse{Id: m["id"].(string)}
+	ret.Response, _ = m["response"].(string)
+	ret.Sdp, _ = m["sdpAnswer"].(string)
+	ret.Msg, _ = m["message"].(string)
+	if m["id"].(string) != id {
+		return ret, errors.New("expected message: " + id)
+	}
+	return ret, nil
+}
+
+func NewPresenterResponse(m map[string]interface{}) (One2ManyResponse, error) {
+	return newOne2ManyResponse("presenterResponse", m)
+}
+
+func NewViewerResponse(m map[string]interface{}) (One2ManyResponse, error) {
+	return newOne2ManyResponse("viewerResponse", m)
+}
+
+type StopRequest struct {
+	Id string   `json:"id"`
+}
+
+func (StopRequest) Message() { return }
+
+func NewStopRequest() Message {
+	return StopRequest{"stop"}
+}
+
+type StopCommunication struct {
+	Id string   `json:"id"`
+}
+
+func (StopCommunication) Message() { return }
+
+func NewStopCommunication(m map[string]interface{}) (StopCommunication, error) {
+	ret := StopCommunication{Id: m["id"].(string)}
+	if m["id"].(string) != "stopCommunication" {
+		return ret, errors.New("expected message: stopCommunication")
+	}
+	return ret, nil
+}
+// --------------
+
+// --- Group call example related structures
+type JoinRoomRequest struct {
+	Id string   `json:"id"`
+	Name string `json:"name"`
+	Room string `json:"room"`
+}
+
+func (JoinRoomRequest) Message() { return }
+
+func NewJoinRoomRequest(name, room string) Message {
+	return JoinRoomRequest{"joinRoom", name, room}
+}
+
+type ExistingParticipants struct {
+	Id string     `json:"id"`
+	Data []string `json:"data"`
+}
+
+func (ExistingParticipants) Message() { return }
+
+func NewExistingParticipants(m map[string]interface{}) (ExistingParticipants, error) {
+	ret := ExistingParticipants{Id: m["id"].(string)}
+	if data, ok := m["data"].([]interface{}); ok {
+		for _, d := range data {
+			if name, ok := d.(string); ok {
+				ret.Data = append(ret.Data, name)
+			}
+		}
+	}
+	if m["id"].(string) != "existingParticipants" {
+		return ret, errors.New("expected message: existingParticipants")
+	}
+	return ret, nil
+}
+
+// newParticipantArrived and participantLeft
+type Participant struct {
+	Id string   `json:"id"`
+	Name string `json:"name"`
+}
+
+func (Participant) Message() { return }
+
+func newParticipant(id string, m map[string]interface{}) (Participant, error) {
+	ret := Participant{Id: m["id"].(string)}
+	ret.Name, _ = m["name"].(string)
+	if m["id"].(string) != id {
+		return ret, errors.New("expected message: " + id)
+	}
+	return ret, nil
+}
+
+func NewNewParticipantArrived(m map[string]interface{}) (Participant, error) {
+	return newParticipant("newParticipantArrived", m)
+}
+
+func NewParticipantLeft(m map[string]interface{}) (Participant, error) {
+	return newParticipant("participantLeft", m)
+}
+
+type ReceiveVideoFromRequest struct {
+	Id string     `json:"id"`
+	Sender string `json:"sender"`
+	Sdp string    `json:"sdpOffer"`
+}
+
+func (ReceiveVideoFromRequest) Message() { return }
+
+func NewReceiveVideoFromRequest(sender, sdp string) Message {
+	return ReceiveVideoFromRequest{"receiveVideoFrom", sender, sdp}
+}
+
+type ReceiveVideoAnswer struct {
+	Id string   `json:"id"`
+	Name string `json:"name"`
+	Sdp string  `json:"sdpAnswer"`
+}
+
+func (ReceiveVideoAnswer) Message() { return }
+
+func NewReceiveVideoAnswer(m map[string]interface{}) (ReceiveVideoAnswer, error) {
+	ret := ReceiveVideoAnswer{Id: m["id"].(string)}
+	ret.Name, _ = m["name"].(string)
+	ret.Sdp, _ = m["sdpAnswer"].(string)
+	if m["id"].(string) != "receiveVideoAnswer" {
+		return ret, errors.New("expected message: receiveVideoAnswer")
+	}
+	return ret, nil
+}
+
+type LeaveRoomRequest struct {
+	Id string   `json:"id"`
+}
+
+func (LeaveRoomRequest) Message() { return }
+
+func NewLeaveRoomRequest() Message {
+	return LeaveRoomRequest{"leaveRoom"}
+}
+// --------------
+
+// --- Recorder example related structures: start/startResponse are the same as for the
+// magic mirror, stop is the same as for the one-to-many example
+func NewStartRequest(sdp string) Message {
+	return NewMagicMirrorRequest(sdp)
+}
+
+func NewStartResponse(m map[string]interface{}) (MagicMirrorResponse, error) {
+	return NewMagicMirrorResponse(m)
+}
+
+type PlayRequest struct {
+	Id string   `json:"id"`
+	Sdp string  `json:"sdpOffer"`
+}
+
+func (PlayRequest) Message() { return }
+
+func NewPlayRequest(sdp string) Message {
+	return PlayRequest{"play", sdp}
+}
+
+type PlayResponse struct {
+	Id string	`json:"id"`
+	Sdp string	`json:"sdpAnswer"`
+}
+
+func (PlayResponse) Message() { return }
+
+func NewPlayResponse(m map[string]interface{}) (PlayResponse, error) {
+	ret := PlayResponse{Id: m["id"].(string)}
+	ret.Sdp, _ = m["sdpAnswer"].(string)
+	if m["id"].(string) != "playResponse" {
+		return ret, errors.New("expected message: playResponse")
+	}
+	return ret, nil
+}
+
+type PlayEnd struct {
+	Id string   `json:"id"`
+}
+
+func (PlayEnd) Message() { return }
+
+func NewPlayEnd(m map[string]interface{}) (PlayEnd, error) {
+	ret := PlayEnd{Id: m["id"].(string)}
+	if m["id"].(string) != "playEnd" {
+		return ret, errors.New("expected message: playEnd")
+	}
+	return ret, nil
+}
+
+type StopPlayRequest struct {
+	Id string   `json:"id"`
+}
+
+func (StopPlayRequest) Message() { return }
+
+func NewStopPlayRequest() Message {
+	return StopPlayRequest{"stopPlay"}
+}
+// --------------
+
 // ICE
 type ICECandidate struct {
 	Id string				`json:"id"`
@@ -161,6 +405,8 @@ func NewICECandidate(m map[string]interface{}) (ICECandidate, error) {
 type OnICECandidate struct {
 	Candidate webrtc.ICECandidateInit  `json:"candidate"`
 	Id string		           `json:"id"`
+	// group call: the participant whose stream the candidate belongs to
+	Name string		           `json:"name,omitempty"`
 }
 
 func (OnICECandidate) Message() { return }
@@ -173,6 +419,14 @@ func NewOnICECandidate(candidate *webrtc.ICECandidate) Message {
 	}
 }
 
+func NewNamedOnICECandidate(candidate *webrtc.ICECandidate, name string) Message {
+	return OnICECandidate{
+		Candidate: candidate.ToJSON(),
+		Id: "onIceCandidate",
+		Name: name,
+	}
+}
+
 ////////////////
 // utils
 func ParseSdp(sdpType webrtc.SDPType, sdp string) (*webrtc.SessionDescription, error) {
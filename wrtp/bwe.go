@@ -0,0 +1,383 @@
+package wrtp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// loss thresholds of the loss-based controller of Google Congestion Control, see
+// draft-ietf-rmcat-gcc-02, section 6, applied to receiver reports until transport-cc feedback
+// arrives
+const (
+	lossIncrease = 0.02
+	lossDecrease = 0.10
+)
+
+/////////////////////////
+// bandwidth estimation
+
+// Estimate is the state of the bandwidth estimator, the bitrates are in bits per second.
+type Estimate struct {
+	// estimated available bandwidth: the GCC estimate capped by REMB
+	Bitrate uint64
+	// last REMB of the receiver, 0 if none
+	REMB uint64
+	// fraction of the packets lost according to the last feedback
+	Loss float64
+	// state of the delay-based controller of GCC, "" before transport-cc feedback
+	Delay string
+}
+
+func (e Estimate) String() string {
+	s := fmt.Sprintf("%d kbps, loss %.1f%%", e.Bitrate/1000, e.Loss*100)
+	if e.Delay != "" {
+		s += ", delay " + e.Delay
+	}
+	if e.REMB > 0 {
+		s += fmt.Sprintf(", REMB %d kbps", e.REMB/1000)
+	}
+	return s
+}
+
+// Estimator is an interceptor factory that estimates the available send bandwidth of a
+// PeerConnection with pion's Google Congestion Control: the delay-based and the loss-based
+// controllers of gcc follow the transport-cc feedback of the receiver, and the REMB of the
+// receiver caps the estimate. Until transport-cc feedback arrives, the loss in RTCP receiver
+// reports moves the estimate like the loss-based controller. Every sender reads the feedback
+// of the PeerConnection, so each feedback packet is taken into account once.
+type Estimator struct {
+	initial, min, max uint64
+
+	lock      sync.Mutex
+	gcc       *gcc.SendSideBWE
+	closeOnce sync.Once
+	// estimate from receiver reports, and from gcc once transport-cc feedback has been received
+	target   uint64
+	estimate Estimate
+	twcc     bool
+	// the last feedback packets, read by several senders
+	seen packetHistory
+
+	// for the summary
+	started, updated time.Time
+	// bitrate integrated over time, in bits
+	bits            float64
+	lowest, highest uint64
+	updates         int
+}
+
+// NewEstimator returns an Estimator that starts at initial, the estimate stays between min and
+// max.
+func NewEstimator(initial, min, max uint64) *Estimator {
+	now := time.Now()
+	return &Estimator{
+		initial:  initial,
+		min:      min,
+		max:      max,
+		target:   initial,
+		estimate: Estimate{Bitrate: initial},
+		started:  now,
+		updated:  now,
+		lowest:   initial,
+		highest:  initial,
+	}
+}
+
+// Estimate returns the current estimate.
+func (e *Estimator) Estimate() Estimate {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.estimate
+}
+
+// Bitrate returns the estimated available bandwidth in bits per second.
+func (e *Estimator) Bitrate() uint64 {
+	return e.Estimate().Bitrate
+}
+
+// Summary returns the lowest, mean and highest estimate so far.
+func (e *Estimator) Summary() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := time.Now()
+	mean := uint64(e.estimate.Bitrate)
+	if d := now.Sub(e.started).Seconds(); d > 0 {
+		mean = uint64((e.bits + float64(e.estimate.Bitrate)*now.Sub(e.updated).Seconds()) / d)
+	}
+	return fmt.Sprintf("lowest %d kbps, mean %d kbps, highest %d kbps, %d updates",
+		e.lowest/1000, mean/1000, e.highest/1000, e.updates)
+}
+
+// sendSideBWE returns the gcc estimator, created with the first interceptor
+func (e *Estimator) sendSideBWE() (*gcc.SendSideBWE, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.gcc != nil {
+		return e.gcc, nil
+	}
+
+	bwe, err := gcc.NewSendSideBWE(
+		gcc.SendSideBWEInitialBitrate(int(e.initial)),
+		gcc.SendSideBWEMinBitrate(int(e.min)),
+		gcc.SendSideBWEMaxBitrate(int(e.max)),
+		// the frames are paced by the senders, and the streams may carry other SSRCs
+		gcc.SendSideBWEPacer(newStreamPacer()))
+	if err != nil {
+		return nil, err
+	}
+	bwe.OnTargetBitrateChange(func(bitrate int) {
+		e.lock.Lock()
+		defer e.lock.Unlock()
+		if e.twcc {
+			e.target = uint64(bitrate)
+			e.update()
+		}
+	})
+	e.gcc = bwe
+	return bwe, nil
+}
+
+func (e *Estimator) close() error {
+	e.lock.Lock()
+	bwe := e.gcc
+	e.lock.Unlock()
+	var err error
+	if bwe != nil {
+		e.closeOnce.Do(func() { err = bwe.Close() })
+	}
+	return err
+}
+
+// fresh tells whether a feedback packet has not just been read by another sender and remembers
+// it, e.lock is held
+func (e *Estimator) fresh(p rtcp.Packet) bool {
+	b, err := p.Marshal()
+	if err != nil {
+		return true
+	}
+	return e.seen.fresh(b, time.Now())
+}
+
+// feedback updates the estimate from the RTCP packets read by a sender
+func (e *Estimator) feedback(bwe *gcc.SendSideBWE, pkts []rtcp.Packet) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for _, p := range pkts {
+		switch p := p.(type) {
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			if e.fresh(p) {
+				e.estimate.REMB = uint64(p.Bitrate)
+				e.update()
+			}
+		case *rtcp.TransportLayerCC:
+			if !e.fresh(p) {
+				continue
+			}
+			// gcc does not call back into the estimator while writing
+			if err := bwe.WriteRTCP([]rtcp.Packet{p}, nil); err != nil {
+				continue
+			}
+			e.twcc = true
+			if lost, count := twccLoss(p); count > 0 {
+				e.estimate.Loss = float64(lost) / float64(count)
+			}
+			// the controllers of gcc update asynchronously, the delay state is of an
+			// earlier feedback
+			e.target = uint64(bwe.GetTargetBitrate())
+			if stats := bwe.GetStats(); stats["delayTargetBitrate"] != 0 {
+				e.estimate.Delay, _ = stats["usage"].(string)
+			}
+			e.update()
+		case *rtcp.ReceiverReport:
+			if e.fresh(p) {
+				e.onReports(p.Reports)
+			}
+		case *rtcp.SenderReport:
+			if e.fresh(p) {
+				e.onReports(p.Reports)
+			}
+		}
+	}
+}
+
+// onReports moves the estimate following the highest loss of the report blocks of a receiver
+// report, unless gcc estimates from transport-cc feedback, e.lock is held
+func (e *Estimator) onReports(reports []rtcp.ReceptionReport) {
+	if e.twcc || len(reports) == 0 {
+		return
+	}
+	loss := 0.0
+	for _, r := range reports {
+		if l := float64(r.FractionLost) / 256; l > loss {
+			loss = l
+		}
+	}
+
+	switch {
+	case loss > lossDecrease:
+		e.target = uint64(float64(e.target) * (1 - 0.5*loss))
+	case loss < lossIncrease:
+		e.target = uint64(float64(e.target) * 1.05)
+	}
+	e.estimate.Loss = loss
+	e.update()
+}
+
+// update sets the estimate from the target and REMB, e.lock is held
+func (e *Estimator) update() {
+	now := time.Now()
+	e.bits += float64(e.estimate.Bitrate) * now.Sub(e.updated).Seconds()
+	e.updated = now
+
+	if e.target < e.min {
+		e.target = e.min
+	}
+	if e.target > e.max {
+		e.target = e.max
+	}
+	bitrate := e.target
+	if e.estimate.REMB > 0 && e.estimate.REMB < bitrate {
+		bitrate = e.estimate.REMB
+	}
+
+	e.estimate.Bitrate = bitrate
+	if bitrate < e.lowest {
+		e.lowest = bitrate
+	}
+	if bitrate > e.highest {
+		e.highest = bitrate
+	}
+	e.updates++
+}
+
+// twccLoss returns the number of packets reported lost and reported in transport-cc feedback
+func twccLoss(p *rtcp.TransportLayerCC) (int, int) {
+	lost, count := 0, 0
+	status := func(symbol uint16) {
+		if count >= int(p.PacketStatusCount) {
+			// padding of the last status vector
+			return
+		}
+		if symbol == rtcp.TypeTCCPacketNotReceived {
+			lost++
+		}
+		count++
+	}
+
+	for _, chunk := range p.PacketChunks {
+		switch c := chunk.(type) {
+		case *rtcp.RunLengthChunk:
+			for i := 0; i < int(c.RunLength); i++ {
+				status(c.PacketStatusSymbol)
+			}
+		case *rtcp.StatusVectorChunk:
+			for _, symbol := range c.SymbolList {
+				status(symbol)
+			}
+		}
+	}
+	return lost, count
+}
+
+// NewInterceptor implements interceptor.Factory.
+func (e *Estimator) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	bwe, err := e.sendSideBWE()
+	if err != nil {
+		return nil, err
+	}
+	return &estimatorInterceptor{estimator: e, gcc: bwe}, nil
+}
+
+type estimatorInterceptor struct {
+	interceptor.NoOp
+	estimator *Estimator
+	gcc       *gcc.SendSideBWE
+}
+
+// BindRTCPReader feeds the RTCP read by the sender to the estimator.
+func (i *estimatorInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		pkts, err := rtcp.Unmarshal(b[:n])
+		if err != nil {
+			return 0, nil, err
+		}
+		i.estimator.feedback(i.gcc, pkts)
+
+		return n, attr, nil
+	})
+}
+
+// BindLocalStream records the departure of the packets for gcc, the packets are tagged with the
+// SSRC of the stream so that the pacer finds the writer of the stream.
+func (i *estimatorInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	pacer := i.gcc.AddStream(info, writer)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		if a == nil {
+			a = interceptor.Attributes{}
+		}
+		a.Set(streamKey, info.SSRC)
+		return pacer.Write(header, payload, a)
+	})
+}
+
+// Close closes gcc.
+func (i *estimatorInterceptor) Close() error {
+	return i.estimator.close()
+}
+
+/////////////////////////
+// pacer
+
+// key of the stream SSRC in the attributes of the packets
+type streamKeyType int
+
+const streamKey streamKeyType = 0
+
+// streamPacer is a gcc pacer that writes the packets at once into the writer of their stream:
+// gcc's pacers look the writer up by the SSRC of the packet, which is not the SSRC of the stream
+// for simulcast layers
+type streamPacer struct {
+	lock    sync.Mutex
+	writers map[uint32]interceptor.RTPWriter
+}
+
+func newStreamPacer() *streamPacer {
+	return &streamPacer{writers: map[uint32]interceptor.RTPWriter{}}
+}
+
+func (p *streamPacer) AddStream(ssrc uint32, writer interceptor.RTPWriter) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.writers[ssrc] = writer
+}
+
+func (p *streamPacer) Write(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+	ssrc, ok := a.Get(streamKey).(uint32)
+	if !ok {
+		ssrc = header.SSRC
+	}
+	p.lock.Lock()
+	w, ok := p.writers[ssrc]
+	p.lock.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("estimator: unknown stream %d", ssrc)
+	}
+	return w.Write(header, payload, a)
+}
+
+func (p *streamPacer) SetTargetBitrate(int) {}
+
+func (p *streamPacer) Close() error {
+	return nil
+}
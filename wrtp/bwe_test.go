@@ -0,0 +1,156 @@
+package wrtp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+)
+
+// readRTCP passes pkts through the RTCP reader of the estimator
+func readRTCP(t *testing.T, e *Estimator, pkts ...rtcp.Packet) {
+	t.Helper()
+	i, err := e.NewInterceptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := rtcp.Marshal(pkts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := i.BindRTCPReader(interceptor.RTCPReaderFunc(
+		func(buf []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+			return copy(buf, b), a, nil
+		}))
+	if _, _, err := reader.Read(make([]byte, 1500), nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receiverReport returns a report of the stream 1234 and of an other stream, seq tells reports
+// apart
+func receiverReport(fractionLost uint8, seq uint32) *rtcp.ReceiverReport {
+	return &rtcp.ReceiverReport{SSRC: 1, Reports: []rtcp.ReceptionReport{
+		{SSRC: 1234, FractionLost: fractionLost, LastSequenceNumber: seq},
+		{SSRC: 5678, LastSequenceNumber: seq},
+	}}
+}
+
+func TestEstimator(t *testing.T) {
+	e := NewEstimator(1000000, 100000, 2000000)
+
+	// no loss: +5%, once for the report blocks and the senders that read the same report
+	readRTCP(t, e, receiverReport(0, 1))
+	readRTCP(t, e, receiverReport(0, 1))
+	if got := e.Bitrate(); got != 1050000 {
+		t.Errorf("no loss: expected 1050000 bps, got %d", got)
+	}
+
+	// 25% loss: -12.5%
+	readRTCP(t, e, receiverReport(64, 2))
+	if got := e.Bitrate(); got != 918750 {
+		t.Errorf("25%% loss: expected 918750 bps, got %d", got)
+	}
+
+	// 5% loss: unchanged
+	readRTCP(t, e, receiverReport(13, 3))
+	if got := e.Bitrate(); got != 918750 {
+		t.Errorf("5%% loss: expected 918750 bps, got %d", got)
+	}
+
+	// REMB caps the estimate
+	readRTCP(t, e, &rtcp.ReceiverEstimatedMaximumBitrate{SenderSSRC: 1, Bitrate: 500000, SSRCs: []uint32{1234}})
+	if got := e.Estimate(); got.Bitrate != 500000 || got.REMB != 500000 {
+		t.Errorf("REMB: expected 500000 bps, got %v", got)
+	}
+	readRTCP(t, e, &rtcp.ReceiverEstimatedMaximumBitrate{SenderSSRC: 1, Bitrate: 5000000, SSRCs: []uint32{1234}})
+	if got := e.Bitrate(); got != 918750 {
+		t.Errorf("high REMB: expected 918750 bps, got %d", got)
+	}
+
+	// the same REMB again later is not a duplicate
+	readRTCP(t, e, &rtcp.ReceiverEstimatedMaximumBitrate{SenderSSRC: 1, Bitrate: 400000, SSRCs: []uint32{1234}})
+	time.Sleep(duplicateWindow)
+	readRTCP(t, e, &rtcp.ReceiverEstimatedMaximumBitrate{SenderSSRC: 1, Bitrate: 5000000, SSRCs: []uint32{1234}})
+	if got := e.Estimate(); got.Bitrate != 918750 || got.REMB != 5000000 {
+		t.Errorf("REMB back to 5000000 bps: expected 918750 bps, got %v", got)
+	}
+
+	// the estimate stays between min and max
+	for n := 0; n < 50; n++ {
+		readRTCP(t, e, receiverReport(0, uint32(100+n)))
+	}
+	if got := e.Bitrate(); got != 2000000 {
+		t.Errorf("expected the max 2000000 bps, got %d", got)
+	}
+	for n := 0; n < 50; n++ {
+		readRTCP(t, e, receiverReport(255, uint32(200+n)))
+	}
+	if got := e.Bitrate(); got != 100000 {
+		t.Errorf("expected the min 100000 bps, got %d", got)
+	}
+}
+
+// TestEstimatorTWCC sends packets of a stream and of a simulcast layer written into it, and
+// feeds back transport-cc with loss to gcc
+func TestEstimatorTWCC(t *testing.T) {
+	e := NewEstimator(1000000, 100000, 2000000)
+	i, err := e.NewInterceptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+
+	out := &capture{}
+	info := &interceptor.StreamInfo{SSRC: 1234, PayloadType: 96,
+		RTPHeaderExtensions: []interceptor.RTPHeaderExtension{{URI: sdp.TransportCCURI, ID: 5}}}
+	writer := i.BindLocalStream(info, out)
+	for n := 0; n < 20; n++ {
+		header := &rtp.Header{Version: 2, PayloadType: 96, SSRC: 1234, SequenceNumber: uint16(n)}
+		if n%2 == 1 {
+			header.SSRC = 5678
+		}
+		ext, err := (&rtp.TransportCCExtension{TransportSequence: uint16(n)}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := header.SetExtension(5, ext); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(header, make([]byte, 1000), nil); err != nil {
+			t.Fatal("packet", n, err)
+		}
+	}
+	if packets := out.wait(t, 20); packets[1].SSRC != 5678 {
+		t.Errorf("unexpected packet %v", packets[1])
+	}
+
+	// the first 10 received 1ms apart, the others lost
+	deltas := make([]*rtcp.RecvDelta, 10)
+	for n := range deltas {
+		deltas[n] = &rtcp.RecvDelta{Type: rtcp.TypeTCCPacketReceivedSmallDelta, Delta: 1000}
+	}
+	feedback := &rtcp.TransportLayerCC{SenderSSRC: 1, MediaSSRC: 1234, PacketStatusCount: 20,
+		PacketChunks: []rtcp.PacketStatusChunk{
+			&rtcp.RunLengthChunk{PacketStatusSymbol: rtcp.TypeTCCPacketReceivedSmallDelta, RunLength: 10},
+			&rtcp.RunLengthChunk{PacketStatusSymbol: rtcp.TypeTCCPacketNotReceived, RunLength: 10},
+		},
+		RecvDeltas: deltas,
+	}
+	feedback.Header = rtcp.Header{Count: rtcp.FormatTCC, Type: rtcp.TypeTransportSpecificFeedback,
+		Length: feedback.Len()/4 - 1}
+	readRTCP(t, e, feedback)
+	got := e.Estimate()
+	if got.Loss != 0.5 {
+		t.Errorf("expected 50%% loss, got %v", got)
+	}
+
+	// receiver reports are ignored once transport-cc feedback arrives
+	readRTCP(t, e, receiverReport(0, 1))
+	if e.Bitrate() != got.Bitrate {
+		t.Errorf("receiver report after transport-cc: expected %d bps, got %v", got.Bitrate, e.Estimate())
+	}
+}
@@ -0,0 +1,419 @@
+package wrtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// pcapng block types and options, see draft-ietf-opsawg-pcapng
+const (
+	pcapngSectionHeader         = 0x0a0d0d0a
+	pcapngInterfaceDesc         = 0x00000001
+	pcapngEnhancedPacket        = 0x00000006
+	pcapngByteOrderMagic        = 0x1a2b3c4d
+	pcapngLinkTypeRaw           = 101 // raw IPv4 or IPv6
+	pcapngOptionFlags           = 2
+	pcapngFlagInbound    uint32 = 1
+	pcapngFlagOutbound   uint32 = 2
+)
+
+// the synthetic addresses of the packets of PeerConnections: the ports tell the connections apart
+var (
+	captureLocalIP  = net.IPv4(127, 0, 0, 1)
+	captureRemoteIP = net.IPv4(127, 0, 0, 2)
+)
+
+const (
+	captureLocalPort  = 10000
+	captureRemotePort = 20000
+)
+
+/////////////////////////
+// capture files
+
+// CaptureFormat is the file format sent and received packets are captured in.
+type CaptureFormat string
+
+const (
+	// the format follows the extension of the capture file: .rtpdump or .rtp, pcapng otherwise
+	CaptureAuto CaptureFormat = "auto"
+	// pcapng with synthetic IP and UDP headers, the direction is in the packet flags
+	CapturePcapng CaptureFormat = "pcapng"
+	// rtpdump of rtptools, without addresses and directions
+	CaptureRTPDump CaptureFormat = "rtpdump"
+)
+
+// ParseCaptureFormat parses auto, pcapng or rtpdump.
+func ParseCaptureFormat(s string) (CaptureFormat, error) {
+	switch f := CaptureFormat(strings.ToLower(s)); f {
+	case CaptureAuto, CapturePcapng, CaptureRTPDump:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid capture format %q: must be one of auto, pcapng or rtpdump", s)
+}
+
+// ResolveCaptureFormat returns the format file is written in: format itself, or if it is auto
+// or empty, the format of the extension of file.
+func ResolveCaptureFormat(file string, format CaptureFormat) CaptureFormat {
+	if format != CaptureAuto && format != "" {
+		return format
+	}
+	switch strings.ToLower(path.Ext(file)) {
+	case ".rtpdump", ".rtp":
+		return CaptureRTPDump
+	}
+	return CapturePcapng
+}
+
+// Capture writes RTP and RTCP packets into a pcapng or rtpdump file as they are sent and
+// received, after SRTP decryption. It is an interceptor factory for PeerConnections, and
+// wraps the UDP connections of plain RTP with Conn. Packet, Conn and Close can be called on a
+// nil Capture, they capture nothing then.
+type Capture struct {
+	format CaptureFormat
+
+	lock  sync.Mutex
+	file  *os.File
+	start time.Time
+	// the next PeerConnection gets ports this much above the base ports
+	next int
+	// writing stops at the first error
+	err error
+}
+
+// NewCapture creates file and writes the header of format into it.
+func NewCapture(file string, format CaptureFormat) (*Capture, error) {
+	format = ResolveCaptureFormat(file, format)
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{format: format, file: f, start: time.Now()}
+
+	var header []byte
+	if format == CaptureRTPDump {
+		header = rtpdumpHeader(c.start, &net.UDPAddr{IP: captureRemoteIP, Port: captureRemotePort})
+	} else {
+		header = append(pcapngSection(), pcapngInterface()...)
+	}
+	// unbuffered, the file is complete even if the process exits without closing it
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Packet captures an RTP or RTCP packet sent from local to remote, or received by local from
+// remote.
+func (c *Capture) Packet(sent bool, local, remote *net.UDPAddr, packet []byte) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+
+	var record []byte
+	if c.format == CaptureRTPDump {
+		record = rtpdumpPacket(now.Sub(c.start), packet)
+	} else {
+		src, dst, flags := remote, local, pcapngFlagInbound
+		if sent {
+			src, dst, flags = local, remote, pcapngFlagOutbound
+		}
+		record = pcapngPacket(now, udpPacket(src, dst, packet), flags)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	if _, c.err = c.file.Write(record); c.err != nil {
+		log.Println("capture stopped:", c.err)
+	}
+}
+
+// Close closes the capture file.
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil {
+		c.err = os.ErrClosed
+	}
+	return c.file.Close()
+}
+
+// Conn returns conn with the packets read and written captured, conn itself on a nil Capture.
+func (c *Capture) Conn(conn *net.UDPConn) net.Conn {
+	if c == nil {
+		return conn
+	}
+	local, _ := conn.LocalAddr().(*net.UDPAddr)
+	remote, _ := conn.RemoteAddr().(*net.UDPAddr)
+	return &captureConn{UDPConn: conn, capture: c, local: local, remote: remote}
+}
+
+// captureConn is a connected UDP socket of plain RTP whose packets are captured
+type captureConn struct {
+	*net.UDPConn
+	capture       *Capture
+	local, remote *net.UDPAddr
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if err == nil {
+		c.capture.Packet(false, c.local, c.remote, b[:n])
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.UDPConn.Write(b)
+	if err == nil {
+		c.capture.Packet(true, c.local, c.remote, b)
+	}
+	return n, err
+}
+
+/////////////////////////
+// interceptor
+
+// NewInterceptor implements interceptor.Factory, the packets of each PeerConnection get their
+// own synthetic ports.
+func (c *Capture) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	c.lock.Lock()
+	n := c.next
+	c.next++
+	c.lock.Unlock()
+	return &captureInterceptor{
+		capture: c,
+		local:   &net.UDPAddr{IP: captureLocalIP, Port: captureLocalPort + n%10000},
+		remote:  &net.UDPAddr{IP: captureRemoteIP, Port: captureRemotePort + n%10000},
+	}, nil
+}
+
+type captureInterceptor struct {
+	interceptor.NoOp
+	capture       *Capture
+	local, remote *net.UDPAddr
+	// the RTCP packets read, by the senders and the receivers of their SSRCs
+	read Duplicates
+}
+
+// BindRTCPReader captures the RTCP packets read, once: each sender and receiver whose SSRC is in a
+// compound packet reads it. The receivers of wcodec read their RTCP, so that receive-only
+// sessions capture it too.
+func (i *captureInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err == nil && i.read.Fresh(b[:n]) {
+			i.capture.Packet(false, i.local, i.remote, b[:n])
+		}
+		return n, attr, err
+	})
+}
+
+// BindRTCPWriter captures the RTCP packets written.
+func (i *captureInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, a interceptor.Attributes) (int, error) {
+		n, err := writer.Write(pkts, a)
+		if err == nil {
+			if b, err := rtcp.Marshal(pkts); err == nil {
+				i.capture.Packet(true, i.local, i.remote, b)
+			}
+		}
+		return n, err
+	})
+}
+
+// BindLocalStream captures the RTP packets written, retransmissions included.
+func (i *captureInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		n, err := writer.Write(header, payload, a)
+		if err == nil {
+			if b, err := header.Marshal(); err == nil {
+				i.capture.Packet(true, i.local, i.remote, append(b, payload...))
+			}
+		}
+		return n, err
+	})
+}
+
+// BindRemoteStream captures the RTP packets read.
+func (i *captureInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err == nil {
+			i.capture.Packet(false, i.local, i.remote, b[:n])
+		}
+		return n, attr, err
+	})
+}
+
+/////////////////////////
+// pcapng
+
+func pcapngSection() []byte {
+	b := make([]byte, 28)
+	binary.LittleEndian.PutUint32(b[0:], pcapngSectionHeader)
+	binary.LittleEndian.PutUint32(b[4:], 28)
+	binary.LittleEndian.PutUint32(b[8:], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(b[12:], 1) // version 1.0
+	// section length unknown
+	binary.LittleEndian.PutUint64(b[16:], 0xffffffffffffffff)
+	binary.LittleEndian.PutUint32(b[24:], 28)
+	return b
+}
+
+// pcapngInterface returns the description of the only interface, with timestamps in
+// microseconds
+func pcapngInterface() []byte {
+	b := make([]byte, 20)
+	binary.LittleEndian.PutUint32(b[0:], pcapngInterfaceDesc)
+	binary.LittleEndian.PutUint32(b[4:], 20)
+	binary.LittleEndian.PutUint16(b[8:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(b[16:], 20)
+	return b
+}
+
+// pcapngPacket returns an enhanced packet block of an IP packet with the direction flags
+func pcapngPacket(t time.Time, packet []byte, flags uint32) []byte {
+	padded := (len(packet) + 3) &^ 3
+	size := 28 + padded + 12 + 4
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint32(b[0:], pcapngEnhancedPacket)
+	binary.LittleEndian.PutUint32(b[4:], uint32(size))
+	us := uint64(t.UnixNano() / int64(time.Microsecond))
+	binary.LittleEndian.PutUint32(b[12:], uint32(us>>32))
+	binary.LittleEndian.PutUint32(b[16:], uint32(us))
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(b[24:], uint32(len(packet)))
+	copy(b[28:], packet)
+	options := b[28+padded:]
+	binary.LittleEndian.PutUint16(options[0:], pcapngOptionFlags)
+	binary.LittleEndian.PutUint16(options[2:], 4)
+	binary.LittleEndian.PutUint32(options[4:], flags)
+	// the end of options is all zeros
+	binary.LittleEndian.PutUint32(b[size-4:], uint32(size))
+	return b
+}
+
+// udpPacket returns payload in an IPv4 or IPv6 and a UDP header
+func udpPacket(src, dst *net.UDPAddr, payload []byte) []byte {
+	udp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], payload)
+
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[6] = 0x40 // don't fragment
+		ip[8], ip[9] = 64, 17
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], internetChecksum(0, ip))
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(src4, dst4, udp))
+		return append(ip, udp...)
+	}
+
+	src16, dst16 := src.IP.To16(), dst.IP.To16()
+	if src16 == nil {
+		src16 = net.IPv6loopback
+	}
+	if dst16 == nil {
+		dst16 = net.IPv6loopback
+	}
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6], ip[7] = 17, 64
+	copy(ip[8:], src16)
+	copy(ip[24:], dst16)
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(src16, dst16, udp))
+	return append(ip, udp...)
+}
+
+// udpChecksum returns the checksum of a UDP packet with its pseudo header, RFC 768
+func udpChecksum(src, dst net.IP, udp []byte) uint16 {
+	pseudo := append(append([]byte{}, src...), dst...)
+	pseudo = append(pseudo, 0, 17, byte(len(udp)>>8), byte(len(udp)))
+	sum := internetChecksum(internetSum(0, pseudo), udp)
+	if sum == 0 {
+		// zero means no checksum
+		sum = 0xffff
+	}
+	return sum
+}
+
+// internetChecksum returns the ones' complement of the ones' complement sum of b added to sum,
+// RFC 1071
+func internetChecksum(sum uint32, b []byte) uint16 {
+	sum = internetSum(sum, b)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func internetSum(sum uint32, b []byte) uint32 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+/////////////////////////
+// rtpdump
+
+// rtpdumpHeader returns the file header of rtptools: the text line, then the start time and the
+// source address
+func rtpdumpHeader(start time.Time, source *net.UDPAddr) []byte {
+	b := []byte(fmt.Sprintf("#!rtpplay1.0 %s/%d\n", source.IP, source.Port))
+	h := make([]byte, 16)
+	binary.BigEndian.PutUint32(h[0:], uint32(start.Unix()))
+	binary.BigEndian.PutUint32(h[4:], uint32(start.Nanosecond()/1000))
+	if ip := source.IP.To4(); ip != nil {
+		copy(h[8:], ip)
+	}
+	binary.BigEndian.PutUint16(h[12:], uint16(source.Port))
+	return append(b, h...)
+}
+
+// rtpdumpPacket returns the record of a packet received at offset from the start, the RTP
+// length of RTCP packets is 0
+func rtpdumpPacket(offset time.Duration, packet []byte) []byte {
+	b := make([]byte, 8, 8+len(packet))
+	binary.BigEndian.PutUint16(b[0:], uint16(8+len(packet)))
+	if !isRTCP(packet) {
+		binary.BigEndian.PutUint16(b[2:], uint16(len(packet)))
+	}
+	binary.BigEndian.PutUint32(b[4:], uint32(offset/time.Millisecond))
+	return append(b, packet...)
+}
+
+// isRTCP tells RTCP packets from RTP ones on a multiplexed port, RFC 5761, section 4
+func isRTCP(packet []byte) bool {
+	return len(packet) >= 2 && packet[1] >= 192 && packet[1] <= 223
+}
@@ -0,0 +1,149 @@
+package wrtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// capturePackets captures an RTP packet sent and an RTCP packet received through the
+// interceptor and returns the file, the RTCP packet is read by two readers but captured once
+func capturePackets(t *testing.T, format CaptureFormat) ([]byte, []byte, []byte) {
+	file := filepath.Join(t.TempDir(), "capture")
+	c, err := NewCapture(file, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := c.NewInterceptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: 7,
+		Timestamp: 3000, SSRC: 1234, Marker: true}, Payload: []byte{1, 2, 3}}
+	writer := i.BindLocalStream(&interceptor.StreamInfo{SSRC: 1234}, &capture{})
+	if _, err := writer.Write(&sent.Header, sent.Payload, nil); err != nil {
+		t.Fatal(err)
+	}
+	rtpBytes, err := sent.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rtcpBytes, err := rtcp.Marshal([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: 1234}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		reader := i.BindRTCPReader(interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+			return copy(b, rtcpBytes), a, nil
+		}))
+		if _, _, err := reader.Read(make([]byte, 1500), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, rtpBytes, rtcpBytes
+}
+
+func TestCapturePcapng(t *testing.T) {
+	b, rtpBytes, rtcpBytes := capturePackets(t, CapturePcapng)
+
+	var packets [][]byte
+	var flags []uint32
+	for len(b) > 0 {
+		typ, size := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if size%4 != 0 || int(size) > len(b) || binary.LittleEndian.Uint32(b[size-4:]) != size {
+			t.Fatalf("invalid block size %d", size)
+		}
+		if typ == pcapngEnhancedPacket {
+			n := binary.LittleEndian.Uint32(b[20:])
+			packets = append(packets, b[28:28+n])
+			flags = append(flags, binary.LittleEndian.Uint32(b[28+(n+3)&^3+4:]))
+		}
+		b = b[size:]
+	}
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(packets))
+	}
+
+	for n, expected := range []struct {
+		src, dst string
+		flags    uint32
+		payload  []byte
+	}{
+		{"127.0.0.1:10000", "127.0.0.2:20000", pcapngFlagOutbound, rtpBytes},
+		{"127.0.0.2:20000", "127.0.0.1:10000", pcapngFlagInbound, rtcpBytes},
+	} {
+		p := packets[n]
+		if p[0] != 0x45 || p[9] != 17 || internetChecksum(0, p[:20]) != 0 {
+			t.Fatalf("packet %d: invalid IPv4 header % x", n, p[:20])
+		}
+		src := &net.UDPAddr{IP: net.IP(p[12:16]), Port: int(binary.BigEndian.Uint16(p[20:]))}
+		dst := &net.UDPAddr{IP: net.IP(p[16:20]), Port: int(binary.BigEndian.Uint16(p[22:]))}
+		if src.String() != expected.src || dst.String() != expected.dst {
+			t.Errorf("packet %d: expected %s -> %s, got %s -> %s", n, expected.src, expected.dst, src, dst)
+		}
+		if !bytes.Equal(p[28:], expected.payload) {
+			t.Errorf("packet %d: expected payload % x, got % x", n, expected.payload, p[28:])
+		}
+		if flags[n] != expected.flags {
+			t.Errorf("packet %d: expected flags %d, got %d", n, expected.flags, flags[n])
+		}
+	}
+}
+
+func TestCaptureRTPDump(t *testing.T) {
+	b, rtpBytes, rtcpBytes := capturePackets(t, CaptureRTPDump)
+
+	line := []byte("#!rtpplay1.0 127.0.0.2/20000\n")
+	if !bytes.HasPrefix(b, line) {
+		t.Fatalf("invalid header %q", b[:len(line)])
+	}
+	b = b[len(line)+16:]
+
+	for n, expected := range []struct {
+		plen    int
+		payload []byte
+	}{{len(rtpBytes), rtpBytes}, {0, rtcpBytes}} {
+		size, plen := int(binary.BigEndian.Uint16(b)), int(binary.BigEndian.Uint16(b[2:]))
+		if size != 8+len(expected.payload) || plen != expected.plen {
+			t.Errorf("packet %d: expected lengths %d and %d, got %d and %d", n,
+				8+len(expected.payload), expected.plen, size, plen)
+		}
+		if !bytes.Equal(b[8:size], expected.payload) {
+			t.Errorf("packet %d: expected payload % x, got % x", n, expected.payload, b[8:size])
+		}
+		b = b[size:]
+	}
+	if len(b) != 0 {
+		t.Errorf("%d bytes after the packets", len(b))
+	}
+}
+
+func TestUDPChecksum(t *testing.T) {
+	src := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 1}
+	dst := &net.UDPAddr{IP: net.ParseIP("::2"), Port: 2}
+	p := udpPacket(src, dst, []byte{0x80, 0x60, 0, 1})
+	if p[0] != 0x60 || len(p) != 40+8+4 {
+		t.Fatalf("invalid IPv6 packet % x", p)
+	}
+	pseudo := append(append([]byte{}, p[8:40]...), 0, 17, 0, 12)
+	if internetChecksum(internetSum(0, pseudo), p[40:]) != 0 {
+		t.Errorf("invalid UDP checksum % x", p[46:48])
+	}
+}
@@ -0,0 +1,355 @@
+package wrtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// the exporter label of the SRTP keys, RFC 5764, section 4.2
+const srtpExporterLabel = "EXTRACTOR-dtls_srtp"
+
+/////////////////////////
+// media key log
+
+// KeyLog writes the key material of the DTLS-SRTP connections of PeerConnections, so that media
+// captured on the wire can be decrypted: the DTLS master secrets in NSS key log format, like
+// the TLS secrets of the signaling connection, and the SRTP master keys and salts derived from
+// them for each SSRC sent and received, as comments.
+type KeyLog struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewKeyLog returns a KeyLog that writes into w.
+func NewKeyLog(w io.Writer) *KeyLog {
+	return &KeyLog{w: w}
+}
+
+func (l *KeyLog) printf(format string, a ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := fmt.Fprintf(l.w, format, a...); err != nil {
+		log.Println("media key log:", err)
+	}
+}
+
+// NewSession returns the key log of a PeerConnection: it must be added to the interceptors of
+// the PeerConnection, and Watch its DTLS transport.
+func (l *KeyLog) NewSession() *KeySession {
+	return &KeySession{log: l, ssrcs: map[keyedSSRC]bool{}}
+}
+
+// KeySession is an interceptor factory that logs the SRTP keys of the SSRCs sent and received
+// by a PeerConnection, once its DTLS transport is connected.
+type KeySession struct {
+	log *KeyLog
+
+	lock sync.Mutex
+	// nil until DTLS is connected
+	keys *srtpKeys
+	// the SSRCs seen, the ones seen before the keys are logged with them
+	ssrcs   map[keyedSSRC]bool
+	pending []keyedSSRC
+}
+
+type keyedSSRC struct {
+	ssrc uint32
+	sent bool
+}
+
+// srtpKeys are the SRTP master keys and salts of a DTLS connection, for SRTP and SRTCP alike
+type srtpKeys struct {
+	profile       string
+	keyLen        int
+	local, remote []byte // key and salt
+}
+
+// Watch logs the DTLS master secret and the SRTP keys of t when it is connected.
+func (s *KeySession) Watch(t *webrtc.DTLSTransport) {
+	t.OnStateChange(func(state webrtc.DTLSTransportState) {
+		if state != webrtc.DTLSTransportStateConnected {
+			return
+		}
+		// called with the transport locked, so its DTLS connection is set
+		conn := dtlsConn(t)
+		if conn == nil {
+			log.Println("media key log: no DTLS connection")
+			return
+		}
+		if err := s.connected(conn); err != nil {
+			log.Println("media key log:", err)
+		}
+	})
+}
+
+// dtlsConn returns the DTLS connection of a transport, pion/webrtc v3.1 does not export it nor
+// takes a dtls.Config.KeyLogWriter: TestKeySessionPeerConnection fails if an update of pion
+// breaks this or dtlsSecrets
+func dtlsConn(t *webrtc.DTLSTransport) *dtls.Conn {
+	f := reflect.ValueOf(t).Elem().FieldByName("conn")
+	if !f.IsValid() || f.Type() != reflect.TypeOf((*dtls.Conn)(nil)) {
+		return nil
+	}
+	return reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().Interface().(*dtls.Conn)
+}
+
+// dtlsSecrets are the fields of the serialized dtls.State that the key log needs
+type dtlsSecrets struct {
+	LocalRandom, RemoteRandom [32]byte
+	MasterSecret              []byte
+	IsClient                  bool
+}
+
+func (s *KeySession) connected(conn *dtls.Conn) error {
+	state := conn.ConnectionState()
+	b, err := state.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var secrets dtlsSecrets
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&secrets); err != nil {
+		return fmt.Errorf("DTLS state: %w", err)
+	}
+	// gob leaves the fields that are not in the state as they are
+	if len(secrets.MasterSecret) == 0 || secrets.LocalRandom == [32]byte{} || secrets.RemoteRandom == [32]byte{} {
+		return errors.New("DTLS state: no master secret or randoms")
+	}
+	clientRandom := secrets.RemoteRandom
+	if secrets.IsClient {
+		clientRandom = secrets.LocalRandom
+	}
+	s.log.printf("CLIENT_RANDOM %x %x\n", clientRandom, secrets.MasterSecret)
+
+	profile, ok := conn.SelectedSRTPProtectionProfile()
+	if !ok {
+		return errors.New("no SRTP protection profile")
+	}
+	keys, err := exportSRTPKeys(&state, profile, secrets.IsClient)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.keys = keys
+	for _, k := range s.pending {
+		s.logSSRC(k)
+	}
+	s.pending = nil
+	return nil
+}
+
+// exportSRTPKeys returns the SRTP keys of the local and the remote end of a DTLS connection
+func exportSRTPKeys(exporter interface {
+	ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error)
+}, profile dtls.SRTPProtectionProfile, isClient bool) (*srtpKeys, error) {
+	keys := &srtpKeys{keyLen: 16}
+	saltLen := 0
+	switch profile {
+	case dtls.SRTP_AES128_CM_HMAC_SHA1_80:
+		keys.profile, saltLen = "SRTP_AES128_CM_HMAC_SHA1_80", 14
+	case dtls.SRTP_AEAD_AES_128_GCM:
+		keys.profile, saltLen = "SRTP_AEAD_AES_128_GCM", 12
+	default:
+		return nil, fmt.Errorf("unknown SRTP protection profile %#x", uint16(profile))
+	}
+
+	// client key, server key, client salt, server salt
+	m, err := exporter.ExportKeyingMaterial(srtpExporterLabel, nil, 2*(keys.keyLen+saltLen))
+	if err != nil {
+		return nil, fmt.Errorf("SRTP keys: %w", err)
+	}
+	n := keys.keyLen
+	client := append(append([]byte{}, m[:n]...), m[2*n:2*n+saltLen]...)
+	server := append(append([]byte{}, m[n:2*n]...), m[2*n+saltLen:]...)
+	keys.local, keys.remote = server, client
+	if isClient {
+		keys.local, keys.remote = client, server
+	}
+	return keys, nil
+}
+
+// ssrc logs the keys of an SSRC the first time it is seen
+func (s *KeySession) ssrc(ssrc uint32, sent bool) {
+	k := keyedSSRC{ssrc: ssrc, sent: sent}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ssrcs[k] {
+		return
+	}
+	s.ssrcs[k] = true
+	if s.keys == nil {
+		s.pending = append(s.pending, k)
+		return
+	}
+	s.logSSRC(k)
+}
+
+// logSSRC logs the keys of an SSRC, the inline key is the base64 master key and salt of SDES
+// and libsrtp tools
+func (s *KeySession) logSSRC(k keyedSSRC) {
+	direction, key := "received", s.keys.remote
+	if k.sent {
+		direction, key = "sent", s.keys.local
+	}
+	s.log.printf("# SRTP %s ssrc=%d profile=%s key=%x salt=%x inline=%s\n", direction, k.ssrc,
+		s.keys.profile, key[:s.keys.keyLen], key[s.keys.keyLen:], base64.StdEncoding.EncodeToString(key))
+}
+
+// NewInterceptor implements interceptor.Factory.
+func (s *KeySession) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return &keyInterceptor{session: s}, nil
+}
+
+type keyInterceptor struct {
+	interceptor.NoOp
+	session *KeySession
+}
+
+// BindLocalStream logs the keys of the SSRCs written, RTX and simulcast layers included.
+func (i *keyInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	i.session.ssrc(info.SSRC, true)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		i.session.ssrc(header.SSRC, true)
+		return writer.Write(header, payload, a)
+	})
+}
+
+// BindRemoteStream logs the keys of the SSRC read.
+func (i *keyInterceptor) BindRemoteStream(info *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	i.session.ssrc(info.SSRC, false)
+	return reader
+}
+
+/////////////////////////
+// decryption of captures
+
+// MediaKeys are the SRTP keys of a media key log, they decrypt the SRTP and SRTCP packets of a
+// capture taken on the wire.
+type MediaKeys struct {
+	// a context for each key, and the one that decrypted each SSRC
+	contexts []*srtp.Context
+	ssrcs    map[uint32]*srtp.Context
+}
+
+// ReadMediaKeys reads the SRTP keys of a key log written by KeyLog, other lines are skipped.
+func ReadMediaKeys(file string) (*MediaKeys, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	k := &MediaKeys{ssrcs: map[uint32]*srtp.Context{}}
+	keys := map[string]bool{}
+	for n, line := range strings.Split(string(b), "\n") {
+		if !strings.HasPrefix(line, "# SRTP ") {
+			continue
+		}
+		fields := map[string]string{}
+		for _, f := range strings.Fields(line) {
+			if i := strings.IndexByte(f, '='); i > 0 {
+				fields[f[:i]] = f[i+1:]
+			}
+		}
+		if keys[fields["key"]+fields["salt"]] {
+			continue
+		}
+		c, err := srtpContext(fields["profile"], fields["key"], fields["salt"])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, n+1, err)
+		}
+		keys[fields["key"]+fields["salt"]] = true
+		k.contexts = append(k.contexts, c)
+	}
+	if len(k.contexts) == 0 {
+		return nil, fmt.Errorf("%s: no SRTP keys", file)
+	}
+	return k, nil
+}
+
+// srtpContext returns the SRTP context of a key of the log, it keeps retransmissions
+func srtpContext(profile, key, salt string) (*srtp.Context, error) {
+	var p srtp.ProtectionProfile
+	switch profile {
+	case "SRTP_AES128_CM_HMAC_SHA1_80":
+		p = srtp.ProtectionProfileAes128CmHmacSha1_80
+	case "SRTP_AEAD_AES_128_GCM":
+		p = srtp.ProtectionProfileAeadAes128Gcm
+	default:
+		return nil, fmt.Errorf("unknown SRTP protection profile %q", profile)
+	}
+	k, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("SRTP key: %w", err)
+	}
+	s, err := hex.DecodeString(salt)
+	if err != nil {
+		return nil, fmt.Errorf("SRTP salt: %w", err)
+	}
+	return srtp.CreateContext(k, s, p, srtp.SRTPNoReplayProtection(), srtp.SRTCPNoReplayProtection())
+}
+
+// Decrypt decrypts the SRTP and SRTCP packets of a capture and returns the packets with the
+// number of SRTP packets dropped. Each packet is decrypted with the key of its SSRC, any key
+// that authenticates it for the RTCP of SSRCs without a key of their own. Packets that no key
+// decrypts are kept if they are not marked as SRTP, e.g., the ones of Capture, so that
+// Decrypt of nil keys drops the SRTP packets.
+func (k *MediaKeys) Decrypt(packets []CapturedPacket) ([]CapturedPacket, int) {
+	decrypted, dropped := packets[:0], 0
+	for _, p := range packets {
+		if data, ok := k.decrypt(p); ok {
+			p.Data, p.SRTP = data, false
+		} else if p.SRTP {
+			dropped++
+			continue
+		}
+		decrypted = append(decrypted, p)
+	}
+	return decrypted, dropped
+}
+
+func (k *MediaKeys) decrypt(p CapturedPacket) ([]byte, bool) {
+	// the SSRC of RTCP is the one of the sender, after the header that ReadCapture checks
+	if k == nil || (!p.RTCP && len(p.Data) < 12) {
+		return nil, false
+	}
+	decrypt := func(c *srtp.Context) ([]byte, error) {
+		if p.RTCP {
+			return c.DecryptRTCP(nil, p.Data, nil)
+		}
+		return c.DecryptRTP(nil, p.Data, nil)
+	}
+	ssrc := binary.BigEndian.Uint32(p.Data[4:])
+	if !p.RTCP {
+		ssrc = binary.BigEndian.Uint32(p.Data[8:])
+	}
+	if c, ok := k.ssrcs[ssrc]; ok {
+		data, err := decrypt(c)
+		return data, err == nil
+	}
+	// a failed authentication leaves the context as is
+	for _, c := range k.contexts {
+		if data, err := decrypt(c); err == nil {
+			k.ssrcs[ssrc] = c
+			return data, true
+		}
+	}
+	return nil, false
+}
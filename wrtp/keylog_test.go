@@ -0,0 +1,317 @@
+package wrtp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/srtp/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// exporter returns the bytes 0, 1, 2... as keying material
+type exporter struct{}
+
+func (exporter) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	if label != srtpExporterLabel {
+		return nil, errors.New("wrong label " + label)
+	}
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b, nil
+}
+
+func TestExportSRTPKeys(t *testing.T) {
+	keys, err := exportSRTPKeys(exporter{}, dtls.SRTP_AES128_CM_HMAC_SHA1_80, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// client key 0-15, server key 16-31, client salt 32-45, server salt 46-59
+	if keys.local[0] != 0 || keys.local[16] != 32 || len(keys.local) != 30 {
+		t.Errorf("client keys %x", keys.local)
+	}
+	if keys.remote[0] != 16 || keys.remote[16] != 46 || len(keys.remote) != 30 {
+		t.Errorf("server keys %x", keys.remote)
+	}
+
+	keys, err = exportSRTPKeys(exporter{}, dtls.SRTP_AEAD_AES_128_GCM, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// client key 0-15, server key 16-31, client salt 32-43, server salt 44-55
+	if keys.local[0] != 16 || keys.local[16] != 44 || len(keys.local) != 28 {
+		t.Errorf("server keys %x", keys.local)
+	}
+}
+
+func TestKeySessionPending(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewKeyLog(&buf).NewSession()
+	i, err := s.NewInterceptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.BindRemoteStream(&interceptor.StreamInfo{SSRC: 1}, nil)
+	i.BindRemoteStream(&interceptor.StreamInfo{SSRC: 1}, nil)
+	if buf.Len() != 0 {
+		t.Fatalf("logged before the keys: %q", buf.String())
+	}
+
+	keys, err := exportSRTPKeys(exporter{}, dtls.SRTP_AES128_CM_HMAC_SHA1_80, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.lock.Lock()
+	s.keys = keys
+	for _, k := range s.pending {
+		s.logSSRC(k)
+	}
+	s.lock.Unlock()
+	i.BindLocalStream(&interceptor.StreamInfo{SSRC: 2}, &capture{})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q", buf.String())
+	}
+	if want := "# SRTP received ssrc=1 profile=SRTP_AES128_CM_HMAC_SHA1_80 key=101112131415161718191a1b1c1d1e1f salt=2e2f303132333435363738393a3b"; !strings.HasPrefix(lines[0], want) {
+		t.Errorf("logged %q, want %q", lines[0], want)
+	}
+	if !strings.HasPrefix(lines[1], "# SRTP sent ssrc=2 ") || !strings.HasSuffix(lines[1], "inline=AAECAwQFBgcICQoLDA0ODyAhIiMkJSYnKCkqKywt") {
+		t.Errorf("logged %q", lines[1])
+	}
+}
+
+// testDTLS is the start of a DTLS ClientHello record
+var testDTLS = []byte{22, 0xfe, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1}
+
+// writeTestKeyLog writes a media key log with the keys of exporter, of SSRC 2 sent and 3
+// received
+func writeTestKeyLog(t *testing.T) (*srtpKeys, string) {
+	t.Helper()
+	keys, err := exportSRTPKeys(exporter{}, dtls.SRTP_AES128_CM_HMAC_SHA1_80, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	s := NewKeyLog(&buf).NewSession()
+	s.keys = keys
+	s.ssrc(2, true)
+	s.ssrc(3, false)
+	keyLog := filepath.Join(t.TempDir(), "keylog")
+	if err := ioutil.WriteFile(keyLog, append([]byte("CLIENT_RANDOM 00 00\n"), buf.Bytes()...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return keys, keyLog
+}
+
+func TestMediaKeysDecrypt(t *testing.T) {
+	// the RTP is sent by 2 and the RTCP by 1, whose key is logged for SSRC 3
+	keys, keyLog := writeTestKeyLog(t)
+
+	local, err := srtp.CreateContext(keys.local[:16], keys.local[16:], srtp.ProtectionProfileAes128CmHmacSha1_80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := srtp.CreateContext(keys.remote[:16], keys.remote[16:], srtp.ProtectionProfileAes128CmHmacSha1_80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtpBytes := append([]byte{}, testRTP...)
+	rtpBytes[11] = 2
+	encryptedRTP, err := local.EncryptRTP(nil, rtpBytes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedRTCP, err := remote.EncryptRTCP(nil, testRTCP, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := writePcap(t, testDTLS, encryptedRTP, encryptedRTCP)
+
+	packets, err := ReadCapture(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 2 || !packets[0].SRTP || !packets[1].SRTP {
+		t.Fatalf("expected 2 SRTP packets, got %v", packets)
+	}
+	var none *MediaKeys
+	if packets, dropped := none.Decrypt(append([]CapturedPacket{}, packets...)); len(packets) != 0 || dropped != 2 {
+		t.Errorf("expected the SRTP packets dropped without keys, got %v", packets)
+	}
+
+	k, err := ReadMediaKeys(keyLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, dropped := k.Decrypt(packets)
+	if dropped != 0 || len(packets) != 2 {
+		t.Fatalf("expected 2 packets decrypted, got %v and %d dropped", packets, dropped)
+	}
+	if p := packets[0]; p.SRTP || p.RTCP || !bytes.Equal(p.Data, rtpBytes) {
+		t.Errorf("expected RTP packet % x, got % x", rtpBytes, p.Data)
+	}
+	if p := packets[1]; p.SRTP || !p.RTCP || !bytes.Equal(p.Data, testRTCP) {
+		t.Errorf("expected RTCP packet % x, got % x", testRTCP, p.Data)
+	}
+}
+
+// keyPeer is a PeerConnection whose keys are logged into log
+type keyPeer struct {
+	pc  *webrtc.PeerConnection
+	log *lockedBuffer
+}
+
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func newKeyPeer(t *testing.T) *keyPeer {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	p := &keyPeer{log: &lockedBuffer{}}
+	keys := NewKeyLog(p.log).NewSession()
+	registry := &interceptor.Registry{}
+	registry.Add(keys)
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry)).
+		NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	keys.Watch(pc.SCTP().Transport())
+	p.pc = pc
+	return p
+}
+
+// srtpKey returns the key logged for an SSRC in a direction
+func (p *keyPeer) srtpKey(direction string, ssrc webrtc.SSRC) string {
+	prefix := fmt.Sprintf("# SRTP %s ssrc=%d ", direction, ssrc)
+	for _, line := range strings.Split(p.log.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
+
+// TestKeySessionPeerConnection logs the keys of a real connection: the DTLS connection and its
+// secrets are read from fields that pion does not export
+func TestKeySessionPeerConnection(t *testing.T) {
+	offerer, answerer := newKeyPeer(t), newKeyPeer(t)
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := offerer.pc.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := offerer.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer.pc)
+	if err := offerer.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := answerer.pc.SetRemoteDescription(*offerer.pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerer.pc.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer.pc)
+	if err := answerer.pc.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := offerer.pc.SetRemoteDescription(*answerer.pc.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the answerer logs the received SSRC once a packet arrives
+	ssrc := sender.GetParameters().Encodings[0].SSRC
+	deadline := time.Now().Add(10 * time.Second)
+	for answerer.srtpKey("received", ssrc) == "" {
+		if time.Now().After(deadline) {
+			t.Fatalf("no keys logged:\noffer: %s\nanswer: %s", offerer.log, answerer.log)
+		}
+		if err := track.WriteRTP(&rtp.Packet{Header: rtp.Header{Version: 2, SequenceNumber: 1}, Payload: []byte{0x10, 0, 0, 0}}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if dtlsConn(offerer.pc.SCTP().Transport()) == nil {
+		t.Fatal("no DTLS connection in the transport")
+	}
+
+	// both ends log the same master secret of the same client random, and the same key
+	random := func(p *keyPeer) string {
+		for _, line := range strings.Split(p.log.String(), "\n") {
+			if strings.HasPrefix(line, "CLIENT_RANDOM ") {
+				return line
+			}
+		}
+		return ""
+	}
+	if r := random(offerer); r == "" || r != random(answerer) {
+		t.Errorf("expected the same master secret, got %q and %q", r, random(answerer))
+	}
+	if sent := offerer.srtpKey("sent", ssrc); sent != answerer.srtpKey("received", ssrc) {
+		t.Errorf("expected the same key, got %q and %q", sent, answerer.srtpKey("received", ssrc))
+	}
+}
+
+// TestMediaKeysDecryptShort drops SRTP packets too short for their header
+func TestMediaKeysDecryptShort(t *testing.T) {
+	_, keyLog := writeTestKeyLog(t)
+	var payloads [][]byte
+	for n := 8; n <= 13; n++ {
+		payloads = append(payloads, testRTP[:n], append(append([]byte{}, testRTCP...), 0, 0)[:n])
+	}
+	packets, err := ReadCapture(writePcap(t, append([][]byte{testDTLS}, payloads...)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != len(payloads) {
+		t.Fatalf("expected %d packets, got %d", len(payloads), len(packets))
+	}
+	k, err := ReadMediaKeys(keyLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packets, dropped := k.Decrypt(packets); len(packets) != 0 || dropped != len(payloads) {
+		t.Errorf("expected %d packets dropped, got %v", len(payloads), packets)
+	}
+}
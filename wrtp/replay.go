@@ -0,0 +1,381 @@
+package wrtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// pcap magic numbers by timestamp resolution, and the link types the packets are read from
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+
+	pcapngOptionTSResol = 9
+
+	// TURN messages that carry the packets of a relayed allocation, RFC 8656
+	stunMagicCookie      = 0x2112a442
+	stunSendIndication   = 0x0016
+	stunDataIndication   = 0x0017
+	stunAttributeData    = 0x0013
+	turnChannelDataFirst = 0x40
+	turnChannelDataLast  = 0x7f
+)
+
+// CapturedPacket is an RTP or RTCP packet read from a capture file.
+type CapturedPacket struct {
+	// since the first packet of the capture
+	Time time.Duration
+	RTCP bool
+	// the packet is SRTP or SRTCP: a DTLS handshake went between its addresses
+	SRTP bool
+	Data []byte
+}
+
+// IsCaptureFile tells whether file is a packet capture by its extension: .pcapng, .pcap,
+// .rtpdump or .rtp.
+func IsCaptureFile(file string) bool {
+	switch strings.ToLower(path.Ext(file)) {
+	case ".pcapng", ".pcap", ".rtpdump", ".rtp":
+		return true
+	}
+	return false
+}
+
+// ReadCapture reads the RTP and RTCP packets of a pcapng, pcap or rtpdump file, the format is
+// told by the start of the file. Packets of pcap files are taken from UDP over IPv4 or IPv6 on
+// Ethernet, Linux cooked or raw IP links, and out of the TURN ChannelData messages and Send and
+// Data indications they are relayed in; other packets and non-RTP UDP payloads, e.g., STUN and
+// DTLS, are skipped. SRTP packets are read as is and marked as such if the capture has the DTLS
+// handshake of their addresses, see MediaKeys to decrypt them.
+func ReadCapture(file string) ([]CapturedPacket, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var packets []CapturedPacket
+	switch {
+	case bytes.HasPrefix(b, []byte("#!rtpplay")):
+		packets, err = readRTPDump(b)
+	case len(b) >= 4 && binary.LittleEndian.Uint32(b) == pcapngSectionHeader:
+		packets, err = readPcapng(b)
+	case len(b) >= 4:
+		packets, err = readPcap(b)
+	default:
+		err = errors.New("unknown capture format")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(packets) == 0 {
+		return nil, fmt.Errorf("%s: no RTP packets", file)
+	}
+	first := packets[0].Time
+	for i := range packets {
+		packets[i].Time -= first
+	}
+	return packets, nil
+}
+
+// isRTP tells whether a UDP payload is RTP or RTCP by its version
+func isRTP(b []byte) bool {
+	return len(b) >= 8 && b[0]>>6 == 2
+}
+
+/////////////////////////
+// rtpdump
+
+func readRTPDump(b []byte) ([]CapturedPacket, error) {
+	eol := bytes.IndexByte(b, '\n')
+	if eol < 0 || len(b) < eol+1+16 {
+		return nil, errors.New("truncated rtpdump header")
+	}
+	b = b[eol+1+16:]
+
+	var packets []CapturedPacket
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return nil, errors.New("truncated rtpdump packet")
+		}
+		size, plen := int(binary.BigEndian.Uint16(b)), binary.BigEndian.Uint16(b[2:])
+		if size < 8 || size > len(b) {
+			return nil, fmt.Errorf("invalid rtpdump packet length %d", size)
+		}
+		data := b[8:size]
+		if isRTP(data) {
+			packets = append(packets, CapturedPacket{
+				Time: time.Duration(binary.BigEndian.Uint32(b[4:])) * time.Millisecond,
+				RTCP: plen == 0,
+				Data: data,
+			})
+		}
+		b = b[size:]
+	}
+	return packets, nil
+}
+
+/////////////////////////
+// pcap and pcapng
+
+func readPcap(b []byte) ([]CapturedPacket, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	resolution := time.Microsecond
+	switch {
+	case binary.LittleEndian.Uint32(b) == pcapMagicMicro:
+	case binary.LittleEndian.Uint32(b) == pcapMagicNano:
+		resolution = time.Nanosecond
+	case binary.BigEndian.Uint32(b) == pcapMagicMicro:
+		order = binary.BigEndian
+	case binary.BigEndian.Uint32(b) == pcapMagicNano:
+		order, resolution = binary.BigEndian, time.Nanosecond
+	default:
+		return nil, errors.New("unknown capture format")
+	}
+	if len(b) < 24 {
+		return nil, errors.New("truncated pcap header")
+	}
+	linkType := order.Uint32(b[20:]) & 0xffff
+	b = b[24:]
+
+	r := wireReader{srtp: map[udpFlow]bool{}}
+	for len(b) > 0 {
+		if len(b) < 16 {
+			return nil, errors.New("truncated pcap packet")
+		}
+		n := int(order.Uint32(b[8:]))
+		if n > len(b)-16 {
+			return nil, fmt.Errorf("invalid pcap packet length %d", n)
+		}
+		t := time.Duration(order.Uint32(b))*time.Second + time.Duration(order.Uint32(b[4:]))*resolution
+		r.packet(t, linkType, b[16:16+n])
+		b = b[16+n:]
+	}
+	return r.packets, nil
+}
+
+// pcapngLink is an interface of a pcapng section
+type pcapngLink struct {
+	linkType uint32
+	// the timestamp unit
+	resolution float64
+}
+
+func readPcapng(b []byte) ([]CapturedPacket, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	var links []pcapngLink
+
+	r := wireReader{srtp: map[udpFlow]bool{}}
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, errors.New("truncated pcapng block")
+		}
+		if binary.LittleEndian.Uint32(b) == pcapngSectionHeader {
+			// each section has its own byte order and interfaces
+			if len(b) < 28 {
+				return nil, errors.New("truncated pcapng section header")
+			}
+			order, links = binary.LittleEndian, nil
+			if binary.BigEndian.Uint32(b[8:]) == pcapngByteOrderMagic {
+				order = binary.BigEndian
+			}
+		}
+		typ, size := order.Uint32(b), int(order.Uint32(b[4:]))
+		if size < 12 || size%4 != 0 || size > len(b) {
+			return nil, fmt.Errorf("invalid pcapng block length %d", size)
+		}
+		block := b[8 : size-4]
+		b = b[size:]
+
+		switch typ {
+		case pcapngInterfaceDesc:
+			if len(block) < 8 {
+				return nil, errors.New("truncated pcapng interface description")
+			}
+			links = append(links, pcapngLink{linkType: uint32(order.Uint16(block)),
+				resolution: pcapngResolution(order, block[8:])})
+		case pcapngEnhancedPacket:
+			if len(block) < 20 {
+				return nil, errors.New("truncated pcapng packet")
+			}
+			id, n := int(order.Uint32(block)), int(order.Uint32(block[12:]))
+			if id >= len(links) || n > len(block)-20 {
+				return nil, errors.New("invalid pcapng packet")
+			}
+			ts := uint64(order.Uint32(block[4:]))<<32 | uint64(order.Uint32(block[8:]))
+			t := time.Duration(float64(ts) * links[id].resolution * float64(time.Second))
+			r.packet(t, links[id].linkType, block[20:20+n])
+		}
+	}
+	return r.packets, nil
+}
+
+// pcapngResolution returns the timestamp unit of an interface in seconds from its options,
+// microseconds by default
+func pcapngResolution(order binary.ByteOrder, options []byte) float64 {
+	for len(options) >= 4 {
+		code, n := order.Uint16(options), int(order.Uint16(options[2:]))
+		if code == 0 || 4+n > len(options) {
+			break
+		}
+		if code == pcapngOptionTSResol && n >= 1 {
+			if v := options[4]; v&0x80 != 0 {
+				return math.Pow(2, -float64(v&0x7f))
+			}
+			return math.Pow(10, -float64(options[4]))
+		}
+		options = options[4+(n+3)&^3:]
+	}
+	return 1e-6
+}
+
+// wireReader collects the RTP and RTCP packets of the frames of a pcap or pcapng file
+type wireReader struct {
+	packets []CapturedPacket
+	// the addresses with a DTLS handshake, their RTP and RTCP is SRTP
+	srtp map[udpFlow]bool
+}
+
+func (r *wireReader) packet(t time.Duration, linkType uint32, frame []byte) {
+	data, flow := udpPayload(linkType, frame)
+	data = turnPayload(data)
+	switch {
+	case isDTLS(data):
+		r.srtp[flow] = true
+	case isRTP(data):
+		r.packets = append(r.packets, CapturedPacket{Time: t, RTCP: isRTCP(data), SRTP: r.srtp[flow], Data: data})
+	}
+}
+
+// isDTLS tells whether a UDP payload is a DTLS handshake record, RFC 7983
+func isDTLS(b []byte) bool {
+	return len(b) >= 13 && b[0] == 22 && b[1] == 0xfe
+}
+
+// turnPayload returns the packet relayed in a TURN ChannelData message, Send or Data
+// indication, or else b
+func turnPayload(b []byte) []byte {
+	if len(b) >= 4 && b[0] >= turnChannelDataFirst && b[0] <= turnChannelDataLast {
+		// UDP needs no padding, so the length may be short of the datagram
+		if n := int(binary.BigEndian.Uint16(b[2:])); 4+n <= len(b) {
+			return b[4 : 4+n]
+		}
+		return nil
+	}
+	if len(b) < 20 || binary.BigEndian.Uint32(b[4:]) != stunMagicCookie {
+		return b
+	}
+	if typ := binary.BigEndian.Uint16(b); typ != stunSendIndication && typ != stunDataIndication {
+		return b
+	}
+	n := int(binary.BigEndian.Uint16(b[2:]))
+	if 20+n > len(b) {
+		return nil
+	}
+	for attrs := b[20 : 20+n]; len(attrs) >= 4; {
+		typ, size := binary.BigEndian.Uint16(attrs), int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			break
+		}
+		if typ == stunAttributeData {
+			return attrs[4 : 4+size]
+		}
+		attrs = attrs[4+(size+3)&^3:]
+	}
+	return nil
+}
+
+// udpFlow are the addresses of a UDP packet in either direction
+type udpFlow struct {
+	a, b string
+}
+
+func newUDPFlow(srcIP, dstIP net.IP, srcPort, dstPort uint16) udpFlow {
+	a := (&net.UDPAddr{IP: srcIP, Port: int(srcPort)}).String()
+	b := (&net.UDPAddr{IP: dstIP, Port: int(dstPort)}).String()
+	if a > b {
+		a, b = b, a
+	}
+	return udpFlow{a: a, b: b}
+}
+
+// udpPayload returns the UDP payload of a frame of a link type and its addresses, nil if it is
+// not UDP over IP
+func udpPayload(linkType uint32, frame []byte) ([]byte, udpFlow) {
+	ip := frame
+	switch linkType {
+	case pcapngLinkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	case linkTypeNull:
+		if len(frame) < 4 {
+			return nil, udpFlow{}
+		}
+		ip = frame[4:]
+	case linkTypeEthernet:
+		offset := 14
+		// VLAN tags
+		for offset+4 <= len(frame) && binary.BigEndian.Uint16(frame[offset-2:]) == 0x8100 {
+			offset += 4
+		}
+		if offset > len(frame) {
+			return nil, udpFlow{}
+		}
+		ip = frame[offset:]
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, udpFlow{}
+		}
+		ip = frame[16:]
+	case linkTypeSLL2:
+		if len(frame) < 20 {
+			return nil, udpFlow{}
+		}
+		ip = frame[20:]
+	default:
+		return nil, udpFlow{}
+	}
+
+	var udp []byte
+	var srcIP, dstIP net.IP
+	switch {
+	case len(ip) >= 20 && ip[0]>>4 == 4:
+		headerLen, total := int(ip[0]&0x0f)*4, int(binary.BigEndian.Uint16(ip[2:]))
+		// fragments are not reassembled
+		if ip[9] != 17 || binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 ||
+			headerLen < 20 || total < headerLen || total > len(ip) {
+			return nil, udpFlow{}
+		}
+		udp, srcIP, dstIP = ip[headerLen:total], net.IP(ip[12:16]), net.IP(ip[16:20])
+	case len(ip) >= 40 && ip[0]>>4 == 6:
+		// extension headers are not followed
+		total := 40 + int(binary.BigEndian.Uint16(ip[4:]))
+		if ip[6] != 17 || total > len(ip) {
+			return nil, udpFlow{}
+		}
+		udp, srcIP, dstIP = ip[40:total], net.IP(ip[8:24]), net.IP(ip[24:40])
+	default:
+		return nil, udpFlow{}
+	}
+
+	if len(udp) < 8 {
+		return nil, udpFlow{}
+	}
+	n := int(binary.BigEndian.Uint16(udp[4:]))
+	if n < 8 || n > len(udp) {
+		return nil, udpFlow{}
+	}
+	return udp[8:n], newUDPFlow(srcIP, dstIP, binary.BigEndian.Uint16(udp), binary.BigEndian.Uint16(udp[2:]))
+}
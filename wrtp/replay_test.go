@@ -0,0 +1,109 @@
+package wrtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	testRTP  = []byte{0x80, 0xe0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0xaa}
+	testRTCP = []byte{0x81, 0xce, 0, 2, 0, 0, 0, 1, 0, 0, 0, 3}
+	// a STUN binding request is skipped
+	testSTUN = []byte{0, 1, 0, 0, 0x21, 0x12, 0xa4, 0x42, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+)
+
+func checkCaptured(t *testing.T, packets []CapturedPacket) {
+	t.Helper()
+	if len(packets) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(packets))
+	}
+	if p := packets[0]; p.Time != 0 || p.RTCP || !bytes.Equal(p.Data, testRTP) {
+		t.Errorf("expected RTP packet % x at 0, got % x at %s", testRTP, p.Data, p.Time)
+	}
+	if p := packets[1]; p.Time < 20*time.Millisecond || !p.RTCP || !bytes.Equal(p.Data, testRTCP) {
+		t.Errorf("expected RTCP packet % x after 20ms, got % x at %s", testRTCP, p.Data, p.Time)
+	}
+}
+
+func TestReadCapture(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	remote := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6000}
+	for _, format := range []CaptureFormat{CapturePcapng, CaptureRTPDump} {
+		t.Run(string(format), func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "capture")
+			c, err := NewCapture(file, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Packet(true, local, remote, testRTP)
+			c.Packet(false, local, remote, testSTUN)
+			time.Sleep(20 * time.Millisecond)
+			c.Packet(false, local, remote, testRTCP)
+			if err := c.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			packets, err := ReadCapture(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCaptured(t, packets)
+		})
+	}
+}
+
+// writePcap writes UDP payloads between two addresses into a pcap file, 20ms apart
+func writePcap(t *testing.T, payloads ...[]byte) string {
+	t.Helper()
+	local := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	remote := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6000}
+
+	// big endian with nanoseconds, Ethernet with a VLAN tag
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint32(b, pcapMagicNano)
+	binary.BigEndian.PutUint32(b[20:], linkTypeEthernet)
+	for i, p := range payloads {
+		frame := append(make([]byte, 12), 0x81, 0x00, 0, 1, 0x08, 0x00)
+		frame = append(frame, udpPacket(local, remote, p)...)
+		record := make([]byte, 16)
+		binary.BigEndian.PutUint32(record, 1000)
+		binary.BigEndian.PutUint32(record[4:], uint32(i*int(20*time.Millisecond)))
+		binary.BigEndian.PutUint32(record[8:], uint32(len(frame)))
+		binary.BigEndian.PutUint32(record[12:], uint32(len(frame)))
+		b = append(append(b, record...), frame...)
+	}
+	file := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadPcap(t *testing.T) {
+	packets, err := ReadCapture(writePcap(t, testRTP, testSTUN, testRTCP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCaptured(t, packets)
+}
+
+func TestReadPcapTURN(t *testing.T) {
+	channelData := append([]byte{0x40, 0, 0, byte(len(testRTP))}, testRTP...)
+	// a Send indication with an XOR-PEER-ADDRESS and the DATA
+	send := []byte{0, 0x16, 0, 0, 0x21, 0x12, 0xa4, 0x42, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12,
+		0, 0x12, 0, 8, 0, 1, 0x21, 0x12, 0x2b, 0x12, 0xa4, 0x40,
+		0, 0x13, 0, byte(len(testRTCP))}
+	send = append(send, testRTCP...)
+	binary.BigEndian.PutUint16(send[2:], uint16(len(send)-20))
+
+	packets, err := ReadCapture(writePcap(t, channelData, testSTUN, send))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkCaptured(t, packets)
+}
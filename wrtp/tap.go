@@ -0,0 +1,116 @@
+package wrtp
+
+import (
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+/////////////////////////
+// RTCP of other streams
+
+// Interceptors is an interceptor factory that builds the interceptors of a registry and keeps
+// the ones of the last PeerConnection, so that the RTCP read by a Tap goes through the same
+// interceptors as the RTCP read by the senders of the PeerConnection.
+type Interceptors struct {
+	registry *interceptor.Registry
+
+	lock  sync.Mutex
+	built interceptor.Interceptor
+}
+
+// NewInterceptors returns a factory of the interceptors of registry.
+func NewInterceptors(registry *interceptor.Registry) *Interceptors {
+	return &Interceptors{registry: registry, built: &interceptor.NoOp{}}
+}
+
+// NewInterceptor implements interceptor.Factory.
+func (i *Interceptors) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	built, err := i.registry.Build(id)
+	if err != nil {
+		return nil, err
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.built = built
+	return built, nil
+}
+
+// Built returns the interceptors of the last PeerConnection, no-ops before.
+func (i *Interceptors) Built() interceptor.Interceptor {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.built
+}
+
+// tapAPI creates the senders of the taps, they send nothing so they need no codecs
+var tapAPI = webrtc.NewAPI()
+
+// Tap reads the RTCP of an SSRC that no sender of a PeerConnection is bound to, e.g., of a
+// simulcast layer written into the stream of another sender: pion drops such RTCP as
+// unhandled. A tap is a sender of its own on the DTLS transport of the PeerConnection that
+// sends nothing, its SSRC is the one to send the stream with.
+type Tap struct {
+	sender *webrtc.RTPSender
+	reader interceptor.RTCPReader
+}
+
+// NewTap returns a tap on transport, its RTCP is read through interceptors.
+func NewTap(transport *webrtc.DTLSTransport, interceptors interceptor.Interceptor) (*Tap, error) {
+	sender, err := tapAPI.NewRTPSender(tapTrack{}, transport)
+	if err != nil {
+		return nil, err
+	}
+	if err := sender.Send(sender.GetParameters()); err != nil {
+		return nil, err
+	}
+	return &Tap{
+		sender: sender,
+		reader: interceptors.BindRTCPReader(interceptor.RTCPReaderFunc(
+			func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+				n, _, err := sender.Read(b)
+				return n, a, err
+			})),
+	}, nil
+}
+
+// SSRC returns the SSRC whose RTCP the tap reads.
+func (t *Tap) SSRC() uint32 {
+	return uint32(t.sender.GetParameters().Encodings[0].SSRC)
+}
+
+// ReadRTCP reads the next compound RTCP packet of the SSRC, like RTPSender.ReadRTCP.
+func (t *Tap) ReadRTCP() ([]rtcp.Packet, interceptor.Attributes, error) {
+	b := make([]byte, receiveMTU)
+	n, a, err := t.reader.Read(b, interceptor.Attributes{})
+	if err != nil {
+		return nil, nil, err
+	}
+	pkts, err := rtcp.Unmarshal(b[:n])
+	if err != nil {
+		return nil, nil, err
+	}
+	return pkts, a, nil
+}
+
+// Close stops reading, ReadRTCP returns an error.
+func (t *Tap) Close() error {
+	return t.sender.Stop()
+}
+
+// tapTrack is the track of a tap sender, nothing is written into it
+type tapTrack struct{}
+
+func (tapTrack) Bind(webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	return webrtc.RTPCodecParameters{}, nil
+}
+
+func (tapTrack) Unbind(webrtc.TrackLocalContext) error { return nil }
+
+func (tapTrack) ID() string { return "tap" }
+
+func (tapTrack) StreamID() string { return "tap" }
+
+func (tapTrack) Kind() webrtc.RTPCodecType { return webrtc.RTPCodecTypeVideo }
@@ -0,0 +1,412 @@
+// Package wrtp contains the RTP interceptors of the WebRTC media path.
+package wrtp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/randutil"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	mimeTypeRTX = "video/rtx"
+	// packets kept for retransmission per stream, about 2 seconds of video at 2 Mbps
+	defaultBufferSize = 512
+	// size of the RTCP packets read, like pion's default receive MTU
+	receiveMTU = 1460
+)
+
+// random SSRCs and sequence numbers, seeded from crypto/rand
+var random = randutil.NewMathRandomGenerator()
+
+// packets remembered to tell apart the ones read more than once: pion passes a compound RTCP
+// packet to the reader of each SSRC in it
+const packetHistorySize = 64
+
+// a packet read again within this time is the same packet read by another SSRC, the readers
+// read it right after each other; an identical packet sent again, e.g., the same REMB or a
+// repeated NACK, comes later and is read again
+const duplicateWindow = 50 * time.Millisecond
+
+// packetHistory remembers the fingerprints of the last packets, the caller serializes the calls
+type packetHistory struct {
+	seen map[uint64]time.Time
+	// the fingerprints in the order they were first seen
+	ring [packetHistorySize]uint64
+	next int
+}
+
+// fresh tells whether b has not been seen within duplicateWindow before now, and remembers it
+func (h *packetHistory) fresh(b []byte, now time.Time) bool {
+	f := fnv.New64a()
+	f.Write(b)
+	sum := f.Sum64()
+	at, ok := h.seen[sum]
+	if ok && now.Sub(at) < duplicateWindow {
+		return false
+	}
+	if h.seen == nil {
+		h.seen = map[uint64]time.Time{}
+	}
+	if !ok {
+		delete(h.seen, h.ring[h.next])
+		h.ring[h.next] = sum
+		h.next = (h.next + 1) % packetHistorySize
+	}
+	h.seen[sum] = now
+	return true
+}
+
+// Duplicates tells apart the compound RTCP packets read by more than one reader of a
+// PeerConnection, so that their feedback is answered once, e.g., the NACKs of the sender and
+// its simulcast layers that are all in the report blocks of a packet. The zero value is ready.
+type Duplicates struct {
+	lock    sync.Mutex
+	history packetHistory
+}
+
+// Fresh tells whether the compound packet b has not just been read by another reader, and
+// remembers it. A nil Duplicates takes every packet for fresh.
+func (d *Duplicates) Fresh(b []byte) bool {
+	if d == nil {
+		return true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.history.fresh(b, time.Now())
+}
+
+/////////////////////////
+// stats
+
+// Stats counts the packets of the send path, the counters are updated atomically.
+type Stats struct {
+	PacketsSent uint64
+	BytesSent   uint64
+	// NACK feedback messages received
+	NACKs uint64
+	// packets requested by NACKs
+	Requested uint64
+	// requested packets that were retransmitted, as RTX or as is
+	Retransmitted      uint64
+	RetransmittedBytes uint64
+	// requested packets that were no longer in the send buffer
+	Missed uint64
+}
+
+func (s *Stats) add(counter *uint64, n int) {
+	atomic.AddUint64(counter, uint64(n))
+}
+
+// Snapshot returns a copy of the counters.
+func (s *Stats) Snapshot() Stats {
+	return Stats{
+		PacketsSent:        atomic.LoadUint64(&s.PacketsSent),
+		BytesSent:          atomic.LoadUint64(&s.BytesSent),
+		NACKs:              atomic.LoadUint64(&s.NACKs),
+		Requested:          atomic.LoadUint64(&s.Requested),
+		Retransmitted:      atomic.LoadUint64(&s.Retransmitted),
+		RetransmittedBytes: atomic.LoadUint64(&s.RetransmittedBytes),
+		Missed:             atomic.LoadUint64(&s.Missed),
+	}
+}
+
+func (s *Stats) String() string {
+	c := s.Snapshot()
+	return fmt.Sprintf("sent %d packets (%d bytes), %d NACKs requested %d packets: "+
+		"retransmitted %d (%d bytes), missed %d", c.PacketsSent, c.BytesSent, c.NACKs,
+		c.Requested, c.Retransmitted, c.RetransmittedBytes, c.Missed)
+}
+
+/////////////////////////
+// NACK responder
+
+// Responder is an interceptor factory that answers NACKs from a send buffer: lost packets are
+// retransmitted on the RTX payload type of their codec in a separate RTX stream (RFC 4588),
+// or as is if there is no RTX for the codec.
+type Responder struct {
+	stats *Stats
+	size  int
+
+	lock sync.Mutex
+	// RTX payload types by the payload type of the media codec
+	rtxTypes map[uint8]uint8
+	// RTX SSRCs by the media SSRC, 0 if RTX is disabled
+	rtxSSRCs map[uint32]uint32
+}
+
+// NewResponder returns a Responder that retransmits on the RTX payload types of codecs and
+// counts into stats.
+func NewResponder(codecs []webrtc.RTPCodecParameters, stats *Stats) *Responder {
+	r := &Responder{stats: stats, size: defaultBufferSize, rtxSSRCs: map[uint32]uint32{}}
+	r.SetCodecs(codecs)
+	return r
+}
+
+// SetCodecs sets the codecs the RTX payload types are looked up in, e.g., the negotiated ones.
+func (r *Responder) SetCodecs(codecs []webrtc.RTPCodecParameters) {
+	rtxTypes := map[uint8]uint8{}
+	for _, c := range codecs {
+		if !strings.EqualFold(c.MimeType, mimeTypeRTX) {
+			continue
+		}
+		for _, p := range strings.Split(c.SDPFmtpLine, ";") {
+			if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && kv[0] == "apt" {
+				if apt, err := strconv.ParseUint(kv[1], 10, 8); err == nil {
+					rtxTypes[uint8(apt)] = uint8(c.PayloadType)
+				}
+			}
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rtxTypes = rtxTypes
+}
+
+// RTXSSRC returns the SSRC of the RTX stream of a media SSRC, this must be signaled to the
+// remote peer in an FID SSRC group. It is 0 if RTX is disabled for the SSRC.
+func (r *Responder) RTXSSRC(ssrc uint32) uint32 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rtx, ok := r.rtxSSRCs[ssrc]
+	if !ok {
+		for rtx == 0 || rtx == ssrc {
+			rtx = random.Uint32()
+		}
+		r.rtxSSRCs[ssrc] = rtx
+	}
+	return rtx
+}
+
+// DisableRTX makes the lost packets of a media SSRC retransmitted as is, e.g., if its RTX
+// stream cannot be signaled.
+func (r *Responder) DisableRTX(ssrc uint32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rtxSSRCs[ssrc] = 0
+}
+
+// signaledRTXSSRC returns the RTX SSRC of a media SSRC if it has been allocated, 0 otherwise
+func (r *Responder) signaledRTXSSRC(ssrc uint32) uint32 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rtxSSRCs[ssrc]
+}
+
+func (r *Responder) rtxType(pt uint8) (uint8, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rtx, ok := r.rtxTypes[pt]
+	return rtx, ok
+}
+
+// NewInterceptor implements interceptor.Factory.
+func (r *Responder) NewInterceptor(id string) (interceptor.Interceptor, error) {
+	return &responderInterceptor{responder: r, streams: map[uint32]*localStream{}}, nil
+}
+
+type responderInterceptor struct {
+	interceptor.NoOp
+	responder *Responder
+
+	lock sync.Mutex
+	// by SSRC, a track may write more than one stream, e.g., simulcast layers
+	streams map[uint32]*localStream
+	// the RTCP packets read, by the senders and the receivers of their SSRCs
+	read Duplicates
+}
+
+// localStream is a media stream with its send buffer and RTX sequence numbers
+type localStream struct {
+	// SSRC of the bound stream the packets are written into
+	bound   uint32
+	writer  interceptor.RTPWriter
+	buffer  *sendBuffer
+	rtxSSRC uint32
+
+	lock   sync.Mutex
+	rtxSeq uint16
+}
+
+func supportsNACK(info *interceptor.StreamInfo) bool {
+	for _, fb := range info.RTCPFeedback {
+		if fb.Type == "nack" && fb.Parameter == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// BindRTCPReader answers the NACKs read by the sender, once: each sender and receiver whose
+// SSRC is in a compound packet reads it.
+func (i *responderInterceptor) BindRTCPReader(reader interceptor.RTCPReader) interceptor.RTCPReader {
+	return interceptor.RTCPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		n, attr, err := reader.Read(b, a)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !i.read.Fresh(b[:n]) {
+			return n, attr, nil
+		}
+
+		pkts, err := rtcp.Unmarshal(b[:n])
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, p := range pkts {
+			if nack, ok := p.(*rtcp.TransportLayerNack); ok {
+				i.responder.stats.add(&i.responder.stats.NACKs, 1)
+				go i.resend(nack)
+			}
+		}
+
+		return n, attr, nil
+	})
+}
+
+// BindLocalStream keeps the packets of the streams that support NACK.
+func (i *responderInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	stats := i.responder.stats
+	if !supportsNACK(info) {
+		return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+			stats.add(&stats.PacketsSent, 1)
+			stats.add(&stats.BytesSent, len(payload))
+			return writer.Write(header, payload, a)
+		})
+	}
+
+	i.newStream(info.SSRC, info.SSRC, i.responder.RTXSSRC(info.SSRC), writer)
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, a interceptor.Attributes) (int, error) {
+		i.lock.Lock()
+		s, ok := i.streams[header.SSRC]
+		i.lock.Unlock()
+		if !ok {
+			// another stream of the track, it has RTX only if it has been signaled
+			s = i.newStream(info.SSRC, header.SSRC, i.responder.signaledRTXSSRC(header.SSRC), writer)
+		}
+
+		s.buffer.add(header, payload)
+		stats.add(&stats.PacketsSent, 1)
+		stats.add(&stats.BytesSent, len(payload))
+		return writer.Write(header, payload, a)
+	})
+}
+
+func (i *responderInterceptor) newStream(bound, ssrc, rtxSSRC uint32, writer interceptor.RTPWriter) *localStream {
+	s := &localStream{
+		bound:   bound,
+		writer:  writer,
+		buffer:  newSendBuffer(i.responder.size),
+		rtxSSRC: rtxSSRC,
+		rtxSeq:  uint16(random.Uint32()),
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.streams[ssrc] = s
+	return s
+}
+
+// UnbindLocalStream drops the send buffers of the streams of the track.
+func (i *responderInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for ssrc, s := range i.streams {
+		if s.bound == info.SSRC {
+			delete(i.streams, ssrc)
+		}
+	}
+}
+
+func (i *responderInterceptor) resend(nack *rtcp.TransportLayerNack) {
+	i.lock.Lock()
+	s, ok := i.streams[nack.MediaSSRC]
+	i.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	stats := i.responder.stats
+	for _, pair := range nack.Nacks {
+		pair.Range(func(seq uint16) bool {
+			stats.add(&stats.Requested, 1)
+			p := s.buffer.get(seq)
+			if p == nil {
+				stats.add(&stats.Missed, 1)
+				return true
+			}
+
+			header, payload := p.Header, p.Payload
+			if rtx, ok := i.responder.rtxType(p.PayloadType); ok && s.rtxSSRC != 0 {
+				header, payload = s.rtxPacket(p, rtx)
+			}
+			if _, err := s.writer.Write(&header, payload, interceptor.Attributes{}); err != nil {
+				return true
+			}
+			stats.add(&stats.Retransmitted, 1)
+			stats.add(&stats.RetransmittedBytes, len(payload))
+			return true
+		})
+	}
+}
+
+// rtxPacket returns an RTX packet of p: the payload is prefixed with the original sequence
+// number, and the packet is sent on the RTX SSRC with its own sequence numbers
+func (s *localStream) rtxPacket(p *rtp.Packet, pt uint8) (rtp.Header, []byte) {
+	s.lock.Lock()
+	seq := s.rtxSeq
+	s.rtxSeq++
+	s.lock.Unlock()
+
+	header := p.Header
+	header.PayloadType = pt
+	header.SSRC = s.rtxSSRC
+	header.SequenceNumber = seq
+
+	payload := make([]byte, 2+len(p.Payload))
+	binary.BigEndian.PutUint16(payload, p.SequenceNumber)
+	copy(payload[2:], p.Payload)
+	return header, payload
+}
+
+// sendBuffer keeps copies of the last packets sent, by sequence number
+type sendBuffer struct {
+	lock    sync.Mutex
+	packets []*rtp.Packet
+}
+
+func newSendBuffer(size int) *sendBuffer {
+	return &sendBuffer{packets: make([]*rtp.Packet, size)}
+}
+
+func (b *sendBuffer) add(header *rtp.Header, payload []byte) {
+	p := &rtp.Packet{Header: *header, Payload: append([]byte{}, payload...)}
+	p.Header.CSRC = append([]uint32{}, header.CSRC...)
+	p.Header.Extensions = append([]rtp.Extension{}, header.Extensions...)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	i := int(header.SequenceNumber) % len(b.packets)
+	b.packets[i] = p
+}
+
+// get returns the packet of seq, unless it has been overwritten
+func (b *sendBuffer) get(seq uint16) *rtp.Packet {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	p := b.packets[int(seq)%len(b.packets)]
+	if p == nil || p.SequenceNumber != seq {
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,167 @@
+package wrtp
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+)
+
+var testCodecs = []webrtc.RTPCodecParameters{
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, PayloadType: 96},
+	{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: mimeTypeRTX, ClockRate: 90000, SDPFmtpLine: "apt=96"}, PayloadType: 97},
+}
+
+// capture collects the packets written by the interceptor
+type capture struct {
+	lock    sync.Mutex
+	packets []rtp.Packet
+}
+
+func (c *capture) Write(header *rtp.Header, payload []byte, _ interceptor.Attributes) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.packets = append(c.packets, rtp.Packet{Header: *header, Payload: append([]byte{}, payload...)})
+	return len(payload), nil
+}
+
+func (c *capture) wait(t *testing.T, n int) []rtp.Packet {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		c.lock.Lock()
+		if len(c.packets) >= n {
+			defer c.lock.Unlock()
+			return c.packets
+		}
+		c.lock.Unlock()
+	}
+	t.Fatalf("expected %d packets", n)
+	return nil
+}
+
+// sendAndNACK sends 10 packets from seq 65530, then NACKs 65534 and 2, and the long gone 1000,
+// the NACK is read by two readers, e.g., of the sender and of a receiver in its report
+func sendAndNACK(t *testing.T, codecs []webrtc.RTPCodecParameters) ([]rtp.Packet, *Responder, *Stats) {
+	stats := &Stats{}
+	r := NewResponder(codecs, stats)
+	i, err := r.NewInterceptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &capture{}
+	info := &interceptor.StreamInfo{SSRC: 1234, PayloadType: 96,
+		RTCPFeedback: []interceptor.RTCPFeedback{{Type: "nack"}}}
+	writer := i.BindLocalStream(info, out)
+	for n := 0; n < 10; n++ {
+		header := &rtp.Header{Version: 2, PayloadType: 96, SSRC: 1234, SequenceNumber: 65530 + uint16(n)}
+		if _, err := writer.Write(header, []byte{byte(n)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nack, err := rtcp.Marshal([]rtcp.Packet{&rtcp.TransportLayerNack{MediaSSRC: 1234,
+		Nacks: []rtcp.NackPair{{PacketID: 65534}, {PacketID: 2}, {PacketID: 1000}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < 2; n++ {
+		reader := i.BindRTCPReader(interceptor.RTCPReaderFunc(
+			func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+				return copy(b, nack), a, nil
+			}))
+		if _, _, err := reader.Read(make([]byte, 1500), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	packets := out.wait(t, 12)[10:]
+	// the missed packet is counted after the others
+	for deadline := time.Now().Add(time.Second); stats.Snapshot().Missed == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the missed packet is not counted")
+		}
+	}
+	return packets, r, stats
+}
+
+func TestRTX(t *testing.T) {
+	packets, r, stats := sendAndNACK(t, testCodecs)
+
+	for i, seq := range []uint16{65534, 2} {
+		p := packets[i]
+		if p.PayloadType != 97 || p.SSRC != r.RTXSSRC(1234) {
+			t.Errorf("RTX packet %d: payload type %d, SSRC %d", i, p.PayloadType, p.SSRC)
+		}
+		if osn := binary.BigEndian.Uint16(p.Payload); osn != seq || len(p.Payload) != 3 {
+			t.Errorf("RTX packet %d: original sequence number %d, expected %d", i, osn, seq)
+		}
+	}
+	if packets[1].SequenceNumber != packets[0].SequenceNumber+1 {
+		t.Error("RTX sequence numbers are not consecutive")
+	}
+
+	c := stats.Snapshot()
+	if c.PacketsSent != 10 || c.NACKs != 1 || c.Requested != 3 || c.Retransmitted != 2 || c.Missed != 1 ||
+		len(packets) != 2 {
+		t.Errorf("invalid stats: %s", stats)
+	}
+}
+
+func TestNoRTX(t *testing.T) {
+	packets, _, _ := sendAndNACK(t, testCodecs[:1])
+
+	for i, seq := range []uint16{65534, 2} {
+		p := packets[i]
+		if p.PayloadType != 96 || p.SSRC != 1234 || p.SequenceNumber != seq {
+			t.Errorf("retransmitted packet %d: payload type %d, SSRC %d, seq %d", i,
+				p.PayloadType, p.SSRC, p.SequenceNumber)
+		}
+	}
+}
+
+func TestOtherStream(t *testing.T) {
+	stats := &Stats{}
+	r := NewResponder(testCodecs, stats)
+	i, err := r.NewInterceptor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a simulcast layer written into the stream of SSRC 1234 with an SSRC of its own
+	out := &capture{}
+	info := &interceptor.StreamInfo{SSRC: 1234, PayloadType: 96,
+		RTCPFeedback: []interceptor.RTCPFeedback{{Type: "nack"}}}
+	writer := i.BindLocalStream(info, out)
+	for n := 0; n < 3; n++ {
+		header := &rtp.Header{Version: 2, PayloadType: 96, SSRC: 5678, SequenceNumber: 100 + uint16(n)}
+		if _, err := writer.Write(header, []byte{byte(n)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nack, err := rtcp.Marshal([]rtcp.Packet{&rtcp.TransportLayerNack{MediaSSRC: 5678,
+		Nacks: []rtcp.NackPair{{PacketID: 101}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := i.BindRTCPReader(interceptor.RTCPReaderFunc(
+		func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+			return copy(b, nack), a, nil
+		}))
+	if _, _, err := reader.Read(make([]byte, 1500), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// its RTX SSRC is not signaled, so it is retransmitted as is
+	p := out.wait(t, 4)[3]
+	if p.PayloadType != 96 || p.SSRC != 5678 || p.SequenceNumber != 101 {
+		t.Errorf("retransmitted packet: payload type %d, SSRC %d, seq %d", p.PayloadType,
+			p.SSRC, p.SequenceNumber)
+	}
+}
@@ -0,0 +1,131 @@
+package wsession
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wkms"
+)
+
+// KMSLoopback drives the media server directly over JSON-RPC, without an application server:
+// it creates a pipeline with a WebRtcEndpoint connected back to itself, sends file and writes
+// the looped-back video into output. The pipeline is released when the whole file is sent.
+func KMSLoopback(cfg Config, file, output string) error {
+	c, err := wkms.Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	pipeline, err := c.CreateMediaPipeline()
+	if err != nil {
+		return err
+	}
+	defer pipeline.Release()
+
+	ep, err := pipeline.CreateWebRtcEndpoint()
+	if err != nil {
+		return err
+	}
+
+	if err := ep.Connect(&ep.MediaElement); err != nil {
+		return err
+	}
+
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	// remote ICE candidates
+	if _, err := ep.OnIceCandidateFound(func(c webrtc.ICECandidateInit) {
+		if err := p.AddRemoteCandidate(c); err != nil {
+			log.Println("cannot add remote ICE candidate:", err)
+		}
+	}); err != nil {
+		return err
+	}
+
+	// local ICE candidates, held back until the endpoint has the offer
+	var lock sync.Mutex
+	var pending []webrtc.ICECandidateInit
+	offered := false
+	addCandidate := func(c webrtc.ICECandidateInit) {
+		if err := ep.AddIceCandidate(c); err != nil {
+			log.Println("cannot add local ICE candidate:", err)
+		}
+	}
+	p.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i == nil {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if !offered {
+			pending = append(pending, i.ToJSON())
+			return
+		}
+		// do not block the PeerConnection
+		go addCandidate(i.ToJSON())
+	})
+
+	videoTrack, err := p.NewVideoTrack(file, cfg.Codec, "pion")
+	if err != nil {
+		return err
+	}
+
+	rtpSender, err := p.AddTrack(videoTrack)
+	if err != nil {
+		return err
+	}
+
+	sender, err := p.SendFile(rtpSender, file, cfg.Codec, videoTrack)
+	if err != nil {
+		return err
+	}
+	receiver, err := p.NewReceiver(output)
+	if err != nil {
+		return err
+	}
+	p.OnTrack(receiver.OnTrack)
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return err
+	}
+
+	answer, err := ep.ProcessOffer(offer)
+	if err != nil {
+		return err
+	}
+
+	lock.Lock()
+	offered = true
+	candidates := pending
+	pending = nil
+	lock.Unlock()
+	for _, c := range candidates {
+		addCandidate(c)
+	}
+
+	if err := p.SetAnswer(answer); err != nil {
+		return err
+	}
+
+	if err := ep.GatherCandidates(); err != nil {
+		return err
+	}
+
+	log.Println("connection setup ready")
+
+	select {
+	case <-sender.Done():
+		return nil
+	case <-p.Done().Done():
+		return errors.New("ICE connection disconnected/failed")
+	}
+}
@@ -0,0 +1,360 @@
+package wsession
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	// size of the per-connection read buffer of the ICE TCP mux, in packets
+	tcpMuxReadBufferSize = 8
+	// pion defaults, SetICETimeouts takes all three
+	defaultICEDisconnectedTimeout = 5 * time.Second
+	defaultICEFailedTimeout       = 25 * time.Second
+	defaultICEKeepaliveInterval   = 2 * time.Second
+)
+
+// ParseNetworkTypes parses a comma-separated list of ICE network types, e.g., udp4,tcp6.
+func ParseNetworkTypes(s string) ([]webrtc.NetworkType, error) {
+	var types []webrtc.NetworkType
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		t, err := webrtc.NewNetworkType(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network type %q: must be one of udp4, udp6, tcp4, "+
+				"tcp6", n)
+		}
+		types = append(types, t)
+	}
+	if len(types) == 0 {
+		return nil, errors.New("no network type given")
+	}
+	return types, nil
+}
+
+// setupNetwork applies the network types, the ICE interface and the TURN transport of the
+// config to s, the returned closer is the ICE TCP listener if a TCP network type is used
+func setupNetwork(s *webrtc.SettingEngine, cfg Config) (io.Closer, error) {
+	types := cfg.NetworkTypes
+	if len(types) == 0 {
+		types = []webrtc.NetworkType{webrtc.NetworkTypeUDP4}
+	}
+	s.SetNetworkTypes(types)
+
+	// disable Multicast DNS
+	s.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+
+	if cfg.VNet != nil {
+		s.SetVNet(cfg.VNet)
+	}
+	s.SetInterfaceFilter(interfaceFilter(cfg))
+
+	if len(cfg.NAT1To1IPs) > 0 {
+		typ := cfg.NAT1To1CandidateType
+		if typ == webrtc.ICECandidateType(0) {
+			typ = webrtc.ICECandidateTypeHost
+		}
+		log.Printf("using NAT 1:1 IPs %v for %s candidates", cfg.NAT1To1IPs, typ)
+		s.SetNAT1To1IPs(cfg.NAT1To1IPs, typ)
+	}
+
+	if cfg.PortMin != 0 || cfg.PortMax != 0 {
+		if err := s.SetEphemeralUDPPortRange(cfg.PortMin, cfg.PortMax); err != nil {
+			return nil, fmt.Errorf("invalid UDP port range %d-%d: %w", cfg.PortMin, cfg.PortMax,
+				err)
+		}
+	}
+
+	if cfg.ICEDisconnectedTimeout != 0 || cfg.ICEFailedTimeout != 0 {
+		disconnected, failed := cfg.ICEDisconnectedTimeout, cfg.ICEFailedTimeout
+		if disconnected == 0 {
+			disconnected = defaultICEDisconnectedTimeout
+		}
+		if failed == 0 {
+			failed = defaultICEFailedTimeout
+		}
+		s.SetICETimeouts(disconnected, failed, defaultICEKeepaliveInterval)
+	}
+
+	// TURN over TCP/TLS: pion dials TLS with certificate verification on and gives no way to
+	// turn it off, so we dial ourselves, insecure for self-signed certificates like the one of
+	// the embedded TURN server
+	if cfg.TurnURI != "" {
+		uri, err := ice.ParseURL(cfg.TurnURI)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TURN URI %q: %w", cfg.TurnURI, err)
+		}
+		if uri.Proto == ice.ProtoTypeTCP && cfg.VNet == nil {
+			s.SetICEProxyDialer(turnDialer{tls: uri.Scheme == ice.SchemeTypeTURNS})
+		}
+	}
+
+	// passive TCP host candidates need a listener, vnet has no TCP so skip it there
+	if cfg.VNet != nil || !hasTCP(types) {
+		return nil, nil
+	}
+
+	network, addr := "tcp", ":0"
+	if cfg.ICEAddr != "" {
+		addr = net.JoinHostPort(cfg.ICEAddr, "0")
+	}
+	if !hasNetworkType(types, webrtc.NetworkTypeTCP6) {
+		network = "tcp4"
+	} else if !hasNetworkType(types, webrtc.NetworkTypeTCP4) {
+		network = "tcp6"
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("ICE TCP listener: %w", err)
+	}
+	log.Println("ICE TCP listener:", l.Addr())
+
+	mux := ice.NewTCPMuxDefault(ice.TCPMuxParams{Listener: l, ReadBufferSize: tcpMuxReadBufferSize})
+	s.SetICETCPMux(mux)
+
+	return mux, nil
+}
+
+func hasTCP(types []webrtc.NetworkType) bool {
+	return hasNetworkType(types, webrtc.NetworkTypeTCP4) ||
+		hasNetworkType(types, webrtc.NetworkTypeTCP6)
+}
+
+func hasNetworkType(types []webrtc.NetworkType, t webrtc.NetworkType) bool {
+	for _, n := range types {
+		if n == t {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceFilter selects the interfaces to gather ICE candidates on from the ICE address,
+// the CIDRs and the excluded interfaces of the config
+func interfaceFilter(cfg Config) func(string) bool {
+	// filter ice candidates: if the ICE address is given, we generate ICE candidates only on
+	// the interface that has this IP: this removes lots of useless ICE trials
+	iceIface := ""
+	if cfg.ICEAddr != "" && cfg.VNet == nil {
+		var err error
+		if iceIface, err = GetIfaceForAddr(cfg.ICEAddr); err == nil {
+			log.Println("using ICE interface:", iceIface)
+		} else {
+			log.Println("failed to use ICE interface:", err)
+		}
+	}
+
+	return func(name string) bool {
+		if iceIface != "" && name != iceIface {
+			return false
+		}
+		if cfg.ExcludeInterfaces != nil && cfg.ExcludeInterfaces.MatchString(name) {
+			return false
+		}
+		// the interfaces of a vnet are not known to the host
+		if len(cfg.CIDRs) > 0 && cfg.VNet == nil {
+			return ifaceInCIDRs(name, cfg.CIDRs)
+		}
+		return true
+	}
+}
+
+// ifaceInCIDRs checks whether the interface has an address in one of the networks
+func ifaceInCIDRs(name string, cidrs []*net.IPNet) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && inCIDRs(ipnet.IP, cidrs) {
+			return true
+		}
+	}
+	return false
+}
+
+func inCIDRs(ip net.IP, cidrs []*net.IPNet) bool {
+	for _, n := range cidrs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// relayOnly tells whether only relay candidates are gathered, this is the default with a TURN
+// server
+func relayOnly(cfg Config) bool {
+	if len(cfg.CandidateTypes) == 0 {
+		return cfg.TurnURI != ""
+	}
+	for _, t := range cfg.CandidateTypes {
+		if t != webrtc.ICECandidateTypeRelay {
+			return false
+		}
+	}
+	return true
+}
+
+// hostOnly tells whether only host candidates are gathered, then the STUN/TURN server is not
+// used at all, so no srflx and relay candidates exist to be used in connectivity checks
+func hostOnly(cfg Config) bool {
+	for _, t := range cfg.CandidateTypes {
+		if t != webrtc.ICECandidateTypeHost {
+			return false
+		}
+	}
+	return len(cfg.CandidateTypes) > 0
+}
+
+// candidateFilter returns the filter of the local ICE candidates signaled to the remote. The
+// setting engine of pion v3.1 enforces the relay-only and host-only cases, the network types
+// and the interfaces, but it cannot skip the other candidate types or the addresses of an
+// interface, so the unwanted types are dropped here, and host candidates must be in the CIDRs
+// unless they carry a NAT 1:1 IP. The candidates dropped here are still gathered, and ICE may
+// use them in connectivity checks, where the remote learns them as peer-reflexive.
+func candidateFilter(cfg Config) func(*webrtc.ICECandidate) bool {
+	natHost := len(cfg.NAT1To1IPs) > 0 && (cfg.NAT1To1CandidateType == webrtc.ICECandidateType(0) ||
+		cfg.NAT1To1CandidateType == webrtc.ICECandidateTypeHost)
+
+	return func(c *webrtc.ICECandidate) bool {
+		if len(cfg.CandidateTypes) > 0 {
+			found := false
+			for _, t := range cfg.CandidateTypes {
+				if c.Typ == t {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		if c.Typ == webrtc.ICECandidateTypeHost && len(cfg.CIDRs) > 0 && !natHost {
+			ip := net.ParseIP(c.Address)
+			return ip != nil && inCIDRs(ip, cfg.CIDRs)
+		}
+		return true
+	}
+}
+
+// ParseCandidateTypes parses a comma-separated list of ICE candidate types, e.g., host,relay.
+func ParseCandidateTypes(s string) ([]webrtc.ICECandidateType, error) {
+	var types []webrtc.ICECandidateType
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		t, err := webrtc.NewICECandidateType(n)
+		if err != nil || t == webrtc.ICECandidateTypePrflx {
+			return nil, fmt.Errorf("invalid candidate type %q: must be one of host, srflx, relay",
+				n)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// ParseCIDRs parses a comma-separated list of networks, e.g., 10.0.0.0/8,fd00::/8.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", n, err)
+		}
+		cidrs = append(cidrs, ipnet)
+	}
+	return cidrs, nil
+}
+
+// ParsePortRange parses a UDP port range, e.g., 10000-20000, an empty range means any port.
+func ParsePortRange(s string) (uint16, uint16, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q: must be <min>-<max>", s)
+	}
+	min, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	max, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %w", s, err)
+	}
+	if min > max {
+		return 0, 0, fmt.Errorf("invalid port range %q: min is larger than max", s)
+	}
+	return uint16(min), uint16(max), nil
+}
+
+// turnDialer connects to a TURN server over TCP or TLS
+type turnDialer struct {
+	tls bool
+}
+
+func (d turnDialer) Dial(network, addr string) (net.Conn, error) {
+	if d.tls {
+		return tls.Dial(network, addr, &tls.Config{InsecureSkipVerify: true})
+	}
+	return net.Dial(network, addr)
+}
+
+// GetIfaceForAddr returns the name of the interface that has the IPv4 or IPv6 address addr.
+func GetIfaceForAddr(addr string) (string, error) {
+	if addr == "" {
+		return "", errors.New("no IP given")
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP: %s", addr)
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Println("could not obtain local interface list:", err)
+		return "", errors.New("net.Interfaces")
+	}
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			log.Printf("could not obtain IP address for interface %s: %v",
+				i.Name, err)
+			return "", errors.New("net.Addrs")
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipnet.IP.Equal(ip) {
+				return i.Name, nil
+			}
+		}
+	}
+	return "", errors.New("addr not found")
+}
@@ -0,0 +1,157 @@
+package wsession
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wmsg"
+)
+
+// Presenter publishes a media file in the one-to-many tutorial.
+func Presenter(cfg Config, file string) error {
+	sig, err := Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	p.ReceiveCandidates(sig)
+	p.SendCandidates(sig)
+
+	videoTrack, err := p.NewVideoTrack(file, cfg.Codec, "pion")
+	if err != nil {
+		return err
+	}
+
+	rtpSender, err := p.AddTrack(videoTrack)
+	if err != nil {
+		return err
+	}
+
+	sender, err := p.SendFile(rtpSender, file, cfg.Codec, videoTrack)
+	if err != nil {
+		return err
+	}
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return err
+	}
+
+	sig.Send(wmsg.NewPresenterRequest(offer))
+
+	m, err := sig.Expect("presenterResponse")
+	if err != nil {
+		return err
+	}
+	res, err := wmsg.NewPresenterResponse(m)
+	if err != nil {
+		return err
+	}
+	if res.Response != "accepted" {
+		return fmt.Errorf("presenter rejected with message: %s", res.Msg)
+	}
+
+	if err := p.SetAnswer(res.Sdp); err != nil {
+		return err
+	}
+
+	log.Println("connection setup ready")
+
+	return waitStop(sig, p, sender.Done())
+}
+
+// Viewer receives the presenter's media in the one-to-many tutorial and writes it to a file.
+func Viewer(cfg Config, file string) error {
+	sig, err := Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	p.ReceiveCandidates(sig)
+	p.SendCandidates(sig)
+
+	// Allow us to receive 1 video track
+	if _, err = p.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return err
+	}
+
+	receiver, err := p.NewReceiver(file)
+	if err != nil {
+		return err
+	}
+	p.OnTrack(receiver.OnTrack)
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return err
+	}
+
+	sig.Send(wmsg.NewViewerRequest(offer))
+
+	m, err := sig.Expect("viewerResponse")
+	if err != nil {
+		return err
+	}
+	res, err := wmsg.NewViewerResponse(m)
+	if err != nil {
+		return err
+	}
+	if res.Response != "accepted" {
+		return fmt.Errorf("viewer rejected with message: %s", res.Msg)
+	}
+
+	if err := p.SetAnswer(res.Sdp); err != nil {
+		return err
+	}
+
+	log.Println("connection setup ready")
+
+	return waitStop(sig, p, nil)
+}
+
+// waitStop blocks until the application server stops the communication, the PeerConnection
+// goes down or done is closed.
+func waitStop(sig *Signaling, p *Peer, done <-chan struct{}) error {
+	stop := make(chan error, 1)
+	go func() {
+		for {
+			m, err := sig.Recv()
+			if err != nil {
+				stop <- err
+				return
+			}
+			if _, err := wmsg.NewStopCommunication(m); err == nil {
+				log.Println("communication stopped by the application server")
+				stop <- nil
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-stop:
+		return err
+	case <-p.Done().Done():
+		return errors.New("ICE connection disconnected/failed")
+	case <-done:
+		return nil
+	}
+}
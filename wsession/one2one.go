@@ -0,0 +1,243 @@
+package wsession
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wmsg"
+)
+
+// register registers user with the one-to-one application server, a rejected registration is
+// not fatal as the user may have been left registered by a previous run.
+func register(sig *Signaling, user string) error {
+	log.Println("registering user:", user)
+	sig.Send(wmsg.NewRegisterRequest(user))
+
+	m, err := sig.Expect("registerResponse")
+	if err != nil {
+		return err
+	}
+	res, err := wmsg.NewRegisterResponse(m)
+	if err != nil {
+		return err
+	}
+	if res.Response != "accepted" {
+		log.Printf("WARN: could not register caller/callee %s: %s\n", user, res.Response)
+	}
+
+	return nil
+}
+
+// Caller registers as user, calls peer in the one-to-one tutorial and sends file until the
+// whole file is sent.
+func Caller(cfg Config, user, peer, file string) error {
+	sig, err := Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	if err := register(sig, user); err != nil {
+		return err
+	}
+
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	p.ReceiveCandidates(sig)
+	p.SendCandidates(sig)
+
+	log.Printf("starting call: %s -> %s\n", user, peer)
+
+	videoTrack, err := p.NewVideoTrack(file, cfg.Codec, "pion")
+	if err != nil {
+		return err
+	}
+
+	rtpSender, err := p.AddTrack(videoTrack)
+	if err != nil {
+		return err
+	}
+
+	sender, err := p.SendFile(rtpSender, file, cfg.Codec, videoTrack)
+	if err != nil {
+		return err
+	}
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return err
+	}
+
+	sig.Send(wmsg.NewCallRequest(user, peer, offer))
+
+	m, err := sig.Expect("callResponse")
+	if err != nil {
+		return err
+	}
+	res, err := wmsg.NewCallResponse(m)
+	if err != nil {
+		return err
+	}
+	log.Println("call response:", res.Response)
+	if res.Response != "accepted" {
+		return fmt.Errorf("call rejected with message: %s", res.Msg)
+	}
+
+	if err := p.SetAnswer(res.Sdp); err != nil {
+		return err
+	}
+
+	log.Println("connection setup ready")
+
+	err = waitStop(sig, p, sender.Done())
+	sig.Send(wmsg.NewStopRequest())
+
+	return err
+}
+
+// Callee registers as user, accepts the first incoming call in the one-to-one tutorial and
+// writes the received video into file until the call is stopped.
+func Callee(cfg Config, user, file string) error {
+	sig, err := Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	if err := register(sig, user); err != nil {
+		return err
+	}
+
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	p.ReceiveCandidates(sig)
+	p.SendCandidates(sig)
+
+	// Allow us to receive 1 video track
+	if _, err = p.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+
+	receiver, err := p.NewReceiver(file)
+	if err != nil {
+		return err
+	}
+	p.OnTrack(receiver.OnTrack)
+
+	m, err := sig.Expect("incomingCall")
+	if err != nil {
+		return err
+	}
+	req, err := wmsg.NewIncomingCallRequest(m)
+	if err != nil {
+		return err
+	}
+	log.Println("new call from:", req.From)
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return err
+	}
+
+	sig.Send(wmsg.NewIncomingCallResponse(req.From, "accept", offer))
+
+	m, err = sig.Expect("startCommunication")
+	if err != nil {
+		return err
+	}
+	start, err := wmsg.NewStartCommunication(m)
+	if err != nil {
+		return err
+	}
+
+	if err := p.SetAnswer(start.Sdp); err != nil {
+		return err
+	}
+
+	log.Println("connection setup ready")
+
+	return waitStop(sig, p, nil)
+}
+
+// MagicMirror sends file to the magic mirror tutorial and writes the mirrored video into
+// output until the whole file is sent.
+func MagicMirror(cfg Config, file, output string) error {
+	sig, err := Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	p.ReceiveCandidates(sig)
+	p.SendCandidates(sig)
+
+	receiver, err := p.NewReceiver(output)
+	if err != nil {
+		return err
+	}
+	p.OnTrack(receiver.OnTrack)
+
+	videoTrack, err := p.NewVideoTrack(file, cfg.Codec, "pion")
+	if err != nil {
+		return err
+	}
+
+	rtpSender, err := p.AddTrack(videoTrack)
+	if err != nil {
+		return err
+	}
+
+	sender, err := p.SendFile(rtpSender, file, cfg.Codec, videoTrack)
+	if err != nil {
+		return err
+	}
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return err
+	}
+
+	sig.Send(wmsg.NewMagicMirrorRequest(offer))
+
+	m, err := sig.Expect("startResponse")
+	if err != nil {
+		return err
+	}
+	res, err := wmsg.NewMagicMirrorResponse(m)
+	if err != nil {
+		return err
+	}
+
+	if err := p.SetAnswer(res.Sdp); err != nil {
+		return err
+	}
+
+	log.Println("connection setup ready")
+
+	select {
+	case <-sender.Done():
+	case <-p.Done().Done():
+		return errors.New("ICE connection disconnected/failed")
+	}
+
+	sig.Send(wmsg.NewStopRequest())
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package wsession
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wmsg"
+)
+
+// give the media server some time to flush the tail of the stream into the recording
+const recordDrainTimeout = 2 * time.Second
+
+// Recorder runs the recorder tutorial: it sends file to the media server to be recorded, then
+// plays back the recording into output and compares the number of frames received with the
+// number of frames sent. An error is returned if more than tolerance percent of the frames
+// are missing.
+func Recorder(cfg Config, file, output string, tolerance float64) error {
+	sig, err := Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	sent, err := record(sig, cfg, file)
+	if err != nil {
+		return fmt.Errorf("record: %w", err)
+	}
+
+	received, err := play(sig, cfg, output)
+	if err != nil {
+		return fmt.Errorf("play: %w", err)
+	}
+
+	loss := 0.0
+	if sent > 0 {
+		loss = 100.0 * float64(sent-received) / float64(sent)
+	}
+	log.Printf("frames sent: %d, frames played back: %d, missing: %.2f%%", sent, received, loss)
+
+	if sent == 0 || loss > tolerance {
+		return fmt.Errorf("frame count mismatch: sent %d, played back %d (tolerance: %.2f%%)",
+			sent, received, tolerance)
+	}
+
+	return nil
+}
+
+// record sends the whole file and returns the number of frames sent
+func record(sig *Signaling, cfg Config, file string) (int, error) {
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+
+	p.ReceiveCandidates(sig)
+	p.SendCandidates(sig)
+
+	videoTrack, err := p.NewVideoTrack(file, cfg.Codec, "pion")
+	if err != nil {
+		return 0, err
+	}
+
+	rtpSender, err := p.AddTrack(videoTrack)
+	if err != nil {
+		return 0, err
+	}
+
+	sender, err := p.SendFile(rtpSender, file, cfg.Codec, videoTrack)
+	if err != nil {
+		return 0, err
+	}
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return 0, err
+	}
+
+	sig.Send(wmsg.NewStartRequest(offer))
+
+	m, err := sig.Expect("startResponse")
+	if err != nil {
+		return 0, err
+	}
+	res, err := wmsg.NewStartResponse(m)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := p.SetAnswer(res.Sdp); err != nil {
+		return 0, err
+	}
+
+	log.Println("recording started")
+
+	select {
+	case <-sender.Done():
+	case <-p.Done().Done():
+		return sender.Frames(), errors.New("ICE connection disconnected/failed")
+	}
+
+	time.Sleep(recordDrainTimeout)
+
+	log.Println("stopping recording")
+	sig.Send(wmsg.NewStopRequest())
+
+	return sender.Frames(), nil
+}
+
+// play receives the recording into output and returns the number of frames received
+func play(sig *Signaling, cfg Config, output string) (int, error) {
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+
+	p.ReceiveCandidates(sig)
+	p.SendCandidates(sig)
+
+	if _, err = p.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return 0, err
+	}
+
+	receiver, err := p.NewReceiver(output)
+	if err != nil {
+		return 0, err
+	}
+	p.OnTrack(receiver.OnTrack)
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return 0, err
+	}
+
+	sig.Send(wmsg.NewPlayRequest(offer))
+
+	m, err := sig.Expect("playResponse")
+	if err != nil {
+		return 0, err
+	}
+	res, err := wmsg.NewPlayResponse(m)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := p.SetAnswer(res.Sdp); err != nil {
+		return 0, err
+	}
+
+	log.Println("playback started")
+
+	end := make(chan error, 1)
+	go func() {
+		_, err := sig.Expect("playEnd")
+		end <- err
+	}()
+
+	select {
+	case err = <-end:
+	case <-p.Done().Done():
+		err = errors.New("ICE connection disconnected/failed")
+	}
+
+	log.Println("playback finished")
+
+	return receiver.Frames(), err
+}
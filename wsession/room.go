@@ -0,0 +1,242 @@
+package wsession
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wmsg"
+)
+
+// Room is a participant of the group-call tutorial. One PeerConnection publishes our own
+// video and there is a separate PeerConnection for receiving the video of each remote
+// participant.
+type Room struct {
+	cfg  Config
+	room string
+	name string
+	// media file to publish
+	file string
+	// prefix of the per-participant output files
+	output string
+
+	sig   *Signaling
+	lock  sync.Mutex
+	peers map[string]*Peer
+}
+
+// JoinRoom joins the named room, publishes file and writes the stream of each remote
+// participant into a file named <output>_<participant>, the participant goes before the
+// extension of output if any. Blocks until the signaling connection is closed.
+func JoinRoom(cfg Config, room, name, file, output string) error {
+	sig, err := Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	r := &Room{
+		cfg:    cfg,
+		room:   room,
+		name:   name,
+		file:   file,
+		output: output,
+		sig:    sig,
+		peers:  map[string]*Peer{},
+	}
+	defer r.close()
+	defer sig.Send(wmsg.NewLeaveRoomRequest())
+
+	sig.OnICECandidate(r.onICECandidate)
+
+	log.Printf("joining room %s as %s", room, name)
+	sig.Send(wmsg.NewJoinRoomRequest(name, room))
+
+	for {
+		m, err := sig.Recv()
+		if err != nil {
+			return err
+		}
+
+		switch m["id"].(string) {
+		case "existingParticipants":
+			ep, err := wmsg.NewExistingParticipants(m)
+			if err != nil {
+				return err
+			}
+			if err := r.publish(); err != nil {
+				return err
+			}
+			for _, p := range ep.Data {
+				if err := r.subscribe(p); err != nil {
+					log.Printf("cannot receive video from %s: %s", p, err)
+				}
+			}
+		case "newParticipantArrived":
+			np, err := wmsg.NewNewParticipantArrived(m)
+			if err != nil {
+				return err
+			}
+			if err := r.subscribe(np.Name); err != nil {
+				log.Printf("cannot receive video from %s: %s", np.Name, err)
+			}
+		case "participantLeft":
+			pl, err := wmsg.NewParticipantLeft(m)
+			if err != nil {
+				return err
+			}
+			r.remove(pl.Name)
+		case "receiveVideoAnswer":
+			ra, err := wmsg.NewReceiveVideoAnswer(m)
+			if err != nil {
+				return err
+			}
+			p := r.peer(ra.Name)
+			if p == nil {
+				log.Printf("receiveVideoAnswer for unknown participant %s", ra.Name)
+				continue
+			}
+			if err := p.SetAnswer(ra.Sdp); err != nil {
+				log.Printf("participant %s: %s", ra.Name, err)
+			}
+		default:
+			log.Println("unhandled message:", m["id"])
+		}
+	}
+}
+
+func (r *Room) peer(name string) *Peer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.peers[name]
+}
+
+func (r *Room) addPeer(name string) (*Peer, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if _, ok := r.peers[name]; ok {
+		return nil, fmt.Errorf("participant %s already exists", name)
+	}
+
+	p, err := NewPeer(r.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i != nil {
+			r.sig.Send(wmsg.NewNamedOnICECandidate(i, name))
+		}
+	})
+
+	r.peers[name] = p
+	return p, nil
+}
+
+func (r *Room) remove(name string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if p, ok := r.peers[name]; ok {
+		log.Printf("participant %s left", name)
+		p.Close()
+		delete(r.peers, name)
+	}
+}
+
+func (r *Room) close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for name, p := range r.peers {
+		p.Close()
+		delete(r.peers, name)
+	}
+}
+
+// remote ICE candidates are tagged with the name of the participant
+func (r *Room) onICECandidate(m map[string]interface{}) {
+	name, _ := m["name"].(string)
+	p := r.peer(name)
+	if p == nil {
+		log.Printf("ICE candidate for unknown participant %s", name)
+		return
+	}
+
+	c, err := ParseICECandidate(m)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := p.AddRemoteCandidate(c); err != nil {
+		log.Println("cannot add remote ICE candidate:", err)
+	}
+}
+
+// publish our own video: this is a receiveVideoFrom request sent with our own name
+func (r *Room) publish() error {
+	p, err := r.addPeer(r.name)
+	if err != nil {
+		return err
+	}
+
+	videoTrack, err := p.NewVideoTrack(r.file, r.cfg.Codec, r.name)
+	if err != nil {
+		return err
+	}
+
+	rtpSender, err := p.AddTrack(videoTrack)
+	if err != nil {
+		return err
+	}
+
+	if _, err := p.SendFile(rtpSender, r.file, r.cfg.Codec, videoTrack); err != nil {
+		return err
+	}
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("publishing %s in room %s", r.file, r.room)
+	r.sig.Send(wmsg.NewReceiveVideoFromRequest(r.name, offer))
+
+	return nil
+}
+
+// subscribe to the video of a remote participant
+func (r *Room) subscribe(name string) error {
+	p, err := r.addPeer(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err = p.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		return err
+	}
+
+	ext := path.Ext(r.output)
+	file := fmt.Sprintf("%s_%s%s", strings.TrimSuffix(r.output, ext), name, ext)
+	receiver, err := p.NewReceiver(file)
+	if err != nil {
+		return err
+	}
+	p.OnTrack(receiver.OnTrack)
+
+	offer, err := p.CreateLocalOffer()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("receiving video from %s into %s", name, file)
+	r.sig.Send(wmsg.NewReceiveVideoFromRequest(name, offer))
+
+	return nil
+}
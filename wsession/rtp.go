@@ -0,0 +1,222 @@
+package wsession
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wcodec"
+	"webrtc-client-go/wmsg"
+	"webrtc-client-go/wrtp"
+)
+
+// createRTPOffer creates an offer for plain RTP: there is no ICE, the address comes from the
+// first local ICE candidate so gathering must complete, and there is no DTLS, so the protocol
+// is rewritten to RTP/AVP. The plain RTP streams are not retransmitted, so RTX is not offered.
+func (p *Peer) createRTPOffer() (*webrtc.SessionDescription, error) {
+	gatherComplete := webrtc.GatheringCompletePromise(p.PeerConnection)
+
+	offer, err := p.CreateOffer(nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create offer: %w", err)
+	}
+	if err = p.SetLocalDescription(offer); err != nil {
+		return nil, fmt.Errorf("cannot set local SDP: %w", err)
+	}
+	<-gatherComplete
+
+	return rewriteProto(p.LocalDescription())
+}
+
+// rewriteProto rewrites the protocol of the first media section to RTP/AVP and removes its RTX
+// payload types
+func rewriteProto(desc *webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse SDP: %w", err)
+	}
+
+	if len(parsed.MediaDescriptions) > 0 {
+		m := parsed.MediaDescriptions[0]
+		m.MediaName.Protos = []string{"RTP", "AVP"}
+
+		rtx := map[string]bool{}
+		for _, a := range m.Attributes {
+			if f := strings.Fields(a.Value); a.Key == "rtpmap" && len(f) == 2 &&
+				strings.HasPrefix(strings.ToLower(f[1]), "rtx/") {
+				rtx[f[0]] = true
+			}
+		}
+		formats := m.MediaName.Formats[:0]
+		for _, f := range m.MediaName.Formats {
+			if !rtx[f] {
+				formats = append(formats, f)
+			}
+		}
+		m.MediaName.Formats = formats
+		attributes := m.Attributes[:0]
+		for _, a := range m.Attributes {
+			switch a.Key {
+			case "rtpmap", "fmtp", "rtcp-fb":
+				if rtx[strings.SplitN(a.Value, " ", 2)[0]] {
+					continue
+				}
+			}
+			attributes = append(attributes, a)
+		}
+		m.Attributes = attributes
+	}
+
+	sdp, err := parsed.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("cannot serialize SDP: %w", err)
+	}
+
+	return &webrtc.SessionDescription{SDP: string(sdp), Type: desc.Type}, nil
+}
+
+// waitRTPStop blocks until the call is stopped by the peer or the signaling connection closes
+func waitRTPStop(sig *Signaling) error {
+	if _, err := sig.Expect("stopCommunication"); err != nil && err != ErrClosed {
+		return err
+	}
+	log.Println("call stopped")
+	return nil
+}
+
+// RTPCaller registers as user, calls peer in the one-to-one tutorial with a plain RTP offer and
+// sends file over RTP.
+func RTPCaller(cfg Config, user, peer, file string) error {
+	if wrtp.IsCaptureFile(file) {
+		return fmt.Errorf("captures are replayed into WebRTC calls only: %s", file)
+	}
+	sig, err := Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	if err := register(sig, user); err != nil {
+		return err
+	}
+
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	log.Printf("starting RTP call: %s -> %s\n", user, peer)
+
+	videoTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: cfg.Codec}, "video", "pion")
+	if err != nil {
+		return err
+	}
+	if _, err = p.AddTrack(videoTrack); err != nil {
+		return err
+	}
+
+	offer, err := p.createRTPOffer()
+	if err != nil {
+		return err
+	}
+
+	sig.Send(wmsg.NewCallRequest(user, peer, offer.SDP))
+
+	m, err := sig.Expect("callResponse")
+	if err != nil {
+		return err
+	}
+	res, err := wmsg.NewCallResponse(m)
+	if err != nil {
+		return err
+	}
+	log.Println("call response:", res.Response)
+	if res.Response != "accepted" {
+		return fmt.Errorf("call rejected with message: %s", res.Msg)
+	}
+
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: res.Sdp}
+	log.Printf("Remote session description received: %v\n", answer)
+
+	// the PeerConnection was only needed for the offer
+	p.Close()
+
+	log.Println("connection setup ready")
+	// the RTP and RTCP sockets close with the call
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wcodec.RTPSendFile(ctx, offer, &answer, file, cfg.Codec, videoTrack, cfg.Capture)
+
+	return waitRTPStop(sig)
+}
+
+// RTPCallee registers as user, accepts the first incoming call in the one-to-one tutorial with
+// a plain RTP offer and writes the video received over RTP into file.
+func RTPCallee(cfg Config, user, file string) error {
+	sig, err := Dial(cfg.Url, cfg.TLS, cfg.KeyLog)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	if err := register(sig, user); err != nil {
+		return err
+	}
+
+	p, err := NewPeer(cfg)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	// allow us to receive 1 video track
+	if _, err = p.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		return err
+	}
+
+	m, err := sig.Expect("incomingCall")
+	if err != nil {
+		return err
+	}
+	req, err := wmsg.NewIncomingCallRequest(m)
+	if err != nil {
+		return err
+	}
+	log.Println("new call from:", req.From)
+
+	offer, err := p.createRTPOffer()
+	if err != nil {
+		return err
+	}
+
+	sig.Send(wmsg.NewIncomingCallResponse(req.From, "accept", offer.SDP))
+
+	m, err = sig.Expect("startCommunication")
+	if err != nil {
+		return err
+	}
+	start, err := wmsg.NewStartCommunication(m)
+	if err != nil {
+		return err
+	}
+
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: start.Sdp}
+	log.Printf("Remote session description received: %v\n", answer)
+
+	// the PeerConnection was only needed for the offer
+	p.Close()
+
+	log.Println("connection setup ready")
+	// key frame requests, freeze checks and the RTP and RTCP sockets stop with the call
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wcodec.RTPReceiveTrack(ctx, offer, &answer, cfg.Codec, file, keyframePolicy(cfg), cfg.FreezeThreshold,
+		cfg.Capture)
+
+	return waitRTPStop(sig)
+}
@@ -0,0 +1,59 @@
+package wsession
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseSSRCLine parses an a=ssrc:<ssrc> <attribute> SDP line
+func parseSSRCLine(line string) (uint32, string, bool) {
+	if !strings.HasPrefix(line, "a=ssrc:") {
+		return 0, "", false
+	}
+	f := strings.SplitN(strings.TrimPrefix(line, "a=ssrc:"), " ", 2)
+	ssrc, err := strconv.ParseUint(f[0], 10, 32)
+	if err != nil || len(f) < 2 {
+		return 0, "", false
+	}
+	return uint32(ssrc), f[1], true
+}
+
+// addRTXGroups signals the RTX streams of the senders in an SDP offer: pion does not, so every
+// media SSRC with RTX gets an FID group with its RTX SSRC after its last a=ssrc line
+func (p *Peer) addRTXGroups(sdp string) string {
+	groups := map[uint32]uint32{}
+	for _, sender := range p.GetSenders() {
+		for _, e := range sender.GetParameters().Encodings {
+			groups[uint32(e.SSRC)] = p.responder.RTXSSRC(uint32(e.SSRC))
+		}
+	}
+
+	lines := strings.Split(sdp, "\r\n")
+	out := make([]string, 0, len(lines))
+	cnames := map[uint32]string{}
+	for i, line := range lines {
+		out = append(out, line)
+		ssrc, attr, ok := parseSSRCLine(line)
+		if !ok {
+			continue
+		}
+		rtx, ok := groups[ssrc]
+		if !ok || rtx == 0 {
+			continue
+		}
+		if strings.HasPrefix(attr, "cname:") {
+			cnames[ssrc] = attr
+		}
+		if i+1 < len(lines) {
+			if next, _, ok := parseSSRCLine(lines[i+1]); ok && next == ssrc {
+				continue
+			}
+		}
+		out = append(out, fmt.Sprintf("a=ssrc-group:FID %d %d", ssrc, rtx))
+		if cname, ok := cnames[ssrc]; ok {
+			out = append(out, fmt.Sprintf("a=ssrc:%d %s", rtx, cname))
+		}
+	}
+	return strings.Join(out, "\r\n")
+}
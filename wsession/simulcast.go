@@ -0,0 +1,148 @@
+package wsession
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wcodec"
+	"webrtc-client-go/wrtp"
+)
+
+// simulcastTracks returns the simulcast tracks of the senders by the MID of their transceiver
+func (p *Peer) simulcastTracks() map[string]*wcodec.SimulcastTrack {
+	tracks := map[string]*wcodec.SimulcastTrack{}
+	for _, t := range p.GetTransceivers() {
+		if t.Sender() == nil || t.Mid() == "" {
+			continue
+		}
+		if track, ok := t.Sender().Track().(*wcodec.SimulcastTrack); ok {
+			tracks[t.Mid()] = track
+		}
+	}
+	return tracks
+}
+
+// sdpSections splits an SDP into the session section and the media sections
+func sdpSections(sdp string) [][]string {
+	sections := [][]string{{}}
+	for _, line := range strings.Split(strings.TrimSuffix(sdp, "\r\n"), "\r\n") {
+		if strings.HasPrefix(line, "m=") {
+			sections = append(sections, []string{})
+		}
+		sections[len(sections)-1] = append(sections[len(sections)-1], line)
+	}
+	return sections
+}
+
+func joinSDPSections(sections [][]string) string {
+	var lines []string
+	for _, s := range sections {
+		lines = append(lines, s...)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func sectionMID(section []string) string {
+	for _, line := range section {
+		if strings.HasPrefix(line, "a=mid:") {
+			return strings.TrimPrefix(line, "a=mid:")
+		}
+	}
+	return ""
+}
+
+// addSimulcast signals the simulcast layers of the senders in an SDP offer like browsers do: the
+// media section gets an a=rid line per layer and an a=simulcast line, and no a=ssrc lines, as
+// pion knows only about the SSRC of one layer
+func (p *Peer) addSimulcast(sdp string) string {
+	tracks := p.simulcastTracks()
+	if len(tracks) == 0 {
+		return sdp
+	}
+
+	sections := sdpSections(sdp)
+	for i, section := range sections[1:] {
+		mid := sectionMID(section)
+		track, ok := tracks[mid]
+		if !ok {
+			continue
+		}
+		track.SetMID(mid)
+
+		var out []string
+		for _, line := range section {
+			if !strings.HasPrefix(line, "a=ssrc:") && !strings.HasPrefix(line, "a=ssrc-group:") {
+				out = append(out, line)
+			}
+		}
+		for _, rid := range track.RIDs() {
+			out = append(out, fmt.Sprintf("a=rid:%s send", rid))
+		}
+		out = append(out, "a=simulcast:send "+strings.Join(track.RIDs(), ";"))
+		sections[i+1] = out
+	}
+	return joinSDPSections(sections)
+}
+
+// acceptSimulcast removes the a=rid and a=simulcast lines from the media sections of the
+// simulcast tracks in an SDP answer, pion would take them for incoming simulcast, and makes the
+// tracks the remote did not accept simulcast for send their highest layer only
+func (p *Peer) acceptSimulcast(sdp string) string {
+	tracks := p.simulcastTracks()
+	if len(tracks) == 0 {
+		return sdp
+	}
+
+	sections := sdpSections(sdp)
+	for i, section := range sections[1:] {
+		mid := sectionMID(section)
+		track, ok := tracks[mid]
+		if !ok {
+			continue
+		}
+
+		accepted := false
+		var out []string
+		for _, line := range section {
+			switch {
+			case strings.HasPrefix(line, "a=simulcast:"):
+				accepted = true
+			case strings.HasPrefix(line, "a=rid:"):
+			default:
+				out = append(out, line)
+			}
+		}
+		sections[i+1] = out
+
+		track.SetSingle(!accepted)
+		if !accepted {
+			rids := track.RIDs()
+			log.Printf("simulcast not accepted for %s, sending layer %s only\n", mid, rids[len(rids)-1])
+		}
+	}
+	return joinSDPSections(sections)
+}
+
+// NewVideoTrack returns the local video track that file of the codec is sent into: a replay
+// track if file is a packet capture, a simulcast track if simulcast layers are configured.
+func (p *Peer) NewVideoTrack(file, codec, streamID string) (webrtc.TrackLocal, error) {
+	capability := webrtc.RTPCodecCapability{MimeType: codec}
+	if wrtp.IsCaptureFile(file) {
+		if len(p.simulcast) > 0 {
+			return nil, fmt.Errorf("captures cannot be sent in simulcast: %s", file)
+		}
+		return wcodec.NewReplayTrack(capability, "video", streamID), nil
+	}
+	if len(p.simulcast) > 0 {
+		track, err := wcodec.NewSimulcastTrack(capability, "video", streamID,
+			wcodec.SimulcastRIDs(len(p.simulcast)+1))
+		if err != nil {
+			return nil, err
+		}
+		return track, nil
+	}
+	return wcodec.NewTrack(capability, "video", streamID)
+}
@@ -0,0 +1,781 @@
+package wsession
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wcodec"
+	"webrtc-client-go/wmsg"
+	"webrtc-client-go/wrtp"
+)
+
+var ErrClosed = errors.New("signaling connection closed")
+
+// bandwidth estimator start, min and max in bits per second, and how often it is logged
+const (
+	bweInitial     = 300000
+	bweMin         = 50000
+	bweMax         = 10000000
+	bweLogInterval = 2 * time.Second
+)
+
+// Config holds everything needed to connect to an application server and to set up
+// PeerConnections towards the media server.
+type Config struct {
+	// application server URL
+	Url string
+	// TLS config of a wss:// URL, KeyLog is set in a copy of it; if nil, the certificate of the
+	// server is verified with the system roots
+	TLS *tls.Config
+	// if not nil, TLS secrets of the signaling connection are dumped here
+	KeyLog io.Writer
+	// if not nil, the RTP and RTCP packets sent and received are captured here
+	Capture *wrtp.Capture
+	// if not nil, the DTLS and SRTP keys of the PeerConnections are logged here
+	MediaKeyLog *wrtp.KeyLog
+	// media key log of a capture sent as the media file, its SRTP packets are decrypted with it
+	CaptureKeyLog string
+	// generate local ICE candidates only on the interface that has this IP
+	ICEAddr string
+	// STUN/TURN server URI and credentials
+	TurnURI    string
+	Username   string
+	Credential string
+	// other STUN/TURN servers, used besides TurnURI
+	ICEServers []webrtc.ICEServer
+	// video codec mime type of the media file
+	Codec string
+	// codec names to send and to receive in preference order, see wcodec.LookupCodec,
+	// default: each other, or else the codec of the media file
+	SendCodecs []string
+	RecvCodecs []string
+	// estimate the available send bandwidth from the feedback of the receiver and log it
+	BWE bool
+	// other IVF encodings of the media file at different bitrates, the sender switches between
+	// them to follow the bandwidth estimate, implies BWE
+	Renditions []string
+	// lower resolution encodings of the media file from the lowest, the file and these are sent
+	// as simulcast layers
+	Simulcast []string
+	// when and how received video tracks request key frames, default: wcodec.DefaultKeyframePolicy
+	Keyframes wcodec.KeyframePolicy
+	// received video is reported frozen after this without a decodable frame, default:
+	// wcodec.DefaultFreezeThreshold
+	FreezeThreshold time.Duration
+	// how the sent media file answers key frame requests, default: wcodec.KeyframeJump
+	KeyframeResponse wcodec.KeyframeResponse
+	// file format of the received media, default: wcodec.OutputAuto
+	OutputFormat wcodec.OutputFormat
+	// ICE network types, default: udp4
+	NetworkTypes []webrtc.NetworkType
+	// gather ICE candidates only on interfaces with an address in these networks
+	CIDRs []*net.IPNet
+	// never gather ICE candidates on interfaces whose name matches this, e.g., docker0|veth.*
+	ExcludeInterfaces *regexp.Regexp
+	// ICE candidate types to gather, default: relay if a TURN server is given, all otherwise
+	CandidateTypes []webrtc.ICECandidateType
+	// external IPs of a static 1:1 NAT, advertised as host or srflx candidates
+	NAT1To1IPs           []string
+	NAT1To1CandidateType webrtc.ICECandidateType
+	// local UDP port range for ICE, zero means any port
+	PortMin, PortMax uint16
+	// ICE connection is reported disconnected/failed after these, zero means the pion default
+	ICEDisconnectedTimeout time.Duration
+	ICEFailedTimeout       time.Duration
+	// if not nil, PeerConnections use this virtual network instead of the host network
+	VNet *vnet.Net
+}
+
+/////////////////////////
+// signaling
+
+// Signaling is a WebSocket connection to a Kurento tutorial application server.
+type Signaling struct {
+	conn *websocket.Conn
+	send chan wmsg.Message
+	recv chan map[string]interface{}
+	// closed when the writer exits
+	done chan struct{}
+	// closed by Close
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	lock        sync.Mutex
+	onCandidate func(m map[string]interface{})
+}
+
+// Dial connects to the application server at url, a wss:// URL with tlsConfig, see
+// Config.TLS.
+func Dial(url string, tlsConfig *tls.Config, keyLog io.Writer) (*Signaling, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = tlsConfig.Clone()
+	if dialer.TLSClientConfig == nil {
+		dialer.TLSClientConfig = &tls.Config{}
+	}
+	dialer.TLSClientConfig.KeyLogWriter = keyLog
+
+	log.Printf("connecting to %s", url)
+	c, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+
+	s := &Signaling{
+		conn:    c,
+		send:    make(chan wmsg.Message),
+		recv:    make(chan map[string]interface{}),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go s.reader()
+	go s.writer()
+
+	return s, nil
+}
+
+// reader: get messages from the webrtc-server
+func (s *Signaling) reader() {
+	defer close(s.recv)
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			log.Println("readMessage:", err)
+			return
+		}
+
+		log.Printf("recv: %s\n", message)
+
+		// dunno the types yet, try to unmarschal
+		m := map[string]interface{}{}
+		if err = json.Unmarshal(message, &m); err != nil {
+			log.Println("JSON unmarschal:", err)
+			continue
+		}
+		if _, ok := m["id"].(string); !ok {
+			log.Println("no message id:", m)
+			continue
+		}
+
+		s.lock.Lock()
+		onCandidate := s.onCandidate
+		s.lock.Unlock()
+		if m["id"].(string) == "iceCandidate" && onCandidate != nil {
+			onCandidate(m)
+			continue
+		}
+
+		select {
+		case s.recv <- m:
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// sender: write messages to the webrtc-server
+func (s *Signaling) writer() {
+	defer close(s.done)
+	for {
+		select {
+		case m := <-s.send:
+			log.Printf("send: %s\n", m)
+			if err := s.conn.WriteJSON(m); err != nil {
+				log.Println("WriteJSON:", err)
+				return
+			}
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// Send queues a message to the application server, messages are dropped once the connection
+// is down.
+func (s *Signaling) Send(m wmsg.Message) {
+	select {
+	case s.send <- m:
+	case <-s.done:
+		log.Printf("signaling connection closed, dropping message: %s\n", m)
+	}
+}
+
+// OnICECandidate sets a handler for iceCandidate messages, these are not delivered by Recv.
+func (s *Signaling) OnICECandidate(f func(m map[string]interface{})) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onCandidate = f
+}
+
+// Recv returns the next message from the application server.
+func (s *Signaling) Recv() (map[string]interface{}, error) {
+	m, ok := <-s.recv
+	if !ok {
+		return nil, ErrClosed
+	}
+	return m, nil
+}
+
+// Expect drops messages until one with the given id arrives, or fails when the application
+// server reports an error.
+func (s *Signaling) Expect(id string) (map[string]interface{}, error) {
+	for {
+		m, err := s.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if m["id"].(string) == id {
+			return m, nil
+		}
+		if m["id"].(string) == "error" {
+			return nil, fmt.Errorf("application server error while waiting for %s: %v",
+				id, m["message"])
+		}
+		log.Printf("expected message: %s, got: %s", id, m["id"])
+	}
+}
+
+func (s *Signaling) Close() error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	return s.conn.Close()
+}
+
+/////////////////////////
+// peer connection
+
+// Peer is a PeerConnection that caches remote ICE candidates until the remote description
+// is set.
+type Peer struct {
+	*webrtc.PeerConnection
+
+	lock      sync.Mutex
+	cache     []webrtc.ICECandidateInit
+	hasRemote bool
+
+	// ICE TCP listener, if any
+	tcpMux io.Closer
+	// local ICE candidates that are not accepted here are not passed to OnICECandidate
+	accept func(*webrtc.ICECandidate) bool
+	// codec preferences of the sending and of the receive-only transceivers
+	sendCodecs, recvCodecs []webrtc.RTPCodecParameters
+	// interceptors of the PeerConnection
+	interceptors *wrtp.Interceptors
+	// answers NACKs, over RTX if negotiated
+	responder *wrtp.Responder
+	stats     wrtp.Stats
+	// bandwidth estimator and the renditions of the media file sent following it, if enabled
+	estimator  *wrtp.Estimator
+	renditions []string
+	// lower simulcast layers of the media file, if any
+	simulcast []string
+	// media key log of a replayed capture, if any
+	captureKeyLog string
+	// key frame requests of the received tracks
+	keyframes       wcodec.KeyframePolicy
+	freezeThreshold time.Duration
+	// answer to the key frame requests of the remote
+	keyframeResponse wcodec.KeyframeResponse
+	// file format of the received media, and the receivers writing it
+	outputFormat wcodec.OutputFormat
+	receivers    []*wcodec.Receiver
+
+	connected       context.Context
+	connectedCancel context.CancelFunc
+	done            context.Context
+	doneCancel      context.CancelFunc
+}
+
+// NewPeer sets up a PeerConnection that uses the codec, ICE interface and TURN server from
+// the config.
+func NewPeer(cfg Config) (*Peer, error) {
+	s := webrtc.SettingEngine{}
+
+	// network types, interfaces and TURN transport
+	tcpMux, err := setupNetwork(&s, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.SetAnsweringDTLSRole(webrtc.DTLSRoleServer)
+
+	// set up media codecs to enforce transcoding
+	m := &webrtc.MediaEngine{}
+
+	sendCodecs, recvCodecs, err := codecPreferences(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Simulcast) > 0 {
+		// the layers are told apart by these
+		for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+			if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri},
+				webrtc.RTPCodecTypeVideo); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	bwe := cfg.BWE || len(cfg.Renditions) > 0
+	if bwe {
+		// ask the receiver for transport-cc feedback on the sent streams
+		sendCodecs = withFeedback(sendCodecs, webrtc.RTCPFeedback{Type: webrtc.TypeRTCPFBTransportCC})
+	}
+
+	// sending transceivers also receive, so the send codecs come first
+	for _, c := range sendCodecs {
+		if err := m.RegisterCodec(c, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, fmt.Errorf("could not register codec %v: %w", c, err)
+		}
+	}
+	// audio is received into containers
+	for _, c := range wcodec.OpusCodecs {
+		if err := m.RegisterCodec(c, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, fmt.Errorf("could not register codec %v: %w", c, err)
+		}
+	}
+
+	// NACKs and RTCP reports, like webrtc.RegisterDefaultInterceptors, but NACKs are answered
+	// by our responder that retransmits over RTX
+	p := &Peer{sendCodecs: sendCodecs, recvCodecs: recvCodecs, simulcast: cfg.Simulcast,
+		captureKeyLog: cfg.CaptureKeyLog, keyframes: keyframePolicy(cfg), freezeThreshold: cfg.FreezeThreshold,
+		keyframeResponse: cfg.KeyframeResponse, outputFormat: cfg.OutputFormat}
+	if p.keyframeResponse == "" {
+		p.keyframeResponse = wcodec.KeyframeJump
+	}
+	registry := &interceptor.Registry{}
+	if cfg.Capture != nil {
+		// first, so that packets are captured as they go on the wire
+		registry.Add(cfg.Capture)
+	}
+	var keys *wrtp.KeySession
+	if cfg.MediaKeyLog != nil {
+		// before the responder, so that the RTX SSRCs are logged too
+		keys = cfg.MediaKeyLog.NewSession()
+		registry.Add(keys)
+	}
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return nil, err
+	}
+	registry.Add(generator)
+	p.responder = wrtp.NewResponder(sendCodecs, &p.stats)
+	registry.Add(p.responder)
+	if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+		return nil, err
+	}
+	if bwe {
+		p.estimator = wrtp.NewEstimator(bweInitial, bweMin, bweMax)
+		p.renditions = cfg.Renditions
+		registry.Add(p.estimator)
+		// transport-wide sequence numbers for the feedback
+		if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, registry); err != nil {
+			return nil, err
+		}
+	}
+
+	config := webrtc.Configuration{}
+	if cfg.TurnURI != "" && hostOnly(cfg) {
+		log.Println("host candidates only, not using STUN/TURN server:", cfg.TurnURI)
+	} else if cfg.TurnURI != "" {
+		log.Println("using STUN/TURN/ICE server:", cfg.TurnURI)
+		config.ICEServers = append(config.ICEServers, webrtc.ICEServer{
+			URLs:           []string{cfg.TurnURI},
+			Username:       cfg.Username,
+			Credential:     cfg.Credential,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		})
+	}
+	for _, server := range cfg.ICEServers {
+		if hostOnly(cfg) {
+			log.Println("host candidates only, not using STUN/TURN server:", server.URLs)
+			continue
+		}
+		log.Println("using STUN/TURN/ICE server:", server.URLs)
+		config.ICEServers = append(config.ICEServers, server)
+	}
+	if relayOnly(cfg) {
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	}
+
+	// kept for the RTCP of the lower simulcast layers
+	p.interceptors = wrtp.NewInterceptors(registry)
+	interceptors := &interceptor.Registry{}
+	interceptors.Add(p.interceptors)
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(s), webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(interceptors)).NewPeerConnection(config)
+	if err != nil {
+		if tcpMux != nil {
+			tcpMux.Close()
+		}
+		return nil, fmt.Errorf("NewPeerConnection: %w", err)
+	}
+
+	p.PeerConnection, p.tcpMux, p.accept = pc, tcpMux, candidateFilter(cfg)
+	if keys != nil {
+		keys.Watch(pc.SCTP().Transport())
+	}
+	p.connected, p.connectedCancel = context.WithCancel(context.Background())
+	p.done, p.doneCancel = context.WithCancel(context.Background())
+
+	pc.OnSignalingStateChange(func(ss webrtc.SignalingState) {
+		log.Println("Signaling state change:", ss)
+	})
+
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Println("Connection state change:", connectionState.String())
+		switch connectionState {
+		case webrtc.ICEConnectionStateConnected:
+			// dump active transport
+			for _, t := range pc.GetSenders() {
+				DumpCandidates(t.Transport().ICETransport())
+			}
+			for _, t := range pc.GetReceivers() {
+				DumpCandidates(t.Transport().ICETransport())
+			}
+			p.connectedCancel()
+		case webrtc.ICEConnectionStateDisconnected, webrtc.ICEConnectionStateFailed,
+			webrtc.ICEConnectionStateClosed:
+			p.doneCancel()
+		}
+	})
+
+	if p.estimator != nil {
+		go p.logEstimate()
+	}
+
+	return p, nil
+}
+
+// withFeedback returns a copy of the codecs where the media codecs have fb as well
+func withFeedback(codecs []webrtc.RTPCodecParameters, fb webrtc.RTCPFeedback) []webrtc.RTPCodecParameters {
+	var out []webrtc.RTPCodecParameters
+	for _, c := range codecs {
+		if len(c.RTCPFeedback) > 0 {
+			c.RTCPFeedback = append(append([]webrtc.RTCPFeedback{}, c.RTCPFeedback...), fb)
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// logEstimate logs the bandwidth estimate while connected
+func (p *Peer) logEstimate() {
+	select {
+	case <-p.connected.Done():
+	case <-p.done.Done():
+		return
+	}
+
+	ticker := time.NewTicker(bweLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Println("bandwidth estimate:", p.estimator.Estimate())
+		case <-p.done.Done():
+			return
+		}
+	}
+}
+
+// keyframePolicy returns the key frame policy of the config, or the default one
+func keyframePolicy(cfg Config) wcodec.KeyframePolicy {
+	if cfg.Keyframes.Request == "" {
+		return wcodec.DefaultKeyframePolicy
+	}
+	return cfg.Keyframes
+}
+
+// codecPreferences returns the codecs of sending transceivers, the send codecs followed by the
+// receive codecs, and of receive-only transceivers
+func codecPreferences(cfg Config) ([]webrtc.RTPCodecParameters, []webrtc.RTPCodecParameters, error) {
+	send, recv := cfg.SendCodecs, cfg.RecvCodecs
+	switch {
+	case len(send) == 0 && len(recv) == 0:
+		// the codec names of the families are the mime subtypes
+		family := strings.ToLower(strings.TrimPrefix(cfg.Codec, "video/"))
+		if _, err := wcodec.LookupCodec(family); err != nil {
+			return nil, nil, fmt.Errorf("unknown codec: %s", cfg.Codec)
+		}
+		send, recv = []string{family}, []string{family}
+	case len(send) == 0:
+		send = recv
+	case len(recv) == 0:
+		recv = send
+	}
+
+	sendCodecs, err := wcodec.CodecPreferences(append(append([]string{}, send...), recv...))
+	if err != nil {
+		return nil, nil, err
+	}
+	recvCodecs, err := wcodec.CodecPreferences(recv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sendCodecs, recvCodecs, nil
+}
+
+// AddTrack adds a sending track whose codec must be one of the send codecs, and sets the codec
+// preferences of its transceiver.
+func (p *Peer) AddTrack(track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	if t, ok := track.(interface {
+		Codec() webrtc.RTPCodecCapability
+	}); ok {
+		if mimeType := t.Codec().MimeType; !wcodec.HasMimeType(p.sendCodecs, mimeType) {
+			return nil, fmt.Errorf("codec %s of track %s is not in the send codecs", mimeType, track.ID())
+		}
+	}
+
+	sender, err := p.PeerConnection.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range p.GetTransceivers() {
+		if t.Sender() == sender {
+			if err := t.SetCodecPreferences(p.sendCodecs); err != nil {
+				return nil, fmt.Errorf("codec preferences: %w", err)
+			}
+		}
+	}
+	// the RTX SSRC is signaled in the offer, except for simulcast, that has no a=ssrc lines
+	for _, e := range sender.GetParameters().Encodings {
+		if _, ok := track.(*wcodec.SimulcastTrack); ok {
+			p.responder.DisableRTX(uint32(e.SSRC))
+		} else {
+			p.responder.RTXSSRC(uint32(e.SSRC))
+		}
+	}
+	return sender, nil
+}
+
+// AddTransceiverFromKind adds a transceiver with the receive codecs as codec preferences.
+func (p *Peer) AddTransceiverFromKind(kind webrtc.RTPCodecType,
+	init ...webrtc.RTPTransceiverInit) (*webrtc.RTPTransceiver, error) {
+	t, err := p.PeerConnection.AddTransceiverFromKind(kind, init...)
+	if err != nil {
+		return nil, err
+	}
+	if kind == webrtc.RTPCodecTypeVideo {
+		if err := t.SetCodecPreferences(p.recvCodecs); err != nil {
+			return nil, fmt.Errorf("codec preferences: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// SendFile streams a media file into a track of NewVideoTrack once ICE is connected: a capture
+// replayed into a replay track, the file and its lower layers into a simulcast track, the file
+// and its renditions following the bandwidth estimate if configured, or else just the file.
+func (p *Peer) SendFile(rtpSender *webrtc.RTPSender, file, codec string,
+	track webrtc.TrackLocal) (*wcodec.Sender, error) {
+	switch t := track.(type) {
+	case *wcodec.ReplayTrack:
+		return wcodec.SendCapture(p.Connected(), rtpSender, file, p.captureKeyLog, t)
+	case *wcodec.SimulcastTrack:
+		return wcodec.SendSimulcast(p.Connected(), rtpSender, p.interceptors.Built(),
+			append(append([]string{}, p.simulcast...), file), codec, t, p.keyframeResponse)
+	case wcodec.SampleTrack:
+		if len(p.renditions) > 0 {
+			return wcodec.SendRenditions(p.Connected(), rtpSender,
+				append([]string{file}, p.renditions...), codec, t, p.estimator.Bitrate), nil
+		}
+		return wcodec.SendFile(p.Connected(), rtpSender, file, codec, t, p.keyframeResponse), nil
+	}
+	return nil, fmt.Errorf("cannot send files into track %s", track.ID())
+}
+
+// NewReceiver returns a receiver that writes the remote tracks into file in the output format
+// and requests key frames and reports freezes following the config until the track ends or the
+// Peer is done. If the format is a container, a receive-only audio transceiver is added so
+// that the audio is written together with the video; it must be called before the offer is
+// created.
+func (p *Peer) NewReceiver(file string) (*wcodec.Receiver, error) {
+	if wcodec.ResolveOutputFormat(file, p.outputFormat) != wcodec.OutputRaw {
+		if _, err := p.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+			webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+			return nil, err
+		}
+	}
+	r := wcodec.NewReceiver(p.done, p.PeerConnection, file, p.outputFormat, p.keyframes,
+		p.freezeThreshold)
+	p.receivers = append(p.receivers, r)
+	return r, nil
+}
+
+// Stats returns the counters of the send path.
+func (p *Peer) Stats() wrtp.Stats {
+	return p.stats.Snapshot()
+}
+
+// Close closes the PeerConnection and the ICE TCP listener, waits until the received tracks are
+// written, and logs the send stats.
+func (p *Peer) Close() error {
+	if p.stats.Snapshot().PacketsSent > 0 {
+		log.Println("RTP send stats:", &p.stats)
+		if p.estimator != nil {
+			log.Println("bandwidth estimate:", p.estimator.Summary())
+		}
+	}
+	p.doneCancel()
+	err := p.PeerConnection.Close()
+	if p.tcpMux != nil {
+		p.tcpMux.Close()
+	}
+	for _, r := range p.receivers {
+		r.Wait()
+	}
+	return err
+}
+
+// OnICECandidate sets the handler of the local ICE candidates, candidates filtered out by the
+// config are dropped.
+func (p *Peer) OnICECandidate(f func(*webrtc.ICECandidate)) {
+	p.PeerConnection.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i != nil && !p.accept(i) {
+			log.Println("Dropping local ICE candidate:", i)
+			return
+		}
+		f(i)
+	})
+}
+
+// Connected returns a context that is canceled when ICE gets connected.
+func (p *Peer) Connected() context.Context {
+	return p.connected
+}
+
+// Done returns a context that is canceled when ICE is disconnected, fails or is closed.
+func (p *Peer) Done() context.Context {
+	return p.done
+}
+
+// SendCandidates forwards local ICE candidates to the application server.
+func (p *Peer) SendCandidates(s *Signaling) {
+	p.OnICECandidate(func(i *webrtc.ICECandidate) {
+		if i != nil {
+			s.Send(wmsg.NewOnICECandidate(i))
+		}
+	})
+}
+
+// ReceiveCandidates adds the remote ICE candidates received from the application server.
+func (p *Peer) ReceiveCandidates(s *Signaling) {
+	s.OnICECandidate(func(m map[string]interface{}) {
+		c, err := ParseICECandidate(m)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if err := p.AddRemoteCandidate(c); err != nil {
+			log.Println("cannot add remote ICE candidate:", err)
+		}
+	})
+}
+
+// AddRemoteCandidate adds a remote ICE candidate, or caches it if there is no remote SDP yet.
+func (p *Peer) AddRemoteCandidate(c webrtc.ICECandidateInit) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.hasRemote {
+		log.Println("Caching remote ICE candidate:", c.Candidate)
+		p.cache = append(p.cache, c)
+		return nil
+	}
+
+	log.Println("Adding remote ICE candidate:", c.Candidate)
+	return p.AddICECandidate(c)
+}
+
+// CreateLocalOffer creates an SDP offer and sets it as the local description.
+func (p *Peer) CreateLocalOffer() (string, error) {
+	offer, err := p.CreateOffer(nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot create offer: %w", err)
+	}
+
+	if err = p.SetLocalDescription(offer); err != nil {
+		return "", fmt.Errorf("cannot set local SDP: %w", err)
+	}
+
+	return p.addSimulcast(p.addRTXGroups(offer.SDP)), nil
+}
+
+// SetAnswer sets the remote SDP answer and adds the cached remote ICE candidates.
+func (p *Peer) SetAnswer(sdp string) error {
+	// remove conflicting fingerprints from SDP
+	desc, err := wmsg.ParseSdp(webrtc.SDPTypeAnswer, p.acceptSimulcast(sdp))
+	if err != nil {
+		return fmt.Errorf("could not parse SDP answer: %w", err)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	log.Printf("Setting remote session description: %v\n", *desc)
+	if err = p.SetRemoteDescription(*desc); err != nil {
+		return fmt.Errorf("cannot set remote SDP: %w", err)
+	}
+	p.hasRemote = true
+
+	// retransmit over RTX only if the remote accepted it
+	for _, sender := range p.GetSenders() {
+		p.responder.SetCodecs(sender.GetParameters().Codecs)
+	}
+
+	// process cached REMOTE ICE candidates
+	for _, c := range p.cache {
+		log.Println("Adding cached remote ICE candidate:", c.Candidate)
+		if err := p.AddICECandidate(c); err != nil {
+			return err
+		}
+	}
+	p.cache = nil
+
+	return nil
+}
+
+/////////////////////////
+// utils
+
+// ParseICECandidate parses the candidate field of an iceCandidate message.
+func ParseICECandidate(m map[string]interface{}) (webrtc.ICECandidateInit, error) {
+	c, ok := m["candidate"].(map[string]interface{})
+	if !ok {
+		return webrtc.ICECandidateInit{}, errors.New("no candidate in iceCandidate message")
+	}
+	candidate, _ := c["candidate"].(string)
+	sdpmid, _ := c["sdpMid"].(string)
+	sdpmlineindex, _ := c["sdpMLineIndex"].(float64)
+	index := uint16(sdpmlineindex)
+	return webrtc.ICECandidateInit{
+		Candidate:     candidate,
+		SDPMid:        &sdpmid,
+		SDPMLineIndex: &index,
+	}, nil
+}
+
+func DumpCandidates(tr *webrtc.ICETransport) {
+	pair, err := tr.GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return
+	}
+	log.Printf("LOCAL candidate: %s", pair.Local.String())
+	log.Printf("REMOTE candidate: %s", pair.Remote.String())
+}
@@ -0,0 +1,374 @@
+package wturn
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/turn/v2"
+)
+
+const (
+	DefaultProbeTimeout = 5 * time.Second
+	// the first packets go in Send indications while pion binds a channel in the background,
+	// the rest go in ChannelData messages
+	probeRounds = 5
+	// rounds are repeated this often until one goes over the bound channel
+	probeChannelInterval = 100 * time.Millisecond
+)
+
+// ProbeConfig is the configuration of a TURN probe.
+type ProbeConfig struct {
+	// TURN server URI, e.g., turn:1.2.3.4:3478?transport=udp or turns:1.2.3.4:443
+	URI      string
+	Username string
+	Password string
+	// timeout of the whole probe, from the allocations to the round trips over the channel
+	Timeout time.Duration
+}
+
+// ProbeResult is the outcome of a successful probe.
+type ProbeResult struct {
+	RelayedAddr   net.Addr
+	PeerAddr      net.Addr
+	AllocateRTT   time.Duration
+	PermissionRTT time.Duration
+	// average over all rounds
+	RoundTripRTT time.Duration
+	// the first round trip in ChannelData messages both ways
+	ChannelRTT time.Duration
+}
+
+// ProbeError reports the step where the probe failed.
+type ProbeError struct {
+	// allocate, permission, round-trip or channel
+	Step string
+	// STUN error code and reason, e.g., 401 Unauthorized or 437 Allocation Mismatch, timeout,
+	// or the error message otherwise
+	Reason string
+	Err    error
+}
+
+func (e *ProbeError) Error() string {
+	return fmt.Sprintf("%s: %s (%s)", e.Step, e.Reason, e.Err)
+}
+
+func (e *ProbeError) Unwrap() error {
+	return e.Err
+}
+
+var stunErrorCode = regexp.MustCompile(`error (\d{3})`)
+
+// pion/turn, and so STUNner, answers 400 instead of 401 to invalid credentials
+var stunErrorReasons = map[string]string{
+	"400": "400 Bad Request (invalid credentials?)",
+	"401": "401 Unauthorized",
+	"403": "403 Forbidden",
+	"437": "437 Allocation Mismatch",
+	"438": "438 Stale Nonce",
+	"441": "441 Wrong Credentials",
+	"486": "486 Allocation Quota Reached",
+	"508": "508 Insufficient Capacity",
+}
+
+func probeError(step string, err error) *ProbeError {
+	reason := err.Error()
+	var netErr net.Error
+	if m := stunErrorCode.FindStringSubmatch(err.Error()); m != nil {
+		reason = m[1]
+		if r, ok := stunErrorReasons[m[1]]; ok {
+			reason = r
+		}
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		reason = "timeout"
+	} else if strings.Contains(err.Error(), "all retransmissions failed") {
+		reason = "timeout"
+	}
+	return &ProbeError{Step: step, Reason: reason, Err: err}
+}
+
+// channelConn counts the ChannelData messages written to and read from the TURN server, to
+// tell whether the data went over the bound channel
+type channelConn struct {
+	net.PacketConn
+	sent, received int64
+}
+
+// isChannelData tells a ChannelData message from STUN by its channel number, 0x4000-0x7fff,
+// RFC 5766, section 11.4
+func isChannelData(b []byte) bool {
+	return len(b) >= 4 && b[0]&0xc0 == 0x40
+}
+
+func (c *channelConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if isChannelData(b) {
+		atomic.AddInt64(&c.sent, 1)
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *channelConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil && isChannelData(b[:n]) {
+		atomic.AddInt64(&c.received, 1)
+	}
+	return n, addr, err
+}
+
+func (c *channelConn) counters() (int64, int64) {
+	return atomic.LoadInt64(&c.sent), atomic.LoadInt64(&c.received)
+}
+
+// probeClient is a TURN client with an allocation
+type probeClient struct {
+	conn    *channelConn
+	client  *turn.Client
+	relay   net.PacketConn
+	elapsed time.Duration
+}
+
+func (p *probeClient) close() {
+	if p.relay != nil {
+		p.relay.Close()
+	}
+	p.client.Close()
+	p.conn.Close()
+}
+
+// prober runs the steps of a probe under a single deadline: when it passes, the clients are
+// closed, which fails their pending transactions and reads
+type prober struct {
+	uri      *ice.URL
+	server   string
+	cfg      ProbeConfig
+	deadline time.Time
+
+	lock    sync.Mutex
+	clients []*probeClient
+	expired bool
+}
+
+func (p *prober) expire() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.expired = true
+	for _, c := range p.clients {
+		c.close()
+	}
+	p.clients = nil
+}
+
+// add registers a client to be closed on expiry, false if the probe has expired already
+func (p *prober) add(c *probeClient) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.expired {
+		return false
+	}
+	p.clients = append(p.clients, c)
+	return true
+}
+
+func (p *prober) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, c := range p.clients {
+		c.close()
+	}
+	p.clients = nil
+}
+
+// error reports the failure of a step, errors after the deadline are timeouts
+func (p *prober) error(step string, err error) *ProbeError {
+	p.lock.Lock()
+	expired := p.expired
+	p.lock.Unlock()
+	if expired {
+		return &ProbeError{Step: step, Reason: "timeout", Err: err}
+	}
+	return probeError(step, err)
+}
+
+// dial opens the transport towards the TURN server
+func (p *prober) dial() (net.PacketConn, error) {
+	if p.uri.Proto == ice.ProtoTypeUDP {
+		return net.ListenPacket("udp4", "0.0.0.0:0")
+	}
+
+	dialer := &net.Dialer{Deadline: p.deadline}
+	var conn net.Conn
+	var err error
+	if p.uri.Scheme == ice.SchemeTypeTURNS {
+		conn, err = tls.DialWithDialer(dialer, "tcp4", p.server, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		conn, err = dialer.Dial("tcp4", p.server)
+	}
+	if err != nil {
+		return nil, probeError("allocate", err)
+	}
+	return turn.NewSTUNConn(conn), nil
+}
+
+func (p *prober) newClient() (*probeClient, error) {
+	conn, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	counted := &channelConn{PacketConn: conn}
+
+	c, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: p.server,
+		TURNServerAddr: p.server,
+		Conn:           counted,
+		Username:       p.cfg.Username,
+		Password:       p.cfg.Password,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := c.Listen(); err != nil {
+		c.Close()
+		conn.Close()
+		return nil, err
+	}
+
+	client := &probeClient{conn: counted, client: c}
+	if !p.add(client) {
+		client.close()
+		return nil, &ProbeError{Step: "allocate", Reason: "timeout",
+			Err: errors.New("probe timed out")}
+	}
+
+	start := time.Now()
+	relay, err := c.Allocate()
+	client.elapsed = time.Since(start)
+	if err != nil {
+		return nil, p.error("allocate", err)
+	}
+	p.lock.Lock()
+	client.relay = relay
+	p.lock.Unlock()
+
+	return client, nil
+}
+
+// Probe checks a TURN server: it makes an allocation, creates a permission and sends packets
+// to a peer through the relay and back, until they go over the channel bound to the peer. The
+// peer is a second allocation on the same server, so the probe works from behind a NAT as
+// well. Failures are reported as a *ProbeError.
+func Probe(cfg ProbeConfig) (*ProbeResult, error) {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultProbeTimeout
+	}
+
+	uri, err := ice.ParseURL(cfg.URI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TURN URI %q: %w", cfg.URI, err)
+	}
+	if uri.Scheme == ice.SchemeTypeTURNS && uri.Proto != ice.ProtoTypeTCP ||
+		uri.Scheme != ice.SchemeTypeTURN && uri.Scheme != ice.SchemeTypeTURNS {
+		return nil, fmt.Errorf("unsupported TURN URI %q: only turn: over UDP/TCP and turns: "+
+			"over TCP are supported", cfg.URI)
+	}
+	if err := CheckIPv4(uri.Host); err != nil {
+		return nil, err
+	}
+
+	p := &prober{uri: uri, server: net.JoinHostPort(uri.Host, strconv.Itoa(uri.Port)), cfg: cfg,
+		deadline: time.Now().Add(cfg.Timeout)}
+	timer := time.AfterFunc(cfg.Timeout, p.expire)
+	defer timer.Stop()
+	defer p.close()
+
+	client, err := p.newClient()
+	if err != nil {
+		return nil, err
+	}
+	peer, err := p.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &ProbeResult{
+		RelayedAddr: client.relay.LocalAddr(),
+		PeerAddr:    peer.relay.LocalAddr(),
+		AllocateRTT: client.elapsed,
+	}
+
+	start := time.Now()
+	if err := client.client.CreatePermission(peer.relay.LocalAddr()); err != nil {
+		return res, p.error("permission", err)
+	}
+	res.PermissionRTT = time.Since(start)
+
+	if err := peer.client.CreatePermission(client.relay.LocalAddr()); err != nil {
+		return res, p.error("permission", err)
+	}
+
+	// the peer echoes everything back
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := peer.relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if _, err := peer.relay.WriteTo(buf[:n], from); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := client.relay.SetReadDeadline(p.deadline); err != nil {
+		return res, p.error("round-trip", err)
+	}
+	var total time.Duration
+	buf := make([]byte, 1500)
+	for i := 0; i < probeRounds || res.ChannelRTT == 0; i++ {
+		if i >= probeRounds {
+			time.Sleep(probeChannelInterval)
+		}
+		msg := []byte(fmt.Sprintf("probe-%d", i))
+		sent, received := client.conn.counters()
+
+		start := time.Now()
+		if _, err := client.relay.WriteTo(msg, peer.relay.LocalAddr()); err != nil {
+			return res, p.error("round-trip", err)
+		}
+
+		n, _, err := client.relay.ReadFrom(buf)
+		if err != nil {
+			step := "round-trip"
+			if i >= probeRounds {
+				// the data made it through the relay, but never over the channel
+				step = "channel"
+			}
+			return res, p.error(step, err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			return res, &ProbeError{Step: "round-trip", Reason: "invalid response",
+				Err: fmt.Errorf("sent %q, received %q", msg, buf[:n])}
+		}
+		rtt := time.Since(start)
+		if i < probeRounds {
+			total += rtt
+		}
+		if s, r := client.conn.counters(); res.ChannelRTT == 0 && s > sent && r > received {
+			res.ChannelRTT = rtt
+		}
+	}
+	res.RoundTripRTT = total / probeRounds
+
+	return res, nil
+}
@@ -0,0 +1,273 @@
+package wturn
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+	"github.com/pion/turn/v2"
+)
+
+// authentication modes, same as in STUNner
+const (
+	AuthPlaintext = "plaintext"
+	AuthLongterm  = "longterm"
+)
+
+const (
+	DefaultRealm = "stunner.l7mp.io"
+	// lifetime of the longterm credentials generated by the clients
+	longtermDuration = 24 * time.Hour
+)
+
+// Config is the configuration of a TURN server.
+type Config struct {
+	Realm string
+	// plaintext: a single static username and password / longterm: time-windowed credentials
+	// generated from the Password as the shared secret, Username is ignored
+	Auth     string
+	Username string
+	Password string
+	// relayed addresses are allocated on this IP, default: the IP of the listener
+	RelayIP net.IP
+	// if not nil, relayed addresses are allocated in this virtual network
+	Net *vnet.Net
+	// if not nil, TCP listeners serve TURN over TLS
+	TLSConfig *tls.Config
+}
+
+// Server is an embedded TURN server.
+type Server struct {
+	server *turn.Server
+	addr   net.Addr
+	// udp, tcp or tls
+	transport string
+}
+
+// CheckIPv4 rejects IPv6 TURN addresses, host or host:port: pion/turn resolves the server and
+// allocates the relayed addresses over IPv4 only, both in the clients and in the server.
+func CheckIPv4(addr string) error {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return fmt.Errorf("IPv6 TURN address %s is not supported, TURN works over IPv4 only", addr)
+	}
+	return nil
+}
+
+// CheckURI rejects TURN URIs with IPv6 addresses, see CheckIPv4.
+func CheckURI(uri string) error {
+	u, err := ice.ParseURL(uri)
+	if err != nil {
+		return fmt.Errorf("invalid TURN URI %q: %w", uri, err)
+	}
+	return CheckIPv4(u.Host)
+}
+
+// Listen starts a TURN server on a UDP address, e.g., 127.0.0.1:3478.
+func Listen(addr string, cfg Config) (*Server, error) {
+	if err := checkListen(addr, cfg); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("TURN listener: %w", err)
+	}
+
+	s, err := Serve(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// ListenTCP starts a TURN server on a TCP address, over TLS if cfg.TLSConfig is set.
+func ListenTCP(addr string, cfg Config) (*Server, error) {
+	if err := checkListen(addr, cfg); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("TURN listener: %w", err)
+	}
+
+	s, err := ServeTCP(l, cfg)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// checkListen rejects IPv6 listener and relay addresses, instead of failing on udp4 and tcp4
+func checkListen(addr string, cfg Config) error {
+	if err := CheckIPv4(addr); err != nil {
+		return err
+	}
+	if cfg.RelayIP != nil {
+		return CheckIPv4(cfg.RelayIP.String())
+	}
+	return nil
+}
+
+// Serve starts a TURN server on conn, the server closes conn on Close.
+func Serve(conn net.PacketConn, cfg Config) (*Server, error) {
+	relayIP, err := relayAddress(cfg, conn.LocalAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	return newServer(cfg, conn.LocalAddr(), "udp", turn.ServerConfig{
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            conn,
+				RelayAddressGenerator: relayAddressGenerator(cfg, relayIP),
+			},
+		},
+	})
+}
+
+// ServeTCP starts a TURN server on l, over TLS if cfg.TLSConfig is set, the server closes l
+// on Close.
+func ServeTCP(l net.Listener, cfg Config) (*Server, error) {
+	relayIP, err := relayAddress(cfg, l.Addr())
+	if err != nil {
+		return nil, err
+	}
+
+	transport := "tcp"
+	if cfg.TLSConfig != nil {
+		l = tls.NewListener(l, cfg.TLSConfig)
+		transport = "tls"
+	}
+
+	return newServer(cfg, l.Addr(), transport, turn.ServerConfig{
+		ListenerConfigs: []turn.ListenerConfig{
+			{
+				Listener:              l,
+				RelayAddressGenerator: relayAddressGenerator(cfg, relayIP),
+			},
+		},
+	})
+}
+
+func newServer(cfg Config, addr net.Addr, transport string, sc turn.ServerConfig) (*Server, error) {
+	if cfg.Realm == "" {
+		cfg.Realm = DefaultRealm
+	}
+	if cfg.Auth == "" {
+		cfg.Auth = AuthPlaintext
+	}
+
+	loggerFactory := logging.NewDefaultLoggerFactory()
+
+	var authHandler turn.AuthHandler
+	switch cfg.Auth {
+	case AuthPlaintext:
+		key := turn.GenerateAuthKey(cfg.Username, cfg.Realm, cfg.Password)
+		authHandler = func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			if username != cfg.Username {
+				log.Printf("TURN: unknown user %q from %s", username, srcAddr)
+				return nil, false
+			}
+			return key, true
+		}
+	case AuthLongterm:
+		authHandler = turn.NewLongTermAuthHandler(cfg.Password, loggerFactory.NewLogger("turn"))
+	default:
+		return nil, fmt.Errorf("unknown TURN authentication mode %q: must be either %s or %s",
+			cfg.Auth, AuthPlaintext, AuthLongterm)
+	}
+
+	sc.Realm = cfg.Realm
+	sc.AuthHandler = authHandler
+	sc.LoggerFactory = loggerFactory
+	server, err := turn.NewServer(sc)
+	if err != nil {
+		return nil, fmt.Errorf("TURN server: %w", err)
+	}
+
+	log.Printf("TURN server listening on %s/%s, authentication: %s", addr, transport, cfg.Auth)
+
+	return &Server{server: server, addr: addr, transport: transport}, nil
+}
+
+// relayAddress returns the IP to allocate relayed addresses on
+func relayAddress(cfg Config, addr net.Addr) (net.IP, error) {
+	if cfg.RelayIP != nil {
+		return cfg.RelayIP, nil
+	}
+
+	var relayIP net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		relayIP = a.IP
+	case *net.TCPAddr:
+		relayIP = a.IP
+	default:
+		return nil, errors.New("cannot find relay address: specify the relay IP")
+	}
+	// the wildcard address cannot be returned to the clients
+	if relayIP.IsUnspecified() {
+		relayIP = net.IPv4(127, 0, 0, 1)
+	}
+	return relayIP, nil
+}
+
+func relayAddressGenerator(cfg Config, relayIP net.IP) turn.RelayAddressGenerator {
+	return &turn.RelayAddressGeneratorStatic{
+		RelayAddress: relayIP,
+		Address:      relayIP.String(),
+		Net:          cfg.Net,
+	}
+}
+
+// URI returns the TURN URI of the server.
+func (s *Server) URI() string {
+	addr := s.addr.String()
+	var ip net.IP
+	var port int
+	switch a := s.addr.(type) {
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip != nil && ip.IsUnspecified() {
+		addr = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	if s.transport == "tls" {
+		return fmt.Sprintf("turns:%s?transport=tcp", addr)
+	}
+	return fmt.Sprintf("turn:%s?transport=%s", addr, s.transport)
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// Credentials returns the username and password a client should use with a TURN server of
+// the given authentication mode: plaintext credentials are used as is, longterm credentials
+// are generated from the password as the shared secret.
+func Credentials(auth, username, password string) (string, string, error) {
+	switch auth {
+	case "", AuthPlaintext:
+		return username, password, nil
+	case AuthLongterm:
+		return turn.GenerateLongTermCredentials(password, longtermDuration)
+	default:
+		return "", "", fmt.Errorf("unknown TURN authentication mode %q: must be either %s or %s",
+			auth, AuthPlaintext, AuthLongterm)
+	}
+}
@@ -0,0 +1,209 @@
+package wturn
+
+import (
+	"errors"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wmock"
+	"webrtc-client-go/wsession"
+)
+
+const testFrames = 60
+
+// allocate tries to allocate a relayed address on the server with the given credentials
+func allocate(t *testing.T, s *Server, username, password string) error {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: s.addr.String(),
+		TURNServerAddr: s.addr.String(),
+		Conn:           conn,
+		Username:       username,
+		Password:       password,
+		Realm:          DefaultRealm,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	relayConn, err := c.Allocate()
+	if err != nil {
+		return err
+	}
+	return relayConn.Close()
+}
+
+func TestAuth(t *testing.T) {
+	for _, auth := range []string{AuthPlaintext, AuthLongterm} {
+		t.Run(auth, func(t *testing.T) {
+			s, err := Listen("127.0.0.1:0", Config{Auth: auth, Username: "user", Password: "pass"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			username, password, err := Credentials(auth, "user", "pass")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := allocate(t, s, username, password); err != nil {
+				t.Fatal("allocation with valid credentials failed:", err)
+			}
+			if err := allocate(t, s, username, "wrong"); err == nil {
+				t.Fatal("allocation with invalid credentials should fail")
+			}
+		})
+	}
+}
+
+func TestUnknownAuth(t *testing.T) {
+	if _, err := Listen("127.0.0.1:0", Config{Auth: "foo"}); err == nil {
+		t.Fatal("unknown authentication mode should be rejected")
+	}
+	if _, _, err := Credentials("foo", "user", "pass"); err == nil {
+		t.Fatal("unknown authentication mode should be rejected")
+	}
+}
+
+func TestIPv6(t *testing.T) {
+	if _, err := Listen("[::1]:0", Config{}); err == nil {
+		t.Error("IPv6 listener should be rejected")
+	}
+	if _, err := Listen("127.0.0.1:0", Config{RelayIP: net.ParseIP("::1")}); err == nil {
+		t.Error("IPv6 relay address should be rejected")
+	}
+	if _, err := Probe(ProbeConfig{URI: "turn:[::1]:3478"}); err == nil {
+		t.Error("IPv6 TURN URI should be rejected")
+	}
+}
+
+// listen starts a TURN server on the given transport: udp, tcp or tls
+func listen(t *testing.T, transport string, cfg Config) *Server {
+	t.Helper()
+
+	var s *Server
+	var err error
+	switch transport {
+	case "udp":
+		s, err = Listen("127.0.0.1:0", cfg)
+	case "tls":
+		if cfg.TLSConfig, err = SelfSignedTLSConfig(); err != nil {
+			t.Fatal(err)
+		}
+		fallthrough
+	case "tcp":
+		s, err = ListenTCP("127.0.0.1:0", cfg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestRelay runs a magic mirror call through the embedded TURN server
+func TestRelay(t *testing.T) {
+	for _, transport := range []string{"udp", "tcp", "tls"} {
+		t.Run(transport, func(t *testing.T) {
+			s := listen(t, transport, Config{Auth: AuthLongterm, Password: "secret"})
+			defer s.Close()
+
+			username, password, err := Credentials(AuthLongterm, "", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			srv := httptest.NewServer(wmock.NewServer())
+			defer srv.Close()
+
+			dir := t.TempDir()
+			input := filepath.Join(dir, "input.ivf")
+			output := filepath.Join(dir, "mirrored")
+			if err := wmock.WriteIVF(input, testFrames); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := wsession.MagicMirror(wsession.Config{
+				Url:        "ws" + strings.TrimPrefix(srv.URL, "http") + "/magicmirror",
+				TurnURI:    s.URI(),
+				Username:   username,
+				Credential: password,
+				Codec:      webrtc.MimeTypeVP8,
+			}, input, output); err != nil {
+				t.Fatal("magic mirror:", err)
+			}
+
+			frames, err := wmock.CountIVFFrames(output + ".ivf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frames < testFrames/2 {
+				t.Fatalf("received %d mirrored frames, sent %d", frames, testFrames)
+			}
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	for _, transport := range []string{"udp", "tcp", "tls"} {
+		t.Run(transport, func(t *testing.T) {
+			s := listen(t, transport, Config{Auth: AuthPlaintext, Username: "user",
+				Password: "pass"})
+			defer s.Close()
+
+			res, err := Probe(ProbeConfig{URI: s.URI(), Username: "user", Password: "pass"})
+			if err != nil {
+				t.Fatal("probe:", err)
+			}
+			if res.RelayedAddr == nil || res.RoundTripRTT == 0 || res.ChannelRTT == 0 {
+				t.Fatalf("invalid probe result: %+v", res)
+			}
+
+			_, err = Probe(ProbeConfig{URI: s.URI(), Username: "user", Password: "wrong"})
+			var perr *ProbeError
+			if !errors.As(err, &perr) || perr.Step != "allocate" ||
+				!strings.HasPrefix(perr.Reason, "400") {
+				t.Fatal("expected a 400 allocate error, got:", err)
+			}
+		})
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	// a server that never answers
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the allocation is cut short by the timeout of the whole probe, not by retransmissions
+	start := time.Now()
+	_, err = Probe(ProbeConfig{URI: "turn:" + conn.LocalAddr().String(), Username: "user",
+		Password: "pass", Timeout: 300 * time.Millisecond})
+	var perr *ProbeError
+	if !errors.As(err, &perr) || perr.Step != "allocate" || perr.Reason != "timeout" {
+		t.Fatal("expected an allocate timeout error, got:", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("probe timed out after %s", elapsed)
+	}
+}
@@ -0,0 +1,288 @@
+package wvnet
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/vnet"
+
+	"webrtc-client-go/wturn"
+)
+
+const (
+	wanCIDR  = "1.2.3.0/24"
+	turnIP   = "1.2.3.4"
+	turnPort = 3478
+	// public IPs of the hosts are allocated from here
+	firstHostIP = 10
+)
+
+// NAT types accepted in Config.NAT
+const (
+	NATNone           = "none"
+	NATFullCone       = "full-cone"
+	NATRestricted     = "restricted"
+	NATPortRestricted = "port-restricted"
+	NATSymmetric      = "symmetric"
+)
+
+// Config describes the impairments of the virtual network.
+type Config struct {
+	// NAT in front of each client added with AddClient, one of the NAT* constants
+	NAT string
+	// percentage of packets dropped on the WAN
+	Loss int
+	// delay and max jitter added on the WAN
+	Latency time.Duration
+	Jitter  time.Duration
+	// seed of the packet loss generators, each link has its own generator seeded from this and
+	// its addresses, so the same seed gives the same loss pattern on a link whatever the
+	// traffic of the other links
+	Seed int64
+	// long-term credentials of the TURN relay
+	Username   string
+	Credential string
+}
+
+// Network is a pion/transport virtual network with a WAN router, a TURN relay on the WAN and
+// any number of clients, each behind its own NAT. PeerConnections built on the nets of the
+// clients (see wsession.Config.VNet) never touch the host network, so ICE and TURN behavior
+// can be tested deterministically on a single machine.
+type Network struct {
+	cfg  Config
+	wan  *vnet.Router
+	turn *wturn.Server
+
+	lock  sync.Mutex
+	links map[Link]*link
+	hosts int
+
+	loggerFactory logging.LoggerFactory
+}
+
+// New starts the WAN router and the TURN relay.
+func New(cfg Config) (*Network, error) {
+	if _, err := parseNAT(cfg.NAT); err != nil {
+		return nil, err
+	}
+
+	n := &Network{
+		cfg:           cfg,
+		links:         map[Link]*link{},
+		loggerFactory: logging.NewDefaultLoggerFactory(),
+	}
+
+	var err error
+	n.wan, err = vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          wanCIDR,
+		MinDelay:      cfg.Latency,
+		MaxJitter:     cfg.Jitter,
+		LoggerFactory: n.loggerFactory,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Loss > 0 {
+		n.wan.AddChunkFilter(n.lossFilter)
+	}
+
+	turnNet := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{turnIP}})
+	if err := n.wan.AddNet(turnNet); err != nil {
+		return nil, err
+	}
+
+	if err := n.wan.Start(); err != nil {
+		return nil, err
+	}
+
+	if err := n.startTurn(turnNet); err != nil {
+		n.wan.Stop()
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n *Network) startTurn(turnNet *vnet.Net) error {
+	conn, err := turnNet.ListenPacket("udp4", fmt.Sprintf("%s:%d", turnIP, turnPort))
+	if err != nil {
+		return err
+	}
+
+	n.turn, err = wturn.Serve(conn, wturn.Config{
+		Auth:     wturn.AuthPlaintext,
+		Username: n.cfg.Username,
+		Password: n.cfg.Credential,
+		RelayIP:  net.ParseIP(turnIP),
+		Net:      turnNet,
+	})
+
+	return err
+}
+
+// Link is a direction of the traffic between two IP addresses on the WAN.
+type Link struct {
+	Source, Destination string
+}
+
+// LinkStats counts the packets routed on a link, and the ones dropped by the loss.
+type LinkStats struct {
+	Packets, Dropped int
+}
+
+type link struct {
+	rand  *rand.Rand
+	stats LinkStats
+}
+
+// lossFilter drops Config.Loss percent of the chunks routed on the WAN
+func (n *Network) lossFilter(c vnet.Chunk) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	l := n.link(Link{Source: chunkIP(c.SourceAddr()), Destination: chunkIP(c.DestinationAddr())})
+	l.stats.Packets++
+	if l.rand.Intn(100) < n.cfg.Loss {
+		l.stats.Dropped++
+		return false
+	}
+	return true
+}
+
+// link returns the state of a link, the lock must be held
+func (n *Network) link(k Link) *link {
+	l, ok := n.links[k]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(k.Source + ">" + k.Destination))
+		l = &link{rand: rand.New(rand.NewSource(n.cfg.Seed ^ int64(h.Sum64())))}
+		n.links[k] = l
+	}
+	return l
+}
+
+func chunkIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Stats returns the packets routed and dropped on the links of the WAN so far, links are
+// counted only if Config.Loss is set.
+func (n *Network) Stats() map[Link]LinkStats {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	stats := make(map[Link]LinkStats, len(n.links))
+	for k, l := range n.links {
+		stats[k] = l.stats
+	}
+	return stats
+}
+
+// TurnURI returns the URI of the TURN relay, to be used as wsession.Config.TurnURI.
+func (n *Network) TurnURI() string {
+	return fmt.Sprintf("turn:%s:%d?transport=udp", turnIP, turnPort)
+}
+
+// AddClient adds a new host to the network behind a NAT of the configured type, or directly
+// on the WAN if the NAT type is "none".
+func (n *Network) AddClient() (*vnet.Net, error) {
+	n.lock.Lock()
+	n.hosts++
+	id := n.hosts
+	n.lock.Unlock()
+
+	natType, _ := parseNAT(n.cfg.NAT)
+	publicIP := fmt.Sprintf("1.2.3.%d", firstHostIP+id)
+
+	if natType == nil {
+		client := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{publicIP}})
+		if err := n.wan.AddNet(client); err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+
+	lan, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          fmt.Sprintf("10.0.%d.0/24", id),
+		StaticIPs:     []string{publicIP},
+		NATType:       natType,
+		LoggerFactory: n.loggerFactory,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := vnet.NewNet(&vnet.NetConfig{})
+	if err := lan.AddNet(client); err != nil {
+		return nil, err
+	}
+
+	if err := n.wan.AddRouter(lan); err != nil {
+		return nil, err
+	}
+
+	// the WAN is already running, children are only started with their parent
+	if err := lan.Start(); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// AddPublicHost adds a new host directly on the WAN, e.g., for a media server.
+func (n *Network) AddPublicHost() (*vnet.Net, error) {
+	n.lock.Lock()
+	n.hosts++
+	id := n.hosts
+	n.lock.Unlock()
+
+	host := vnet.NewNet(&vnet.NetConfig{
+		StaticIPs: []string{fmt.Sprintf("1.2.3.%d", firstHostIP+id)}})
+	if err := n.wan.AddNet(host); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// Close stops the TURN relay and the routers.
+func (n *Network) Close() error {
+	if err := n.turn.Close(); err != nil {
+		return err
+	}
+	return n.wan.Stop()
+}
+
+func parseNAT(nat string) (*vnet.NATType, error) {
+	natType := &vnet.NATType{MappingLifeTime: 30 * time.Second}
+
+	switch strings.ToLower(nat) {
+	case "", NATNone:
+		return nil, nil
+	case NATFullCone:
+		natType.MappingBehavior = vnet.EndpointIndependent
+		natType.FilteringBehavior = vnet.EndpointIndependent
+	case NATRestricted:
+		natType.MappingBehavior = vnet.EndpointIndependent
+		natType.FilteringBehavior = vnet.EndpointAddrDependent
+	case NATPortRestricted:
+		natType.MappingBehavior = vnet.EndpointIndependent
+		natType.FilteringBehavior = vnet.EndpointAddrPortDependent
+	case NATSymmetric:
+		natType.MappingBehavior = vnet.EndpointAddrPortDependent
+		natType.FilteringBehavior = vnet.EndpointAddrPortDependent
+	default:
+		return nil, fmt.Errorf("unknown NAT type %q: must be one of %s, %s, %s, %s or %s", nat,
+			NATNone, NATFullCone, NATRestricted, NATPortRestricted, NATSymmetric)
+	}
+
+	return natType, nil
+}
@@ -0,0 +1,175 @@
+package wvnet_test
+
+import (
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+
+	"webrtc-client-go/wmock"
+	"webrtc-client-go/wsession"
+	"webrtc-client-go/wvnet"
+)
+
+const testFrames = 60
+
+// mirror runs a magic mirror call through the TURN relay of a virtual network with the given
+// impairments and returns the number of frames received back and the packets of the links
+func mirror(t *testing.T, cfg wvnet.Config) (int, map[wvnet.Link]wvnet.LinkStats) {
+	t.Helper()
+
+	cfg.Username, cfg.Credential = "user", "pass"
+	n, err := wvnet.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	client, err := n.AddClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	media, err := n.AddPublicHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := wmock.NewServer()
+	s.VNet = media
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.ivf")
+	output := filepath.Join(dir, "mirrored")
+	if err := wmock.WriteIVF(input, testFrames); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wsession.MagicMirror(wsession.Config{
+		Url:        "ws" + strings.TrimPrefix(srv.URL, "http") + "/magicmirror",
+		TurnURI:    n.TurnURI(),
+		Username:   cfg.Username,
+		Credential: cfg.Credential,
+		Codec:      webrtc.MimeTypeVP8,
+		VNet:       client,
+	}, input, output); err != nil {
+		t.Fatal("magic mirror:", err)
+	}
+
+	frames, err := wmock.CountIVFFrames(output + ".ivf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames, n.Stats()
+}
+
+func TestNAT(t *testing.T) {
+	for _, nat := range []string{wvnet.NATNone, wvnet.NATFullCone, wvnet.NATRestricted,
+		wvnet.NATPortRestricted, wvnet.NATSymmetric} {
+		t.Run(nat, func(t *testing.T) {
+			if frames, _ := mirror(t, wvnet.Config{NAT: nat}); frames < testFrames/2 {
+				t.Fatalf("received %d mirrored frames, sent %d", frames, testFrames)
+			}
+		})
+	}
+}
+
+func TestImpairment(t *testing.T) {
+	frames, stats := mirror(t, wvnet.Config{
+		NAT:     wvnet.NATSymmetric,
+		Loss:    5,
+		Latency: 20 * time.Millisecond,
+		Jitter:  5 * time.Millisecond,
+		Seed:    1,
+	})
+	// retransmissions may recover every lost packet, so the loss is checked on the links
+	if frames == 0 {
+		t.Fatalf("no mirrored frames arrived of %d", testFrames)
+	}
+	var total wvnet.LinkStats
+	for _, s := range stats {
+		total.Packets += s.Packets
+		total.Dropped += s.Dropped
+	}
+	if total.Dropped == 0 || total.Dropped == total.Packets {
+		t.Fatalf("expected some but not all packets to be dropped, dropped %d of %d",
+			total.Dropped, total.Packets)
+	}
+}
+
+func TestLinkSeed(t *testing.T) {
+	// the loss of a link does not depend on the traffic of the other links
+	const packets = 100
+	dropped := func(other bool) int {
+		n, err := wvnet.New(wvnet.Config{Loss: 50, Seed: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer n.Close()
+
+		var conns []net.PacketConn
+		for i := 0; i < 3; i++ {
+			host, err := n.AddPublicHost()
+			if err != nil {
+				t.Fatal(err)
+			}
+			eth, err := host.InterfaceByName("eth0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs, err := eth.Addrs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := host.ListenPacket("udp4", addrs[0].(*net.IPNet).IP.String()+":5000")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+
+		dst := conns[2].LocalAddr()
+		for i := 0; i < packets; i++ {
+			if _, err := conns[0].WriteTo([]byte{byte(i)}, dst); err != nil {
+				t.Fatal(err)
+			}
+			if other {
+				if _, err := conns[1].WriteTo([]byte{byte(i)}, dst); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		link := wvnet.Link{Source: conns[0].LocalAddr().(*net.UDPAddr).IP.String(),
+			Destination: dst.(*net.UDPAddr).IP.String()}
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if s := n.Stats()[link]; s.Packets == packets {
+				return s.Dropped
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%d packets routed on %v, sent %d", n.Stats()[link].Packets, link, packets)
+		return 0
+	}
+
+	alone, shared := dropped(false), dropped(true)
+	if alone == 0 || alone == packets {
+		t.Fatalf("dropped %d of %d packets at 50%% loss", alone, packets)
+	}
+	if alone != shared {
+		t.Fatalf("dropped %d packets alone, but %d with another link", alone, shared)
+	}
+}
+
+func TestUnknownNAT(t *testing.T) {
+	if _, err := wvnet.New(wvnet.Config{NAT: "foo"}); err == nil {
+		t.Fatal("unknown NAT type should be rejected")
+	}
+}